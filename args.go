@@ -0,0 +1,54 @@
+package nfs
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	xdr2 "github.com/rasky/go-xdr/xdr2"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// errGarbageArgs reports procedure arguments that could not be decoded, which are answered
+// with GARBAGE_ARGS rather than with a status of the procedure.
+func errGarbageArgs(err error) error {
+	return fmt.Errorf("%w: %v", &ResponseCodeGarbageArgsError{}, err)
+}
+
+// argsLimit is the most bytes a single argument of a request read from `r` may hold, which
+// is what remains of the request when its size is known.
+func argsLimit(r io.Reader) uint {
+	if limited, ok := r.(*io.LimitedReader); ok {
+		if limited.N <= 0 {
+			// a limit of zero is no limit to the decoder, and one byte is as short a read.
+			return 1
+		}
+		return uint(limited.N)
+	}
+	return math.MaxInt32
+}
+
+// readArgs decodes the arguments of a procedure from its body. Opaque and string arguments
+// are not allocated larger than what remains of the request, so that a client announcing
+// a huge argument in a small request is refused rather than answered with an allocation.
+func readArgs(r io.Reader, v interface{}) error {
+	_, err := xdr2.UnmarshalLimited(r, v, argsLimit(r))
+	return err
+}
+
+// readOpaque decodes a variable length opaque argument, bounded as by readArgs, and the
+// padding following it.
+func readOpaque(r io.Reader) ([]byte, error) {
+	length, err := xdr.ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if uint(length) > argsLimit(r) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, length+(4-length%4)%4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf[:length], nil
+}
@@ -0,0 +1,93 @@
+package nfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+)
+
+// maxAuthUnixGIDs is the limit on supplementary groups in an AUTH_SYS credential, per rfc5531 appendix A.
+const maxAuthUnixGIDs = 16
+
+// errBadAuthUnix is returned when an AUTH_SYS credential body cannot be decoded.
+var errBadAuthUnix = errors.New("malformed AUTH_SYS credential")
+
+// UnixCredential is the identity a client claims with the AUTH_SYS (AUTH_UNIX) flavor, or
+// that the principal of an RPCSEC_GSS context is mapped to.
+type UnixCredential struct {
+	// Flavor is the auth flavor of the request. The remaining fields are only set for
+	// AuthFlavorUnix and AuthFlavorRPCSECGSS.
+	Flavor      AuthFlavor
+	Stamp       uint32
+	MachineName string
+	UID         uint32
+	GID         uint32
+	// GIDs are the supplementary groups of the user.
+	GIDs []uint32
+}
+
+type credentialContextKey struct{}
+
+// CredFromContext returns the credential of the request being handled.
+// For AUTH_NULL requests, the zero value is returned.
+func CredFromContext(ctx context.Context) UnixCredential {
+	if cred, ok := ctx.Value(credentialContextKey{}).(UnixCredential); ok {
+		return cred
+	}
+	return UnixCredential{}
+}
+
+func withCredential(ctx context.Context, cred UnixCredential) context.Context {
+	return context.WithValue(ctx, credentialContextKey{}, cred)
+}
+
+// parseAuthUnix decodes the body of an AUTH_SYS credential.
+// The body is parsed directly, rather than through xdr reflection, so that
+// claimed lengths are checked against the bytes actually present.
+func parseAuthUnix(body []byte) (UnixCredential, error) {
+	cred := UnixCredential{Flavor: AuthFlavorUnix}
+	next := func() (uint32, bool) {
+		if len(body) < 4 {
+			return 0, false
+		}
+		v := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		return v, true
+	}
+
+	var ok bool
+	if cred.Stamp, ok = next(); !ok {
+		return cred, errBadAuthUnix
+	}
+	nameLen, ok := next()
+	if !ok || nameLen > MNTNameLen || uint32(len(body)) < nameLen {
+		return cred, errBadAuthUnix
+	}
+	cred.MachineName = string(body[:nameLen])
+	// opaque data is padded to a multiple of 4 bytes.
+	padded := (nameLen + 3) &^ 3
+	if uint32(len(body)) < padded {
+		return cred, errBadAuthUnix
+	}
+	body = body[padded:]
+
+	if cred.UID, ok = next(); !ok {
+		return cred, errBadAuthUnix
+	}
+	if cred.GID, ok = next(); !ok {
+		return cred, errBadAuthUnix
+	}
+	gidCount, ok := next()
+	if !ok || gidCount > maxAuthUnixGIDs {
+		return cred, errBadAuthUnix
+	}
+	cred.GIDs = make([]uint32, 0, gidCount)
+	for i := uint32(0); i < gidCount; i++ {
+		gid, ok := next()
+		if !ok {
+			return cred, errBadAuthUnix
+		}
+		cred.GIDs = append(cred.GIDs, gid)
+	}
+	return cred, nil
+}
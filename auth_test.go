@@ -0,0 +1,329 @@
+package nfs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+
+	"github.com/go-git/go-billy/v5"
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// credRecordingHandler remembers the credential presented with the last mount.
+type credRecordingHandler struct {
+	nfs.Handler
+	mounted chan nfs.UnixCredential
+}
+
+func (h *credRecordingHandler) Mount(ctx context.Context, c net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	h.mounted <- nfs.CredFromContext(ctx)
+	return h.Handler.Mount(ctx, c, req)
+}
+
+func TestAuthUnixCredentialInContext(t *testing.T) {
+	_, handler := newMemHandler(t)
+	recorder := &credRecordingHandler{handler, make(chan nfs.UnixCredential, 1)}
+	c := dialServer(t, startServer(t, &nfs.Server{Handler: recorder}))
+
+	auth := rpc.NewAuthUnix("client.example", 1000, 100)
+	mountServer(t, c, auth.Auth())
+
+	expected := nfs.UnixCredential{
+		Flavor:      nfs.AuthFlavorUnix,
+		Stamp:       auth.Stamp,
+		MachineName: "client.example",
+		UID:         1000,
+		GID:         100,
+		GIDs:        []uint32{0},
+	}
+	if cred := <-recorder.mounted; !reflect.DeepEqual(cred, expected) {
+		t.Fatalf("handler saw credential %+v, expected %+v", cred, expected)
+	}
+
+	mountServer(t, c, rpc.AuthNull)
+	if cred := <-recorder.mounted; !reflect.DeepEqual(cred, nfs.UnixCredential{}) {
+		t.Fatalf("expected zero credential for AUTH_NULL, got %+v", cred)
+	}
+}
+
+// userGroupMapper maps each group into a range of its own for each user, as a mapper of
+// per-user private groups might.
+type userGroupMapper struct{}
+
+func (userGroupMapper) MapIn(uid, gid uint32) (uint32, uint32) { return uid + 10000, gid + uid*1000 }
+func (userGroupMapper) MapOut(uid, gid uint32) (uint32, uint32) {
+	return uid - 10000, gid - (uid-10000)*1000
+}
+
+func TestIDMapperMapsGroupsWithClientUID(t *testing.T) {
+	_, handler := newMemHandler(t)
+	recorder := &credRecordingHandler{handler, make(chan nfs.UnixCredential, 1)}
+	srv := &nfs.Server{Handler: recorder, Export: nfs.ExportOptions{IDMapper: userGroupMapper{}}}
+	c := dialServer(t, startServer(t, srv))
+
+	auth := rpc.NewAuthUnix("client.example", 7, 100)
+	auth.Gids = 200
+	mountServer(t, c, auth.Auth())
+
+	// the supplementary groups are mapped alongside uid 7, not the uid it is mapped to.
+	cred := <-recorder.mounted
+	if cred.UID != 10007 || cred.GID != 7100 || !reflect.DeepEqual(cred.GIDs, []uint32{7200}) {
+		t.Fatalf("credential was mapped to %d:%d with groups %v", cred.UID, cred.GID, cred.GIDs)
+	}
+}
+
+func TestMalformedAuthUnixRejected(t *testing.T) {
+	_, handler := newMemHandler(t)
+	c := dialServer(t, startServer(t, &nfs.Server{Handler: handler}))
+
+	mounter := nfsc.Mount{Client: c}
+	// a machine name claiming to be longer than the credential.
+	if _, err := mounter.Mount("/", rpc.Auth{Flavor: 1, Body: []byte{0, 0, 0, 1, 0, 0, 1, 0}}); err == nil {
+		t.Fatal("expected a malformed credential to be rejected")
+	}
+}
+
+func TestRootSquash(t *testing.T) {
+	_, handler := newMemHandler(t)
+	recorder := &credRecordingHandler{handler, make(chan nfs.UnixCredential, 1)}
+	srv := &nfs.Server{
+		Handler: recorder,
+		Export:  nfs.ExportOptions{Squash: nfs.RootSquash, AnonUID: 65534, AnonGID: 65533},
+	}
+	c := dialServer(t, startServer(t, srv))
+
+	mountServer(t, c, rpc.NewAuthUnix("client.example", 0, 0).Auth())
+	cred := <-recorder.mounted
+	if cred.UID != 65534 || cred.GID != 65533 || !reflect.DeepEqual(cred.GIDs, []uint32{65533}) {
+		t.Fatalf("root was not squashed: %+v", cred)
+	}
+
+	mountServer(t, c, rpc.NewAuthUnix("client.example", 1000, 100).Auth())
+	if cred := <-recorder.mounted; cred.UID != 1000 || cred.GID != 100 {
+		t.Fatalf("non-root user should not be squashed: %+v", cred)
+	}
+}
+
+func TestAllSquash(t *testing.T) {
+	_, handler := newMemHandler(t)
+	recorder := &credRecordingHandler{handler, make(chan nfs.UnixCredential, 1)}
+	srv := &nfs.Server{
+		Handler: recorder,
+		Export:  nfs.ExportOptions{Squash: nfs.AllSquash, AnonUID: 65534, AnonGID: 65534},
+	}
+	c := dialServer(t, startServer(t, srv))
+
+	mountServer(t, c, rpc.NewAuthUnix("client.example", 1000, 100).Auth())
+	if cred := <-recorder.mounted; cred.UID != 65534 || cred.GID != 65534 || len(cred.GIDs) != 0 {
+		t.Fatalf("user was not squashed: %+v", cred)
+	}
+}
+
+func mustParseCIDR(t *testing.T, s string) net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+func TestAllowedCIDRsAdmitsListedClient(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{
+		Handler: handler,
+		Export:  nfs.ExportOptions{AllowedCIDRs: []net.IPNet{mustParseCIDR(t, "10.0.0.0/8"), mustParseCIDR(t, "127.0.0.0/8")}},
+	}
+	c := dialServer(t, startServerOn(t, srv, "127.0.0.1:0"))
+
+	target := mountServer(t, c, rpc.AuthNull)
+	if _, err := target.FSInfo(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllowedCIDRsRejectsUnlistedClient(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{
+		Handler: handler,
+		Export:  nfs.ExportOptions{AllowedCIDRs: []net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}},
+	}
+	c := dialServer(t, startServerOn(t, srv, "127.0.0.1:0"))
+
+	mounter := nfsc.Mount{Client: c}
+	if _, err := mounter.Mount("/", rpc.AuthNull); err == nil {
+		t.Fatal("expected mount from an unlisted address to be rejected")
+	}
+
+	// nfs calls are refused before the handle is resolved, so even an
+	// unknown handle is answered with ACCES rather than STALE.
+	type getAttrArgs struct {
+		rpc.Header
+		Handle []byte
+	}
+	res, err := c.Call(&getAttrArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureGetAttr),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle: []byte("0123456789abcdef"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nfs.NFSStatus(status) != nfs.NFSStatusAccess {
+		t.Fatalf("expected ACCES, got %v", nfs.NFSStatus(status))
+	}
+}
+
+func TestAllowedCIDRsIPv6(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{
+		Handler: handler,
+		Export:  nfs.ExportOptions{AllowedCIDRs: []net.IPNet{mustParseCIDR(t, "::1/128")}},
+	}
+	c := dialServer(t, startServerOn(t, srv, "[::1]:0"))
+	mountServer(t, c, rpc.AuthNull)
+
+	srv = &nfs.Server{
+		Handler: handler,
+		Export:  nfs.ExportOptions{AllowedCIDRs: []net.IPNet{mustParseCIDR(t, "fd00::/8")}},
+	}
+	c = dialServer(t, startServerOn(t, srv, "[::1]:0"))
+	mounter := nfsc.Mount{Client: c}
+	if _, err := mounter.Mount("/", rpc.AuthNull); err == nil {
+		t.Fatal("expected mount from outside the IPv6 network to be rejected")
+	}
+}
+
+func TestReadOnlyExport(t *testing.T) {
+	mem, handler := newMemHandler(t)
+	srv := &nfs.Server{Handler: handler, Export: nfs.ExportOptions{ReadOnly: true}}
+	c := dialServer(t, startServer(t, srv))
+	target := mountServer(t, c, rpc.AuthNull)
+
+	if _, err := target.FSInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := target.Lookup("/test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.ReadDirPlus("/"); err != nil {
+		t.Fatal(err)
+	}
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type handleArgs struct {
+		rpc.Header
+		Handle []byte
+	}
+	for _, proc := range []nfs.NFSProcedure{
+		nfs.NFSProcedureSetAttr, nfs.NFSProcedureWrite, nfs.NFSProcedureCreate, nfs.NFSProcedureMkDir,
+		nfs.NFSProcedureSymlink, nfs.NFSProcedureMkNod, nfs.NFSProcedureRemove, nfs.NFSProcedureRmDir,
+		nfs.NFSProcedureRename, nfs.NFSProcedureLink, nfs.NFSProcedureCommit,
+		nfs.NFSProcedureSetXattr, nfs.NFSProcedureRemoveXattr,
+	} {
+		res, err := c.Call(&handleArgs{
+			Header: rpc.Header{
+				Rpcvers: 2,
+				Prog:    nfsc.Nfs3Prog,
+				Vers:    nfsc.Nfs3Vers,
+				Proc:    uint32(proc),
+				Cred:    rpc.AuthNull,
+				Verf:    rpc.AuthNull,
+			},
+			Handle: root,
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", proc, err)
+		}
+		status, err := xdr.ReadUint32(res)
+		if err != nil {
+			t.Fatalf("%v: %v", proc, err)
+		}
+		if nfs.NFSStatus(status) != nfs.NFSStatusROFS {
+			t.Errorf("%v: expected ROFS, got %v", proc, nfs.NFSStatus(status))
+		}
+	}
+
+	if _, err := target.Create("/new.txt", 0666); err == nil {
+		t.Fatal("expected create on a read-only export to fail")
+	}
+	if _, err := mem.Stat("/new.txt"); err == nil {
+		t.Fatal("read-only export was modified")
+	}
+}
+
+func TestRequiredAuthFlavors(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{
+		Handler: handler,
+		Export:  nfs.ExportOptions{RequiredAuthFlavors: []nfs.AuthFlavor{nfs.AuthFlavorUnix}},
+	}
+	addr := startServer(t, srv)
+
+	// an AUTH_NULL mount is denied with AUTH_ERROR, as too weak.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := bytes.NewBuffer(nil)
+	for _, v := range []interface{}{uint32(1), uint32(0), rpc.Header{
+		Rpcvers: 2,
+		Prog:    mountProg,
+		Vers:    3,
+		Proc:    uint32(nfs.MountProcMount),
+		Cred:    rpc.AuthNull,
+		Verf:    rpc.AuthNull,
+	}, []byte("/")} {
+		if err := xdr.Write(msg, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record := binary.BigEndian.AppendUint32(nil, uint32(msg.Len())|1<<31)
+	if _, err := conn.Write(append(record, msg.Bytes()...)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reply struct {
+		Record     uint32
+		Xid        uint32
+		MsgType    uint32
+		ReplyStat  uint32
+		RejectStat uint32
+		AuthStat   uint32
+	}
+	if err := xdr.Read(conn, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.ReplyStat != rpc.MsgDenied || reply.RejectStat != 1 || reply.AuthStat != uint32(nfs.AuthStatTooWeak) {
+		t.Fatalf("expected an AUTH_TOOWEAK rejection, got %+v", reply)
+	}
+
+	// AUTH_SYS is accepted.
+	c := dialServer(t, addr)
+	target := mountServer(t, c, rpc.NewAuthUnix("client.example", 1000, 100).Auth())
+	if _, err := target.FSInfo(); err != nil {
+		t.Fatal(err)
+	}
+}
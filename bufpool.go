@@ -0,0 +1,47 @@
+package nfs
+
+import "sync"
+
+// defaultPooledBufferSize bounds the buffers kept for reuse when the server does not set
+// MaxReadSize or MaxWriteSize, and is the transfer size clients commonly settle on.
+const defaultPooledBufferSize = 1 << 20
+
+// bufferPool recycles the buffers carrying the data of READ and WRITE requests, so that
+// transfers at line rate do not allocate a fresh buffer for each request.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+// get returns a buffer of length `n`. Its contents are left from an earlier request, and
+// must be overwritten or cleared before use.
+func (p *bufferPool) get(n int) *[]byte {
+	b, _ := p.pool.Get().(*[]byte)
+	if b == nil || cap(*b) < n {
+		buf := make([]byte, n)
+		return &buf
+	}
+	*b = (*b)[:n]
+	return b
+}
+
+// put returns a buffer for reuse, unless it is larger than `limit`.
+func (p *bufferPool) put(b *[]byte, limit int) {
+	if cap(*b) > limit {
+		return
+	}
+	*b = (*b)[:0]
+	p.pool.Put(b)
+}
+
+// pooledBufferSize is the size of the largest buffer the server keeps for reuse, matching
+// the largest transfer it advertises.
+func (s *Server) pooledBufferSize() int {
+	size := s.MaxReadSize
+	if s.MaxWriteSize > size {
+		size = s.MaxWriteSize
+	}
+	if size == 0 {
+		return defaultPooledBufferSize
+	}
+	return int(size)
+}
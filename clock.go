@@ -0,0 +1,36 @@
+package nfs
+
+import (
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// Clock is the source of the times the server stamps files with.
+type Clock interface {
+	Now() time.Time
+}
+
+// now is the current time of the server's Clock.
+func (s *Server) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock.Now()
+	}
+	return time.Now()
+}
+
+// stampTimes sets the times of a file the server has just made to the time of its Clock,
+// unless the client chose them. Without a Clock, or a backend able to change the times of
+// files, the filesystem stamps the times itself.
+func (w *response) stampTimes(attrs *SetFileAttributes, changer billy.Change) {
+	if w.Server.Clock == nil || changer == nil {
+		return
+	}
+	now := w.Server.Clock.Now()
+	if attrs.SetAtime == nil {
+		attrs.SetAtime = &now
+	}
+	if attrs.SetMtime == nil {
+		attrs.SetMtime = &now
+	}
+}
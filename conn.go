@@ -4,11 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	xdr2 "github.com/rasky/go-xdr/xdr2"
 	"github.com/willscott/go-nfs-client/nfs/rpc"
@@ -20,6 +23,11 @@ var (
 	ErrInputInvalid = errors.New("invalid input")
 	// ErrAlreadySent is returned when writing a header/status multiple times
 	ErrAlreadySent = errors.New("response already started")
+	// ErrRequestTooLarge is returned when a request exceeds the MaxRequestSize of the server
+	ErrRequestTooLarge = errors.New("request too large")
+
+	errClientNotAllowed = errors.New("client address not allowed by export")
+	errReadOnlyExport   = errors.New("export is read-only")
 )
 
 // ResponseCode is a combination of accept_stat and reject_stat.
@@ -36,77 +44,180 @@ const (
 	ResponseCodeAuthError
 )
 
+// reject_stat values for denied replies, per rfc5531 section 9.
+const (
+	rejectStatRPCMismatch = 0
+	rejectStatAuthError   = 1
+)
+
 type conn struct {
 	*Server
-	writeSerializer chan []byte
+	writeSerializer chan reply
 	net.Conn
+	readLimiter  *tokenBucket
+	writeLimiter *tokenBucket
+	// datagram is set for the senders of UDP requests.
+	datagram bool
+	// role is that of the socket the connection was accepted on.
+	role socketRole
+	// pending counts requests whose replies have not yet been written, so that Shutdown waits for them.
+	pending atomic.Int32
+	// handlingMu guards handling, the number of requests being handled, which arms the
+	// IdleTimeout whenever it drops to zero.
+	handlingMu sync.Mutex
+	handling   int
 }
 
 func (c *conn) serve(ctx context.Context) {
 	connCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	c.writeSerializer = make(chan []byte, 1)
+	c.writeSerializer = make(chan reply, 1)
 	go c.serializeWrites(connCtx)
 
-	bio := bufio.NewReader(c.Conn)
+	body := c.readAhead(cancel)
+	defer body.Close()
+	bio := bufio.NewReader(body)
+
+	// requests are handled concurrently only when several may be in flight at once.
+	var slots chan struct{}
+	if c.Server.MaxRequestsPerConnection > 1 {
+		slots = make(chan struct{}, c.Server.MaxRequestsPerConnection)
+	}
+	var inFlight sync.WaitGroup
+	defer inFlight.Wait()
+
+	c.trackHandling(0)
 	for {
-		w, err := c.readRequestHeader(connCtx, bio)
-		if err != nil {
-			if err == io.EOF {
-				// Clean close.
+		// a request is pending from its first byte, so that Shutdown does not cut it off.
+		if _, err := bio.Peek(1); err != nil {
+			c.Close()
+			return
+		}
+		c.pending.Add(1)
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			case <-connCtx.Done():
 				c.Close()
 				return
 			}
-			return
 		}
-		Log.Tracef("request: %v", w.req)
-		err = c.handle(connCtx, w)
-		respErr := w.finish(connCtx)
+		w, err := c.readRequestHeader(connCtx, bio)
 		if err != nil {
-			Log.Errorf("error handling req: %v", err)
-			// failure to handle at a level needing to close the connection.
+			// io.EOF is a clean close; anything else is a malformed stream.
 			c.Close()
 			return
 		}
-		if respErr != nil {
-			Log.Errorf("error sending response: %v", respErr)
+		// the request is under way, and is not cut off however long it takes.
+		c.trackHandling(1)
+		Log.Tracef("request: %v", w.req)
+		if slots == nil {
+			if !c.serveRequest(connCtx, w) {
+				return
+			}
+			continue
+		}
+		// the rest of the request is read before it is handled, so that the next can be read.
+		if err := w.readBody(); err != nil {
 			c.Close()
 			return
 		}
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			defer func() { <-slots }()
+			c.serveRequest(connCtx, w)
+		}()
 	}
 }
 
+// serveRequest handles a request and queues its reply, reporting false, with the connection
+// closed, if the connection is not to be served further.
+func (c *conn) serveRequest(ctx context.Context, w *response) bool {
+	defer c.trackHandling(-1)
+	err := c.handle(ctx, w)
+	respErr := w.finish(ctx)
+	if err != nil {
+		Log.Errorf("error handling req: %v", err)
+		// failure to handle at a level needing to close the connection.
+		c.Close()
+		return false
+	}
+	if respErr != nil {
+		if ctx.Err() == nil {
+			Log.Errorf("error sending response: %v", respErr)
+		}
+		c.Close()
+		return false
+	}
+	return true
+}
+
+// trackHandling counts the requests being handled, arming the IdleTimeout while there are
+// none and disarming it while there are.
+func (c *conn) trackHandling(delta int) {
+	c.handlingMu.Lock()
+	defer c.handlingMu.Unlock()
+	c.handling += delta
+	if c.Server.IdleTimeout <= 0 {
+		return
+	}
+	if c.handling == 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.Server.IdleTimeout))
+	} else {
+		_ = c.Conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// readAhead reads from the connection in the background, so that a disconnect
+// cancels the connection context even while a request is being handled.
+func (c *conn) readAhead(cancel context.CancelFunc) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := c.Conn.Read(buf)
+			if n > 0 {
+				if _, werr := pw.Write(buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				cancel()
+				_ = pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr
+}
+
 func (c *conn) serializeWrites(ctx context.Context) {
 	// todo: maybe don't need the extra buffer
 	writer := bufio.NewWriter(c.Conn)
-	var fragmentBuf [4]byte
-	var fragmentInt uint32
+	records := &recordWriter{w: writer, conn: c.Conn}
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case msg, ok := <-c.writeSerializer:
+		case r, ok := <-c.writeSerializer:
 			if !ok {
 				return
 			}
-			// prepend the fragmentation header
-			fragmentInt = uint32(len(msg))
-			fragmentInt |= (1 << 31)
-			binary.BigEndian.PutUint32(fragmentBuf[:], fragmentInt)
-			n, err := writer.Write(fragmentBuf[:])
-			if n < 4 || err != nil {
+			records.start(len(r.msg)+r.data.size(), c.Server.MaxFragmentSize)
+			if _, err := records.Write(r.msg); err != nil {
+				r.data.close()
 				return
 			}
-			n, err = writer.Write(msg)
-			if err != nil {
-				return
-			}
-			if n < len(msg) {
-				panic("todo: ensure writes complete fully.")
+			if r.data != nil {
+				if err := r.data.writeTo(records); err != nil {
+					return
+				}
 			}
-			if err = writer.Flush(); err != nil {
+			if err := writer.Flush(); err != nil {
 				return
 			}
+			c.pending.Add(-1)
 		}
 	}
 }
@@ -114,6 +225,21 @@ func (c *conn) serializeWrites(ctx context.Context) {
 // Handle a request. errors from this method indicate a failure to read or
 // write on the network stream, and trigger a disconnection of the connection.
 func (c *conn) handle(ctx context.Context, w *response) error {
+	if c.Server.Metrics != nil {
+		start := time.Now()
+		defer func() {
+			if w.responded && !w.discard {
+				c.Server.Metrics.ObserveProcedure(w.req.procedureName(), w.replyStatus(), time.Since(start))
+			}
+		}()
+	}
+	if !c.role.serves(w.req.Header.Prog) {
+		Log.Debugf("program %d is not served on %v", w.req.Header.Prog, c.LocalAddr())
+		if err := w.drain(ctx); err != nil {
+			return err
+		}
+		return c.err(ctx, w, &ResponseCodeProgUnavailableError{})
+	}
 	handler := c.Server.handlerFor(w.req.Header.Prog, w.req.Header.Proc)
 	if handler == nil {
 		Log.Errorf("No handler for %d.%d", w.req.Header.Prog, w.req.Header.Proc)
@@ -122,10 +248,104 @@ func (c *conn) handle(ctx context.Context, w *response) error {
 		}
 		return c.err(ctx, w, &ResponseCodeProcUnavailableError{})
 	}
-	appError := handler(ctx, w, c.Server.Handler)
+	if w.req.Header.Prog == nfsServiceID {
+		w.errorFmt = nfsErrorFormatter(NFSProcedure(w.req.Header.Proc))
+	}
+	ctx, endSpan := c.startSpan(ctx, w)
+	defer endSpan()
+	var args *prefixWriter
+	if c.Server.OnRequest != nil {
+		args = &prefixWriter{max: maxSummarizedArgs}
+		defer c.reportRequest(w, time.Now(), args)
+	}
+	if admitErr := c.admit(w); admitErr != nil {
+		if err := w.drain(ctx); err != nil {
+			return err
+		}
+		return c.err(ctx, w, admitErr)
+	}
+	defer w.sealIntegrity()
+	ctx, authErr := c.authenticate(ctx, w)
+	if authErr != nil {
+		if err := w.drain(ctx); err != nil {
+			return err
+		}
+		if errors.Is(authErr, errGSSReplay) {
+			Log.Debugf("dropping replayed %v", w.req)
+			w.discard = true
+			return nil
+		}
+		return c.err(ctx, w, authErr)
+	}
+	if w.gss != nil && w.gss.control() {
+		if ctlErr := c.gssControl(w); ctlErr != nil {
+			if err := w.drain(ctx); err != nil {
+				return err
+			}
+			return c.err(ctx, w, ctlErr)
+		}
+		return w.drain(ctx)
+	}
+	if args != nil {
+		w.captureArgs(args)
+	}
+	ctx = withLimits(ctx, w.transferLimits())
+	timedOut, panicked := false, false
+	if key, ok := c.replyCacheKey(w); ok {
+		reply, inProgress := c.Server.replies.begin(key, c.Server.replyCacheTTL())
+		if inProgress || reply != nil {
+			if err := w.drain(ctx); err != nil {
+				return err
+			}
+			if inProgress {
+				// the original is still being handled, and will be answered.
+				Log.Debugf("dropping retransmitted %v", w.req)
+				w.discard = true
+				return nil
+			}
+			Log.Debugf("replaying reply to retransmitted %v", w.req)
+			w.responded = true
+			_, err := w.writer.Write(reply)
+			return err
+		}
+		defer func() {
+			// a timed out request is answered to be retried, and one whose handler panicked
+			// may succeed when retried, so their replies are not replayed.
+			if w.responded && ctx.Err() == nil && !timedOut && !panicked {
+				c.Server.replies.complete(key, w.writer.Bytes())
+			} else {
+				c.Server.replies.abandon(key)
+			}
+		}()
+	}
+	var appError error
+	if c.Server.ProcedureTimeout > 0 {
+		// the handler may be left running past the deadline, so it must not read the connection.
+		if err := w.readBody(); err != nil {
+			return err
+		}
+		timedOut, panicked, appError = c.callHandlerWithin(ctx, handler, w)
+	} else {
+		panicked, appError = c.callHandler(ctx, handler, w)
+	}
 	if drainErr := w.drain(ctx); drainErr != nil {
 		return drainErr
 	}
+	if ctx.Err() != nil {
+		// the connection is going away, so there is no one left to respond to.
+		return nil
+	}
+	if timedOut {
+		Log.Errorf("%v timed out after %v", w.req, c.Server.ProcedureTimeout)
+		appError = &NFSStatusError{NFSStatusJukebox, context.DeadlineExceeded}
+	}
+	if appError != nil && !w.responded && w.req.Header.Prog == nfsServiceID && errors.Is(appError, ErrJukebox()) {
+		// the backend asked for the request to be retried, whatever status the handler chose.
+		Log.Debugf("%v is to be retried: %v", w.req, appError)
+		if err := c.err(ctx, w, &NFSStatusError{NFSStatusJukebox, appError}); err != nil {
+			return err
+		}
+	}
 	if appError != nil && !w.responded {
 		Log.Errorf("call to %+v failed: %v", handler, appError)
 		if err := c.err(ctx, w, appError); err != nil {
@@ -141,6 +361,122 @@ func (c *conn) handle(ctx context.Context, w *response) error {
 	return nil
 }
 
+// callHandler runs the handler of a procedure. A panic in the handler is logged and answered
+// with NFSStatusServerFault, or a system error outside of NFS, in place of anything the
+// handler had written, so that the connection goes on to serve its other requests.
+func (c *conn) callHandler(ctx context.Context, handler HandleFunc, w *response) (panicked bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			Log.Errorf("%v panicked: %v\n%s", w.req, r, debug.Stack())
+			w.writer.Reset()
+			w.responded = false
+			w.data.close()
+			w.data = nil
+			panicked, err = true, &NFSStatusError{NFSStatusServerFault, fmt.Errorf("handler panicked: %v", r)}
+			if w.req.Header.Prog != nfsServiceID {
+				err = &ResponseCodeSystemError{}
+			}
+		}
+	}()
+	return false, handler(ctx, w, c.Server.Handler)
+}
+
+// callHandlerWithin runs the handler of a procedure as callHandler does, giving up on it at
+// the ProcedureTimeout of the server. A backend call blocked past the deadline would hold
+// the request, so the handler runs in a goroutine of its own, on a copy of the response.
+// Once it is given up on, what it goes on to write is thrown away.
+func (c *conn) callHandlerWithin(ctx context.Context, handler HandleFunc, w *response) (timedOut, panicked bool, err error) {
+	procCtx, cancel := context.WithTimeout(ctx, c.Server.ProcedureTimeout)
+	defer cancel()
+
+	// the body, read into memory, is left for the handler alone.
+	req := *w.req
+	w.req.Body = &io.LimitedReader{R: bytes.NewReader(nil)}
+	late := *w
+	late.req = &req
+	late.writer = bytes.NewBuffer(append([]byte{}, w.writer.Bytes()...))
+	type result struct {
+		panicked bool
+		err      error
+	}
+	var mu sync.Mutex
+	abandoned := false
+	done := make(chan result, 1)
+	go func() {
+		panicked, err := c.callHandler(procCtx, handler, &late)
+		mu.Lock()
+		defer mu.Unlock()
+		if abandoned {
+			late.data.close()
+			return
+		}
+		done <- result{panicked, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-procCtx.Done():
+		mu.Lock()
+		select {
+		case r = <-done:
+		default:
+			abandoned = true
+		}
+		mu.Unlock()
+		if abandoned {
+			return true, false, nil
+		}
+	}
+	*w.req = req
+	late.req = w.req
+	*w = late
+	// a handler that gave up at the deadline without answering is answered for.
+	return procCtx.Err() != nil && !w.responded, r.panicked, r.err
+}
+
+// admit checks a request against the access controls of the export before it is dispatched.
+// NULL procedures are always answered, so that clients can probe the server.
+func (c *conn) admit(w *response) error {
+	if w.req.Header.Proc == 0 {
+		return nil
+	}
+	if !c.Server.Export.allowsAddr(c.Conn.RemoteAddr()) {
+		Log.Debugf("rejecting %v from %v: address not allowed", w.req, c.Conn.RemoteAddr())
+		if w.req.Header.Prog == nfsServiceID {
+			return &NFSStatusError{NFSStatusAccess, errClientNotAllowed}
+		}
+		return &AuthError{AuthStatTooWeak}
+	}
+	if c.Server.Export.ReadOnly && w.req.Header.Prog == nfsServiceID && NFSProcedure(w.req.Header.Proc).mutates() {
+		return &NFSStatusError{NFSStatusROFS, errReadOnlyExport}
+	}
+	return nil
+}
+
+// authenticate attaches the credential of the request to the context it is handled with.
+func (c *conn) authenticate(ctx context.Context, w *response) (context.Context, error) {
+	cred := UnixCredential{Flavor: AuthFlavor(w.req.Header.Cred.Flavor)}
+	if w.req.Header.Proc != 0 && !c.Server.Export.allowsFlavor(cred.Flavor) {
+		Log.Debugf("rejecting %v: auth flavor %d is not accepted by the export", w.req, cred.Flavor)
+		return ctx, &AuthError{AuthStatTooWeak}
+	}
+	if cred.Flavor == AuthFlavorUnix {
+		var err error
+		if cred, err = parseAuthUnix(w.req.Header.Cred.Body); err != nil {
+			Log.Debugf("rejecting %v: %v", w.req, err)
+			return ctx, &AuthError{AuthStatBadCred}
+		}
+	} else if cred.Flavor == AuthFlavorRPCSECGSS {
+		var err error
+		if cred, err = c.authenticateGSS(w); err != nil {
+			return ctx, err
+		}
+	}
+	cred = c.Server.Export.squash(c.Server.Export.mapIn(cred))
+	return withCredential(ctx, cred), nil
+}
+
 func (c *conn) err(ctx context.Context, w *response, err error) error {
 	select {
 	case <-ctx.Done():
@@ -187,6 +523,19 @@ type response struct {
 	err       error
 	errorFmt  func(error) RPCError
 	req       *request
+	// discard is set when a request is to go unanswered, having been retransmitted
+	// while the original was still being handled.
+	discard bool
+	// data, if set, is file data following the reply in w.writer.
+	data *streamedData
+	// gss is the RPCSEC_GSS state of the request, if it was sent with the flavor.
+	gss *gssRequest
+	// verf, if set, is the verifier of the reply in place of AUTH_NULL.
+	verf *rpc.Auth
+	// resultsAt is the offset in w.writer of the results of an accepted reply.
+	resultsAt int
+	// sealed is set once the results have been wrapped for RPCSEC_GSS integrity.
+	sealed bool
 }
 
 func (w *response) writeXdrHeader() error {
@@ -221,15 +570,30 @@ func (w *response) writeHeader(code ResponseCode) error {
 		return err
 	}
 
-	if status == rpc.MsgAccepted {
-		// Write opaque_auth header.
-		err = xdr.Write(w.writer, &rpc.AuthNull)
-		if err != nil {
-			return err
+	if status == rpc.MsgDenied {
+		// Denied replies carry a reject_stat rather than an accept_stat.
+		rejectStat := uint32(rejectStatRPCMismatch)
+		if code == ResponseCodeAuthError {
+			rejectStat = rejectStatAuthError
 		}
+		return xdr.Write(w.writer, &rejectStat)
+	}
+
+	// Write opaque_auth header.
+	verf := &rpc.AuthNull
+	if w.verf != nil {
+		verf = w.verf
+	}
+	err = xdr.Write(w.writer, verf)
+	if err != nil {
+		return err
 	}
 
-	return xdr.Write(w.writer, &code)
+	if err := xdr.Write(w.writer, &code); err != nil {
+		return err
+	}
+	w.resultsAt = w.writer.Len()
+	return nil
 }
 
 // Write a response to an xdr message
@@ -267,11 +631,32 @@ func (w *response) drain(ctx context.Context) error {
 	return io.ErrUnexpectedEOF
 }
 
+// readBody reads the rest of the request frame into memory, leaving it as the body.
+func (w *response) readBody() error {
+	reader, ok := w.req.Body.(*io.LimitedReader)
+	if !ok {
+		return io.ErrUnexpectedEOF
+	}
+	body := make([]byte, reader.N)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return err
+	}
+	w.req.Body = &io.LimitedReader{R: bytes.NewReader(body), N: int64(len(body))}
+	return nil
+}
+
 func (w *response) finish(ctx context.Context) error {
+	if w.discard {
+		w.data.close()
+		w.conn.pending.Add(-1)
+		return nil
+	}
 	select {
-	case w.conn.writeSerializer <- w.writer.Bytes():
+	case w.conn.writeSerializer <- reply{w.writer.Bytes(), w.data}:
 		return nil
 	case <-ctx.Done():
+		w.data.close()
+		w.conn.pending.Add(-1)
 		return ctx.Err()
 	}
 }
@@ -294,14 +679,33 @@ func (c *conn) readRequestHeader(ctx context.Context, reader *bufio.Reader) (w *
 	if reqLen < 40 {
 		return nil, ErrInputInvalid
 	}
+	if limit := c.Server.maxRequestSize(); int64(reqLen) > limit {
+		Log.Warnf("closing connection from %v: request of %d bytes exceeds the limit of %d", c.Conn.RemoteAddr(), reqLen, limit)
+		return nil, ErrRequestTooLarge
+	}
+
+	return c.readRequest(&io.LimitedReader{R: reader, N: int64(reqLen)})
+}
+
+// requestSizeSlack is how much larger than the largest WRITE a request may be by default,
+// leaving room for its call header, credentials and other arguments.
+const requestSizeSlack = 1 << 20
 
-	r := io.LimitedReader{R: reader, N: int64(reqLen)}
+func (s *Server) maxRequestSize() int64 {
+	if s.MaxRequestSize > 0 {
+		return int64(s.MaxRequestSize)
+	}
+	wtmax, _ := transferSizes(defaultTransferSize, s.MaxWriteSize, 0)
+	return int64(wtmax) + requestSizeSlack
+}
 
-	xid, err := xdr.ReadUint32(&r)
+// readRequest parses the call header of a single rpc message, leaving its body in `r`.
+func (c *conn) readRequest(r *io.LimitedReader) (w *response, err error) {
+	xid, err := xdr.ReadUint32(r)
 	if err != nil {
 		return nil, err
 	}
-	reqType, err := xdr.ReadUint32(&r)
+	reqType, err := xdr.ReadUint32(r)
 	if err != nil {
 		return nil, err
 	}
@@ -312,9 +716,9 @@ func (c *conn) readRequestHeader(ctx context.Context, reader *bufio.Reader) (w *
 	req := request{
 		xid,
 		rpc.Header{},
-		&r,
+		r,
 	}
-	if err = xdr.Read(&r, &req.Header); err != nil {
+	if err = readArgs(r, &req.Header); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,699 @@
+package nfs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// stallingFS blocks the first write to any file until released, and counts the writes made.
+type stallingFS struct {
+	billy.Filesystem
+	started chan struct{}
+	release chan struct{}
+	closed  chan struct{}
+	writes  atomic.Int32
+}
+
+func (s *stallingFS) OpenFile(name string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := s.Filesystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &stallingFile{f, s}, nil
+}
+
+type stallingFile struct {
+	billy.File
+	fs *stallingFS
+}
+
+func (f *stallingFile) Write(p []byte) (int, error) {
+	if f.fs.writes.Add(1) == 1 {
+		close(f.fs.started)
+		<-f.fs.release
+	}
+	return f.File.Write(p)
+}
+
+func (f *stallingFile) Close() error {
+	defer close(f.fs.closed)
+	return f.File.Close()
+}
+
+func TestDisconnectCancelsWrite(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/test")
+	fs := &stallingFS{
+		Filesystem: mem,
+		started:    make(chan struct{}),
+		release:    make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	c := dialServer(t, startServer(t, &nfs.Server{Handler: handler}))
+	target := mountServer(t, c, rpc.AuthNull)
+	_, fh, err := target.Lookup("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type writeArgs struct {
+		rpc.Header
+		Handle []byte
+		Offset uint64
+		Count  uint32
+		How    uint32
+		Data   []byte
+	}
+	data := make([]byte, 1<<20)
+	go func() {
+		_, _ = c.Call(&writeArgs{
+			Header: rpc.Header{
+				Rpcvers: 2,
+				Prog:    nfsc.Nfs3Prog,
+				Vers:    nfsc.Nfs3Vers,
+				Proc:    uint32(nfs.NFSProcedureWrite),
+				Cred:    rpc.AuthNull,
+				Verf:    rpc.AuthNull,
+			},
+			Handle: fh,
+			Count:  uint32(len(data)),
+			How:    2,
+			Data:   data,
+		})
+	}()
+
+	select {
+	case <-fs.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write never reached the filesystem")
+	}
+	_ = c.Close()
+	// give the server a moment to observe the disconnect.
+	time.Sleep(100 * time.Millisecond)
+	close(fs.release)
+
+	select {
+	case <-fs.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write was not abandoned after disconnect")
+	}
+	if n := fs.writes.Load(); n != 1 {
+		t.Fatalf("server kept copying after disconnect: %d chunks written", n)
+	}
+}
+
+// sendCall writes a single rpc call as a record over `c`, without waiting for its reply.
+func sendCall(t *testing.T, c net.Conn, xid, prog, vers, proc uint32, args ...interface{}) {
+	t.Helper()
+	msg := bytes.NewBuffer(nil)
+	call := []interface{}{xid, uint32(0), rpc.Header{
+		Rpcvers: 2,
+		Prog:    prog,
+		Vers:    vers,
+		Proc:    proc,
+		Cred:    rpc.AuthNull,
+		Verf:    rpc.AuthNull,
+	}}
+	for _, v := range append(call, args...) {
+		if err := xdr.Write(msg, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record := binary.BigEndian.AppendUint32(nil, uint32(msg.Len())|1<<31)
+	if _, err := c.Write(append(record, msg.Bytes()...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// callFragmented sends a single rpc call as a record over `c`, and reassembles the record
+// of its reply, checking that no fragment exceeds `maxFragment` bytes. It returns the
+// results of the accepted reply and the number of fragments it arrived in.
+func callFragmented(t *testing.T, c net.Conn, maxFragment int, xid, prog, vers, proc uint32, args ...interface{}) (*bytes.Reader, int) {
+	t.Helper()
+	sendCall(t, c, xid, prog, vers, proc, args...)
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var body []byte
+	fragments := 0
+	for last := false; !last; {
+		var header [4]byte
+		if _, err := io.ReadFull(c, header[:]); err != nil {
+			t.Fatal(err)
+		}
+		fragment := binary.BigEndian.Uint32(header[:])
+		last = fragment&(1<<31) != 0
+		size := int(fragment &^ (1 << 31))
+		if size > maxFragment {
+			t.Fatalf("fragment of %d bytes exceeds the maximum of %d", size, maxFragment)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(c, data); err != nil {
+			t.Fatal(err)
+		}
+		body = append(body, data...)
+		fragments++
+	}
+
+	reply := bytes.NewReader(body)
+	var header struct {
+		Xid        uint32
+		MsgType    uint32
+		ReplyStat  uint32
+		Verf       rpc.Auth
+		AcceptStat uint32
+	}
+	if err := xdr.Read(reply, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Xid != xid || header.MsgType != 1 || header.ReplyStat != 0 || header.AcceptStat != 0 {
+		t.Fatalf("unexpected reply header %+v", header)
+	}
+	return reply, fragments
+}
+
+func TestFragmentedReplies(t *testing.T) {
+	const maxFragment = 64
+	dir := t.TempDir()
+	contents := make([]byte, 1001)
+	for i := range contents {
+		contents[i] = byte(i * 7)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data"), contents, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(newOSFileFS(dir)), 1024)
+	c, err := net.Dial("tcp", startServer(t, &nfs.Server{Handler: handler, MaxFragmentSize: maxFragment}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	reply, _ := callFragmented(t, c, maxFragment, 1, mountProg, mountVers, uint32(nfs.MountProcMount), "/")
+	var mount struct {
+		Status uint32
+		Handle []byte
+	}
+	if err := xdr.Read(reply, &mount); err != nil || mount.Status != 0 {
+		t.Fatalf("mount failed with status %d: %v", mount.Status, err)
+	}
+	reply, _ = callFragmented(t, c, maxFragment, 2, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureLookup), mount.Handle, "data")
+	var lookup struct {
+		Status uint32
+		Handle []byte
+	}
+	if err := xdr.Read(reply, &lookup); err != nil || lookup.Status != uint32(nfs.NFSStatusOk) {
+		t.Fatalf("lookup failed with status %d: %v", lookup.Status, err)
+	}
+
+	// a large read is streamed from the file, padded to a multiple of four bytes, and a
+	// small one is buffered. Each reply being read intact shows the previous one ended
+	// where its record did.
+	for i, count := range []uint32{nfs.CheckRead + 1, 100} {
+		reply, fragments := callFragmented(t, c, maxFragment, uint32(3+i), nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureRead), lookup.Handle, uint64(0), count)
+		var read struct {
+			Status uint32
+			Attr   nfsc.PostOpAttr
+			Count  uint32
+			EOF    uint32
+			Data   []byte
+		}
+		if err := xdr.Read(reply, &read); err != nil {
+			t.Fatal(err)
+		}
+		if read.Status != uint32(nfs.NFSStatusOk) {
+			t.Fatalf("read failed: %v", nfs.NFSStatus(read.Status))
+		}
+		want := contents
+		if int(count) < len(want) {
+			want = want[:count]
+		}
+		if !bytes.Equal(read.Data, want) || read.Count != uint32(len(want)) {
+			t.Fatalf("read of %d bytes returned %d unexpected bytes", count, len(read.Data))
+		}
+		if fragments < 2 {
+			t.Fatalf("reply of %d bytes arrived in a single fragment", reply.Size())
+		}
+	}
+}
+
+func TestOversizedRequestClosesConnection(t *testing.T) {
+	_, handler := newMemHandler(t)
+	c, err := net.Dial("tcp", startServer(t, &nfs.Server{Handler: handler}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the start of a WRITE claiming nearly 2GiB of data, in a record of the same size.
+	call := bytes.NewBuffer(nil)
+	for _, v := range []interface{}{uint32(1), uint32(0), rpc.Header{
+		Rpcvers: 2,
+		Prog:    nfsc.Nfs3Prog,
+		Vers:    nfsc.Nfs3Vers,
+		Proc:    uint32(nfs.NFSProcedureWrite),
+		Cred:    rpc.AuthNull,
+		Verf:    rpc.AuthNull,
+	}, []byte("handle"), uint64(0), uint32(1<<31 - 1), uint32(0), uint32(1<<31 - 1)} {
+		if err := xdr.Write(call, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	record := binary.BigEndian.AppendUint32(nil, 1<<31|(1<<31-1))
+	if _, err := c.Write(append(record, call.Bytes()...)); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("connection answered an oversized request with %d bytes", n)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection was not closed after an oversized request")
+	}
+	runtime.ReadMemStats(&after)
+	if grown := after.TotalAlloc - before.TotalAlloc; grown > 64<<20 {
+		t.Fatalf("server allocated %d bytes for an oversized request", grown)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	_, handler := newMemHandler(t)
+	c, err := net.Dial("tcp", startServer(t, &nfs.Server{Handler: handler, IdleTimeout: timeout}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// each request restarts the window, so a connection in use outlives the timeout.
+	for i := 0; i < 3; i++ {
+		time.Sleep(timeout / 2)
+		callFragmented(t, c, 1<<20, uint32(i), nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureNull))
+	}
+
+	idle := time.Now()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("idle connection sent unexpected data")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("idle connection was not closed")
+	}
+	if elapsed := time.Since(idle); elapsed < timeout/2 {
+		t.Fatalf("idle connection was closed after %v, before the timeout", elapsed)
+	}
+}
+
+// slowFS opens files whose reads each take `delay`.
+type slowFS struct {
+	billy.Filesystem
+	delay time.Duration
+}
+
+func (s *slowFS) Open(name string) (billy.File, error) {
+	return s.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (s *slowFS) OpenFile(name string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := s.Filesystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &slowFile{f, s.delay}, nil
+}
+
+type slowFile struct {
+	billy.File
+	delay time.Duration
+}
+
+func (f *slowFile) ReadAt(p []byte, off int64) (int, error) {
+	time.Sleep(f.delay)
+	return f.File.ReadAt(p, off)
+}
+
+func TestProcedureTimeout(t *testing.T) {
+	const size = 1 << 20
+	mem := memfs.New()
+	f, _ := mem.Create("/slow")
+	_, _ = f.Write(make([]byte, size))
+	_ = f.Close()
+	// the read is made in chunks that each take a while, and outlasts the timeout.
+	fs := &slowFS{mem, 20 * time.Millisecond}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	fh := handler.ToHandle(fs, []string{"slow"})
+	c, err := net.Dial("tcp", startServer(t, &nfs.Server{Handler: handler, ProcedureTimeout: 50 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	reply, _ := callFragmented(t, c, size*2, 1, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureRead), fh, uint64(0), uint32(size))
+	status, err := xdr.ReadUint32(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nfs.NFSStatus(status) != nfs.NFSStatusJukebox {
+		t.Fatalf("slow read returned %v", nfs.NFSStatus(status))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second/4 {
+		t.Fatalf("slow read was answered after %v", elapsed)
+	}
+	// the connection goes on to answer the next request.
+	callFragmented(t, c, 1<<20, 2, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureNull))
+}
+
+// blockedFS blocks in Lstat of the "blocked" file until released, as a backend with no
+// context to cancel its calls by would.
+type blockedFS struct {
+	billy.Filesystem
+	released chan struct{}
+}
+
+func (b *blockedFS) Lstat(name string) (os.FileInfo, error) {
+	if name == "blocked" {
+		<-b.released
+	}
+	return b.Filesystem.Lstat(name)
+}
+
+func TestProcedureTimeoutBlockedBackend(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/blocked")
+	fs := &blockedFS{mem, make(chan struct{})}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	fh := handler.ToHandle(fs, []string{"blocked"})
+	c, err := net.Dial("tcp", startServer(t, &nfs.Server{Handler: handler, ProcedureTimeout: 50 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer close(fs.released)
+
+	start := time.Now()
+	reply, _ := callFragmented(t, c, 1<<20, 1, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureGetAttr), fh)
+	status, err := xdr.ReadUint32(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nfs.NFSStatus(status) != nfs.NFSStatusJukebox {
+		t.Fatalf("blocked getattr returned %v", nfs.NFSStatus(status))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second/4 {
+		t.Fatalf("blocked getattr was answered after %v", elapsed)
+	}
+	// the connection goes on to answer the next request while the backend is still blocked.
+	callFragmented(t, c, 1<<20, 2, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureNull))
+}
+
+// unavailableFS opens files whose reads fail until the backend is available again.
+type unavailableFS struct {
+	billy.Filesystem
+}
+
+func (u *unavailableFS) Open(name string) (billy.File, error) {
+	return u.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (u *unavailableFS) OpenFile(name string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := u.Filesystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &unavailableFile{f}, nil
+}
+
+type unavailableFile struct {
+	billy.File
+}
+
+func (f *unavailableFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("object store unreachable: %w", nfs.ErrJukebox())
+}
+
+func TestJukeboxFromBackend(t *testing.T) {
+	mem := memfs.New()
+	// the file holds data, so that reading it reaches the backend.
+	if f, err := mem.Create("/data"); err == nil {
+		_, _ = f.Write([]byte("data"))
+		_ = f.Close()
+	}
+	fs := &unavailableFS{mem}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	fh := handler.ToHandle(fs, []string{"data"})
+	c, err := net.Dial("tcp", startServer(t, &nfs.Server{Handler: handler}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// READ reports failed reads as NFSStatusIO, unless the backend asks for a retry.
+	reply, _ := callFragmented(t, c, 1<<20, 1, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureRead), fh, uint64(0), uint32(16))
+	var read struct {
+		Status uint32
+		Attr   nfsc.PostOpAttr
+	}
+	if err := xdr.Read(reply, &read); err != nil {
+		t.Fatal(err)
+	}
+	if nfs.NFSStatus(read.Status) != nfs.NFSStatusJukebox {
+		t.Fatalf("read from an unavailable backend returned %v", nfs.NFSStatus(read.Status))
+	}
+	if reply.Len() != 0 {
+		t.Fatalf("unexpected %d bytes after the failed read", reply.Len())
+	}
+}
+
+// concurrencyFS opens files whose reads each take `delay`, recording how many of them are
+// made at once.
+type concurrencyFS struct {
+	billy.Filesystem
+	delay   time.Duration
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (c *concurrencyFS) Open(name string) (billy.File, error) {
+	return c.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (c *concurrencyFS) OpenFile(name string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := c.Filesystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &concurrencyFile{f, c}, nil
+}
+
+type concurrencyFile struct {
+	billy.File
+	fs *concurrencyFS
+}
+
+func (f *concurrencyFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	f.fs.current++
+	if f.fs.current > f.fs.max {
+		f.fs.max = f.fs.current
+	}
+	f.fs.mu.Unlock()
+	time.Sleep(f.fs.delay)
+	f.fs.mu.Lock()
+	f.fs.current--
+	f.fs.mu.Unlock()
+	return f.File.ReadAt(p, off)
+}
+
+func TestMaxRequestsPerConnection(t *testing.T) {
+	const limit, requests = 3, 12
+	mem := memfs.New()
+	f, _ := mem.Create("/data")
+	_, _ = f.Write([]byte("data"))
+	_ = f.Close()
+	fs := &concurrencyFS{Filesystem: mem, delay: 20 * time.Millisecond}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	fh := handler.ToHandle(fs, []string{"data"})
+	c, err := net.Dial("tcp", startServer(t, &nfs.Server{Handler: handler, MaxRequestsPerConnection: limit}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for xid := uint32(1); xid <= requests; xid++ {
+		sendCall(t, c, xid, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureRead), fh, uint64(0), uint32(4))
+	}
+	// replies are sent as they are ready, so they are matched to their calls by xid.
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	answered := make(map[uint32]bool)
+	for len(answered) < requests {
+		var header [8]byte
+		if _, err := io.ReadFull(c, header[:]); err != nil {
+			t.Fatal(err)
+		}
+		rest := make([]byte, int(binary.BigEndian.Uint32(header[:4])&^(1<<31))-4)
+		if _, err := io.ReadFull(c, rest); err != nil {
+			t.Fatal(err)
+		}
+		answered[binary.BigEndian.Uint32(header[4:])] = true
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.max > limit {
+		t.Fatalf("%d requests of a connection were handled at once, above the limit of %d", fs.max, limit)
+	}
+	if fs.max < 2 {
+		t.Fatal("pipelined requests were not handled concurrently")
+	}
+}
+
+// panickingHandler is a handler that panics on FSSTAT.
+type panickingHandler struct {
+	nfs.Handler
+}
+
+func (p *panickingHandler) FSStat(ctx context.Context, fs billy.Filesystem, stat *nfs.FSStat) error {
+	panic("fsstat is broken")
+}
+
+func TestHandlerPanic(t *testing.T) {
+	mem := memfs.New()
+	f, _ := mem.Create("/data")
+	_ = f.Close()
+	handler := &panickingHandler{helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)}
+	fh := handler.ToHandle(mem, []string{"data"})
+	c, err := net.Dial("tcp", startServer(t, &nfs.Server{Handler: handler}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	reply, _ := callFragmented(t, c, 1<<20, 1, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureFSStat), fh)
+	status, err := xdr.ReadUint32(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nfs.NFSStatus(status) != nfs.NFSStatusServerFault {
+		t.Fatalf("panicking fsstat returned %v", nfs.NFSStatus(status))
+	}
+	// the connection goes on to answer other procedures.
+	reply, _ = callFragmented(t, c, 1<<20, 2, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureGetAttr), fh)
+	if status, err := xdr.ReadUint32(reply); err != nil || nfs.NFSStatus(status) != nfs.NFSStatusOk {
+		t.Fatalf("getattr after a panic returned %v: %v", nfs.NFSStatus(status), err)
+	}
+}
+
+// sharedPathHandler returns the path of a handle in the same backing array each time, with
+// room to spare, as a handler holding its paths may.
+type sharedPathHandler struct {
+	nfs.Handler
+	mu    sync.Mutex
+	paths map[string][]string
+}
+
+func (s *sharedPathHandler) FromHandle(fh []byte) (billy.Filesystem, []string, error) {
+	fs, path, err := s.Handler.FromHandle(fh)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.paths[string(fh)]; !ok {
+		s.paths[string(fh)] = append(make([]string, 0, len(path)+8), path...)
+	}
+	return fs, s.paths[string(fh)], nil
+}
+
+// lingeringFS delays each Stat, to keep the requests stating their files in flight together.
+type lingeringFS struct {
+	billy.Filesystem
+}
+
+func (l *lingeringFS) Stat(name string) (os.FileInfo, error) {
+	time.Sleep(time.Millisecond)
+	return l.Filesystem.Stat(name)
+}
+
+func TestPipelinedRequestsCopyPaths(t *testing.T) {
+	const requests = 16
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "data"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < requests; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("from%02d", i)), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := linkFS{&lingeringFS{osfs.New(dir)}}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	root, data := handler.ToHandle(fs, []string{}), handler.ToHandle(fs, []string{"data"})
+	shared := &sharedPathHandler{Handler: handler, paths: make(map[string][]string)}
+	c, err := net.Dial("tcp", startServer(t, &nfs.Server{Handler: shared, MaxRequestsPerConnection: 8}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	noAttrs := []interface{}{uint32(0), uint32(0), uint32(0), uint32(0), uint32(0), uint32(0)}
+	xid := uint32(0)
+	for i := 0; i < requests; i++ {
+		xid++
+		sendCall(t, c, xid, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureCreate),
+			append([]interface{}{root, fmt.Sprintf("file%02d", i), uint32(0)}, noAttrs...)...)
+		xid++
+		sendCall(t, c, xid, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureMkDir),
+			append([]interface{}{root, fmt.Sprintf("dir%02d", i)}, noAttrs...)...)
+		xid++
+		sendCall(t, c, xid, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureSymlink),
+			append(append([]interface{}{root, fmt.Sprintf("link%02d", i)}, noAttrs...), "target")...)
+		xid++
+		sendCall(t, c, xid, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureLink), data, root, fmt.Sprintf("hard%02d", i))
+		xid++
+		sendCall(t, c, xid, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureRename),
+			root, fmt.Sprintf("from%02d", i), root, fmt.Sprintf("to%02d", i))
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for answered := uint32(0); answered < xid; answered++ {
+		var header [8]byte
+		if _, err := io.ReadFull(c, header[:]); err != nil {
+			t.Fatal(err)
+		}
+		rest := make([]byte, int(binary.BigEndian.Uint32(header[:4])&^(1<<31))-4)
+		if _, err := io.ReadFull(c, rest); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < requests; i++ {
+		for _, name := range []string{"file%02d", "dir%02d", "link%02d", "hard%02d", "to%02d"} {
+			if _, err := os.Lstat(filepath.Join(dir, fmt.Sprintf(name, i))); err != nil {
+				t.Fatalf("pipelined request made the wrong file: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package nfs
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// maxDirLinks bounds how many directories have their link count kept at once.
+const maxDirLinks = 4096
+
+// dirLinkKey identifies a directory with its link count kept.
+type dirLinkKey struct {
+	fs   billy.Filesystem
+	path string
+}
+
+// dirLinks keeps the link counts of directories whose filesystem does not report them, so
+// that their subdirectories are counted once rather than on every attribute fetch. A
+// directory's count is dropped with its cookie verifier, when an entry is added to or
+// removed from it.
+type dirLinks struct {
+	mu     sync.Mutex
+	counts map[dirLinkKey]uint32
+}
+
+// get is the link count of the directory at a path: those of its parent and its "." entry,
+// and the ".." entry of each of its subdirectories.
+func (d *dirLinks) get(fs billy.Filesystem, path string) uint32 {
+	key := dirLinkKey{fs, path}
+	d.mu.Lock()
+	links, ok := d.counts[key]
+	d.mu.Unlock()
+	if ok {
+		return links
+	}
+
+	links = 2
+	contents, err := fs.ReadDir(path)
+	if err != nil {
+		return links
+	}
+	for _, c := range contents {
+		if c.IsDir() {
+			links++
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.counts == nil {
+		d.counts = make(map[dirLinkKey]uint32)
+	}
+	if len(d.counts) >= maxDirLinks {
+		for k := range d.counts {
+			delete(d.counts, k)
+			break
+		}
+	}
+	d.counts[key] = links
+	return links
+}
+
+// forget drops the link count of the directory at a path.
+func (d *dirLinks) forget(fs billy.Filesystem, path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.counts, dirLinkKey{fs, path})
+}
+
+// forgetTree drops the link counts of the directory at a path and of those below it, which
+// another directory may take the place of once it is removed or renamed.
+func (d *dirLinks) forgetTree(fs billy.Filesystem, path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for k := range d.counts {
+		if k.fs == fs && (k.path == path || strings.HasPrefix(k.path, prefix)) {
+			delete(d.counts, k)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package nfs
+
+import (
+	"bytes"
+	"container/list"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultReplyCacheTTL is how long replies are kept for retransmissions when
+// Server.ReplyCacheTTL is not set.
+const DefaultReplyCacheTTL = 2 * time.Minute
+
+// maxReplyCacheEntries bounds the replies held at once; the oldest are evicted first.
+const maxReplyCacheEntries = 4096
+
+// replyChecksumLen is how much of the arguments of a call its key sums, as Linux does, so
+// that a call reusing an xid with other arguments is not mistaken for a retransmission.
+const replyChecksumLen = 256
+
+// replyKey identifies a call as retransmitted by a client. Clients may retransmit over a
+// new connection, from another port, so only the host is used.
+type replyKey struct {
+	xid      uint32
+	host     string
+	prog     uint32
+	proc     uint32
+	checksum uint32
+}
+
+type replyEntry struct {
+	key     replyKey
+	reply   []byte
+	done    bool
+	expires time.Time
+}
+
+// replyCache is a duplicate request cache, per rfc1813 section 4.3. It holds the replies to
+// non-idempotent requests, so that a retransmitted request is answered again without being
+// executed again. Entries share a ttl, so the list of them is ordered by expiry, too.
+type replyCache struct {
+	mu      sync.Mutex
+	entries map[replyKey]*list.Element
+	order   list.List
+}
+
+// begin looks up a call. If it has been answered, the earlier reply is returned; if it is
+// still being handled, `inProgress` is set and the duplicate should be dropped. Otherwise
+// the call is recorded as in progress, to be completed or abandoned by the caller.
+func (c *replyCache) begin(key replyKey, ttl time.Duration) (reply []byte, inProgress bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.expireLocked(now)
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*replyEntry)
+		return entry.reply, !entry.done
+	}
+	if c.entries == nil {
+		c.entries = make(map[replyKey]*list.Element)
+	}
+	for c.order.Len() >= maxReplyCacheEntries {
+		c.removeLocked(c.order.Front())
+	}
+	c.entries[key] = c.order.PushBack(&replyEntry{key: key, expires: now.Add(ttl)})
+	return nil, false
+}
+
+// complete records the reply to a call recorded by begin.
+func (c *replyCache) complete(key replyKey, reply []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*replyEntry)
+		entry.reply, entry.done = append([]byte(nil), reply...), true
+	}
+}
+
+// abandon forgets a call recorded by begin that was not answered, so that a retransmission
+// is handled afresh.
+func (c *replyCache) abandon(key replyKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.removeLocked(el)
+	}
+}
+
+func (c *replyCache) expireLocked(now time.Time) {
+	for el := c.order.Front(); el != nil && now.After(el.Value.(*replyEntry).expires); el = c.order.Front() {
+		c.removeLocked(el)
+	}
+}
+
+func (c *replyCache) removeLocked(el *list.Element) {
+	delete(c.entries, el.Value.(*replyEntry).key)
+	c.order.Remove(el)
+}
+
+func (s *Server) replyCacheTTL() time.Duration {
+	if s.ReplyCacheTTL == 0 {
+		return DefaultReplyCacheTTL
+	}
+	return s.ReplyCacheTTL
+}
+
+// replyCacheKey is the key the reply to a request is cached under. Only the replies to
+// NFS procedures that modify the filesystem are cached, as others are safely repeated.
+func (c *conn) replyCacheKey(w *response) (replyKey, bool) {
+	// RPCSEC_GSS retransmissions reuse their sequence number, and are dropped as replays.
+	if c.Server.replyCacheTTL() < 0 || w.req.Header.Prog != nfsServiceID || !NFSProcedure(w.req.Header.Proc).mutates() || w.gss != nil {
+		return replyKey{}, false
+	}
+	return replyKey{w.req.xid, clientHost(c.Conn.RemoteAddr()), w.req.Header.Prog, w.req.Header.Proc, w.argsChecksum()}, true
+}
+
+// argsChecksum sums the start of the arguments of a request, leaving them to be read.
+func (w *response) argsChecksum() uint32 {
+	body, ok := w.req.Body.(*io.LimitedReader)
+	if !ok {
+		return 0
+	}
+	head := make([]byte, replyChecksumLen)
+	n, _ := io.ReadFull(body, head)
+	w.req.Body = &io.LimitedReader{R: io.MultiReader(bytes.NewReader(head[:n]), body.R), N: body.N + int64(n)}
+	return crc32.ChecksumIEEE(head[:n])
+}
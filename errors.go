@@ -90,7 +90,7 @@ func (a *AuthError) Error() string {
 // MarshalBinary sends the specific auth status
 func (a *AuthError) MarshalBinary() (data []byte, err error) {
 	var resp [4]byte
-	binary.LittleEndian.PutUint32(resp[:], uint32(a.AuthStat))
+	binary.BigEndian.PutUint32(resp[:], uint32(a.AuthStat))
 	return resp[:], nil
 }
 
@@ -112,8 +112,8 @@ func (r *RPCMismatchError) Error() string {
 // MarshalBinary sends the specific rpc mismatch range
 func (r *RPCMismatchError) MarshalBinary() (data []byte, err error) {
 	var resp [8]byte
-	binary.LittleEndian.PutUint32(resp[0:4], uint32(r.Low))
-	binary.LittleEndian.PutUint32(resp[4:8], uint32(r.High))
+	binary.BigEndian.PutUint32(resp[0:4], uint32(r.Low))
+	binary.BigEndian.PutUint32(resp[4:8], uint32(r.High))
 	return resp[:], nil
 }
 
@@ -135,6 +135,42 @@ func (r *ResponseCodeProcUnavailableError) MarshalBinary() (data []byte, err err
 	return []byte{}, nil
 }
 
+// ResponseCodeProgUnavailableError is an RPCError
+type ResponseCodeProgUnavailableError struct {
+}
+
+// Code for ResponseCodeProgUnavailableError
+func (r *ResponseCodeProgUnavailableError) Code() ResponseCode {
+	return ResponseCodeProgUnavailable
+}
+
+func (r *ResponseCodeProgUnavailableError) Error() string {
+	return "The requested program is not served on this socket"
+}
+
+// MarshalBinary - this error has no associated body
+func (r *ResponseCodeProgUnavailableError) MarshalBinary() (data []byte, err error) {
+	return []byte{}, nil
+}
+
+// ResponseCodeGarbageArgsError is an RPCError
+type ResponseCodeGarbageArgsError struct {
+}
+
+// Code for ResponseCodeGarbageArgsError
+func (r *ResponseCodeGarbageArgsError) Code() ResponseCode {
+	return ResponseCodeGarbageArgs
+}
+
+func (r *ResponseCodeGarbageArgsError) Error() string {
+	return "The procedure arguments could not be decoded"
+}
+
+// MarshalBinary - this error has no associated body
+func (r *ResponseCodeGarbageArgsError) MarshalBinary() (data []byte, err error) {
+	return []byte{}, nil
+}
+
 // ResponseCodeSystemError is an RPCError
 type ResponseCodeSystemError struct {
 }
@@ -170,11 +206,64 @@ type NFSStatusError struct {
 	WrappedErr error
 }
 
+// handleError is the error for a handle the Handler could not resolve.
+func handleError(err error) error {
+	var statusErr *NFSStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr
+	}
+	return &NFSStatusError{NFSStatusStale, err}
+}
+
+// Errorf returns an NFSStatusError reporting `status`, wrapping an error formatted as by
+// fmt.Errorf. The message is only logged; clients receive the bare status.
+func Errorf(status NFSStatus, format string, args ...interface{}) error {
+	return &NFSStatusError{status, fmt.Errorf(format, args...)}
+}
+
+// Errors reporting common statuses. Any error reporting the same status matches them with
+// errors.Is, whatever it wraps.
+func ErrPerm() error        { return &NFSStatusError{NFSStatus: NFSStatusPerm} }
+func ErrNoEnt() error       { return &NFSStatusError{NFSStatus: NFSStatusNoEnt} }
+func ErrIO() error          { return &NFSStatusError{NFSStatus: NFSStatusIO} }
+func ErrAccess() error      { return &NFSStatusError{NFSStatus: NFSStatusAccess} }
+func ErrExist() error       { return &NFSStatusError{NFSStatus: NFSStatusExist} }
+func ErrNotDir() error      { return &NFSStatusError{NFSStatus: NFSStatusNotDir} }
+func ErrIsDir() error       { return &NFSStatusError{NFSStatus: NFSStatusIsDir} }
+func ErrInval() error       { return &NFSStatusError{NFSStatus: NFSStatusInval} }
+func ErrFBig() error        { return &NFSStatusError{NFSStatus: NFSStatusFBig} }
+func ErrNoSpc() error       { return &NFSStatusError{NFSStatus: NFSStatusNoSPC} }
+func ErrROFS() error        { return &NFSStatusError{NFSStatus: NFSStatusROFS} }
+func ErrNameTooLong() error { return &NFSStatusError{NFSStatus: NFSStatusNameTooLong} }
+func ErrNotEmpty() error    { return &NFSStatusError{NFSStatus: NFSStatusNotEmpty} }
+func ErrDQuot() error       { return &NFSStatusError{NFSStatus: NFSStatusDQuot} }
+func ErrStale() error       { return &NFSStatusError{NFSStatus: NFSStatusStale} }
+func ErrBadHandle() error   { return &NFSStatusError{NFSStatus: NFSStatusBadHandle} }
+func ErrNotSupp() error     { return &NFSStatusError{NFSStatus: NFSStatusNotSupp} }
+func ErrServerFault() error { return &NFSStatusError{NFSStatus: NFSStatusServerFault} }
+
+// ErrJukebox reports that the backend is temporarily unable to serve a request, such as a
+// remote store that cannot be reached. Handlers and backends return it, or an error wrapping
+// it, for transient conditions. The request is then answered with NFSStatusJukebox, however
+// the handler reported the failure, so that the client backs off and retries it rather than
+// failing.
+func ErrJukebox() error { return &NFSStatusError{NFSStatus: NFSStatusJukebox} }
+
 // Error is The wrapped error
 func (s *NFSStatusError) Error() string {
+	if s.WrappedErr != nil {
+		return s.NFSStatus.String() + ": " + s.WrappedErr.Error()
+	}
 	return s.NFSStatus.String()
 }
 
+// Is matches another NFSStatusError of the same status, so that errors.Is(err, ErrStale())
+// holds for any error reporting a stale handle.
+func (s *NFSStatusError) Is(target error) bool {
+	t, ok := target.(*NFSStatusError)
+	return ok && t.NFSStatus == s.NFSStatus
+}
+
 // Code for NFS issues are successful RPC responses
 func (s *NFSStatusError) Code() ResponseCode {
 	return ResponseCodeSuccess
@@ -0,0 +1,71 @@
+package nfs_test
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+)
+
+func TestStatusErrors(t *testing.T) {
+	err := nfs.Errorf(nfs.NFSStatusNoEnt, "looking up %s: %w", "a.txt", os.ErrNotExist)
+	if !errors.Is(err, nfs.ErrNoEnt()) {
+		t.Fatalf("%v does not match ErrNoEnt", err)
+	}
+	if errors.Is(err, nfs.ErrStale()) {
+		t.Fatalf("%v matches ErrStale", err)
+	}
+	// the wrapped error remains reachable, and is included for logging.
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("%v does not wrap os.ErrNotExist", err)
+	}
+	if msg := err.Error(); msg != nfs.NFSStatusNoEnt.String()+": looking up a.txt: "+os.ErrNotExist.Error() {
+		t.Fatalf("unexpected message %q", msg)
+	}
+
+	// matching sees through further wrapping.
+	wrapped := fmt.Errorf("handling request: %w", err)
+	var statusErr *nfs.NFSStatusError
+	if !errors.As(wrapped, &statusErr) || statusErr.NFSStatus != nfs.NFSStatusNoEnt {
+		t.Fatalf("could not extract the status of %v", wrapped)
+	}
+	if !errors.Is(wrapped, nfs.ErrNoEnt()) {
+		t.Fatalf("%v does not match ErrNoEnt", wrapped)
+	}
+
+	// only the bare status is sent to clients.
+	body, _ := statusErr.MarshalBinary()
+	if len(body) != 4 || body[3] != byte(nfs.NFSStatusNoEnt) {
+		t.Fatalf("status marshaled as %x", body)
+	}
+}
+
+func TestStatusFromError(t *testing.T) {
+	pathErr := func(errno syscall.Errno) error {
+		return &fs.PathError{Op: "open", Path: "/a", Err: errno}
+	}
+	for _, tc := range []struct {
+		err    error
+		status nfs.NFSStatus
+	}{
+		{nil, nfs.NFSStatusOk},
+		{pathErr(syscall.ENOENT), nfs.NFSStatusNoEnt},
+		{pathErr(syscall.EACCES), nfs.NFSStatusAccess},
+		{pathErr(syscall.EEXIST), nfs.NFSStatusExist},
+		{pathErr(syscall.ENOTEMPTY), nfs.NFSStatusNotEmpty},
+		{pathErr(syscall.EDQUOT), nfs.NFSStatusDQuot},
+		{pathErr(syscall.ENOSPC), nfs.NFSStatusNoSPC},
+		{os.ErrNotExist, nfs.NFSStatusNoEnt},
+		{fmt.Errorf("stat: %w", os.ErrPermission), nfs.NFSStatusAccess},
+		{nfs.ErrStale(), nfs.NFSStatusStale},
+		{errors.New("disk on fire"), nfs.NFSStatusIO},
+	} {
+		if status := nfs.StatusFromError(tc.err); status != tc.status {
+			t.Errorf("%v mapped to %v, expected %v", tc.err, status, tc.status)
+		}
+	}
+}
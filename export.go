@@ -0,0 +1,184 @@
+package nfs
+
+import (
+	"net"
+	"os"
+)
+
+// SquashMode selects which client identities are mapped to the anonymous user of an export.
+type SquashMode int
+
+// SquashMode values
+const (
+	// NoSquash passes client identities through unchanged.
+	NoSquash SquashMode = iota
+	// RootSquash maps uid and gid 0 to the anonymous user and group.
+	RootSquash
+	// AllSquash maps every uid and gid to the anonymous user and group.
+	AllSquash
+)
+
+// ExportOptions controls how the server admits and presents requests to its Handler.
+type ExportOptions struct {
+	// Squash selects which AUTH_SYS identities are replaced by AnonUID / AnonGID
+	// before the request reaches the Handler.
+	Squash SquashMode
+	// AnonUID and AnonGID are the anonymous identity, commonly 65534 ("nobody").
+	AnonUID uint32
+	AnonGID uint32
+	// AllowedCIDRs restricts the export to clients connecting from these networks.
+	// When empty, clients from any address are admitted.
+	AllowedCIDRs []net.IPNet
+	// ReadOnly refuses every mutating nfs procedure with NFS3ERR_ROFS,
+	// without invoking the Handler.
+	ReadOnly bool
+	// Normalization converts the file names clients send, and those listed to them, to a
+	// single Unicode normalization form, so that a file is found whichever form a client
+	// names it in. Existing entries are matched whatever form they are stored in.
+	Normalization Normalization
+	// RequiredAuthFlavors, if set, are the only auth flavors requests are accepted with, such
+	// as AuthFlavorUnix to refuse AUTH_NULL. Other requests are rejected with AUTH_TOOWEAK,
+	// other than calls to NULL procedures, and MNT advertises these flavors to clients.
+	RequiredAuthFlavors []AuthFlavor
+	// IDMapper, if set, translates the uids and gids of AUTH_SYS clients to those of the
+	// filesystem, and the owners of files back to those of clients, for clients whose
+	// identities differ from those of the server. Client identities are mapped before they
+	// are squashed.
+	IDMapper IDMapper
+}
+
+// IDMapper translates between the uids and gids of clients and those of the filesystem.
+type IDMapper interface {
+	// MapIn translates the identity of a client to that of the filesystem.
+	MapIn(uid, gid uint32) (uint32, uint32)
+	// MapOut translates the owner of a file to the identity of clients.
+	MapOut(uid, gid uint32) (uint32, uint32)
+}
+
+// allowsFlavor reports whether requests sent with an auth flavor may access the export.
+func (o *ExportOptions) allowsFlavor(flavor AuthFlavor) bool {
+	if len(o.RequiredAuthFlavors) == 0 {
+		return true
+	}
+	for _, f := range o.RequiredAuthFlavors {
+		if f == flavor {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAddr reports whether a client at `addr` may access the export.
+func (o *ExportOptions) allowsAddr(addr net.Addr) bool {
+	if len(o.AllowedCIDRs) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range o.AllowedCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// mapIn translates an AUTH_SYS credential to the identities of the filesystem.
+func (o *ExportOptions) mapIn(cred UnixCredential) UnixCredential {
+	if o.IDMapper == nil || cred.Flavor != AuthFlavorUnix {
+		return cred
+	}
+	// each supplementary group is mapped alongside the uid the client sent.
+	uid := cred.UID
+	cred.UID, cred.GID = o.IDMapper.MapIn(uid, cred.GID)
+	gids := make([]uint32, len(cred.GIDs))
+	for i, gid := range cred.GIDs {
+		_, gids[i] = o.IDMapper.MapIn(uid, gid)
+	}
+	cred.GIDs = gids
+	return cred
+}
+
+// squash applies the export's identity mapping to an AUTH_SYS credential.
+func (o *ExportOptions) squash(cred UnixCredential) UnixCredential {
+	if cred.Flavor != AuthFlavorUnix && cred.Flavor != AuthFlavorRPCSECGSS {
+		return cred
+	}
+	switch o.Squash {
+	case RootSquash:
+		if cred.UID == 0 {
+			cred.UID = o.AnonUID
+		}
+		if cred.GID == 0 {
+			cred.GID = o.AnonGID
+		}
+		gids := make([]uint32, len(cred.GIDs))
+		for i, g := range cred.GIDs {
+			if g == 0 {
+				g = o.AnonGID
+			}
+			gids[i] = g
+		}
+		cred.GIDs = gids
+	case AllSquash:
+		cred.UID = o.AnonUID
+		cred.GID = o.AnonGID
+		cred.GIDs = []uint32{}
+	}
+	return cred
+}
+
+// fileAttribute is the fattr3 of a file, with its owner as presented to clients.
+func (w *response) fileAttribute(info os.FileInfo) *FileAttribute {
+	attr := ToFileAttribute(info)
+	if mapper := w.Server.Export.IDMapper; mapper != nil {
+		attr.UID, attr.GID = mapper.MapOut(attr.UID, attr.GID)
+	}
+	return attr
+}
+
+// readSetFileAttributes reads the sattr3 of a request, with the owner it sets translated
+// to the identities of the filesystem.
+func (w *response) readSetFileAttributes() (*SetFileAttributes, error) {
+	attrs, err := readSetFileAttributesAt(w.req.Body, w.Server.now())
+	if err != nil {
+		return attrs, err
+	}
+	w.mapSetFileAttributes(attrs)
+	return attrs, nil
+}
+
+// mapSetFileAttributes translates the owner a sattr3 sets to the identities of the filesystem.
+func (w *response) mapSetFileAttributes(attrs *SetFileAttributes) {
+	if w.Server.Export.IDMapper == nil {
+		return
+	}
+	var uid, gid uint32
+	if attrs.SetUID != nil {
+		uid = *attrs.SetUID
+	}
+	if attrs.SetGID != nil {
+		gid = *attrs.SetGID
+	}
+	uid, gid = w.Server.Export.IDMapper.MapIn(uid, gid)
+	if attrs.SetUID != nil {
+		attrs.SetUID = &uid
+	}
+	if attrs.SetGID != nil {
+		attrs.SetGID = &gid
+	}
+}
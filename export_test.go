@@ -0,0 +1,32 @@
+package nfs
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// MaxMountEntries is how many mounts the server records for MOUNT DUMP.
+const MaxMountEntries = maxMountEntries
+
+// DecodeArgs decodes the arguments of a READ, WRITE, READDIR, CREATE or SYMLINK from the
+// body of a request, as the server does before handling them.
+func DecodeArgs(proc NFSProcedure, args []byte) error {
+	body := &io.LimitedReader{R: bytes.NewReader(args), N: int64(len(args))}
+	var err error
+	switch proc {
+	case NFSProcedureRead:
+		_, err = readReadArgs(body)
+	case NFSProcedureWrite:
+		_, err = readWriteArgs(body, &writeArgs{}, &bufferPool{})
+	case NFSProcedureReadDir:
+		_, err = readReadDirArgs(body)
+	case NFSProcedureCreate:
+		_, err = readCreateArgs(body, time.Now())
+	case NFSProcedureSymlink:
+		_, err = readSymlinkArgs(body, time.Now())
+	default:
+		panic("no decoder for " + proc.String())
+	}
+	return err
+}
@@ -2,6 +2,7 @@ package nfs
 
 import (
 	"errors"
+	"hash/fnv"
 	"io"
 	"math"
 	"os"
@@ -96,12 +97,8 @@ func ToFileAttribute(info os.FileInfo) *FileAttribute {
 		f.Type = FileTypeLink
 	} else if m&os.ModeCharDevice != 0 {
 		f.Type = FileTypeCharacter
-		// TODO: set major/minor dev number
-		//f.SpecData = 0,0
 	} else if m&os.ModeDevice != 0 {
 		f.Type = FileTypeBlock
-		// TODO: set major/minor dev number
-		//f.SpecData = 0,0
 	} else if m&os.ModeSocket != 0 {
 		f.Type = FileTypeSocket
 	} else if m&os.ModeNamedPipe != 0 {
@@ -109,17 +106,27 @@ func ToFileAttribute(info os.FileInfo) *FileAttribute {
 	} else {
 		f.Type = FileTypeRegular
 	}
-	// The number of hard links to the file.
+	// The number of hard links to the file. A directory is linked from its parent and
+	// from its own "." entry.
 	f.Nlink = 1
+	if info.IsDir() {
+		f.Nlink = 2
+	}
+
+	f.Filesize = uint64(info.Size())
+	// without a report of the space allocated to the file, it is taken to be its size.
+	f.Used = uint64(info.Size())
 
 	if a := file.GetInfo(info); a != nil {
 		f.Nlink = a.Nlink
 		f.UID = a.UID
 		f.GID = a.GID
+		f.Used = a.Blocks * 512
+		if f.Type == FileTypeCharacter || f.Type == FileTypeBlock {
+			f.SpecData = [2]uint32{a.Major, a.Minor}
+		}
 	}
 
-	f.Filesize = uint64(info.Size())
-	f.Used = uint64(info.Size())
 	f.Atime = ToNFSTime(info.ModTime())
 	f.Mtime = f.Atime
 	f.Ctime = f.Atime
@@ -127,13 +134,63 @@ func ToFileAttribute(info os.FileInfo) *FileAttribute {
 }
 
 // tryStat attempts to create a FileAttribute from a path.
-func tryStat(fs billy.Filesystem, path []string) *FileAttribute {
-	attrs, err := fs.Stat(fs.Join(path...))
+func (w *response) tryStat(fs billy.Filesystem, path []string) *FileAttribute {
+	// attributes describe the object itself, never the target of a symlink.
+	attrs, err := fs.Lstat(fs.Join(path...))
 	if err != nil || attrs == nil {
 		Log.Errorf("err loading attrs for %s: %v", fs.Join(path...), err)
 		return nil
 	}
-	return ToFileAttribute(attrs)
+	return w.attributesOf(fs, path, attrs)
+}
+
+// preOpAttrs is the wcc_attr of a file before a procedure changes it, or nil if it cannot
+// be read.
+func (w *response) preOpAttrs(fs billy.Filesystem, path []string) *FileCacheAttribute {
+	info, err := fs.Lstat(fs.Join(path...))
+	if err != nil {
+		return nil
+	}
+	return w.fileAttribute(info).AsCache()
+}
+
+// attributesOf is the fattr3 of the file at a path, given its Lstat. Directories whose
+// filesystem reports no link count are counted 2 links and one for each subdirectory.
+func (w *response) attributesOf(fs billy.Filesystem, path []string, info os.FileInfo) *FileAttribute {
+	attr := w.fileAttribute(info)
+	attr.Fileid = w.fileID(fs, path, info)
+	if info.IsDir() && file.GetInfo(info) == nil {
+		attr.Nlink = w.Server.dirLinks.get(fs, fs.Join(path...))
+	}
+	return attr
+}
+
+// fileID is the fileid of the file at a path, which is the same in every reply that
+// describes the file: the inode number the filesystem reports for it, so that hard links
+// share it, or otherwise the id a FileIDer keeps for it or a hash of its handle.
+// `info` is the file's Lstat, or nil to stat it.
+func (w *response) fileID(fs billy.Filesystem, path []string, info os.FileInfo) uint64 {
+	if info == nil {
+		info, _ = fs.Lstat(fs.Join(path...))
+	}
+	if info != nil {
+		if a := file.GetInfo(info); a != nil && a.Fileid != 0 {
+			return a.Fileid
+		}
+	}
+	if ider, ok := w.Server.Handler.(FileIDer); ok {
+		if id, ok := ider.FileID(fs, path); ok {
+			return id
+		}
+	}
+	id := w.Server.Handler.ToHandle(fs, path)
+	if len(id) == 0 {
+		// without room for a handle, the path is the best remaining name for the file.
+		id = []byte(fs.Join(path...))
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(id)
+	return h.Sum64()
 }
 
 // WriteWcc writes the `wcc_data` representation of an object.
@@ -165,6 +222,18 @@ func WriteWcc(writer io.Writer, pre *FileCacheAttribute, post *FileAttribute) er
 	return nil
 }
 
+// writePostOpFH writes the `post_op_fh3` representation of a handle, which is left out when
+// the handler could not mint one.
+func writePostOpFH(writer io.Writer, fh []byte) error {
+	if len(fh) == 0 {
+		return xdr.Write(writer, uint32(0))
+	}
+	if err := xdr.Write(writer, uint32(1)); err != nil {
+		return err
+	}
+	return xdr.Write(writer, fh)
+}
+
 // WritePostOpAttrs writes the `post_op_attr` representation of a files attributes
 func WritePostOpAttrs(writer io.Writer, post *FileAttribute) error {
 	if post == nil {
@@ -241,24 +310,28 @@ func (s *SetFileAttributes) Apply(changer billy.Change, fs billy.Filesystem, fil
 			}
 		}
 	}
-	if s.SetSize != nil {
+	if s.SetSize != nil && *s.SetSize != curr.Filesize {
 		if curr.Mode()&os.ModeSymlink != 0 {
 			return &NFSStatusError{NFSStatusNotSupp, os.ErrInvalid}
 		}
-		fp, err := fs.OpenFile(file, os.O_WRONLY|os.O_EXCL, 0)
-		if errors.Is(err, os.ErrPermission) {
-			return &NFSStatusError{NFSStatusAccess, err}
-		} else if err != nil {
-			return err
+		if curOS.IsDir() {
+			return &NFSStatusError{NFSStatusIsDir, os.ErrInvalid}
 		}
 		if *s.SetSize > math.MaxInt64 {
 			return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
 		}
+		fp, err := fs.OpenFile(file, os.O_WRONLY, 0)
+		if errors.Is(err, os.ErrPermission) {
+			return &NFSStatusError{NFSStatusAccess, err}
+		} else if err != nil {
+			return &NFSStatusError{NFSStatusIO, err}
+		}
 		if err := fp.Truncate(int64(*s.SetSize)); err != nil {
-			return err
+			_ = fp.Close()
+			return &NFSStatusError{NFSStatusIO, err}
 		}
 		if err := fp.Close(); err != nil {
-			return err
+			return &NFSStatusError{NFSStatusIO, err}
 		}
 	}
 
@@ -271,7 +344,7 @@ func (s *SetFileAttributes) Apply(changer billy.Change, fs billy.Filesystem, fil
 		if s.SetMtime != nil {
 			mtime = s.SetMtime
 		}
-		if atime != curr.Atime.Native() || mtime != curr.Mtime.Native() {
+		if !atime.Equal(*curr.Atime.Native()) || !mtime.Equal(*curr.Mtime.Native()) {
 			if changer == nil {
 				return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
 			}
@@ -296,6 +369,11 @@ func (s *SetFileAttributes) Mode(def os.FileMode) os.FileMode {
 
 // ReadSetFileAttributes reads an sattr3 xdr stream into a go struct.
 func ReadSetFileAttributes(r io.Reader) (*SetFileAttributes, error) {
+	return readSetFileAttributesAt(r, time.Now())
+}
+
+// readSetFileAttributesAt reads an sattr3, with times set to the server's time set to `now`.
+func readSetFileAttributesAt(r io.Reader, now time.Time) (*SetFileAttributes, error) {
 	attrs := SetFileAttributes{}
 	hasMode, err := xdr.ReadUint32(r)
 	if err != nil {
@@ -346,7 +424,6 @@ func ReadSetFileAttributes(r io.Reader) (*SetFileAttributes, error) {
 		return nil, err
 	}
 	if aTime == 1 {
-		now := time.Now()
 		attrs.SetAtime = &now
 	} else if aTime == 2 {
 		t := FileTime{}
@@ -360,7 +437,6 @@ func ReadSetFileAttributes(r io.Reader) (*SetFileAttributes, error) {
 		return nil, err
 	}
 	if mTime == 1 {
-		now := time.Now()
 		attrs.SetMtime = &now
 	} else if mTime == 2 {
 		t := FileTime{}
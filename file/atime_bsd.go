@@ -0,0 +1,13 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package file
+
+import (
+	"syscall"
+	"time"
+)
+
+func atime(s *syscall.Stat_t) time.Time {
+	return time.Unix(s.Atimespec.Unix())
+}
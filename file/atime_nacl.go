@@ -0,0 +1,13 @@
+//go:build nacl
+// +build nacl
+
+package file
+
+import (
+	"syscall"
+	"time"
+)
+
+func atime(s *syscall.Stat_t) time.Time {
+	return time.Unix(s.Atime, s.AtimeNsec)
+}
@@ -0,0 +1,13 @@
+//go:build dragonfly || linux || openbsd || solaris
+// +build dragonfly linux openbsd solaris
+
+package file
+
+import (
+	"syscall"
+	"time"
+)
+
+func atime(s *syscall.Stat_t) time.Time {
+	return time.Unix(s.Atim.Unix())
+}
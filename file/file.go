@@ -1,11 +1,23 @@
 package file
 
-import "os"
+import (
+	"os"
+	"time"
+)
 
 type FileInfo struct {
 	Nlink uint32
 	UID   uint32
 	GID   uint32
+	// Fileid is the inode number of the file.
+	Fileid uint64
+	// Blocks is the number of 512-byte blocks allocated to the file.
+	Blocks uint64
+	// Major and Minor identify the device of a device node.
+	Major uint32
+	Minor uint32
+	// Atime is the last access time of the file, or zero if the backend does not report it.
+	Atime time.Time
 }
 
 // GetInfo extracts some non-standardized items from the result of a Stat call.
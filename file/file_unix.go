@@ -5,6 +5,8 @@ package file
 import (
 	"os"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func getInfo(info os.FileInfo) *FileInfo {
@@ -13,6 +15,11 @@ func getInfo(info os.FileInfo) *FileInfo {
 		fi.Nlink = uint32(s.Nlink)
 		fi.UID = s.Uid
 		fi.GID = s.Gid
+		fi.Fileid = uint64(s.Ino)
+		fi.Blocks = uint64(s.Blocks)
+		fi.Major = uint32(unix.Major(uint64(s.Rdev)))
+		fi.Minor = uint32(unix.Minor(uint64(s.Rdev)))
+		fi.Atime = atime(s)
 		return fi
 	}
 	return nil
@@ -1,6 +1,9 @@
 package nfs
 
-import "time"
+import (
+	"os"
+	"time"
+)
 
 // FSStat returns metadata about a file system
 type FSStat struct {
@@ -13,3 +16,48 @@ type FSStat struct {
 	// CacheHint is called "invarsec" in the nfs standard
 	CacheHint time.Duration
 }
+
+// StatFS is implemented by billy filesystems that can report their capacity.
+// When a backend does not implement it, FSSTAT reports effectively unbounded space.
+type StatFS interface {
+	StatFS() (FSStat, error)
+}
+
+// PathConf describes the POSIX path limits of a file system, as reported by PATHCONF.
+type PathConf struct {
+	LinkMax         uint32
+	NameMax         uint32
+	NoTrunc         bool
+	ChownRestricted bool
+	CaseInsensitive bool
+	CasePreserving  bool
+}
+
+// PathConfFS is implemented by billy filesystems that can describe their own path limits.
+// When a backend does not implement it, PATHCONF reports the limits of a typical posix file system.
+type PathConfFS interface {
+	PathConf() PathConf
+}
+
+// MknodFS is implemented by billy filesystems that can create special files.
+// The type of the node is given by the os.ModeNamedPipe, os.ModeSocket, os.ModeDevice and
+// os.ModeCharDevice bits of `mode`; `major` and `minor` identify the device of device nodes.
+// Backends return billy.ErrNotSupported for node types they cannot create.
+type MknodFS interface {
+	Mknod(name string, mode os.FileMode, major, minor uint32) error
+}
+
+// LinkFS is implemented by billy filesystems that can create hard links.
+type LinkFS interface {
+	Link(oldname, newname string) error
+}
+
+// XattrFS is implemented by billy filesystems that store extended attributes of their files,
+// which are served through the xattr procedures. Backends report attributes that are not set
+// with an error wrapping os.ErrNotExist.
+type XattrFS interface {
+	Getxattr(name, attr string) ([]byte, error)
+	Setxattr(name, attr string, value []byte) error
+	Listxattr(name string) ([]string, error)
+	Removexattr(name, attr string) error
+}
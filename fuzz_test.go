@@ -0,0 +1,147 @@
+package nfs_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/willscott/go-nfs"
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+	"github.com/willscott/go-nfs/helpers"
+)
+
+// encodeArgs is the XDR encoding of the arguments of a procedure.
+func encodeArgs(tb testing.TB, args ...interface{}) []byte {
+	tb.Helper()
+	buf := bytes.NewBuffer(nil)
+	for _, arg := range args {
+		if err := xdr.Write(buf, arg); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// setAttrs is an sattr3 setting the mode and leaving the rest of the attributes untouched.
+var setAttrs = []interface{}{uint32(1), uint32(0644), uint32(0), uint32(0), uint32(0), uint32(0), uint32(0)}
+
+// validArgs are well formed arguments of each procedure with a fuzzed decoder.
+func validArgs(tb testing.TB) map[nfs.NFSProcedure][]byte {
+	handle := make([]byte, 16)
+	return map[nfs.NFSProcedure][]byte{
+		nfs.NFSProcedureRead:    encodeArgs(tb, handle, uint64(0), uint32(4096)),
+		nfs.NFSProcedureWrite:   encodeArgs(tb, handle, uint64(0), uint32(4), uint32(0), []byte("data")),
+		nfs.NFSProcedureReadDir: encodeArgs(tb, handle, uint64(0), uint64(0), uint32(4096)),
+		nfs.NFSProcedureCreate:  encodeArgs(tb, append([]interface{}{handle, []byte("file"), uint32(0)}, setAttrs...)...),
+		nfs.NFSProcedureSymlink: encodeArgs(tb, append(append([]interface{}{handle, []byte("link")}, setAttrs...), []byte("target"))...),
+	}
+}
+
+// checkDecode fails unless the arguments decode, or are refused with an error the server
+// answers for.
+func checkDecode(t *testing.T, proc nfs.NFSProcedure, args []byte) error {
+	t.Helper()
+	err := nfs.DecodeArgs(proc, args)
+	var garbage *nfs.ResponseCodeGarbageArgsError
+	var status *nfs.NFSStatusError
+	if err != nil && !errors.As(err, &garbage) && !errors.As(err, &status) {
+		t.Fatalf("decoding %v arguments failed with %v", proc, err)
+	}
+	return err
+}
+
+func fuzzDecode(f *testing.F, proc nfs.NFSProcedure) {
+	f.Add(validArgs(f)[proc])
+	f.Add([]byte{})
+	f.Add([]byte{0x7f, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, args []byte) {
+		checkDecode(t, proc, args)
+	})
+}
+
+func FuzzReadArgs(f *testing.F)    { fuzzDecode(f, nfs.NFSProcedureRead) }
+func FuzzWriteArgs(f *testing.F)   { fuzzDecode(f, nfs.NFSProcedureWrite) }
+func FuzzReadDirArgs(f *testing.F) { fuzzDecode(f, nfs.NFSProcedureReadDir) }
+func FuzzCreateArgs(f *testing.F)  { fuzzDecode(f, nfs.NFSProcedureCreate) }
+func FuzzSymlinkArgs(f *testing.F) { fuzzDecode(f, nfs.NFSProcedureSymlink) }
+
+func TestTruncatedArgs(t *testing.T) {
+	for proc, args := range validArgs(t) {
+		if err := checkDecode(t, proc, args); err != nil {
+			t.Fatalf("valid %v arguments failed to decode: %v", proc, err)
+		}
+		for n := 0; n < len(args); n++ {
+			var garbage *nfs.ResponseCodeGarbageArgsError
+			if err := checkDecode(t, proc, args[:n]); !errors.As(err, &garbage) {
+				t.Fatalf("%v arguments truncated to %d bytes decoded with %v", proc, n, err)
+			}
+		}
+	}
+}
+
+func TestOversizedArgsAreNotAllocated(t *testing.T) {
+	// each argument announces a handle of 2GiB, in a request of a few bytes.
+	huge := []byte{0x7f, 0xff, 0xff, 0xfc, 0, 0, 0, 0}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for proc := range validArgs(t) {
+		if err := checkDecode(t, proc, huge); err == nil {
+			t.Fatalf("decoded %v arguments announcing a huge handle", proc)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	if grown := after.TotalAlloc - before.TotalAlloc; grown > 1<<20 {
+		t.Fatalf("decoding allocated %d bytes for oversized arguments", grown)
+	}
+}
+
+func TestGarbageArgsReply(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)
+	c, err := net.Dial("tcp", startServer(t, &nfs.Server{Handler: handler}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	expectGarbageArgs := func(xid, prog, vers, proc uint32, args ...interface{}) {
+		t.Helper()
+		sendCall(t, c, xid, prog, vers, proc, args...)
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var reply struct {
+			Fragment   uint32
+			Xid        uint32
+			MsgType    uint32
+			ReplyStat  uint32
+			Verf       rpc.Auth
+			AcceptStat uint32
+		}
+		if err := xdr.Read(c, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Xid != xid || reply.ReplyStat != 0 || reply.AcceptStat != uint32(nfs.ResponseCodeGarbageArgs) {
+			t.Fatalf("expected a GARBAGE_ARGS reply to procedure %d of program %d, got %+v", proc, prog, reply)
+		}
+	}
+
+	// a READ of a handle, missing its offset and count.
+	expectGarbageArgs(1, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureRead), make([]byte, 16))
+	// every procedure taking arguments is answered alike when they are missing altogether.
+	xid := uint32(2)
+	for proc := nfs.NFSProcedureGetAttr; proc <= nfs.NFSProcedureCommit; proc++ {
+		expectGarbageArgs(xid, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(proc))
+		xid++
+	}
+	for _, proc := range []nfs.MountProcedure{nfs.MountProcMount, nfs.MountProcUmnt} {
+		expectGarbageArgs(xid, mountProg, mountVers, uint32(proc))
+		xid++
+	}
+	// the connection goes on to answer the next request.
+	callFragmented(t, c, 1<<20, xid, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureNull))
+}
@@ -0,0 +1,432 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// rpcGSSVersion is the version of the RPCSEC_GSS credential, per rfc2203 section 5.
+const rpcGSSVersion = 1
+
+// The RPCSEC_GSS procedures a credential names, per rfc2203 section 5.
+const (
+	rpcGSSData uint32 = iota
+	rpcGSSInit
+	rpcGSSContinueInit
+	rpcGSSDestroy
+)
+
+// GSSService is the protection an RPCSEC_GSS request is sent with, per rfc2203 section 5.
+type GSSService uint32
+
+// GSSService values
+const (
+	// GSSServiceNone authenticates the header of requests, but leaves their arguments and results unprotected.
+	GSSServiceNone GSSService = 1
+	// GSSServiceIntegrity also checksums the arguments and results, as with krb5i.
+	GSSServiceIntegrity GSSService = 2
+	// GSSServicePrivacy also encrypts the arguments and results, as with krb5p.
+	GSSServicePrivacy GSSService = 3
+)
+
+// GSS-API major status codes answered to clients establishing a context, per rfc2744.
+const (
+	gssComplete       uint32 = 0
+	gssContinueNeeded uint32 = 1
+	gssFailure        uint32 = 13 << 16
+)
+
+// rpcGSSMaxSeq bounds the sequence numbers of a context, per rfc2203 section 5.3.3.1.
+const rpcGSSMaxSeq = 0x80000000
+
+// DefaultGSSWindow is the sequence window of RPCSEC_GSS contexts when GSSAuth.Window is not set.
+const DefaultGSSWindow = 128
+
+// DefaultGSSContexts is the number of RPCSEC_GSS contexts held when GSSAuth.MaxContexts is not set.
+const DefaultGSSContexts = 1024
+
+// errGSSReplay is returned for requests replayed, or reordered past the sequence window,
+// which are dropped without being answered.
+var errGSSReplay = errors.New("rpcsec_gss sequence number replayed or outside of the window")
+
+// GSSMechanism establishes the security contexts of RPCSEC_GSS clients, such as for Kerberos
+// V5 through a GSS-API implementation.
+type GSSMechanism interface {
+	// Accept processes a context token a client sent with RPCSEC_GSS_INIT, for which ctx is
+	// nil, or with RPCSEC_GSS_CONTINUE_INIT, for which ctx is the context returned for the
+	// previous token. It returns the context, the token to answer the client with, and whether
+	// the context is established. A *GSSError is answered with its major and minor status.
+	Accept(ctx GSSContext, token []byte) (GSSContext, []byte, bool, error)
+}
+
+// GSSContext is a security context established with a client by a GSSMechanism.
+type GSSContext interface {
+	// Principal is the authenticated name of the client, such as "alice@EXAMPLE.COM".
+	Principal() string
+	// GetMIC computes a message integrity code over msg.
+	GetMIC(msg []byte) ([]byte, error)
+	// VerifyMIC checks a message integrity code over msg.
+	VerifyMIC(msg, mic []byte) error
+}
+
+// GSSError is a GSS-API failure to establish a context.
+type GSSError struct {
+	Major uint32
+	Minor uint32
+}
+
+func (e *GSSError) Error() string {
+	return fmt.Sprintf("gss failure: major status %#x, minor status %d", e.Major, e.Minor)
+}
+
+// GSSAuth configures the RPCSEC_GSS authentication of requests, per rfc2203. Requests are
+// handled as the identity of the principal of their context, and may be sent with
+// GSSServiceNone or GSSServiceIntegrity; GSSServicePrivacy is refused as too weak an offer
+// of what the server supports.
+type GSSAuth struct {
+	// Mechanism establishes the contexts of clients.
+	Mechanism GSSMechanism
+	// Identity maps the principal of an established context to the identity its requests are
+	// handled as. A principal it fails for cannot establish a context. When nil, principals
+	// are handled as the anonymous user of the export.
+	Identity func(principal string) (UnixCredential, error)
+	// Window is the number of sequence numbers a client may have outstanding at once. Zero
+	// uses DefaultGSSWindow.
+	Window uint32
+	// MaxContexts bounds the contexts held at once, dropping the least recently used first.
+	// Zero uses DefaultGSSContexts.
+	MaxContexts int
+}
+
+func (g *GSSAuth) window() uint32 {
+	if g.Window > 0 {
+		return g.Window
+	}
+	return DefaultGSSWindow
+}
+
+// gssCred is the body of an RPCSEC_GSS credential.
+type gssCred struct {
+	Version uint32
+	Proc    uint32
+	Seq     uint32
+	Service GSSService
+	Handle  []byte
+}
+
+// gssRequest is the RPCSEC_GSS state of a request.
+type gssRequest struct {
+	cred    gssCred
+	session *gssSession
+}
+
+// control reports whether the request establishes or destroys a context, rather than
+// calling the procedure it names.
+func (g *gssRequest) control() bool {
+	return g.cred.Proc != rpcGSSData
+}
+
+// gssSession is a context established, or being established, with a client. Its context,
+// identity and window are set before it is added to the table of contexts and not changed
+// after, as the requests of the context read them concurrently; each step of establishing
+// a context adds a new session for its handle.
+type gssSession struct {
+	ctx         GSSContext
+	established bool
+	cred        UnixCredential
+
+	mu sync.Mutex
+	// the sequence numbers seen within the window below the highest, top.
+	top  uint32
+	seen []uint32
+}
+
+// accept records the sequence number of a request, reporting false for one seen before
+// or too far behind the highest seen to be told apart from a replay.
+func (s *gssSession) accept(seq uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	window := uint32(len(s.seen))
+	if seq+window <= s.top {
+		return false
+	}
+	slot := &s.seen[seq%window]
+	if *slot == seq+1 {
+		return false
+	}
+	*slot = seq + 1
+	if seq > s.top {
+		s.top = seq
+	}
+	return true
+}
+
+// gssContexts holds the contexts of a server by their handle.
+type gssContexts struct {
+	once     sync.Once
+	sessions *lru.Cache[string, *gssSession]
+}
+
+func (t *gssContexts) table(limit int) *lru.Cache[string, *gssSession] {
+	t.once.Do(func() {
+		if limit <= 0 {
+			limit = DefaultGSSContexts
+		}
+		t.sessions, _ = lru.New[string, *gssSession](limit)
+	})
+	return t.sessions
+}
+
+// authenticateGSS checks the RPCSEC_GSS credential and verifier of a request, returning the
+// identity of its context. The arguments of requests sent with integrity are checked and
+// unwrapped, so that the procedure reads them as it would those of any other request.
+func (c *conn) authenticateGSS(w *response) (UnixCredential, error) {
+	none := UnixCredential{Flavor: AuthFlavorRPCSECGSS}
+	auth := c.Server.GSS
+	if auth == nil || auth.Mechanism == nil {
+		return none, &AuthError{AuthStatBadCred}
+	}
+	var cred gssCred
+	if err := xdr.Read(bytes.NewReader(w.req.Header.Cred.Body), &cred); err != nil || cred.Version != rpcGSSVersion {
+		return none, &AuthError{AuthStatBadCred}
+	}
+	w.gss = &gssRequest{cred: cred}
+	switch cred.Proc {
+	case rpcGSSInit, rpcGSSContinueInit:
+		if w.req.Header.Proc != 0 {
+			return none, &AuthError{AuthStatBadCred}
+		}
+		return none, nil
+	case rpcGSSData, rpcGSSDestroy:
+	default:
+		return none, &AuthError{AuthStatBadCred}
+	}
+	if cred.Proc == rpcGSSDestroy && w.req.Header.Proc != 0 {
+		return none, &AuthError{AuthStatBadCred}
+	}
+
+	table := c.Server.gssContexts.table(auth.MaxContexts)
+	session, ok := table.Get(string(cred.Handle))
+	if !ok || !session.established {
+		return none, &AuthError{AuthStatRPCGSSCredProblem}
+	}
+	if cred.Seq >= rpcGSSMaxSeq {
+		table.Remove(string(cred.Handle))
+		return none, &AuthError{AuthStatRPCGSSCTXProblem}
+	}
+	if w.req.Header.Verf.Flavor != uint32(AuthFlavorRPCSECGSS) {
+		return none, &AuthError{AuthStatRPCGSSCredProblem}
+	}
+	if err := session.ctx.VerifyMIC(w.req.callHeader(), w.req.Header.Verf.Body); err != nil {
+		Log.Debugf("rejecting %v: %v", w.req, err)
+		return none, &AuthError{AuthStatRPCGSSCredProblem}
+	}
+	if !session.accept(cred.Seq) {
+		return none, errGSSReplay
+	}
+	switch cred.Service {
+	case GSSServiceNone, GSSServiceIntegrity:
+	case GSSServicePrivacy:
+		return none, &AuthError{AuthStatTooWeak}
+	default:
+		return none, &AuthError{AuthStatBadCred}
+	}
+	w.gss.session = session
+
+	// the reply is verified by the checksum of the sequence number of the request.
+	var seq [4]byte
+	binary.BigEndian.PutUint32(seq[:], cred.Seq)
+	mic, err := session.ctx.GetMIC(seq[:])
+	if err != nil {
+		return none, &AuthError{AuthStatRPCGSSCTXProblem}
+	}
+	w.verf = &rpc.Auth{Flavor: uint32(AuthFlavorRPCSECGSS), Body: mic}
+
+	if cred.Service == GSSServiceIntegrity && cred.Proc == rpcGSSData {
+		if err := w.unwrapIntegrity(); err != nil {
+			Log.Debugf("rejecting %v: %v", w.req, err)
+			return session.cred, &ResponseCodeGarbageArgsError{}
+		}
+	}
+	return session.cred, nil
+}
+
+// callHeader encodes the call header of a request, from its xid up to its credential, as
+// checksummed by the verifier of an RPCSEC_GSS request.
+func (r *request) callHeader() []byte {
+	header := struct {
+		Xid     uint32
+		Type    uint32
+		Rpcvers uint32
+		Prog    uint32
+		Vers    uint32
+		Proc    uint32
+		Cred    rpc.Auth
+	}{r.xid, 0, r.Header.Rpcvers, r.Header.Prog, r.Header.Vers, r.Header.Proc, r.Header.Cred}
+	var buf bytes.Buffer
+	_ = xdr.Write(&buf, header)
+	return buf.Bytes()
+}
+
+// unwrapIntegrity checks the rpc_gss_integ_data the arguments of a request are sent in, and
+// replaces the body of the request with the arguments.
+func (w *response) unwrapIntegrity() error {
+	data, err := readOpaque(w.req.Body)
+	if err != nil {
+		return err
+	}
+	checksum, err := readOpaque(w.req.Body)
+	if err != nil {
+		return err
+	}
+	if err := w.gss.session.ctx.VerifyMIC(data, checksum); err != nil {
+		return err
+	}
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != w.gss.cred.Seq {
+		return errors.New("sequence number of the arguments does not match the credential")
+	}
+	if err := w.drain(context.Background()); err != nil {
+		return err
+	}
+	args := data[4:]
+	w.req.Body = &io.LimitedReader{R: bytes.NewReader(args), N: int64(len(args))}
+	return nil
+}
+
+// sealIntegrity wraps the results of a successful reply in rpc_gss_integ_data, for requests
+// sent with GSSServiceIntegrity.
+func (w *response) sealIntegrity() {
+	if w.gss == nil || w.gss.session == nil || w.gss.control() || w.gss.cred.Service != GSSServiceIntegrity || w.resultsAt == 0 || w.discard {
+		return
+	}
+	if binary.BigEndian.Uint32(w.writer.Bytes()[w.resultsAt-4:]) != uint32(ResponseCodeSuccess) {
+		return
+	}
+	results := w.writer.Bytes()[w.resultsAt:]
+	data := make([]byte, 4+len(results))
+	binary.BigEndian.PutUint32(data, w.gss.cred.Seq)
+	copy(data[4:], results)
+	w.writer.Truncate(w.resultsAt)
+	mic, err := w.gss.session.ctx.GetMIC(data)
+	if err != nil {
+		Log.Errorf("error sealing reply to %v: %v", w.req, err)
+		// the results cannot be sent unprotected, so the reply becomes a system error.
+		w.writer.Truncate(w.resultsAt - 4)
+		_ = xdr.Write(w.writer, uint32(ResponseCodeSystemErr))
+		return
+	}
+	_ = xdr.Write(w.writer, data)
+	_ = xdr.Write(w.writer, mic)
+	w.sealed = true
+}
+
+// gssInitResult is the rpc_gss_init_res answered to a client establishing a context.
+type gssInitResult struct {
+	Handle []byte
+	Major  uint32
+	Minor  uint32
+	Window uint32
+	Token  []byte
+}
+
+// gssControl answers the control procedures of RPCSEC_GSS, establishing and destroying
+// the contexts of clients.
+func (c *conn) gssControl(w *response) error {
+	auth := c.Server.GSS
+	table := c.Server.gssContexts.table(auth.MaxContexts)
+	cred := w.gss.cred
+	if cred.Proc == rpcGSSDestroy {
+		table.Remove(string(cred.Handle))
+		return w.Write([]byte{})
+	}
+
+	token, err := readOpaque(w.req.Body)
+	if err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	var prev GSSContext
+	handle := cred.Handle
+	if cred.Proc == rpcGSSContinueInit {
+		prevSession, ok := table.Get(string(handle))
+		if !ok || prevSession.established {
+			return &AuthError{AuthStatRPCGSSCredProblem}
+		}
+		prev = prevSession.ctx
+	}
+
+	res := gssInitResult{Window: auth.window()}
+	ctx, out, complete, err := auth.Mechanism.Accept(prev, token)
+	var identity UnixCredential
+	if err == nil && complete {
+		identity, err = c.gssIdentity(ctx.Principal())
+	}
+	if err != nil {
+		Log.Debugf("failed to establish a gss context for %v: %v", c.Conn.RemoteAddr(), err)
+		if cred.Proc == rpcGSSContinueInit {
+			table.Remove(string(handle))
+		}
+		res = gssInitResult{Major: gssFailure, Token: out}
+		var gssErr *GSSError
+		if errors.As(err, &gssErr) {
+			res.Major, res.Minor = gssErr.Major, gssErr.Minor
+		}
+		return w.writeGSSInitResult(res)
+	}
+
+	if cred.Proc == rpcGSSInit {
+		handle = make([]byte, 16)
+		if _, err := rand.Read(handle); err != nil {
+			return &ResponseCodeSystemError{}
+		}
+	}
+	session := &gssSession{ctx: ctx}
+	res.Handle, res.Token = handle, out
+	if !complete {
+		res.Major = gssContinueNeeded
+	} else {
+		// the established context is verified by the checksum of the window.
+		var window [4]byte
+		binary.BigEndian.PutUint32(window[:], res.Window)
+		mic, err := ctx.GetMIC(window[:])
+		if err != nil {
+			return &ResponseCodeSystemError{}
+		}
+		w.verf = &rpc.Auth{Flavor: uint32(AuthFlavorRPCSECGSS), Body: mic}
+		session.cred = identity
+		session.seen = make([]uint32, res.Window)
+		session.established = true
+	}
+	table.Add(string(handle), session)
+	return w.writeGSSInitResult(res)
+}
+
+// gssIdentity is the identity the requests of a principal are handled as.
+func (c *conn) gssIdentity(principal string) (UnixCredential, error) {
+	cred := UnixCredential{UID: c.Server.Export.AnonUID, GID: c.Server.Export.AnonGID}
+	if identity := c.Server.GSS.Identity; identity != nil {
+		var err error
+		if cred, err = identity(principal); err != nil {
+			return UnixCredential{}, err
+		}
+	}
+	cred.Flavor = AuthFlavorRPCSECGSS
+	return cred, nil
+}
+
+func (w *response) writeGSSInitResult(res gssInitResult) error {
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, res); err != nil {
+		return &ResponseCodeSystemError{}
+	}
+	return w.Write(writer.Bytes())
+}
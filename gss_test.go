@@ -0,0 +1,396 @@
+package nfs_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// mockMechanism establishes contexts in two steps: an "init" token is answered with a
+// "challenge", which the client completes with an "answer". MICs are HMACs under key.
+type mockMechanism struct {
+	key []byte
+}
+
+func (m *mockMechanism) Accept(ctx nfs.GSSContext, token []byte) (nfs.GSSContext, []byte, bool, error) {
+	switch {
+	case ctx == nil && string(token) == "init":
+		return &mockContext{m.key}, []byte("challenge"), false, nil
+	case ctx != nil && string(token) == "answer":
+		return ctx, []byte("welcome"), true, nil
+	}
+	return nil, nil, false, &nfs.GSSError{Major: 9 << 16, Minor: 7}
+}
+
+type mockContext struct {
+	key []byte
+}
+
+func (c *mockContext) Principal() string { return "alice@EXAMPLE.COM" }
+
+func (c *mockContext) GetMIC(msg []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(msg)
+	return mac.Sum(nil), nil
+}
+
+func (c *mockContext) VerifyMIC(msg, mic []byte) error {
+	want, _ := c.GetMIC(msg)
+	if !hmac.Equal(want, mic) {
+		return errors.New("bad mic")
+	}
+	return nil
+}
+
+// gssClient makes RPCSEC_GSS calls over a raw TCP connection, so that the credential and
+// verifier of each call can be controlled.
+type gssClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	xid    uint32
+	ctx    *mockContext
+	handle []byte
+}
+
+type gssTestCred struct {
+	Version uint32
+	Proc    uint32
+	Seq     uint32
+	Service uint32
+	Handle  []byte
+}
+
+type gssReply struct {
+	accepted   bool
+	authStat   uint32
+	verf       rpc.Auth
+	acceptStat uint32
+	results    []byte
+}
+
+const (
+	gssTestData     = 0
+	gssTestInit     = 1
+	gssTestContinue = 2
+	gssTestDestroy  = 3
+)
+
+func (c *gssClient) send(proc uint32, cred gssTestCred, args []byte) {
+	c.t.Helper()
+	c.xid++
+	var credBody bytes.Buffer
+	_ = xdr.Write(&credBody, cred)
+	var call bytes.Buffer
+	_ = xdr.Write(&call, struct {
+		Xid, Type, Rpcvers, Prog, Vers, Proc uint32
+		Cred                                 rpc.Auth
+	}{c.xid, 0, 2, mountProg, 3, proc, rpc.Auth{Flavor: uint32(nfs.AuthFlavorRPCSECGSS), Body: credBody.Bytes()}})
+	verf := rpc.AuthNull
+	if cred.Proc == gssTestData || cred.Proc == gssTestDestroy {
+		mic, _ := c.ctx.GetMIC(call.Bytes())
+		verf = rpc.Auth{Flavor: uint32(nfs.AuthFlavorRPCSECGSS), Body: mic}
+	}
+	_ = xdr.Write(&call, verf)
+	call.Write(args)
+
+	frame := make([]byte, 4, 4+call.Len())
+	binary.BigEndian.PutUint32(frame, uint32(call.Len())|1<<31)
+	if _, err := c.conn.Write(append(frame, call.Bytes()...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// receive reads the next reply, reporting false if none arrives in time.
+func (c *gssClient) receive() (gssReply, bool) {
+	c.t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	defer func() { _ = c.conn.SetReadDeadline(time.Time{}) }()
+	var header [4]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return gssReply{}, false
+		}
+		c.t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[:])&^(1<<31))
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		c.t.Fatal(err)
+	}
+	r := bytes.NewReader(body)
+	var head struct{ Xid, Type, Stat uint32 }
+	if err := xdr.Read(r, &head); err != nil {
+		c.t.Fatal(err)
+	}
+	var reply gssReply
+	if head.Stat != rpc.MsgAccepted {
+		var denied struct{ Reject, Stat uint32 }
+		_ = xdr.Read(r, &denied)
+		reply.authStat = denied.Stat
+		return reply, true
+	}
+	reply.accepted = true
+	if err := xdr.Read(r, &reply.verf); err != nil {
+		c.t.Fatal(err)
+	}
+	reply.acceptStat, _ = xdr.ReadUint32(r)
+	reply.results, _ = io.ReadAll(r)
+	return reply, true
+}
+
+func (c *gssClient) call(proc uint32, cred gssTestCred, args []byte) gssReply {
+	c.t.Helper()
+	c.send(proc, cred, args)
+	reply, ok := c.receive()
+	if !ok {
+		c.t.Fatal("call went unanswered")
+	}
+	return reply
+}
+
+type gssTestInitResult struct {
+	Handle []byte
+	Major  uint32
+	Minor  uint32
+	Window uint32
+	Token  []byte
+}
+
+func (c *gssClient) initCall(proc uint32, token string) gssTestInitResult {
+	c.t.Helper()
+	var args bytes.Buffer
+	_ = xdr.Write(&args, []byte(token))
+	reply := c.call(0, gssTestCred{Version: 1, Proc: proc, Handle: c.handle}, args.Bytes())
+	if !reply.accepted || reply.acceptStat != 0 {
+		c.t.Fatalf("context establishment was not accepted: %+v", reply)
+	}
+	var res gssTestInitResult
+	if err := xdr.Read(bytes.NewReader(reply.results), &res); err != nil {
+		c.t.Fatal(err)
+	}
+	if res.Major == 0 {
+		var window [4]byte
+		binary.BigEndian.PutUint32(window[:], res.Window)
+		if err := c.ctx.VerifyMIC(window[:], reply.verf.Body); err != nil {
+			c.t.Fatalf("verifier of the established context did not match: %v", err)
+		}
+	}
+	return res
+}
+
+func dialGSS(t *testing.T, addr string) *gssClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &gssClient{t: t, conn: conn, reader: bufio.NewReader(conn), ctx: &mockContext{[]byte("secret")}}
+}
+
+func mountArgs() []byte {
+	var args bytes.Buffer
+	_ = xdr.Write(&args, []byte("/"))
+	return args.Bytes()
+}
+
+func TestGSSHandshake(t *testing.T) {
+	_, handler := newMemHandler(t)
+	recorder := &credRecordingHandler{handler, make(chan nfs.UnixCredential, 4)}
+	srv := &nfs.Server{
+		Handler: recorder,
+		GSS: &nfs.GSSAuth{
+			Mechanism: &mockMechanism{[]byte("secret")},
+			Identity: func(principal string) (nfs.UnixCredential, error) {
+				if principal != "alice@EXAMPLE.COM" {
+					return nfs.UnixCredential{}, errors.New("unknown principal")
+				}
+				return nfs.UnixCredential{UID: 1000, GID: 100}, nil
+			},
+			Window: 8,
+		},
+	}
+	c := dialGSS(t, startServer(t, srv))
+
+	// a bad token fails with the status of the mechanism.
+	if res := c.initCall(gssTestInit, "bogus"); res.Major != 9<<16 || res.Minor != 7 {
+		t.Fatalf("expected the failure of the mechanism, got %+v", res)
+	}
+
+	res := c.initCall(gssTestInit, "init")
+	if res.Major != 1 || string(res.Token) != "challenge" || len(res.Handle) == 0 {
+		t.Fatalf("expected the context to continue, got %+v", res)
+	}
+	c.handle = res.Handle
+
+	// the context cannot be used until it is established.
+	if reply := c.call(1, gssTestCred{Version: 1, Proc: gssTestData, Seq: 1, Service: 1, Handle: c.handle}, mountArgs()); reply.accepted || reply.authStat != uint32(nfs.AuthStatRPCGSSCredProblem) {
+		t.Fatalf("expected a call on an incomplete context to be refused, got %+v", reply)
+	}
+
+	res = c.initCall(gssTestContinue, "answer")
+	if res.Major != 0 || res.Window != 8 || string(res.Token) != "welcome" || !bytes.Equal(res.Handle, c.handle) {
+		t.Fatalf("expected the context to be established, got %+v", res)
+	}
+
+	// a call with no protection beyond the header is handled as the mapped identity.
+	reply := c.call(1, gssTestCred{Version: 1, Proc: gssTestData, Seq: 1, Service: 1, Handle: c.handle}, mountArgs())
+	if !reply.accepted || reply.acceptStat != 0 || binary.BigEndian.Uint32(reply.results) != 0 {
+		t.Fatalf("mount failed: %+v", reply)
+	}
+	if err := c.ctx.VerifyMIC([]byte{0, 0, 0, 1}, reply.verf.Body); err != nil {
+		t.Fatalf("reply verifier did not checksum the sequence number: %v", err)
+	}
+	if cred := <-recorder.mounted; cred.Flavor != nfs.AuthFlavorRPCSECGSS || cred.UID != 1000 || cred.GID != 100 {
+		t.Fatalf("mount was not handled as the principal: %+v", cred)
+	}
+
+	// a replayed sequence number is dropped.
+	c.send(1, gssTestCred{Version: 1, Proc: gssTestData, Seq: 1, Service: 1, Handle: c.handle}, mountArgs())
+	if reply, ok := c.receive(); ok {
+		t.Fatalf("replayed call was answered: %+v", reply)
+	}
+
+	// a call with integrity has its arguments and results checksummed.
+	var args bytes.Buffer
+	_ = xdr.Write(&args, append([]byte{0, 0, 0, 2}, mountArgs()...))
+	mic, _ := c.ctx.GetMIC(append([]byte{0, 0, 0, 2}, mountArgs()...))
+	_ = xdr.Write(&args, mic)
+	reply = c.call(1, gssTestCred{Version: 1, Proc: gssTestData, Seq: 2, Service: 2, Handle: c.handle}, args.Bytes())
+	if !reply.accepted || reply.acceptStat != 0 {
+		t.Fatalf("mount with integrity failed: %+v", reply)
+	}
+	r := bytes.NewReader(reply.results)
+	data, err := xdr.ReadOpaque(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := xdr.ReadOpaque(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ctx.VerifyMIC(data, checksum); err != nil {
+		t.Fatalf("results were not checksummed: %v", err)
+	}
+	if binary.BigEndian.Uint32(data) != 2 || binary.BigEndian.Uint32(data[4:]) != 0 {
+		t.Fatalf("unexpected sealed results %x", data)
+	}
+	<-recorder.mounted
+
+	// arguments that do not match their checksum are refused.
+	tampered := args.Bytes()
+	tampered[len(tampered)-1] ^= 1
+	reply = c.call(1, gssTestCred{Version: 1, Proc: gssTestData, Seq: 3, Service: 2, Handle: c.handle}, tampered)
+	if !reply.accepted || reply.acceptStat != uint32(nfs.ResponseCodeGarbageArgs) {
+		t.Fatalf("expected tampered arguments to be refused, got %+v", reply)
+	}
+
+	// a header that does not match its verifier is refused.
+	c.ctx.key = []byte("other")
+	reply = c.call(1, gssTestCred{Version: 1, Proc: gssTestData, Seq: 4, Service: 1, Handle: c.handle}, mountArgs())
+	if reply.accepted || reply.authStat != uint32(nfs.AuthStatRPCGSSCredProblem) {
+		t.Fatalf("expected a forged header to be refused, got %+v", reply)
+	}
+	c.ctx.key = []byte("secret")
+
+	// privacy is not offered.
+	reply = c.call(1, gssTestCred{Version: 1, Proc: gssTestData, Seq: 5, Service: 3, Handle: c.handle}, mountArgs())
+	if reply.accepted || reply.authStat != uint32(nfs.AuthStatTooWeak) {
+		t.Fatalf("expected privacy to be refused, got %+v", reply)
+	}
+
+	// the context is gone once destroyed.
+	if reply := c.call(0, gssTestCred{Version: 1, Proc: gssTestDestroy, Seq: 6, Service: 1, Handle: c.handle}, nil); !reply.accepted || reply.acceptStat != 0 {
+		t.Fatalf("destroying the context failed: %+v", reply)
+	}
+	reply = c.call(1, gssTestCred{Version: 1, Proc: gssTestData, Seq: 7, Service: 1, Handle: c.handle}, mountArgs())
+	if reply.accepted || reply.authStat != uint32(nfs.AuthStatRPCGSSCredProblem) {
+		t.Fatalf("expected a destroyed context to be refused, got %+v", reply)
+	}
+}
+
+func TestGSSIntegrityRequestInfo(t *testing.T) {
+	_, handler := newMemHandler(t)
+	infos := make(chan nfs.RequestInfo, 4)
+	srv := &nfs.Server{
+		Handler: handler,
+		GSS: &nfs.GSSAuth{
+			Mechanism: &mockMechanism{[]byte("secret")},
+			Identity: func(principal string) (nfs.UnixCredential, error) {
+				return nfs.UnixCredential{UID: 1000, GID: 100}, nil
+			},
+		},
+		OnRequest: func(info nfs.RequestInfo) { infos <- info },
+	}
+	c := dialGSS(t, startServer(t, srv))
+	c.handle = c.initCall(gssTestInit, "init").Handle
+	c.initCall(gssTestContinue, "answer")
+	for len(infos) > 0 {
+		<-infos
+	}
+
+	// the arguments are summarized as unwrapped, rather than as their sequence number and checksum.
+	var args bytes.Buffer
+	_ = xdr.Write(&args, append([]byte{0, 0, 0, 1}, mountArgs()...))
+	mic, _ := c.ctx.GetMIC(append([]byte{0, 0, 0, 1}, mountArgs()...))
+	_ = xdr.Write(&args, mic)
+	if reply := c.call(1, gssTestCred{Version: 1, Proc: gssTestData, Seq: 1, Service: 2, Handle: c.handle}, args.Bytes()); !reply.accepted || reply.acceptStat != 0 {
+		t.Fatalf("mount with integrity failed: %+v", reply)
+	}
+	info := <-infos
+	if info.Procedure != "mount.Mount" || info.Args != `path="/"` {
+		t.Fatalf("mount with integrity was observed as %s(%s)", info.Procedure, info.Args)
+	}
+}
+
+func TestGSSPipelinedEstablishment(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{
+		Handler:                  handler,
+		GSS:                      &nfs.GSSAuth{Mechanism: &mockMechanism{[]byte("secret")}},
+		MaxRequestsPerConnection: 8,
+	}
+	c := dialGSS(t, startServer(t, srv))
+	c.handle = c.initCall(gssTestInit, "init").Handle
+
+	// calls on the context may be handled while it is being established.
+	var answer bytes.Buffer
+	_ = xdr.Write(&answer, []byte("answer"))
+	c.send(0, gssTestCred{Version: 1, Proc: gssTestContinue, Handle: c.handle}, answer.Bytes())
+	const calls = 6
+	for seq := uint32(1); seq <= calls; seq++ {
+		c.send(1, gssTestCred{Version: 1, Proc: gssTestData, Seq: seq, Service: 1, Handle: c.handle}, mountArgs())
+	}
+	for i := 0; i <= calls; i++ {
+		if _, ok := c.receive(); !ok {
+			t.Fatalf("call %d of %d went unanswered", i, calls+1)
+		}
+	}
+
+	// the context is established once its last step has been answered.
+	reply := c.call(1, gssTestCred{Version: 1, Proc: gssTestData, Seq: calls + 1, Service: 1, Handle: c.handle}, mountArgs())
+	if !reply.accepted || reply.acceptStat != 0 {
+		t.Fatalf("mount failed: %+v", reply)
+	}
+}
+
+func TestGSSUnconfigured(t *testing.T) {
+	_, handler := newMemHandler(t)
+	c := dialGSS(t, startServer(t, &nfs.Server{Handler: handler}))
+	reply := c.call(1, gssTestCred{Version: 1, Proc: gssTestData, Seq: 1, Service: 1}, mountArgs())
+	if reply.accepted || reply.authStat != uint32(nfs.AuthStatBadCred) {
+		t.Fatalf("expected RPCSEC_GSS to be refused, got %+v", reply)
+	}
+}
@@ -23,8 +23,12 @@ type Handler interface {
 	FSStat(context.Context, billy.Filesystem, *FSStat) error
 
 	// represent file objects as opaque references
-	// Can be safely implemented via helpers/cachinghandler.
+	// Can be safely implemented via helpers/cachinghandler. It may return nil when it has no
+	// room for another handle, in which case the handle is left out of replies where it is
+	// optional, and LOOKUP is answered with NFSStatusJukebox so that the client retries.
 	ToHandle(fs billy.Filesystem, path []string) []byte
+	// FromHandle may return an NFSStatusError to choose the status reported, such as
+	// NFSStatusBadHandle for a malformed handle; other errors are reported as stale.
 	FromHandle(fh []byte) (billy.Filesystem, []string, error)
 	// How many handles can be safely maintained by the handler.
 	HandleLimit() int
@@ -38,3 +42,61 @@ type CachingHandler interface {
 	// fs.FileInfo needs to be sorted by Name(), nil in case of a cache-miss
 	DataForVerifier(path string, verifier uint64) []fs.FileInfo
 }
+
+// VerifierInvalidator is implemented by CachingHandlers that can drop a cached directory listing.
+// The server invalidates a directory's listing after changing its entries, so that clients
+// resuming a stale listing are told to restart it with NFS3ERR_BAD_COOKIE.
+type VerifierInvalidator interface {
+	InvalidateVerifier(path string)
+}
+
+// HandleRenamer is implemented by Handlers that can follow renamed files to their new path.
+// The server calls it after a RENAME, so that handles to the moved entry and to anything
+// below it continue to resolve.
+type HandleRenamer interface {
+	RenameHandles(fs billy.Filesystem, from, to []string)
+}
+
+// FileIDer is implemented by Handlers that keep an id for each file they hold handles for.
+// The server reports it as the fileid of files whose filesystem reports no inode number,
+// so it must follow a file across the renames the Handler follows, as its handles do.
+// FileID reports false for a file the Handler has no id for.
+type FileIDer interface {
+	FileID(fs billy.Filesystem, path []string) (uint64, bool)
+}
+
+// HandleBatcher is implemented by Handlers that can mint the handles of many files at once
+// more cheaply than through ToHandle for each, such as for the entries of a READDIRPLUS.
+// The handles returned are those ToHandle would return, in the order of `paths`.
+type HandleBatcher interface {
+	ToHandles(fs billy.Filesystem, paths [][]string) [][]byte
+}
+
+// CaseInsensitiveHandler is implemented by Handlers whose filesystems do not tell names apart
+// by case. When CaseInsensitive reports true, LOOKUP finds entries named in another case,
+// answering with the name the entry is stored under, and CREATE treats a name differing
+// only in case from an existing entry as naming that entry.
+type CaseInsensitiveHandler interface {
+	CaseInsensitive() bool
+}
+
+// ExportLister is implemented by Handlers that serve more than a single root export.
+// The listed exports are reported to clients by the MOUNT EXPORT procedure (`showmount -e`).
+type ExportLister interface {
+	Exports() []ExportEntry
+}
+
+// ContextHandler is implemented by Handlers that resolve file handles with the context of the
+// request they are resolved for, such as to consult CredFromContext or LimitsFromContext.
+// The server calls FromHandleContext in place of FromHandle.
+type ContextHandler interface {
+	FromHandleContext(ctx context.Context, fh []byte) (billy.Filesystem, []string, error)
+}
+
+// fromHandle resolves a file handle through the Handler, with the context of the request.
+func fromHandle(ctx context.Context, userHandle Handler, fh []byte) (billy.Filesystem, []string, error) {
+	if ch, ok := userHandle.(ContextHandler); ok {
+		return ch.FromHandleContext(ctx, fh)
+	}
+	return userHandle.FromHandle(fh)
+}
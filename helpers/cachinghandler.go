@@ -1,9 +1,17 @@
 package helpers
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"io/fs"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/willscott/go-nfs"
 
@@ -12,121 +20,875 @@ import (
 	lru "github.com/hashicorp/golang-lru/v2"
 )
 
+// ErrInvalidCacheLimit is returned when a caching handler is configured with a cache size it cannot hold.
+var ErrInvalidCacheLimit = errors.New("cache limit must be positive")
+
+// ErrInvalidHandleLength is returned when a caching handler is configured with a handle
+// length outside of the 16 to 64 bytes it can mint, or shorter than the 32 bytes of a
+// signed handle.
+var ErrInvalidHandleLength = errors.New("handle length must be between 16 and 64 bytes")
+
+// ErrInvalidPath is returned when a handle is asked for a path with a "." or ".." component,
+// which the paths of cached handles never hold.
+var ErrInvalidPath = errors.New("path components may not be . or ..")
+
+// ErrNilFilesystem is returned when a handle is asked for a file of a nil filesystem, which
+// could never be served through it.
+var ErrNilFilesystem = errors.New("filesystem may not be nil")
+
+// minHandleLength is the size of the id identifying each handle.
+const minHandleLength = 16
+
+// handleMACLength is the size of the signature following the id of handles minted with a HandleKey.
+const handleMACLength = 16
+
+// CachingHandlerOptions configures a CachingHandler built with NewCachingHandlerWithOptions.
+type CachingHandlerOptions struct {
+	// Limit is the number of file handles to cache.
+	Limit int
+	// VerifierLimit is the number of directory listings to cache. If zero, Limit is used.
+	VerifierLimit int
+	// NoVerifierCache caches no directory listings at all. Verifiers are then a hash of each
+	// listing, and READDIR reads the directory again for every call, so that without
+	// nfs.Server.StableCookies a listing paged through is only resumed while the directory
+	// is unchanged. This suits filesystems that list directories cheaply and atomically,
+	// trading the memory of the listings for reading them again. VerifierLimit is ignored.
+	NoVerifierCache bool
+	// Deterministic derives handles from paths rather than minting them randomly.
+	// See NewDeterministicCachingHandler for the tradeoffs.
+	Deterministic bool
+	// HandleLength is the size of the handles minted, in bytes. Handles are an id padded
+	// with zeros to this length, and handles of any other length are rejected as malformed.
+	// It must be between 16 and nfs.FHSize, and if zero, 16 is used.
+	HandleLength int
+	// HandleKey, if set, is a secret that handles are signed with, so that a client cannot
+	// forge a handle by guessing its id. The id is followed by a truncated HMAC-SHA256 of it,
+	// which FromHandle checks before looking the id up, rejecting handles that do not match
+	// as NFSStatusBadHandle. Signed handles are at least 32 bytes, which is the default
+	// HandleLength when a key is set.
+	HandleKey []byte
+	// HandleTTL, if set, expires handles that have not been resolved for this long, even
+	// while the cache has room for them. Clients holding an expired handle receive a stale
+	// handle error.
+	HandleTTL time.Duration
+	// MaxLimit, if greater than Limit, lets the cache grow rather than evict a handle when
+	// it fills, doubling in size each time up to MaxLimit handles.
+	MaxLimit int
+	// Cache, if set, is a cache of handles the handler shares with the other handlers given
+	// it, in place of a cache of its own. The limit of the cache then applies to them
+	// together, and Limit and MaxLimit are ignored.
+	Cache *HandleCache
+	// RefuseWhenFull keeps the cached handles once the cache is full and cannot grow, rather
+	// than evicting the least recently used of them for a new one. ToHandle then returns the
+	// cached handle of a path it holds, and nil for any other path, which the server answers
+	// for with NFSStatusJukebox so that the client retries. Refusals are counted in
+	// CacheStats, and a warning is logged as the cache starts refusing handles.
+	RefuseWhenFull bool
+	// CaseInsensitive serves filesystems that do not tell names apart by case. Paths that
+	// differ only in case share their place in the cache, and the server matches names
+	// looked up or created in another case to the entries stored under them.
+	CaseInsensitive bool
+	// Codec, if set, mints handles that encode the FSID and path of their files, in place of
+	// the UUIDs otherwise looked up in the cache. Such handles resolve without being cached,
+	// so they outlive evictions and restarts, but only for filesystems registered with
+	// RegisterFilesystem, and they go stale when their file is renamed. The handle limits,
+	// Deterministic, HandleLength and HandleKey do not apply to them.
+	Codec HandleCodec
+}
+
+// NewCachingHandlerWithOptions wraps a handler to provide a to/from-file handle cache,
+// returning an error wrapping ErrInvalidCacheLimit if the options cannot be satisfied.
+func NewCachingHandlerWithOptions(h nfs.Handler, opts CachingHandlerOptions) (nfs.Handler, error) {
+	c, err := newCachingHandler(h, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
 // NewCachingHandler wraps a handler to provide a basic to/from-file handle cache.
+// It panics if limit is not positive.
 func NewCachingHandler(h nfs.Handler, limit int) nfs.Handler {
-	cache, _ := lru.New[uuid.UUID, entry](limit)
-	verifiers, _ := lru.New[uint64, verifier](limit)
-	return &CachingHandler{
-		Handler:         h,
-		activeHandles:   cache,
-		activeVerifiers: verifiers,
-		cacheLimit:      limit,
-	}
+	return mustCachingHandler(newCachingHandler(h, CachingHandlerOptions{Limit: limit}))
 }
 
 // NewCachingHandlerWithVerifierLimit provides a basic to/from-file handle cache that can be tuned with a smaller cache of active directory listings.
+// It panics if either limit is negative or limit is zero.
 func NewCachingHandlerWithVerifierLimit(h nfs.Handler, limit int, verifierLimit int) nfs.Handler {
-	cache, _ := lru.New[uuid.UUID, entry](limit)
-	verifiers, _ := lru.New[uint64, verifier](verifierLimit)
-	return &CachingHandler{
+	return mustCachingHandler(newCachingHandler(h, CachingHandlerOptions{Limit: limit, VerifierLimit: verifierLimit}))
+}
+
+// NewDeterministicCachingHandler wraps a handler to provide a to/from-file handle cache
+// where handles are derived from the filesystem root and path rather than randomly
+// minted. The same path always maps to the same handle, so a handle remains valid
+// once its path is looked up again after having been evicted from the cache.
+//
+// Handles are a 128-bit truncated SHA-1 of the path, and filesystems are identified
+// by their FSID if registered, or otherwise their `Root()`. Distinct paths colliding
+// is vanishingly unlikely, but two unregistered filesystems reporting the same root
+// will share handles for the same path, with the most recently cached filesystem winning.
+// It panics if limit is not positive.
+func NewDeterministicCachingHandler(h nfs.Handler, limit int) nfs.Handler {
+	return mustCachingHandler(newCachingHandler(h, CachingHandlerOptions{Limit: limit, Deterministic: true}))
+}
+
+func mustCachingHandler(c *CachingHandler, err error) *CachingHandler {
+	if err != nil {
+		panic(fmt.Sprintf("helpers: invalid caching handler configuration: %v", err))
+	}
+	return c
+}
+
+func newCachingHandler(h nfs.Handler, opts CachingHandlerOptions) (*CachingHandler, error) {
+	cache := opts.Cache
+	if cache == nil {
+		if opts.Limit <= 0 {
+			return nil, fmt.Errorf("%w: handle limit %d", ErrInvalidCacheLimit, opts.Limit)
+		}
+		if opts.MaxLimit < 0 || opts.MaxLimit > 0 && opts.MaxLimit < opts.Limit {
+			return nil, fmt.Errorf("%w: max limit %d below handle limit %d", ErrInvalidCacheLimit, opts.MaxLimit, opts.Limit)
+		}
+	}
+	if opts.VerifierLimit < 0 {
+		return nil, fmt.Errorf("%w: verifier limit %d", ErrInvalidCacheLimit, opts.VerifierLimit)
+	}
+	if opts.VerifierLimit == 0 {
+		opts.VerifierLimit = opts.Limit
+		if cache != nil {
+			opts.VerifierLimit = cache.cacheLimit
+		}
+	}
+	minLength := minHandleLength
+	if len(opts.HandleKey) > 0 {
+		minLength += handleMACLength
+	}
+	if opts.HandleLength == 0 {
+		opts.HandleLength = minLength
+	}
+	if opts.HandleLength < minLength || opts.HandleLength > nfs.FHSize {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidHandleLength, opts.HandleLength)
+	}
+
+	c := &CachingHandler{
 		Handler:         h,
-		activeHandles:   cache,
-		activeVerifiers: verifiers,
-		cacheLimit:      limit,
+		refuseWhenFull:  opts.RefuseWhenFull,
+		deterministic:   opts.Deterministic,
+		handleLength:    opts.HandleLength,
+		handleKey:       append([]byte(nil), opts.HandleKey...),
+		handleTTL:       opts.HandleTTL,
+		caseInsensitive: opts.CaseInsensitive,
+		codec:           opts.Codec,
+		cache:           cache,
 	}
+	var err error
+	if c.cache == nil {
+		if c.cache, err = newHandleCache(opts.Limit, opts.MaxLimit); err != nil {
+			return nil, err
+		}
+	}
+	if opts.NoVerifierCache {
+		return c, nil
+	}
+	if c.activeVerifiers, err = lru.New[uint64, verifier](opts.VerifierLimit); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 // CachingHandler implements to/from handle via an LRU cache.
+// It is safe for concurrent use by the connections of a server.
 type CachingHandler struct {
 	nfs.Handler
-	activeHandles   *lru.Cache[uuid.UUID, entry]
+	// OnEvict, if set, is called with each handle that is purged from the cache.
+	// A client still holding the handle will receive a stale handle error.
+	// It is called after the cache locks are released, so it may call back into
+	// the handler, for instance to re-pin the path with ToHandle.
+	OnEvict func(fh []byte, f billy.Filesystem, path []string)
+
+	// cache holds the handles, and may be shared with other handlers. Its lock also guards
+	// the verifiers of the handler.
+	cache *HandleCache
+	// activeVerifiers is nil with NoVerifierCache.
 	activeVerifiers *lru.Cache[uint64, verifier]
-	cacheLimit      int
+	refuseWhenFull  bool
+	deterministic   bool
+	handleLength    int
+	handleKey       []byte
+	handleTTL       time.Duration
+	caseInsensitive bool
+	codec           HandleCodec
+
+	handleHits        atomic.Uint64
+	handleMisses      atomic.Uint64
+	handleEvictions   atomic.Uint64
+	handleGrowths     atomic.Uint64
+	handleRefusals    atomic.Uint64
+	verifierHits      atomic.Uint64
+	verifierMisses    atomic.Uint64
+	verifierEvictions atomic.Uint64
+}
+
+// CacheStats is a snapshot of the behavior of a CachingHandler's caches.
+type CacheStats struct {
+	// Handles is the number of file handles currently cached, by all of the handlers
+	// sharing the cache.
+	Handles int
+	// Verifiers is the number of directory listings currently cached.
+	Verifiers int
+	// Limit is the maximum number of file handles that will be cached, until the cache
+	// grows towards its MaxLimit. It is shared by the handlers sharing the cache.
+	Limit int
+
+	HandleHits      uint64
+	HandleMisses    uint64
+	HandleEvictions uint64
+	// HandleGrowths counts the times the cache grew instead of evicting a handle.
+	HandleGrowths uint64
+	// HandleRefusals counts the handles not minted because the cache was full.
+	HandleRefusals    uint64
+	VerifierHits      uint64
+	VerifierMisses    uint64
+	VerifierEvictions uint64
+}
+
+// Stats reports the current size of the caches and the counts of hits, misses
+// and evictions since the handler was created.
+func (c *CachingHandler) Stats() CacheStats {
+	verifiers := 0
+	if c.activeVerifiers != nil {
+		verifiers = c.activeVerifiers.Len()
+	}
+	return CacheStats{
+		Handles:           c.cache.activeHandles.Len(),
+		Verifiers:         verifiers,
+		Limit:             c.HandleLimit(),
+		HandleHits:        c.handleHits.Load(),
+		HandleMisses:      c.handleMisses.Load(),
+		HandleEvictions:   c.handleEvictions.Load(),
+		HandleGrowths:     c.handleGrowths.Load(),
+		HandleRefusals:    c.handleRefusals.Load(),
+		VerifierHits:      c.verifierHits.Load(),
+		VerifierMisses:    c.verifierMisses.Load(),
+		VerifierEvictions: c.verifierEvictions.Load(),
+	}
 }
 
 type entry struct {
-	f billy.Filesystem
-	p []string
+	// owner is the handler that minted the handle.
+	owner *CachingHandler
+	f     billy.Filesystem
+	p     []string
+	// used is when the handle was last resolved, in unix nanoseconds. It is shared by the
+	// copies of the entry, so that it can be refreshed while holding only the read lock.
+	used *atomic.Int64
+	// fileid is reported for the file while any of its handles are cached. Handles minted
+	// for a cached path share it, and it follows the entry across renames.
+	fileid uint64
+}
+
+func (c *CachingHandler) newEntry(f billy.Filesystem, p []string) entry {
+	e := entry{owner: c, f: f, p: p, used: new(atomic.Int64)}
+	e.used.Store(time.Now().UnixNano())
+	return e
+}
+
+// expired reports whether an entry has gone unused for longer than the handle ttl.
+func (c *CachingHandler) expired(e entry, now time.Time) bool {
+	return c.handleTTL > 0 && now.UnixNano()-e.used.Load() > int64(c.handleTTL)
+}
+
+// expireLocked removes the handles that have expired. Handles are ordered by when they
+// were last used, so only the oldest need to be checked.
+func (c *CachingHandler) expireLocked(now time.Time) {
+	for {
+		k, e, ok := c.cache.activeHandles.GetOldest()
+		if !ok || !e.owner.expired(e, now) {
+			return
+		}
+		c.cache.activeHandles.Remove(k)
+		c.handleEvictions.Add(1)
+	}
+}
+
+type pathKey struct {
+	owner *CachingHandler
+	f     billy.Filesystem
+	p     string
+}
+
+func (c *CachingHandler) keyFor(f billy.Filesystem, path []string) pathKey {
+	return pathKey{c, f, strings.Join(c.fold(path), "/")}
+}
+
+// fold is the form of a path that the cache compares, which differs from the path itself
+// only for case insensitive filesystems.
+func (c *CachingHandler) fold(path []string) []string {
+	if !c.caseInsensitive {
+		return path
+	}
+	folded := make([]string, len(path))
+	for i, name := range path {
+		folded[i] = strings.ToLower(name)
+	}
+	return folded
+}
+
+// CaseInsensitive reports whether the handler serves filesystems that do not tell names
+// apart by case, as set by CachingHandlerOptions.
+func (c *CachingHandler) CaseInsensitive() bool {
+	return c.caseInsensitive
+}
+
+// putLocked caches a handle, replacing any entry it had, and indexes it by path.
+func (c *CachingHandler) putLocked(id uuid.UUID, e entry) (evicted bool) {
+	if e.fileid == 0 {
+		e.fileid = c.fileIDLocked(id, e)
+	}
+	if old, ok := c.cache.activeHandles.Peek(id); ok {
+		old.owner.unindexLocked(id, old)
+	}
+	evicted = c.cache.activeHandles.Add(id, e)
+	c.cache.byPath[c.keyFor(e.f, e.p)] = id
+	c.cache.byTree.add(id, e.f, c.fold(e.p))
+	return evicted
+}
+
+// fileIDLocked is the fileid of a new entry: that of the handles already cached for its path,
+// or else one derived from the id of its handle.
+func (c *CachingHandler) fileIDLocked(id uuid.UUID, e entry) uint64 {
+	for _, k := range []uuid.UUID{id, c.cache.byPath[c.keyFor(e.f, e.p)]} {
+		if cached, ok := c.cache.activeHandles.Peek(k); ok && cached.owner == c && cached.fileid != 0 && c.keyFor(cached.f, cached.p) == c.keyFor(e.f, e.p) {
+			return cached.fileid
+		}
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(id[:])
+	if fileid := h.Sum64(); fileid != 0 {
+		return fileid
+	}
+	return 1
+}
+
+// FileID is the id kept for the file at a path while any of its handles are cached, which
+// follows the file across renames. A handle is minted for a path that has none, and no id is
+// reported for a path no handle would be minted for, or by a handler with a HandleCodec.
+func (c *CachingHandler) FileID(f billy.Filesystem, path []string) (uint64, bool) {
+	if c.codec != nil {
+		return 0, false
+	}
+	c.cache.mu.Lock()
+	defer c.cache.notifyEvicted()
+	defer c.cache.mu.Unlock()
+	if cleaned, err := cleanPath(path); err == nil && f != nil {
+		if id, ok := c.cache.byPath[c.keyFor(f, cleaned)]; ok {
+			if e, ok := c.cache.activeHandles.Peek(id); ok && e.owner == c {
+				return e.fileid, true
+			}
+		}
+	}
+	c.expireLocked(time.Now())
+	id, ok := c.toHandleLocked(f, path)
+	if !ok {
+		return 0, false
+	}
+	e, ok := c.cache.activeHandles.Peek(id)
+	return e.fileid, ok
+}
+
+func (c *CachingHandler) unindexLocked(id uuid.UUID, e entry) {
+	if k := c.keyFor(e.f, e.p); c.cache.byPath[k] == id {
+		delete(c.cache.byPath, k)
+	}
+	c.cache.byTree.remove(id, e.f, c.fold(e.p))
 }
 
 // ToHandle takes a file and represents it with an opaque handle to reference it.
 // In stateless nfs (when it's serving a unix fs) this can be the device + inode
 // but we can generalize with a stateful local cache of handed out IDs.
+// Empty components of the path are dropped, and no handle is minted for a path with a
+// "." or ".." component, or for a nil filesystem.
 func (c *CachingHandler) ToHandle(f billy.Filesystem, path []string) []byte {
-	id := uuid.New()
-	c.activeHandles.Add(id, entry{f, path})
-	b, _ := id.MarshalBinary()
+	if c.codec != nil {
+		return c.encodeWithCodec(f, path)
+	}
+	c.cache.mu.Lock()
+	c.expireLocked(time.Now())
+	id, ok := c.toHandleLocked(f, path)
+	c.cache.mu.Unlock()
+	c.cache.notifyEvicted()
+	if !ok {
+		return nil
+	}
+	return c.encodeHandle(id)
+}
+
+// ToHandles mints the handles of many files of a filesystem, as ToHandle does for each of
+// them, while taking the cache lock only once. The handle of a path ToHandle would not mint
+// a handle for is nil.
+func (c *CachingHandler) ToHandles(f billy.Filesystem, paths [][]string) [][]byte {
+	if c.codec != nil {
+		handles := make([][]byte, len(paths))
+		for i, path := range paths {
+			handles[i] = c.encodeWithCodec(f, path)
+		}
+		return handles
+	}
+	ids := make([]uuid.UUID, len(paths))
+	minted := make([]bool, len(paths))
+	c.cache.mu.Lock()
+	c.expireLocked(time.Now())
+	for i, path := range paths {
+		ids[i], minted[i] = c.toHandleLocked(f, path)
+	}
+	c.cache.mu.Unlock()
+	c.cache.notifyEvicted()
+	handles := make([][]byte, len(paths))
+	for i, id := range ids {
+		if minted[i] {
+			handles[i] = c.encodeHandle(id)
+		}
+	}
+	return handles
+}
+
+// toHandleLocked caches the id of a handle for a file, reporting false when none is minted.
+func (c *CachingHandler) toHandleLocked(f billy.Filesystem, path []string) (uuid.UUID, bool) {
+	if f == nil {
+		nfs.Log.Errorf("not minting a handle for %s: %v", strings.Join(path, "/"), ErrNilFilesystem)
+		return uuid.UUID{}, false
+	}
+	path, err := cleanPath(path)
+	if err != nil {
+		nfs.Log.Errorf("not minting a handle: %v", err)
+		return uuid.UUID{}, false
+	}
+	id := c.mintLocked(f, path)
+	if c.insertLocked(id, c.newEntry(f, path)) {
+		return id, true
+	}
+	existing, ok := c.cache.byPath[c.keyFor(f, path)]
+	if !ok {
+		c.handleRefusals.Add(1)
+		if !c.cache.refusing.Swap(true) {
+			nfs.Log.Warnf("handle cache is full with %d handles, refusing to mint a handle for %s", c.cache.cacheLimit, strings.Join(path, "/"))
+		}
+		return uuid.UUID{}, false
+	}
+	if e, ok := c.cache.activeHandles.Get(existing); ok {
+		e.used.Store(time.Now().UnixNano())
+	}
+	return existing, true
+}
+
+// insertLocked caches a handle within the limits of the cache, evicting the least recently
+// used handle to make room for it unless RefuseWhenFull is set, in which case it reports
+// false rather than caching a handle the cache has no room for.
+func (c *CachingHandler) insertLocked(id uuid.UUID, e entry) bool {
+	if _, cached := c.cache.activeHandles.Peek(id); !cached && !c.makeRoomLocked() && c.refuseWhenFull {
+		return false
+	}
+	if c.putLocked(id, e) {
+		c.handleEvictions.Add(1)
+	}
+	return true
+}
+
+// makeRoomLocked reports whether the cache can take another handle without evicting one,
+// growing it towards its MaxLimit if it is full.
+func (c *CachingHandler) makeRoomLocked() bool {
+	if c.cache.activeHandles.Len() < c.cache.cacheLimit {
+		c.cache.refusing.Store(false)
+		return true
+	}
+	if c.cache.cacheLimit >= c.cache.maxLimit {
+		return false
+	}
+	limit := c.cache.cacheLimit * 2
+	if limit > c.cache.maxLimit {
+		limit = c.cache.maxLimit
+	}
+	c.cache.activeHandles.Resize(limit)
+	c.cache.cacheLimit = limit
+	c.handleGrowths.Add(1)
+	nfs.Log.Infof("handle cache grown to %d of at most %d handles", limit, c.cache.maxLimit)
+	return true
+}
+
+// Preload caches handles for `paths` of `f` ahead of any client asking for them, so that
+// with Deterministic handles, those that clients held before a restart resolve at once
+// rather than as stale. Paths that are already cached keep their handles.
+func (c *CachingHandler) Preload(f billy.Filesystem, paths [][]string) {
+	if f == nil || c.codec != nil {
+		return
+	}
+	c.cache.mu.Lock()
+	c.expireLocked(time.Now())
+	for _, path := range paths {
+		path, err := cleanPath(path)
+		if err != nil {
+			continue
+		}
+		if _, ok := c.cache.byPath[c.keyFor(f, path)]; ok {
+			continue
+		}
+		if !c.insertLocked(c.mintLocked(f, path), c.newEntry(f, path)) {
+			break
+		}
+	}
+	c.cache.mu.Unlock()
+	c.cache.notifyEvicted()
+}
+
+// cleanPath is a copy of a path without its empty components, so that the cached paths can
+// be compared component by component. It is ErrInvalidPath for a path that does not name a
+// file by its components alone.
+func cleanPath(path []string) ([]string, error) {
+	cleaned := make([]string, 0, len(path))
+	for _, name := range path {
+		switch name {
+		case "":
+			continue
+		case ".", "..":
+			return path, fmt.Errorf("%w: %q", ErrInvalidPath, strings.Join(path, "/"))
+		}
+		cleaned = append(cleaned, name)
+	}
+	return cleaned, nil
+}
+
+// encodeHandle pads an id, and its signature if handles are signed, to the configured
+// handle length.
+func (c *CachingHandler) encodeHandle(id uuid.UUID) []byte {
+	b := make([]byte, c.handleLength)
+	copy(b, id[:])
+	if len(c.handleKey) > 0 {
+		copy(b[minHandleLength:], c.signHandle(id))
+	}
 	return b
 }
 
-// FromHandle converts from an opaque handle to the file it represents
+// signHandle is the signature of a handle id under the HandleKey.
+func (c *CachingHandler) signHandle(id uuid.UUID) []byte {
+	mac := hmac.New(sha256.New, c.handleKey)
+	mac.Write(id[:])
+	return mac.Sum(nil)[:handleMACLength]
+}
+
+// decodeHandle extracts the id of a handle minted by encodeHandle. Handles that could
+// not have been minted are reported as NFSStatusBadHandle.
+func (c *CachingHandler) decodeHandle(fh []byte) (uuid.UUID, error) {
+	if len(fh) != c.handleLength {
+		return uuid.UUID{}, nfs.Errorf(nfs.NFSStatusBadHandle, "handle is %d bytes, expected %d", len(fh), c.handleLength)
+	}
+	var id uuid.UUID
+	copy(id[:], fh)
+	padding := fh[minHandleLength:]
+	if len(c.handleKey) > 0 {
+		if !hmac.Equal(padding[:handleMACLength], c.signHandle(id)) {
+			return uuid.UUID{}, nfs.Errorf(nfs.NFSStatusBadHandle, "handle signature does not match")
+		}
+		padding = padding[handleMACLength:]
+	}
+	for _, b := range padding {
+		if b != 0 {
+			return uuid.UUID{}, nfs.Errorf(nfs.NFSStatusBadHandle, "handle padding is not zero")
+		}
+	}
+	return id, nil
+}
+
+// FromHandle converts from an opaque handle to the file it represents. Malformed handles
+// are reported as NFSStatusBadHandle, and those no longer cached as NFSStatusStale.
 func (c *CachingHandler) FromHandle(fh []byte) (billy.Filesystem, []string, error) {
-	id, err := uuid.FromBytes(fh)
+	if c.codec != nil {
+		return c.decodeWithCodec(fh)
+	}
+	id, err := c.decodeHandle(fh)
 	if err != nil {
 		return nil, []string{}, err
 	}
 
-	if f, ok := c.activeHandles.Get(id); ok {
-		for _, k := range c.activeHandles.Keys() {
-			candidate, _ := c.activeHandles.Peek(k)
-			if hasPrefix(f.p, candidate.p) {
-				_, _ = c.activeHandles.Get(k)
+	now := time.Now()
+	c.cache.mu.RLock()
+	f, ok := c.cache.activeHandles.Peek(id)
+	if ok && !c.expired(f, now) && c.resolvableLocked(id, f) {
+		_, _ = c.cache.activeHandles.Get(id)
+		f.used.Store(now.UnixNano())
+		c.handleHits.Add(1)
+		// touch the ancestor directories, so that they are not evicted before their children.
+		for i := len(f.p) - 1; i >= 0; i-- {
+			if parent, ok := c.cache.byPath[c.keyFor(f.f, f.p[:i])]; ok {
+				if pe, ok := c.cache.activeHandles.Get(parent); ok {
+					pe.used.Store(now.UnixNano())
+				}
 			}
 		}
-		if ok {
-			return f.f, f.p, nil
+		c.cache.mu.RUnlock()
+		return f.f, f.p, nil
+	}
+	c.cache.mu.RUnlock()
+	c.handleMisses.Add(1)
+	if ok {
+		c.cache.mu.Lock()
+		c.expireLocked(now)
+		if e, ok := c.cache.activeHandles.Peek(id); ok && c.expired(e, now) {
+			c.cache.activeHandles.Remove(id)
+			c.handleEvictions.Add(1)
 		}
+		c.cache.mu.Unlock()
+		c.cache.notifyEvicted()
 	}
-	return nil, []string{}, &nfs.NFSStatusError{NFSStatus: nfs.NFSStatusStale}
+	return nil, []string{}, nfs.ErrStale()
 }
 
-// HandleLimit exports how many file handles can be safely stored by this cache.
-func (c *CachingHandler) HandleLimit() int {
-	return c.cacheLimit
+// Resolve looks up the filesystem and path a handle maps to, for tooling inspecting the cache.
+// Unlike FromHandle, it leaves the handle, its ancestors and the cache statistics untouched,
+// so that inspecting a handle does not change which handles are evicted next.
+func (c *CachingHandler) Resolve(fh []byte) (billy.Filesystem, []string, error) {
+	if c.codec != nil {
+		return c.decodeWithCodec(fh)
+	}
+	id, err := c.decodeHandle(fh)
+	if err != nil {
+		return nil, []string{}, err
+	}
+
+	c.cache.mu.RLock()
+	defer c.cache.mu.RUnlock()
+	f, ok := c.cache.activeHandles.Peek(id)
+	if !ok || c.expired(f, time.Now()) || !c.resolvableLocked(id, f) {
+		return nil, []string{}, nfs.ErrStale()
+	}
+	return f.f, f.p, nil
 }
 
+// UpdateHandle points an existing handle at a new filesystem and path, such as after the file it
+// references has been moved, so that clients holding the handle continue to resolve it.
+// The path is cleaned as by ToHandle, and one with a "." or ".." component is rejected with
+// ErrInvalidPath, as is a nil filesystem with ErrNilFilesystem. Handles minted by a Codec
+// cannot be updated, and are rejected with ErrStatelessHandle.
+func (c *CachingHandler) UpdateHandle(fh []byte, f billy.Filesystem, path []string) error {
+	if c.codec != nil {
+		return ErrStatelessHandle
+	}
+	id, err := c.decodeHandle(fh)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return ErrNilFilesystem
+	}
+	if path, err = cleanPath(path); err != nil {
+		return err
+	}
+
+	c.cache.mu.Lock()
+	defer c.cache.mu.Unlock()
+	e, ok := c.cache.activeHandles.Peek(id)
+	if !ok || e.owner != c {
+		return nfs.ErrStale()
+	}
+	// entries are stored by value, so the updated entry must be written back.
+	e.f = f
+	e.p = path
+	e.used.Store(time.Now().UnixNano())
+	c.putLocked(id, e)
+	return nil
+}
+
+// RenameHandles points the cached handles of the entry at `from`, and of everything below
+// it, at the same entries under `to`. Handles previously cached for `to` or anything below
+// it refer to entries the rename replaced, and are dropped.
+func (c *CachingHandler) RenameHandles(f billy.Filesystem, from, to []string) {
+	if c.codec != nil {
+		return
+	}
+	c.cache.mu.Lock()
+	for _, k := range c.cache.byTree.below(f, c.fold(to)) {
+		if e, ok := c.cache.activeHandles.Peek(k); ok && e.owner == c && !hasPrefix(c.fold(e.p), c.fold(from)) {
+			c.cache.activeHandles.Remove(k)
+		}
+	}
+	for _, k := range c.cache.byTree.below(f, c.fold(from)) {
+		e, ok := c.cache.activeHandles.Peek(k)
+		if !ok || e.owner != c {
+			continue
+		}
+		p := make([]string, 0, len(to)+len(e.p)-len(from))
+		p = append(p, to...)
+		e.p = append(p, e.p[len(from):]...)
+		e.used.Store(time.Now().UnixNano())
+		c.putLocked(k, e)
+	}
+	c.cache.mu.Unlock()
+	c.cache.notifyEvicted()
+}
+
+// hasPrefix reports whether `path` is at or below `prefix`.
 func hasPrefix(path, prefix []string) bool {
-	if len(prefix) > len(path) {
+	if len(path) < len(prefix) {
 		return false
 	}
-	for i, e := range prefix {
-		if path[i] != e {
+	for i := range prefix {
+		if path[i] != prefix[i] {
 			return false
 		}
 	}
 	return true
 }
 
+// handleNamespace scopes deterministic handles to this library.
+var handleNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/willscott/go-nfs"))
+
+func hashFilesystemAndPath(f billy.Filesystem, fsid FSID, path []string) uuid.UUID {
+	// length-prefix each component so that e.g. ["ab", "c"] and ["a", "bc"] differ.
+	var data []byte
+	// registered filesystems are identified by their FSID, and others by their root.
+	root := f.Root()
+	if fsid != 0 {
+		root = fmt.Sprintf("fsid:%d", fsid)
+	}
+	data = binary.BigEndian.AppendUint64(data, uint64(len(root)))
+	data = append(data, root...)
+	for _, p := range path {
+		data = binary.BigEndian.AppendUint64(data, uint64(len(p)))
+		data = append(data, p...)
+	}
+	return uuid.NewSHA1(handleNamespace, data)
+}
+
+// HandleLimit exports how many file handles can be safely stored by this cache.
+func (c *CachingHandler) HandleLimit() int {
+	c.cache.mu.RLock()
+	defer c.cache.mu.RUnlock()
+	return c.cache.cacheLimit
+}
+
+// HandleUtilization is the fraction of the handles the cache can hold that are cached, up to
+// its MaxLimit when it may grow. As it nears 1, new handles evict those cached, or are
+// refused with RefuseWhenFull.
+func (c *CachingHandler) HandleUtilization() float64 {
+	c.cache.mu.RLock()
+	defer c.cache.mu.RUnlock()
+	limit := c.cache.cacheLimit
+	if c.cache.maxLimit > limit {
+		limit = c.cache.maxLimit
+	}
+	return float64(c.cache.activeHandles.Len()) / float64(limit)
+}
+
+// PrintHandles writes each active handle and the path it refers to, one per line and
+// oldest first, to `w`. It is meant for diagnostics.
+func (c *CachingHandler) PrintHandles(w io.Writer) error {
+	c.cache.mu.RLock()
+	defer c.cache.mu.RUnlock()
+	for _, k := range c.cache.activeHandles.Keys() {
+		e, ok := c.cache.activeHandles.Peek(k)
+		if !ok || e.owner != c {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%x: %s\n", k[:], strings.Join(e.p, "/")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifierInfo describes a directory listing cached by a CachingHandler.
+type VerifierInfo struct {
+	// Verifier is the cookie verifier the listing is handed out under.
+	Verifier uint64
+	// Path is the directory listed.
+	Path string
+	// Entries is the number of entries in the listing.
+	Entries int
+}
+
+// DumpVerifiers lists the cached directory listings, oldest first. It is meant for
+// diagnostics, such as of READDIR cookies, and like Resolve, it leaves the order in which
+// listings are evicted untouched.
+func (c *CachingHandler) DumpVerifiers() []VerifierInfo {
+	if c.activeVerifiers == nil {
+		return []VerifierInfo{}
+	}
+	c.cache.mu.RLock()
+	defer c.cache.mu.RUnlock()
+	keys := c.activeVerifiers.Keys()
+	infos := make([]VerifierInfo, 0, len(keys))
+	for _, k := range keys {
+		if v, ok := c.activeVerifiers.Peek(k); ok {
+			infos = append(infos, VerifierInfo{Verifier: k, Path: v.path, Entries: len(v.contents)})
+		}
+	}
+	return infos
+}
+
 type verifier struct {
 	path     string
 	contents []fs.FileInfo
 }
 
-func hashPathAndContents(path string, contents []fs.FileInfo) uint64 {
-	//calculate a cookie-verifier.
-	vHash := sha256.New()
+func (c *CachingHandler) VerifierFor(path string, contents []fs.FileInfo) uint64 {
+	id := nfs.HashPathAndContents(path, contents)
+	if c.activeVerifiers == nil {
+		return id
+	}
+	c.cache.mu.Lock()
+	if c.activeVerifiers.Add(id, verifier{path, contents}) {
+		c.verifierEvictions.Add(1)
+	}
+	c.cache.mu.Unlock()
+	return id
+}
 
-	// Add the path to avoid collisions of directories with the same content
-	vHash.Write(binary.BigEndian.AppendUint64([]byte{}, uint64(len(path))))
-	vHash.Write([]byte(path))
+// InvalidateVerifier removes the cached listings of the directory at path.
+func (c *CachingHandler) InvalidateVerifier(path string) {
+	c.removeVerifiers(func(p string) bool { return p == path || c.caseInsensitive && strings.EqualFold(p, path) })
+}
 
-	for _, c := range contents {
-		vHash.Write([]byte(c.Name())) // Never fails according to the docs
+// InvalidateVerifierPrefix removes the cached listings of the directory at path and of
+// every directory below it, such as after the directory has been renamed or removed.
+func (c *CachingHandler) InvalidateVerifierPrefix(path string) {
+	if c.caseInsensitive {
+		prefix := strings.ToLower(path)
+		c.removeVerifiers(func(p string) bool { return hasPathPrefix(strings.ToLower(p), prefix) })
+		return
 	}
+	c.removeVerifiers(func(p string) bool { return hasPathPrefix(p, path) })
+}
 
-	verify := vHash.Sum(nil)[0:8]
-	return binary.BigEndian.Uint64(verify)
+func (c *CachingHandler) removeVerifiers(match func(path string) bool) {
+	if c.activeVerifiers == nil {
+		return
+	}
+	c.cache.mu.Lock()
+	defer c.cache.mu.Unlock()
+	for _, k := range c.activeVerifiers.Keys() {
+		if v, ok := c.activeVerifiers.Peek(k); ok && match(v.path) {
+			c.activeVerifiers.Remove(k)
+		}
+	}
 }
 
-func (c *CachingHandler) VerifierFor(path string, contents []fs.FileInfo) uint64 {
-	id := hashPathAndContents(path, contents)
-	c.activeVerifiers.Add(id, verifier{path, contents})
-	return id
+// hasPathPrefix reports whether the joined path is at or below the joined prefix.
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
 }
 
 func (c *CachingHandler) DataForVerifier(path string, id uint64) []fs.FileInfo {
+	if c.activeVerifiers == nil {
+		return nil
+	}
+	c.cache.mu.RLock()
+	defer c.cache.mu.RUnlock()
 	if cache, ok := c.activeVerifiers.Get(id); ok {
+		c.verifierHits.Add(1)
 		return cache.contents
 	}
+	c.verifierMisses.Add(1)
 	return nil
 }
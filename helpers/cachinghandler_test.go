@@ -0,0 +1,977 @@
+package helpers_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+)
+
+func TestCachingHandlerConcurrentAccess(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 128)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				path := []string{"dir", fmt.Sprintf("file-%d-%d", i, j%32)}
+				fh := handler.ToHandle(mem, path)
+				// the handle may have been evicted by another goroutine, but
+				// a resolved handle must always map back to its own path.
+				if _, p, err := handler.FromHandle(fh); err == nil {
+					if len(p) != len(path) || p[1] != path[1] {
+						t.Errorf("handle resolved to %v, expected %v", p, path)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestDeterministicCachingHandler(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewDeterministicCachingHandler(helpers.NewNullAuthHandler(mem), 2)
+
+	fh := handler.ToHandle(mem, []string{"a", "b"})
+	if !bytes.Equal(fh, handler.ToHandle(mem, []string{"a", "b"})) {
+		t.Fatal("same path should map to the same handle")
+	}
+	if bytes.Equal(fh, handler.ToHandle(mem, []string{"ab"})) {
+		t.Fatal("distinct paths should map to distinct handles")
+	}
+
+	// evict the original entry, then re-populate it.
+	handler.ToHandle(mem, []string{"c"})
+	handler.ToHandle(mem, []string{"d"})
+	if _, _, err := handler.FromHandle(fh); err == nil {
+		t.Fatal("expected handle to be evicted")
+	}
+	handler.ToHandle(mem, []string{"a", "b"})
+	_, p, err := handler.FromHandle(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, []string{"a", "b"}) {
+		t.Fatalf("handle resolved to %v after re-population", p)
+	}
+}
+
+func TestCachingHandlerStats(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewCachingHandlerWithVerifierLimit(helpers.NewNullAuthHandler(mem), 2, 1).(*helpers.CachingHandler)
+
+	fh := handler.ToHandle(mem, []string{"a"})
+	handler.ToHandle(mem, []string{"b"})
+	if _, _, err := handler.FromHandle(fh); err != nil {
+		t.Fatal(err)
+	}
+	handler.ToHandle(mem, []string{"c"})
+	if _, _, err := handler.FromHandle([]byte("0123456789abcdef")); err == nil {
+		t.Fatal("expected a miss for an unknown handle")
+	}
+
+	v := handler.VerifierFor("/", nil)
+	handler.DataForVerifier("/", v)
+	handler.VerifierFor("/other", nil)
+	handler.DataForVerifier("/", v)
+
+	stats := handler.Stats()
+	expected := helpers.CacheStats{
+		Handles:           2,
+		Verifiers:         1,
+		Limit:             2,
+		HandleHits:        1,
+		HandleMisses:      1,
+		HandleEvictions:   1,
+		VerifierHits:      1,
+		VerifierMisses:    1,
+		VerifierEvictions: 1,
+	}
+	if stats != expected {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+// warnRecorder counts the warnings logged, passing everything else to the logger it wraps.
+type warnRecorder struct {
+	nfs.Logger
+	mu       sync.Mutex
+	warnings []string
+}
+
+func (r *warnRecorder) Warnf(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.warnings = append(r.warnings, fmt.Sprintf(format, args...))
+}
+
+func TestCachingHandlerGrowth(t *testing.T) {
+	mem := memfs.New()
+	h, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), helpers.CachingHandlerOptions{Limit: 2, MaxLimit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*helpers.CachingHandler)
+
+	var handles [][]byte
+	for i := 0; i < 5; i++ {
+		handles = append(handles, handler.ToHandle(mem, []string{fmt.Sprintf("f%d", i)}))
+	}
+	for i, fh := range handles {
+		if _, _, err := handler.FromHandle(fh); err != nil {
+			t.Fatalf("handle %d was evicted while the cache could grow: %v", i, err)
+		}
+	}
+	stats := handler.Stats()
+	if stats.Limit != 5 || stats.HandleGrowths != 2 || stats.HandleEvictions != 0 {
+		t.Fatalf("unexpected stats after growing: %+v", stats)
+	}
+	if u := handler.HandleUtilization(); u != 1 {
+		t.Fatalf("expected a full cache, got utilization %v", u)
+	}
+
+	// past the hard limit, handles are evicted again.
+	handler.ToHandle(mem, []string{"f5"})
+	if _, _, err := handler.FromHandle(handles[0]); err == nil {
+		t.Fatal("expected the oldest handle to be evicted past the max limit")
+	}
+	if _, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), helpers.CachingHandlerOptions{Limit: 2, MaxLimit: 1}); !errors.Is(err, helpers.ErrInvalidCacheLimit) {
+		t.Fatalf("expected a max limit below the limit to be rejected, got %v", err)
+	}
+}
+
+func TestCachingHandlerRefuseWhenFull(t *testing.T) {
+	logs := &warnRecorder{Logger: nfs.Log}
+	nfs.SetLogger(logs)
+	t.Cleanup(func() { nfs.SetLogger(logs.Logger) })
+
+	mem := memfs.New()
+	h, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), helpers.CachingHandlerOptions{Limit: 4, RefuseWhenFull: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*helpers.CachingHandler)
+
+	var handles [][]byte
+	for i := 0; i < 4; i++ {
+		handles = append(handles, handler.ToHandle(mem, []string{fmt.Sprintf("f%d", i)}))
+		if u, want := handler.HandleUtilization(), float64(i+1)/4; u != want {
+			t.Fatalf("expected utilization %v with %d handles, got %v", want, i+1, u)
+		}
+	}
+	for i := 4; i < 8; i++ {
+		if fh := handler.ToHandle(mem, []string{fmt.Sprintf("f%d", i)}); fh != nil {
+			t.Fatalf("minted a handle for f%d into a full cache", i)
+		}
+	}
+	for i, fh := range handles {
+		if _, _, err := handler.FromHandle(fh); err != nil {
+			t.Fatalf("handle %d was evicted from a cache refusing new handles: %v", i, err)
+		}
+	}
+	// paths already cached keep their handles.
+	if fh := handler.ToHandle(mem, []string{"f1"}); !bytes.Equal(fh, handles[1]) {
+		t.Fatal("expected the cached handle of a path held by the full cache")
+	}
+
+	stats := handler.Stats()
+	if stats.Handles != 4 || stats.HandleRefusals != 4 || stats.HandleEvictions != 0 {
+		t.Fatalf("unexpected stats while refusing handles: %+v", stats)
+	}
+	logs.mu.Lock()
+	warnings := len(logs.warnings)
+	logs.mu.Unlock()
+	if warnings != 1 {
+		t.Fatalf("expected a single warning as the cache started refusing handles, got %d", warnings)
+	}
+}
+
+func TestCachingHandlerOnEvict(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 2).(*helpers.CachingHandler)
+
+	var evictedHandle []byte
+	var evictedPath []string
+	handler.OnEvict = func(fh []byte, f billy.Filesystem, path []string) {
+		if f != mem {
+			t.Errorf("evicted handle on unexpected filesystem")
+		}
+		evictedHandle = fh
+		evictedPath = path
+	}
+
+	first := handler.ToHandle(mem, []string{"a", "first"})
+	handler.ToHandle(mem, []string{"a", "second"})
+	if evictedPath != nil {
+		t.Fatal("no eviction expected below the limit")
+	}
+	handler.ToHandle(mem, []string{"a", "third"})
+	if !bytes.Equal(evictedHandle, first) || !reflect.DeepEqual(evictedPath, []string{"a", "first"}) {
+		t.Fatalf("unexpected eviction of %v", evictedPath)
+	}
+}
+
+func TestCachingHandlerKeepsAncestorsWarm(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 3)
+
+	dir := handler.ToHandle(mem, []string{"dir"})
+	file := handler.ToHandle(mem, []string{"dir", "file"})
+	handler.ToHandle(mem, []string{"other"})
+
+	// resolving the file refreshes its directory, so the next insertion
+	// evicts "other" rather than "dir".
+	if _, _, err := handler.FromHandle(file); err != nil {
+		t.Fatal(err)
+	}
+	handler.ToHandle(mem, []string{"new"})
+	if _, _, err := handler.FromHandle(dir); err != nil {
+		t.Fatal("ancestor of a recently used handle was evicted")
+	}
+}
+
+func TestCachingHandlerResolve(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 2).(*helpers.CachingHandler)
+
+	oldest := handler.ToHandle(mem, []string{"dir", "oldest"})
+	handler.ToHandle(mem, []string{"dir", "newer"})
+	f, p, err := handler.Resolve(oldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != mem || !reflect.DeepEqual(p, []string{"dir", "oldest"}) {
+		t.Fatalf("handle resolved to %v", p)
+	}
+	if stats := handler.Stats(); stats.HandleHits != 0 || stats.HandleMisses != 0 {
+		t.Fatalf("resolving a handle was counted: %+v", stats)
+	}
+
+	// resolving did not refresh the oldest handle, so it is still the next to be evicted.
+	handler.ToHandle(mem, []string{"dir", "newest"})
+	if _, _, err := handler.Resolve(oldest); handleStatus(t, err) != nfs.NFSStatusStale {
+		t.Fatalf("oldest handle was not evicted: %v", err)
+	}
+}
+
+func TestCachingHandlerPreload(t *testing.T) {
+	mem := memfs.New()
+	opts := helpers.CachingHandlerOptions{Limit: 16, Deterministic: true}
+	paths := [][]string{{"dir"}, {"dir", "a"}, {"dir", "b"}, {"other"}}
+
+	before, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handles := make([][]byte, len(paths))
+	for i, p := range paths {
+		handles[i] = before.ToHandle(mem, p)
+	}
+
+	// a restarted handler resolves the handles of the previous one once they are preloaded.
+	h, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := h.(*helpers.CachingHandler)
+	if _, _, err := after.FromHandle(handles[0]); handleStatus(t, err) != nfs.NFSStatusStale {
+		t.Fatalf("handle resolved before preloading: %v", err)
+	}
+	after.Preload(mem, paths)
+	for i, fh := range handles {
+		f, p, err := after.FromHandle(fh)
+		if err != nil {
+			t.Fatalf("preloaded %v did not resolve: %v", paths[i], err)
+		}
+		if f != mem || !reflect.DeepEqual(p, paths[i]) {
+			t.Fatalf("handle of %v resolved to %v", paths[i], p)
+		}
+	}
+	after.Preload(mem, paths)
+	if n := after.Stats().Handles; n != len(paths) {
+		t.Fatalf("%d handles cached after preloading %d paths twice", n, len(paths))
+	}
+}
+
+func BenchmarkFromHandle(b *testing.B) {
+	mem := memfs.New()
+	const handles = 50000
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), handles)
+	for i := 0; i < handles-4; i++ {
+		handler.ToHandle(mem, []string{fmt.Sprintf("file-%d", i)})
+	}
+	handler.ToHandle(mem, []string{"a"})
+	handler.ToHandle(mem, []string{"a", "b"})
+	handler.ToHandle(mem, []string{"a", "b", "c"})
+	fh := handler.ToHandle(mem, []string{"a", "b", "c", "d"})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := handler.FromHandle(fh); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCachingHandlerToHandles(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewDeterministicCachingHandler(helpers.NewNullAuthHandler(mem), 16).(*helpers.CachingHandler)
+
+	paths := [][]string{{"a"}, {"a", "b"}, {"a", ".."}, {"c"}}
+	handles := handler.ToHandles(mem, paths)
+	if len(handles) != len(paths) {
+		t.Fatalf("expected %d handles, got %d", len(paths), len(handles))
+	}
+	for i, fh := range handles {
+		if paths[i][len(paths[i])-1] == ".." {
+			if fh != nil {
+				t.Fatalf("minted a handle for %v", paths[i])
+			}
+			continue
+		}
+		if !bytes.Equal(fh, handler.ToHandle(mem, paths[i])) {
+			t.Fatalf("batch handle of %v differs from its ToHandle", paths[i])
+		}
+		if _, p, err := handler.FromHandle(fh); err != nil || !reflect.DeepEqual(p, paths[i]) {
+			t.Fatalf("batch handle of %v resolved to %v: %v", paths[i], p, err)
+		}
+	}
+}
+
+// BenchmarkToHandles mints the handles of directory listings from concurrent readers, one
+// listing at a time or entry by entry.
+func BenchmarkToHandles(b *testing.B) {
+	const entries = 256
+	paths := make([][]string, entries)
+	for i := range paths {
+		paths[i] = []string{"dir", fmt.Sprintf("file-%d", i)}
+	}
+	for _, batched := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batched=%v", batched), func(b *testing.B) {
+			mem := memfs.New()
+			handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 16*entries).(*helpers.CachingHandler)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if batched {
+						handler.ToHandles(mem, paths)
+						continue
+					}
+					for _, path := range paths {
+						handler.ToHandle(mem, path)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestCachingHandlerUpdateHandle(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 16).(*helpers.CachingHandler)
+
+	fh := handler.ToHandle(mem, []string{"old", "name"})
+	if err := handler.UpdateHandle(fh, mem, []string{"new", "name"}); err != nil {
+		t.Fatal(err)
+	}
+	_, p, err := handler.FromHandle(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, []string{"new", "name"}) {
+		t.Fatalf("handle resolved to %v after update", p)
+	}
+}
+
+func TestCachingHandlerCleansPaths(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewDeterministicCachingHandler(helpers.NewNullAuthHandler(mem), 16).(*helpers.CachingHandler)
+
+	messy := []string{"a", "", "b", ""}
+	fh := handler.ToHandle(mem, messy)
+	_, p, err := handler.FromHandle(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, []string{"a", "b"}) {
+		t.Fatalf("handle of %q resolved to %q", messy, p)
+	}
+	if !bytes.Equal(fh, handler.ToHandle(mem, []string{"a", "b"})) {
+		t.Fatal("expected a path with empty components to share the handle of its clean form")
+	}
+	if !reflect.DeepEqual(messy, []string{"a", "", "b", ""}) {
+		t.Fatalf("the path handed to ToHandle was modified: %q", messy)
+	}
+
+	for _, path := range [][]string{{"a", ".", "b"}, {"a", "..", "b"}, {".."}} {
+		if fh := handler.ToHandle(mem, path); fh != nil {
+			t.Fatalf("minted a handle for %q", path)
+		}
+		if err := handler.UpdateHandle(fh, mem, path); !errors.Is(err, helpers.ErrInvalidPath) {
+			t.Fatalf("expected updating a handle to %q to be rejected, got %v", path, err)
+		}
+	}
+	if err := handler.UpdateHandle(fh, mem, []string{"", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, p, err := handler.FromHandle(fh); err != nil || !reflect.DeepEqual(p, []string{"c"}) {
+		t.Fatalf("handle resolved to %q after an update with an empty component: %v", p, err)
+	}
+}
+
+func TestCachingHandlerInvalidLimit(t *testing.T) {
+	inner := helpers.NewNullAuthHandler(memfs.New())
+	for _, opts := range []helpers.CachingHandlerOptions{
+		{Limit: 0},
+		{Limit: -1},
+		{Limit: 8, VerifierLimit: -1},
+	} {
+		h, err := helpers.NewCachingHandlerWithOptions(inner, opts)
+		if !errors.Is(err, helpers.ErrInvalidCacheLimit) {
+			t.Fatalf("expected ErrInvalidCacheLimit for %+v, got %v", opts, err)
+		}
+		if h != nil {
+			t.Fatalf("expected no handler for %+v", opts)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected NewCachingHandler to panic on a zero limit")
+		}
+	}()
+	helpers.NewCachingHandler(inner, 0)
+}
+
+// handleStatus is the NFS status of an error from FromHandle.
+func handleStatus(t *testing.T, err error) nfs.NFSStatus {
+	t.Helper()
+	var statusErr *nfs.NFSStatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected an NFSStatusError, got %v", err)
+	}
+	return statusErr.NFSStatus
+}
+
+func TestCachingHandlerHandleLength(t *testing.T) {
+	mem := memfs.New()
+	h, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), helpers.CachingHandlerOptions{Limit: 16, HandleLength: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh := h.ToHandle(mem, []string{"a"})
+	if len(fh) != 32 {
+		t.Fatalf("minted a %d byte handle, expected 32", len(fh))
+	}
+	if _, p, err := h.FromHandle(fh); err != nil || !reflect.DeepEqual(p, []string{"a"}) {
+		t.Fatalf("handle resolved to %v, %v", p, err)
+	}
+
+	// handles of the wrong length, or with garbage padding, could never have been minted.
+	padded := append([]byte(nil), fh...)
+	padded[31] = 1
+	for _, bad := range [][]byte{fh[:16], append(fh, 0), padded} {
+		if _, _, err := h.FromHandle(bad); handleStatus(t, err) != nfs.NFSStatusBadHandle {
+			t.Fatalf("malformed handle %x was not reported as a bad handle: %v", bad, err)
+		}
+	}
+
+	// a well-formed handle that is not cached is stale.
+	unknown := make([]byte, 32)
+	unknown[0] = 1
+	if _, _, err := h.FromHandle(unknown); handleStatus(t, err) != nfs.NFSStatusStale {
+		t.Fatalf("unknown handle was not reported as stale: %v", err)
+	}
+
+	for _, length := range []int{8, nfs.FHSize + 1} {
+		_, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), helpers.CachingHandlerOptions{Limit: 16, HandleLength: length})
+		if !errors.Is(err, helpers.ErrInvalidHandleLength) {
+			t.Fatalf("expected ErrInvalidHandleLength for a %d byte handle, got %v", length, err)
+		}
+	}
+}
+
+func TestCachingHandlerSignedHandles(t *testing.T) {
+	mem := memfs.New()
+	opts := helpers.CachingHandlerOptions{Limit: 16, HandleKey: []byte("server secret")}
+	h, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh := h.ToHandle(mem, []string{"a"})
+	if len(fh) != 32 {
+		t.Fatalf("minted a %d byte signed handle, expected 32", len(fh))
+	}
+	if _, p, err := h.FromHandle(fh); err != nil || !reflect.DeepEqual(p, []string{"a"}) {
+		t.Fatalf("signed handle resolved to %v, %v", p, err)
+	}
+
+	// changing any byte of the id or its signature makes a handle that was never minted.
+	for i := range fh {
+		tampered := append([]byte(nil), fh...)
+		tampered[i] ^= 0x01
+		if _, _, err := h.FromHandle(tampered); handleStatus(t, err) != nfs.NFSStatusBadHandle {
+			t.Fatalf("handle with byte %d flipped was not reported as a bad handle: %v", i, err)
+		}
+	}
+
+	// nor are handles signed with another key honored.
+	other, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), helpers.CachingHandlerOptions{Limit: 16, HandleKey: []byte("another secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := other.FromHandle(fh); handleStatus(t, err) != nfs.NFSStatusBadHandle {
+		t.Fatalf("handle signed with another key was not reported as a bad handle: %v", err)
+	}
+
+	opts.HandleLength = 16
+	if _, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), opts); !errors.Is(err, helpers.ErrInvalidHandleLength) {
+		t.Fatalf("expected ErrInvalidHandleLength for a 16 byte signed handle, got %v", err)
+	}
+}
+
+func TestCachingHandlerHandleTTL(t *testing.T) {
+	mem := memfs.New()
+	h, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), helpers.CachingHandlerOptions{Limit: 16, HandleTTL: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*helpers.CachingHandler)
+
+	idle := handler.ToHandle(mem, []string{"idle"})
+	abandoned := handler.ToHandle(mem, []string{"abandoned"})
+	time.Sleep(100 * time.Millisecond)
+	if _, _, err := handler.FromHandle(idle); handleStatus(t, err) != nfs.NFSStatusStale {
+		t.Fatalf("expired handle was not reported as stale: %v", err)
+	}
+
+	// expired handles are reclaimed, even those no client asks for again.
+	fresh := handler.ToHandle(mem, []string{"fresh"})
+	if n := handler.Stats().Handles; n != 1 {
+		t.Fatalf("%d handles are cached, expected only the fresh one", n)
+	}
+	if _, _, err := handler.FromHandle(abandoned); handleStatus(t, err) != nfs.NFSStatusStale {
+		t.Fatalf("abandoned handle was not reported as stale: %v", err)
+	}
+	if _, _, err := handler.FromHandle(fresh); err != nil {
+		t.Fatalf("fresh handle did not resolve: %v", err)
+	}
+}
+
+func TestCachingHandlerFSIDs(t *testing.T) {
+	for _, deterministic := range []bool{false, true} {
+		h, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(memfs.New()), helpers.CachingHandlerOptions{Limit: 16, Deterministic: deterministic})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := h.(*helpers.CachingHandler)
+		// both filesystems report the same root, so only their FSIDs tell them apart.
+		first, second := memfs.New(), memfs.New()
+		if err := handler.RegisterFilesystem(1, first); err != nil {
+			t.Fatal(err)
+		}
+		if err := handler.RegisterFilesystem(2, second); err != nil {
+			t.Fatal(err)
+		}
+		if err := handler.RegisterFilesystem(2, first); !errors.Is(err, helpers.ErrFSIDInUse) {
+			t.Fatalf("expected ErrFSIDInUse registering a second filesystem as 2, got %v", err)
+		}
+
+		for fsid, f := range map[helpers.FSID]billy.Filesystem{1: first, 2: second} {
+			fh := handler.ToHandle(f, []string{"same", "path"})
+			if got, err := handler.HandleFSID(fh); err != nil || got != fsid {
+				t.Fatalf("handle carries fsid %d, %v, expected %d", got, err, fsid)
+			}
+			resolved, p, err := handler.FromHandle(fh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resolved != f || !reflect.DeepEqual(p, []string{"same", "path"}) {
+				t.Fatalf("handle for fsid %d resolved to the wrong file (deterministic: %v)", fsid, deterministic)
+			}
+			if registered, ok := handler.Filesystem(fsid); !ok || registered != f {
+				t.Fatalf("fsid %d is not registered to its filesystem", fsid)
+			}
+		}
+	}
+}
+
+type fakeFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (f fakeFileInfo) Name() string       { return f.name }
+func (f fakeFileInfo) Size() int64        { return f.size }
+func (f fakeFileInfo) Mode() fs.FileMode  { return f.mode }
+func (f fakeFileInfo) ModTime() time.Time { return f.modTime }
+func (f fakeFileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f fakeFileInfo) Sys() interface{}   { return nil }
+
+func TestVerifierIncludesEntryMetadata(t *testing.T) {
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(memfs.New()), 16).(*helpers.CachingHandler)
+
+	then := time.Unix(1600000000, 0)
+	before := []fs.FileInfo{fakeFileInfo{"a.txt", 10, 0644, then}}
+	after := []fs.FileInfo{fakeFileInfo{"a.txt", 10, 0644, then.Add(time.Second)}}
+
+	if handler.VerifierFor("/dir", before) == handler.VerifierFor("/dir", after) {
+		t.Fatal("listings differing in mtime should have distinct verifiers")
+	}
+	if handler.VerifierFor("/dir", before) != handler.VerifierFor("/dir", before) {
+		t.Fatal("identical listings should have the same verifier")
+	}
+}
+
+func TestVerifierSeparatesPathFromEntries(t *testing.T) {
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(memfs.New()), 16).(*helpers.CachingHandler)
+
+	entry := fakeFileInfo{"b", 0, 0, time.Unix(0, 0)}
+	// a path spelling out the encoding of an entry, as it would be hashed without its length.
+	path := "x" + string(binary.BigEndian.AppendUint64(nil, 1)) + "b" + string(make([]byte, 20))
+	if nfs.HashPathAndContents("x", []fs.FileInfo{entry}) == nfs.HashPathAndContents(path, nil) {
+		t.Fatal("a path and an entry of its directory hashed as a longer path")
+	}
+	if v := handler.VerifierFor("x", []fs.FileInfo{entry}); v != nfs.HashPathAndContents("x", []fs.FileInfo{entry}) {
+		t.Fatal("cached listings have a verifier of their own")
+	}
+}
+
+func TestInvalidateVerifierPrefix(t *testing.T) {
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(memfs.New()), 16).(*helpers.CachingHandler)
+	listing := []fs.FileInfo{fakeFileInfo{"a.txt", 1, 0644, time.Unix(1600000000, 0)}}
+
+	verifiers := map[string]uint64{}
+	for _, p := range []string{"dir", "dir/sub", "dir/sub/deeper", "dirt", "other"} {
+		verifiers[p] = handler.VerifierFor(p, listing)
+	}
+
+	handler.InvalidateVerifierPrefix("dir")
+	for p, v := range verifiers {
+		cached := handler.DataForVerifier(p, v) != nil
+		expected := p == "dirt" || p == "other"
+		if cached != expected {
+			t.Errorf("verifier for %s cached: %v, expected %v", p, cached, expected)
+		}
+	}
+}
+
+func TestCachingHandlerPrintHandles(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 16).(*helpers.CachingHandler)
+
+	first := handler.ToHandle(mem, []string{"a"})
+	second := handler.ToHandle(mem, []string{"a", "b"})
+
+	var out bytes.Buffer
+	if err := handler.PrintHandles(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("%x: a\n%x: a/b\n", first, second)
+	if out.String() != expected {
+		t.Fatalf("unexpected output %q, expected %q", out.String(), expected)
+	}
+}
+
+func TestCachingHandlerDumpVerifiers(t *testing.T) {
+	mem := memfs.New()
+	for _, name := range []string{"/dir/a", "/dir/b", "/other/c"} {
+		if _, err := mem.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := helpers.NewCachingHandlerWithVerifierLimit(helpers.NewNullAuthHandler(mem), 16, 2).(*helpers.CachingHandler)
+	if dump := handler.DumpVerifiers(); len(dump) != 0 {
+		t.Fatalf("expected no verifiers before any listing, got %+v", dump)
+	}
+
+	listing := func(dir string) []fs.FileInfo {
+		contents, err := mem.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+	first := handler.VerifierFor("/dir", listing("/dir"))
+	second := handler.VerifierFor("/other", listing("/other"))
+	expected := []helpers.VerifierInfo{
+		{Verifier: first, Path: "/dir", Entries: 2},
+		{Verifier: second, Path: "/other", Entries: 1},
+	}
+	if dump := handler.DumpVerifiers(); !reflect.DeepEqual(dump, expected) {
+		t.Fatalf("unexpected dump %+v, expected %+v", dump, expected)
+	}
+
+	// dumping does not refresh the listings, so the oldest is still evicted first.
+	third := handler.VerifierFor("/", listing("/"))
+	expected = []helpers.VerifierInfo{
+		{Verifier: second, Path: "/other", Entries: 1},
+		{Verifier: third, Path: "/", Entries: 2},
+	}
+	if dump := handler.DumpVerifiers(); !reflect.DeepEqual(dump, expected) {
+		t.Fatalf("unexpected dump after eviction %+v, expected %+v", dump, expected)
+	}
+}
+
+func TestCachingHandlerRenameHandles(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 16).(*helpers.CachingHandler)
+
+	top := handler.ToHandle(mem, []string{"top"})
+	mid := handler.ToHandle(mem, []string{"top", "mid"})
+	deep := handler.ToHandle(mem, []string{"top", "mid", "file"})
+	sibling := handler.ToHandle(mem, []string{"topper", "file"})
+
+	handler.RenameHandles(mem, []string{"top"}, []string{"renamed"})
+	for _, tc := range []struct {
+		fh       []byte
+		expected []string
+	}{
+		{top, []string{"renamed"}},
+		{mid, []string{"renamed", "mid"}},
+		{deep, []string{"renamed", "mid", "file"}},
+		{sibling, []string{"topper", "file"}},
+	} {
+		_, p, err := handler.FromHandle(tc.fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(p, tc.expected) {
+			t.Errorf("handle resolved to %v after rename, expected %v", p, tc.expected)
+		}
+	}
+}
+
+func TestCachingHandlerFileID(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 16).(*helpers.CachingHandler)
+
+	id, ok := handler.FileID(mem, []string{"dir", "file"})
+	if !ok {
+		t.Fatal("no fileid for a file")
+	}
+	// handles minted later for the file share its id.
+	_ = handler.ToHandle(mem, []string{"dir", "file"})
+	if again, _ := handler.FileID(mem, []string{"dir", "file"}); again != id {
+		t.Fatalf("fileid changed from %d to %d", id, again)
+	}
+	if other, _ := handler.FileID(mem, []string{"dir", "other"}); other == id {
+		t.Fatal("two files share a fileid")
+	}
+
+	handler.RenameHandles(mem, []string{"dir"}, []string{"moved"})
+	if moved, _ := handler.FileID(mem, []string{"moved", "file"}); moved != id {
+		t.Fatalf("renamed file has fileid %d, had %d", moved, id)
+	}
+}
+
+func TestCachingHandlerCaseInsensitive(t *testing.T) {
+	mem := memfs.New()
+	h, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), helpers.CachingHandlerOptions{Limit: 16, CaseInsensitive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*helpers.CachingHandler)
+
+	fh := handler.ToHandle(mem, []string{"Dir", "File.txt"})
+	// a rename named in another case moves the same cached handles.
+	handler.RenameHandles(mem, []string{"dir"}, []string{"moved"})
+	_, p, err := handler.FromHandle(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"moved", "File.txt"}; !reflect.DeepEqual(p, expected) {
+		t.Fatalf("handle resolved to %v after rename, expected %v", p, expected)
+	}
+}
+
+// BenchmarkRenameHandles renames a small directory among a growing number of other cached
+// handles. The cost should depend on the handles moved, not the size of the cache.
+func BenchmarkRenameHandles(b *testing.B) {
+	for _, cached := range []int{1000, 10000} {
+		b.Run(fmt.Sprintf("cached=%d", cached), func(b *testing.B) {
+			mem := memfs.New()
+			handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), cached+100).(*helpers.CachingHandler)
+			for i := 0; i < cached; i++ {
+				handler.ToHandle(mem, []string{fmt.Sprintf("dir%d", i%100), fmt.Sprintf("file%d", i)})
+			}
+			handler.ToHandle(mem, []string{"a"})
+			for i := 0; i < 10; i++ {
+				handler.ToHandle(mem, []string{"a", fmt.Sprintf("file%d", i)})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handler.RenameHandles(mem, []string{"a"}, []string{"b"})
+				handler.RenameHandles(mem, []string{"b"}, []string{"a"})
+			}
+		})
+	}
+}
+
+func TestCachingHandlerSharedCache(t *testing.T) {
+	const limit = 4
+	cache, err := helpers.NewHandleCache(limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memA, memB := memfs.New(), memfs.New()
+	h, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(memA), helpers.CachingHandlerOptions{Cache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := h.(*helpers.CachingHandler)
+	b, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(memB), helpers.CachingHandlerOptions{Cache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fhA := a.ToHandle(memA, []string{"a"})
+	fhB := b.ToHandle(memB, []string{"b"})
+	if _, _, err := b.FromHandle(fhA); err == nil {
+		t.Fatal("handle of one handler resolved through another")
+	}
+	if f, p, err := a.FromHandle(fhA); err != nil || f != memA || !reflect.DeepEqual(p, []string{"a"}) {
+		t.Fatalf("handle resolved to %v: %v", p, err)
+	}
+	if err := a.UpdateHandle(fhB, memA, []string{"c"}); err == nil {
+		t.Fatal("updated the handle of another handler")
+	}
+
+	// handles minted through either handler count towards the one limit.
+	for i := 0; i < limit; i++ {
+		b.ToHandle(memB, []string{fmt.Sprintf("file-%d", i)})
+	}
+	if stats := a.Stats(); stats.Handles != limit || stats.Limit != limit {
+		t.Fatalf("expected %d shared handles, got %+v", limit, stats)
+	}
+	if _, _, err := a.FromHandle(fhA); err == nil {
+		t.Fatal("handle evicted by another handler still resolved")
+	}
+}
+
+func TestCachingHandlerNilFilesystem(t *testing.T) {
+	mem := memfs.New()
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 16).(*helpers.CachingHandler)
+
+	if fh := handler.ToHandle(nil, []string{"a"}); fh != nil {
+		t.Fatal("minted a handle for a nil filesystem")
+	}
+	if handles := handler.ToHandles(nil, [][]string{{"a"}}); handles[0] != nil {
+		t.Fatal("minted a batch handle for a nil filesystem")
+	}
+	fh := handler.ToHandle(mem, []string{"a"})
+	if err := handler.UpdateHandle(fh, nil, []string{"a"}); !errors.Is(err, helpers.ErrNilFilesystem) {
+		t.Fatalf("expected pointing a handle at a nil filesystem to be rejected, got %v", err)
+	}
+	if f, _, err := handler.FromHandle(fh); err != nil || f != mem {
+		t.Fatalf("rejected update changed the handle: %v", err)
+	}
+
+	// a handle on a filesystem restored as nil is stale rather than resolved to it.
+	before := helpers.NewPersistentCachingHandler(helpers.NewNullAuthHandler(mem), 16, map[string]billy.Filesystem{"mem": mem})
+	fh = before.ToHandle(mem, []string{"a"})
+	var state bytes.Buffer
+	if err := before.Save(&state); err != nil {
+		t.Fatal(err)
+	}
+	after := helpers.NewPersistentCachingHandler(helpers.NewNullAuthHandler(mem), 16, map[string]billy.Filesystem{"mem": nil})
+	if err := after.Load(&state); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := after.FromHandle(fh); handleStatus(t, err) != nfs.NFSStatusStale {
+		t.Fatalf("expected a handle on a nil filesystem to be stale, got %v", err)
+	}
+}
+
+// tenantCodec encodes handles as a tenant byte, the FSID and the path of the file.
+type tenantCodec struct {
+	tenant byte
+}
+
+func (tc tenantCodec) Encode(fsid helpers.FSID, path []string) []byte {
+	fh := []byte{tc.tenant}
+	fh = binary.BigEndian.AppendUint32(fh, uint32(fsid))
+	return append(fh, strings.Join(path, "/")...)
+}
+
+func (tc tenantCodec) Decode(fh []byte) (helpers.FSID, []string, error) {
+	if len(fh) < 5 || fh[0] != tc.tenant {
+		return 0, nil, errors.New("handle of another tenant")
+	}
+	fsid := helpers.FSID(binary.BigEndian.Uint32(fh[1:5]))
+	if len(fh) == 5 {
+		return fsid, []string{}, nil
+	}
+	return fsid, strings.Split(string(fh[5:]), "/"), nil
+}
+
+func TestCachingHandlerCodec(t *testing.T) {
+	mem := memfs.New()
+	newHandler := func(tenant byte) *helpers.CachingHandler {
+		h, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), helpers.CachingHandlerOptions{Limit: 1, Codec: tenantCodec{tenant}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := h.(*helpers.CachingHandler)
+		if err := handler.RegisterFilesystem(7, mem); err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+	handler := newHandler(1)
+
+	if fh := handler.ToHandle(memfs.New(), []string{"a"}); fh != nil {
+		t.Fatal("minted a handle for an unregistered filesystem")
+	}
+	fh := handler.ToHandle(mem, []string{"a", "b"})
+	if fh[0] != 1 {
+		t.Fatalf("handle %x is not tagged with its tenant", fh)
+	}
+	if fsid, err := handler.HandleFSID(fh); err != nil || fsid != 7 {
+		t.Fatalf("handle carries fsid %d: %v", fsid, err)
+	}
+	// handles are not cached, so the limit of one does not evict the first.
+	handler.ToHandle(mem, []string{"c"})
+	if f, p, err := handler.FromHandle(fh); err != nil || f != mem || !reflect.DeepEqual(p, []string{"a", "b"}) {
+		t.Fatalf("handle resolved to %v: %v", p, err)
+	}
+	root := handler.ToHandle(mem, []string{})
+	if _, p, err := handler.FromHandle(root); err != nil || len(p) != 0 {
+		t.Fatalf("root handle resolved to %v: %v", p, err)
+	}
+
+	// another server of the tenant resolves the handle without having minted it.
+	if _, p, err := newHandler(1).FromHandle(fh); err != nil || !reflect.DeepEqual(p, []string{"a", "b"}) {
+		t.Fatalf("handle resolved elsewhere to %v: %v", p, err)
+	}
+	if _, _, err := newHandler(2).FromHandle(fh); handleStatus(t, err) != nfs.NFSStatusBadHandle {
+		t.Fatalf("expected the handle of another tenant to be rejected, got %v", err)
+	}
+	if _, _, err := handler.FromHandle(tenantCodec{1}.Encode(7, []string{"..", "etc"})); handleStatus(t, err) != nfs.NFSStatusBadHandle {
+		t.Fatalf("expected a handle escaping its filesystem to be rejected, got %v", err)
+	}
+	if _, _, err := handler.FromHandle(tenantCodec{1}.Encode(8, []string{"a"})); handleStatus(t, err) != nfs.NFSStatusStale {
+		t.Fatalf("expected a handle of an unknown filesystem to be stale, got %v", err)
+	}
+	if err := handler.UpdateHandle(fh, mem, []string{"d"}); !errors.Is(err, helpers.ErrStatelessHandle) {
+		t.Fatalf("expected updating a codec handle to be rejected, got %v", err)
+	}
+}
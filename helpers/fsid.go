@@ -0,0 +1,98 @@
+package helpers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/google/uuid"
+)
+
+// ErrFSIDInUse is returned when registering a filesystem under an FSID, or an FSID for a
+// filesystem, that is already registered otherwise.
+var ErrFSIDInUse = errors.New("fsid is already registered")
+
+// FSID is a small identifier for a filesystem registered with a CachingHandler, carried in
+// each handle minted for its files. Registering each export under the same FSID every time
+// the server starts keeps the filesystem of a handle recognizable across restarts and in logs.
+// Zero is reserved for filesystems that are not registered.
+type FSID uint32
+
+// fsidOf reads the FSID carried by the first bytes of a handle id.
+func fsidOf(id uuid.UUID) FSID {
+	return FSID(binary.BigEndian.Uint32(id[:4]))
+}
+
+// withFSID stamps an FSID over the first bytes of a handle id.
+func withFSID(id uuid.UUID, fsid FSID) uuid.UUID {
+	binary.BigEndian.PutUint32(id[:4], uint32(fsid))
+	return id
+}
+
+// RegisterFilesystem identifies `f` by `id` in the handles minted for its files from now on.
+// Registering the same filesystem under the same id again is allowed.
+func (c *CachingHandler) RegisterFilesystem(id FSID, f billy.Filesystem) error {
+	if id == 0 {
+		return fmt.Errorf("%w: zero is reserved", ErrFSIDInUse)
+	}
+	c.cache.mu.Lock()
+	defer c.cache.mu.Unlock()
+	if existing, ok := c.cache.filesystems[id]; ok {
+		if existing == f {
+			return nil
+		}
+		return fmt.Errorf("%w: %d", ErrFSIDInUse, id)
+	}
+	if existing, ok := c.cache.fsids[f]; ok {
+		return fmt.Errorf("%w: filesystem is registered as %d", ErrFSIDInUse, existing)
+	}
+	c.cache.filesystems[id] = f
+	c.cache.fsids[f] = id
+	return nil
+}
+
+// Filesystem returns the filesystem registered under `id`.
+func (c *CachingHandler) Filesystem(id FSID) (billy.Filesystem, bool) {
+	c.cache.mu.RLock()
+	defer c.cache.mu.RUnlock()
+	f, ok := c.cache.filesystems[id]
+	return f, ok
+}
+
+// HandleFSID reads the FSID of the filesystem a handle was minted for, whether or not the
+// handle is still cached. Handles of unregistered filesystems carry an FSID of zero.
+func (c *CachingHandler) HandleFSID(fh []byte) (FSID, error) {
+	if c.codec != nil {
+		fsid, _, err := c.codec.Decode(fh)
+		return fsid, err
+	}
+	id, err := c.decodeHandle(fh)
+	if err != nil {
+		return 0, err
+	}
+	return fsidOf(id), nil
+}
+
+// mintLocked creates the id of a new handle for a file.
+func (c *CachingHandler) mintLocked(f billy.Filesystem, path []string) uuid.UUID {
+	fsid := c.cache.fsids[f]
+	if c.deterministic {
+		return withFSID(hashFilesystemAndPath(f, fsid, c.fold(path)), fsid)
+	}
+	return withFSID(uuid.New(), fsid)
+}
+
+// resolvableLocked reports whether a cached entry may be resolved through a handle id. The
+// entry must have been minted by the handler for a filesystem, and the id must carry the
+// FSID of the entry's filesystem if it is registered.
+func (c *CachingHandler) resolvableLocked(id uuid.UUID, e entry) bool {
+	if e.owner != c || e.f == nil {
+		return false
+	}
+	fsid := fsidOf(id)
+	if fsid == 0 {
+		return true
+	}
+	return c.cache.filesystems[fsid] == e.f
+}
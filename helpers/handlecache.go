@@ -0,0 +1,102 @@
+package helpers
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/google/uuid"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// HandleCache holds the file handles of one or more CachingHandlers. Handlers sharing a
+// cache, such as those of the exports of a server, keep to its single limit together rather
+// than each to a limit of its own, evicting the least recently used handle of any of them.
+// They also share a registry of FSIDs, so that the handles of their filesystems carry
+// distinct FSIDs, and each handler resolves only the handles it minted itself. Handlers
+// minting Deterministic handles for the same filesystem mint the same handle for a path,
+// which resolves through whichever of them minted it last.
+type HandleCache struct {
+	// mu guards compound operations across the caches, such as keeping byPath
+	// consistent with activeHandles, which the LRU's own locking does not cover.
+	mu            sync.RWMutex
+	activeHandles *lru.Cache[uuid.UUID, entry]
+	// byPath indexes the most recent handle for each cached path, so that
+	// the ancestors of a path can be found without scanning the cache.
+	byPath map[pathKey]uuid.UUID
+	// byTree indexes every cached handle by its path, so that renames only visit
+	// the handles they move.
+	byTree pathTree
+	// filesystems and fsids are the registry of RegisterFilesystem.
+	filesystems map[FSID]billy.Filesystem
+	fsids       map[billy.Filesystem]FSID
+	// cacheLimit is the number of handles the cache holds, which grows towards maxLimit.
+	cacheLimit int
+	maxLimit   int
+	// refusing is set while the cache is full, so that refusals are only warned of once.
+	refusing atomic.Bool
+
+	evictedMu sync.Mutex
+	evicted   []evictedHandle
+}
+
+// NewHandleCache creates a cache of up to `limit` file handles, to be shared by the
+// CachingHandlers it is given to as CachingHandlerOptions.Cache. It returns an error
+// wrapping ErrInvalidCacheLimit if limit is not positive.
+func NewHandleCache(limit int) (*HandleCache, error) {
+	return newHandleCache(limit, 0)
+}
+
+func newHandleCache(limit, maxLimit int) (*HandleCache, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w: handle limit %d", ErrInvalidCacheLimit, limit)
+	}
+	hc := &HandleCache{
+		byPath:      make(map[pathKey]uuid.UUID),
+		byTree:      make(pathTree),
+		filesystems: make(map[FSID]billy.Filesystem),
+		fsids:       make(map[billy.Filesystem]FSID),
+		cacheLimit:  limit,
+		maxLimit:    maxLimit,
+	}
+	var err error
+	if hc.activeHandles, err = lru.NewWithEvict[uuid.UUID, entry](limit, hc.onHandleEvicted); err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+// Len is the number of handles cached, by all of the handlers sharing the cache.
+func (hc *HandleCache) Len() int {
+	return hc.activeHandles.Len()
+}
+
+type evictedHandle struct {
+	id uuid.UUID
+	entry
+}
+
+// onHandleEvicted is called by the LRU with the cache write lock held,
+// so evictions are queued until notifyEvicted.
+func (hc *HandleCache) onHandleEvicted(id uuid.UUID, e entry) {
+	e.owner.unindexLocked(id, e)
+	if e.owner.OnEvict == nil {
+		return
+	}
+	hc.evictedMu.Lock()
+	hc.evicted = append(hc.evicted, evictedHandle{id, e})
+	hc.evictedMu.Unlock()
+}
+
+// notifyEvicted calls OnEvict of the handlers that minted the queued evictions. It must be
+// called without the cache lock held.
+func (hc *HandleCache) notifyEvicted() {
+	hc.evictedMu.Lock()
+	evicted := hc.evicted
+	hc.evicted = nil
+	hc.evictedMu.Unlock()
+	for _, e := range evicted {
+		e.owner.OnEvict(e.owner.encodeHandle(e.id), e.f, e.p)
+	}
+}
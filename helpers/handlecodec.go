@@ -0,0 +1,78 @@
+package helpers
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs"
+)
+
+// ErrStatelessHandle is returned when a handle encoded by a HandleCodec is asked to be
+// pointed at another file, which it cannot be as it carries the path it refers to.
+var ErrStatelessHandle = errors.New("handles of a codec cannot be updated")
+
+// HandleCodec encodes the handle of a file from the FSID of its filesystem and its path,
+// and decodes them back from the handle. A CachingHandler given a codec mints its handles
+// with it in place of cached UUIDs, so that handles can carry routing information, such as
+// a shard or tenant, and resolve without any state on the server.
+//
+// Decode is handed any handle a client presents, and should report those it could not have
+// encoded with an error, which is answered with NFSStatusBadHandle unless it is an
+// nfs.NFSStatusError. Encoded handles must be at most nfs.FHSize bytes.
+type HandleCodec interface {
+	Encode(fsid FSID, path []string) []byte
+	Decode(fh []byte) (FSID, []string, error)
+}
+
+// encodeWithCodec mints the handle of a file of a registered filesystem with the codec,
+// returning nil if none can be minted.
+func (c *CachingHandler) encodeWithCodec(f billy.Filesystem, path []string) []byte {
+	path, err := cleanPath(path)
+	if err != nil {
+		nfs.Log.Errorf("not minting a handle: %v", err)
+		return nil
+	}
+	if f == nil {
+		nfs.Log.Errorf("not minting a handle for %s: %v", strings.Join(path, "/"), ErrNilFilesystem)
+		return nil
+	}
+	c.cache.mu.RLock()
+	fsid, ok := c.cache.fsids[f]
+	c.cache.mu.RUnlock()
+	if !ok {
+		nfs.Log.Errorf("not minting a handle for %s: filesystem is not registered", strings.Join(path, "/"))
+		return nil
+	}
+	fh := c.codec.Encode(fsid, path)
+	if len(fh) == 0 || len(fh) > nfs.FHSize {
+		nfs.Log.Errorf("not minting a handle for %s: codec encoded %d bytes", strings.Join(path, "/"), len(fh))
+		return nil
+	}
+	return fh
+}
+
+// decodeWithCodec resolves a handle minted by encodeWithCodec. Handles the codec rejects,
+// or whose paths are not clean, are reported as NFSStatusBadHandle, and those of
+// filesystems no longer registered as NFSStatusStale.
+func (c *CachingHandler) decodeWithCodec(fh []byte) (billy.Filesystem, []string, error) {
+	fsid, path, err := c.codec.Decode(fh)
+	if err != nil {
+		var nfsErr *nfs.NFSStatusError
+		if errors.As(err, &nfsErr) {
+			return nil, []string{}, err
+		}
+		return nil, []string{}, nfs.Errorf(nfs.NFSStatusBadHandle, "decoding handle: %v", err)
+	}
+	// a handle a client made up must not reach outside of its filesystem.
+	if path, err = cleanPath(path); err != nil {
+		return nil, []string{}, nfs.Errorf(nfs.NFSStatusBadHandle, "decoding handle: %v", err)
+	}
+	c.cache.mu.RLock()
+	f, ok := c.cache.filesystems[fsid]
+	c.cache.mu.RUnlock()
+	if !ok {
+		return nil, []string{}, nfs.ErrStale()
+	}
+	return f, path, nil
+}
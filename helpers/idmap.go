@@ -0,0 +1,50 @@
+package helpers
+
+import "github.com/willscott/go-nfs"
+
+var _ nfs.IDMapper = (*StaticIDMapper)(nil)
+
+// NewStaticIDMapper maps the client uids and gids that are keys of `uids` and `gids` to the
+// filesystem identities they map to, and those identities back to the clients. Identities
+// missing from the tables pass through unchanged. When several client identities map to
+// the same filesystem identity, which of them it maps back to is unspecified.
+func NewStaticIDMapper(uids, gids map[uint32]uint32) *StaticIDMapper {
+	m := &StaticIDMapper{
+		uidsIn:  make(map[uint32]uint32, len(uids)),
+		uidsOut: make(map[uint32]uint32, len(uids)),
+		gidsIn:  make(map[uint32]uint32, len(gids)),
+		gidsOut: make(map[uint32]uint32, len(gids)),
+	}
+	for client, server := range uids {
+		m.uidsIn[client] = server
+		m.uidsOut[server] = client
+	}
+	for client, server := range gids {
+		m.gidsIn[client] = server
+		m.gidsOut[server] = client
+	}
+	return m
+}
+
+// StaticIDMapper is an nfs.IDMapper translating identities through fixed tables.
+type StaticIDMapper struct {
+	uidsIn, uidsOut map[uint32]uint32
+	gidsIn, gidsOut map[uint32]uint32
+}
+
+// MapIn translates a client identity to that of the filesystem.
+func (m *StaticIDMapper) MapIn(uid, gid uint32) (uint32, uint32) {
+	return lookupID(m.uidsIn, uid), lookupID(m.gidsIn, gid)
+}
+
+// MapOut translates the owner of a file to the identity of clients.
+func (m *StaticIDMapper) MapOut(uid, gid uint32) (uint32, uint32) {
+	return lookupID(m.uidsOut, uid), lookupID(m.gidsOut, gid)
+}
+
+func lookupID(table map[uint32]uint32, id uint32) uint32 {
+	if mapped, ok := table[id]; ok {
+		return mapped
+	}
+	return id
+}
@@ -0,0 +1,106 @@
+package helpers
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"path"
+	"sort"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs"
+)
+
+// NewMultiExportHandler serves each filesystem in `exports` to clients mounting its path,
+// such as "/photos", with a handle cache of `limit` entries shared among them.
+// Each filesystem is registered under an FSID derived from its export path, so that its
+// handles can be told apart from those of the other exports. A filesystem may only be
+// exported under a single path.
+func NewMultiExportHandler(exports map[string]billy.Filesystem, limit int) (*MultiExportHandler, error) {
+	router := &exportRouter{exports: make(map[string]billy.Filesystem, len(exports))}
+	for p, f := range exports {
+		router.exports[cleanExportPath(p)] = f
+	}
+	c, err := newCachingHandler(router, CachingHandlerOptions{Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	for p, f := range router.exports {
+		if err := c.RegisterFilesystem(exportFSID(p), f); err != nil {
+			return nil, err
+		}
+	}
+	return &MultiExportHandler{c, router}, nil
+}
+
+// MultiExportHandler is a CachingHandler over several filesystems, each mounted by its own path.
+type MultiExportHandler struct {
+	*CachingHandler
+	router *exportRouter
+}
+
+// Exports lists the export paths, as reported to clients by the MOUNT EXPORT procedure.
+func (h *MultiExportHandler) Exports() []nfs.ExportEntry {
+	entries := make([]nfs.ExportEntry, 0, len(h.router.exports))
+	for p := range h.router.exports {
+		entries = append(entries, nfs.ExportEntry{Dir: p})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Dir < entries[j].Dir })
+	return entries
+}
+
+// exportRouter answers mounts with the filesystem exported at the requested path.
+type exportRouter struct {
+	exports map[string]billy.Filesystem
+}
+
+// Mount backs Mount RPC Requests, choosing the filesystem exported at the requested path.
+func (r *exportRouter) Mount(ctx context.Context, conn net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	f, ok := r.exports[cleanExportPath(string(req.Dirpath))]
+	if !ok {
+		return nfs.MountStatusErrNoEnt, nil, nil
+	}
+	return nfs.MountStatusOk, f, []nfs.AuthFlavor{nfs.AuthFlavorNull}
+}
+
+// Change provides an interface for updating file attributes.
+func (r *exportRouter) Change(fs billy.Filesystem) billy.Change {
+	if c, ok := fs.(billy.Change); ok {
+		return c
+	}
+	return nil
+}
+
+// FSStat provides information about a filesystem.
+func (r *exportRouter) FSStat(ctx context.Context, f billy.Filesystem, s *nfs.FSStat) error {
+	return nil
+}
+
+// ToHandle handled by CachingHandler
+func (r *exportRouter) ToHandle(f billy.Filesystem, s []string) []byte {
+	return []byte{}
+}
+
+// FromHandle handled by CachingHandler
+func (r *exportRouter) FromHandle([]byte) (billy.Filesystem, []string, error) {
+	return nil, []string{}, nil
+}
+
+// HandleLimit handled by CachingHandler
+func (r *exportRouter) HandleLimit() int {
+	return -1
+}
+
+func cleanExportPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// exportFSID derives a stable FSID from an export path. Zero is reserved, so it is skipped.
+func exportFSID(p string) FSID {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(p))
+	if id := FSID(h.Sum32()); id != 0 {
+		return id
+	}
+	return 1
+}
@@ -0,0 +1,72 @@
+package helpers_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestMultiExportHandler(t *testing.T) {
+	exports := map[string]billy.Filesystem{"/photos": memfs.New(), "/docs": memfs.New()}
+	for p, f := range exports {
+		if err := util.WriteFile(f, "/whoami", []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler, err := helpers.NewMultiExportHandler(exports, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = nfs.Serve(listener, handler)
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+
+	for p := range exports {
+		c, err := rpc.DialTCP("tcp", nil, listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		mounter := nfsc.Mount{Client: c}
+		target, err := mounter.Mount(p, rpc.AuthNull)
+		if err != nil {
+			t.Fatalf("mounting %s: %v", p, err)
+		}
+		f, err := target.Open("/whoami")
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != p {
+			t.Fatalf("mount of %s read %q", p, contents)
+		}
+	}
+
+	c, err := rpc.DialTCP("tcp", nil, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	mounter := nfsc.Mount{Client: c}
+	if _, err := mounter.Mount("/music", rpc.AuthNull); err == nil {
+		t.Fatal("mounted a path that is not exported")
+	}
+}
@@ -0,0 +1,82 @@
+package helpers
+
+import (
+	"github.com/go-git/go-billy/v5"
+	"github.com/google/uuid"
+)
+
+// pathTree indexes the cached handles by their path, one tree per filesystem, so that
+// the handles at and below a path can be found without scanning the whole cache.
+type pathTree map[billy.Filesystem]*pathNode
+
+type pathNode struct {
+	ids      map[uuid.UUID]struct{}
+	children map[string]*pathNode
+}
+
+func (t pathTree) add(id uuid.UUID, f billy.Filesystem, path []string) {
+	n, ok := t[f]
+	if !ok {
+		n = &pathNode{}
+		t[f] = n
+	}
+	for _, name := range path {
+		child, ok := n.children[name]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*pathNode)
+			}
+			child = &pathNode{}
+			n.children[name] = child
+		}
+		n = child
+	}
+	if n.ids == nil {
+		n.ids = make(map[uuid.UUID]struct{})
+	}
+	n.ids[id] = struct{}{}
+}
+
+// remove drops a handle from the tree, along with the nodes it leaves empty.
+func (t pathTree) remove(id uuid.UUID, f billy.Filesystem, path []string) {
+	root, ok := t[f]
+	if !ok {
+		return
+	}
+	if root.remove(id, path) {
+		delete(t, f)
+	}
+}
+
+// remove reports whether the node is left empty.
+func (n *pathNode) remove(id uuid.UUID, path []string) bool {
+	if len(path) == 0 {
+		delete(n.ids, id)
+	} else if child, ok := n.children[path[0]]; ok && child.remove(id, path[1:]) {
+		delete(n.children, path[0])
+	}
+	return len(n.ids) == 0 && len(n.children) == 0
+}
+
+// below lists the handles at `path` and everywhere below it.
+func (t pathTree) below(f billy.Filesystem, path []string) []uuid.UUID {
+	n, ok := t[f]
+	for i := 0; ok && i < len(path); i++ {
+		n, ok = n.children[path[i]]
+	}
+	if !ok {
+		return nil
+	}
+	var ids []uuid.UUID
+	var walk func(n *pathNode)
+	walk = func(n *pathNode) {
+		for id := range n.ids {
+			ids = append(ids, id)
+		}
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(n)
+	return ids
+}
@@ -0,0 +1,119 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/willscott/go-nfs"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/google/uuid"
+)
+
+// persistedStateVersion is the version of the format written by Save.
+const persistedStateVersion = 1
+
+// NewPersistentCachingHandler wraps a handler to provide a to/from-file handle cache
+// that can be saved and restored across server restarts.
+// `filesystems` names each filesystem that handles may refer to. The names are
+// written out by Save and used by Load to re-resolve the filesystem of each handle.
+// It panics if limit is not positive.
+func NewPersistentCachingHandler(h nfs.Handler, limit int, filesystems map[string]billy.Filesystem) *PersistentCachingHandler {
+	return &PersistentCachingHandler{
+		CachingHandler: mustCachingHandler(newCachingHandler(h, CachingHandlerOptions{Limit: limit})),
+		filesystems:    filesystems,
+	}
+}
+
+// NewPersistentCachingHandlerWithOptions wraps a handler as NewPersistentCachingHandler does,
+// with a cache configured by `opts`. It returns an error wrapping ErrInvalidCacheLimit if the
+// options cannot be satisfied.
+func NewPersistentCachingHandlerWithOptions(h nfs.Handler, opts CachingHandlerOptions, filesystems map[string]billy.Filesystem) (*PersistentCachingHandler, error) {
+	c, err := newCachingHandler(h, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &PersistentCachingHandler{CachingHandler: c, filesystems: filesystems}, nil
+}
+
+// PersistentCachingHandler is a CachingHandler whose handles can be serialized
+// on shutdown and reloaded on startup, so that clients do not need to remount.
+type PersistentCachingHandler struct {
+	*CachingHandler
+	filesystems map[string]billy.Filesystem
+}
+
+type persistedState struct {
+	Version int               `json:"version"`
+	Handles []persistedHandle `json:"handles"`
+}
+
+type persistedHandle struct {
+	Handle     uuid.UUID `json:"handle"`
+	Filesystem string    `json:"fs"`
+	Path       []string  `json:"path"`
+}
+
+func (c *PersistentCachingHandler) filesystemName(f billy.Filesystem) (string, bool) {
+	for name, candidate := range c.filesystems {
+		if candidate == f {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Save writes the active handles to `w`.
+// Handles on filesystems not named in the handler's filesystem map are skipped.
+func (c *PersistentCachingHandler) Save(w io.Writer) error {
+	c.cache.mu.RLock()
+	state := persistedState{Version: persistedStateVersion}
+	// Keys are ordered oldest to newest, so that Load restores recency.
+	for _, k := range c.cache.activeHandles.Keys() {
+		e, ok := c.cache.activeHandles.Peek(k)
+		if !ok || e.owner != c.CachingHandler {
+			continue
+		}
+		name, ok := c.filesystemName(e.f)
+		if !ok {
+			continue
+		}
+		state.Handles = append(state.Handles, persistedHandle{k, name, e.p})
+	}
+	c.cache.mu.RUnlock()
+
+	return json.NewEncoder(w).Encode(state)
+}
+
+// Load reads handles previously written by Save from `r` and adds them to the cache, within
+// its limits as handles minted by ToHandle are. Handles on filesystems that can no longer be
+// resolved by name, and those of paths ToHandle would not mint a handle for, are skipped.
+// Once a cache set to RefuseWhenFull is full, the remaining handles are skipped.
+func (c *PersistentCachingHandler) Load(r io.Reader) error {
+	var state persistedState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+	if state.Version != persistedStateVersion {
+		return fmt.Errorf("unsupported handle state version %d", state.Version)
+	}
+
+	c.cache.mu.Lock()
+	for _, h := range state.Handles {
+		f, ok := c.filesystems[h.Filesystem]
+		if !ok || f == nil {
+			continue
+		}
+		path, err := cleanPath(h.Path)
+		if err != nil {
+			continue
+		}
+		if !c.insertLocked(h.Handle, c.newEntry(f, path)) {
+			break
+		}
+	}
+	c.cache.mu.Unlock()
+	c.cache.notifyEvicted()
+	return nil
+}
@@ -0,0 +1,109 @@
+package helpers_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/willscott/go-nfs/helpers"
+)
+
+func TestPersistentCachingHandlerSaveLoad(t *testing.T) {
+	docs := memfs.New()
+	scratch := memfs.New()
+	named := map[string]billy.Filesystem{"docs": docs, "scratch": scratch}
+
+	before := helpers.NewPersistentCachingHandler(helpers.NewNullAuthHandler(docs), 16, named)
+	root := before.ToHandle(docs, []string{})
+	file := before.ToHandle(docs, []string{"a", "b.txt"})
+	other := before.ToHandle(scratch, []string{"tmp"})
+	unnamed := before.ToHandle(memfs.New(), []string{"lost"})
+
+	var state bytes.Buffer
+	if err := before.Save(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	// the restarted server no longer knows about the scratch filesystem.
+	after := helpers.NewPersistentCachingHandler(helpers.NewNullAuthHandler(docs), 16, map[string]billy.Filesystem{"docs": docs})
+	if err := after.Load(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	if f, p, err := after.FromHandle(root); err != nil || f != docs || len(p) != 0 {
+		t.Fatalf("root handle did not survive reload: %v %v", p, err)
+	}
+	if f, p, err := after.FromHandle(file); err != nil || f != docs || !reflect.DeepEqual(p, []string{"a", "b.txt"}) {
+		t.Fatalf("file handle did not survive reload: %v %v", p, err)
+	}
+	if _, _, err := after.FromHandle(other); err == nil {
+		t.Fatal("handle on an unresolvable filesystem should be skipped")
+	}
+	if _, _, err := after.FromHandle(unnamed); err == nil {
+		t.Fatal("handle on an unnamed filesystem should not be saved")
+	}
+}
+
+// savedHandles is the state Save writes for the handles of `paths` of `f`, minted in order.
+func savedHandles(t *testing.T, f billy.Filesystem, paths ...[]string) ([][]byte, *bytes.Buffer) {
+	t.Helper()
+	before := helpers.NewPersistentCachingHandler(helpers.NewNullAuthHandler(f), 16, map[string]billy.Filesystem{"fs": f})
+	handles := make([][]byte, len(paths))
+	for i, p := range paths {
+		handles[i] = before.ToHandle(f, p)
+	}
+	var state bytes.Buffer
+	if err := before.Save(&state); err != nil {
+		t.Fatal(err)
+	}
+	return handles, &state
+}
+
+func TestPersistentCachingHandlerLoadCleansPaths(t *testing.T) {
+	mem := memfs.New()
+	handles, state := savedHandles(t, mem, []string{"a", "b"})
+	// a state written by hand, or by an older version, may hold paths ToHandle would clean or refuse.
+	edited := strings.Replace(state.String(), `["a","b"]`, `["","a","","b"]`, 1)
+	edited = strings.Replace(edited, `"handles":[`, `"handles":[{"handle":"6ba7b810-9dad-11d1-80b4-00c04fd430c8","fs":"fs","path":["..","etc"]},`, 1)
+
+	after := helpers.NewPersistentCachingHandler(helpers.NewNullAuthHandler(mem), 16, map[string]billy.Filesystem{"fs": mem})
+	if err := after.Load(strings.NewReader(edited)); err != nil {
+		t.Fatal(err)
+	}
+	if _, p, err := after.FromHandle(handles[0]); err != nil || !reflect.DeepEqual(p, []string{"a", "b"}) {
+		t.Fatalf("handle resolved to %v after reload: %v", p, err)
+	}
+	if n := after.Stats().Handles; n != 1 {
+		t.Fatalf("%d handles were loaded, expected the path outside the filesystem to be skipped", n)
+	}
+}
+
+func TestPersistentCachingHandlerLoadKeepsLimits(t *testing.T) {
+	mem := memfs.New()
+	handles, state := savedHandles(t, mem, []string{"a"}, []string{"b"}, []string{"c"})
+
+	evicting := helpers.NewPersistentCachingHandler(helpers.NewNullAuthHandler(mem), 2, map[string]billy.Filesystem{"fs": mem})
+	if err := evicting.Load(bytes.NewReader(state.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if stats := evicting.Stats(); stats.Handles != 2 || stats.HandleEvictions != 1 {
+		t.Fatalf("loading 3 handles into a cache of 2 left %d handles after %d evictions", stats.Handles, stats.HandleEvictions)
+	}
+
+	refusing, err := helpers.NewPersistentCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), helpers.CachingHandlerOptions{Limit: 2, RefuseWhenFull: true}, map[string]billy.Filesystem{"fs": mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := refusing.Load(bytes.NewReader(state.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if stats := refusing.Stats(); stats.Handles != 2 || stats.HandleEvictions != 0 {
+		t.Fatalf("loading 3 handles into a full cache left %d handles after %d evictions", stats.Handles, stats.HandleEvictions)
+	}
+	if _, _, err := refusing.FromHandle(handles[2]); err == nil {
+		t.Fatal("a handle beyond the limit of a refusing cache was loaded")
+	}
+}
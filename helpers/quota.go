@@ -0,0 +1,72 @@
+package helpers
+
+import (
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs"
+)
+
+// NewByteQuota limits each filesystem to `total` bytes written, and each user to `perUser`
+// bytes on each filesystem. A limit of zero or less is not enforced.
+func NewByteQuota(total, perUser int64) *ByteQuota {
+	return &ByteQuota{
+		total:   total,
+		perUser: perUser,
+		fsUsage: make(map[billy.Filesystem]int64),
+		usage:   make(map[userOnFS]int64),
+	}
+}
+
+// ByteQuota is an nfs.Quota counting the bytes written through the server, by filesystem
+// and by user. Usage starts from zero, and files removed are not credited back.
+type ByteQuota struct {
+	total   int64
+	perUser int64
+
+	mu      sync.Mutex
+	fsUsage map[billy.Filesystem]int64
+	usage   map[userOnFS]int64
+}
+
+type userOnFS struct {
+	fs  billy.Filesystem
+	uid uint32
+}
+
+// Reserve holds `n` bytes for the user, refusing growth past their quota with ErrDQuot and
+// past the total of the filesystem with ErrNoSpc. The bytes are counted as used until
+// released, when those left unwritten are credited back.
+func (q *ByteQuota) Reserve(fs billy.Filesystem, uid uint32, n int64) (func(used int64), error) {
+	user := userOnFS{fs, uid}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if used := q.usage[user]; q.perUser > 0 && used+n > q.perUser {
+		return nil, nfs.Errorf(nfs.NFSStatusDQuot, "uid %d has used %d of %d bytes", uid, used, q.perUser)
+	}
+	if used := q.fsUsage[fs]; q.total > 0 && used+n > q.total {
+		return nil, nfs.Errorf(nfs.NFSStatusNoSPC, "filesystem has used %d of %d bytes", used, q.total)
+	}
+	q.usage[user] += n
+	q.fsUsage[fs] += n
+
+	return func(used int64) {
+		if used < 0 {
+			used = 0
+		}
+		if unused := n - used; unused > 0 {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.usage[user] -= unused
+			q.fsUsage[fs] -= unused
+		}
+	}, nil
+}
+
+// Usage reports the bytes written to `fs` in total, and by the user `uid`, including those
+// reserved by requests still writing.
+func (q *ByteQuota) Usage(fs billy.Filesystem, uid uint32) (total, user int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.fsUsage[fs], q.usage[userOnFS{fs, uid}]
+}
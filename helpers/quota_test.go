@@ -0,0 +1,49 @@
+package helpers_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/willscott/go-nfs/helpers"
+)
+
+func TestByteQuotaReserve(t *testing.T) {
+	fs := memfs.New()
+	quota := helpers.NewByteQuota(100, 0)
+
+	// concurrent reservations are not allowed more than the quota between them.
+	const requests = 16
+	releases := make(chan func(int64), requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(uid uint32) {
+			defer wg.Done()
+			if release, err := quota.Reserve(fs, uid, 30); err == nil {
+				releases <- release
+			}
+		}(uint32(i))
+	}
+	wg.Wait()
+	close(releases)
+	if len(releases) != 3 {
+		t.Fatalf("%d reservations of 30 bytes fit a quota of 100", len(releases))
+	}
+
+	// the bytes a request did not write are credited back.
+	used := []int64{30, 10, 0}
+	for release := range releases {
+		release(used[0])
+		used = used[1:]
+	}
+	if total, _ := quota.Usage(fs, 0); total != 40 {
+		t.Fatalf("quota used %d bytes after releasing, expected 40", total)
+	}
+	if _, err := quota.Reserve(fs, 0, 60); err != nil {
+		t.Fatalf("reserving the credited bytes failed: %v", err)
+	}
+	if _, err := quota.Reserve(fs, 0, 1); err == nil {
+		t.Fatal("reserving past the quota succeeded")
+	}
+}
@@ -0,0 +1,265 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/willscott/go-nfs"
+)
+
+// DefaultReadAheadWindow is the number of bytes read ahead of a sequential reader when
+// NewReadAheadHandler is given no window.
+const DefaultReadAheadWindow = 1 << 20
+
+// readAheadFiles bounds the number of files read ahead of at once, for each filesystem.
+const readAheadFiles = 64
+
+// NewReadAheadHandler wraps a handler so that READs following on from the previous READ of
+// a file also fetch the `window` bytes after them from the filesystem, and later READs of
+// those bytes are answered without reaching it. A READ elsewhere in the file drops what was
+// read ahead. This suits filesystems where each read is slow, such as those over a network.
+//
+// The filesystems mounted through the handler are wrapped, and do not expose the optional
+// interfaces of the filesystems they wrap, other than billy.Capable. Changes made to files
+// other than through the handler are not seen until what was read ahead of them is dropped.
+func NewReadAheadHandler(h nfs.Handler, window int) *ReadAheadHandler {
+	if window <= 0 {
+		window = DefaultReadAheadWindow
+	}
+	return &ReadAheadHandler{
+		Handler: h,
+		window:  window,
+		wrapped: make(map[billy.Filesystem]*readAheadFS),
+	}
+}
+
+// ReadAheadHandler is a Handler reading ahead of sequential readers of its files.
+type ReadAheadHandler struct {
+	nfs.Handler
+	window int
+
+	mu      sync.Mutex
+	wrapped map[billy.Filesystem]*readAheadFS
+}
+
+// Mount backs Mount RPC Requests, answering with the mounted filesystem wrapped to read ahead.
+func (h *ReadAheadHandler) Mount(ctx context.Context, conn net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	status, fs, auths := h.Handler.Mount(ctx, conn, req)
+	if status != nfs.MountStatusOk || fs == nil {
+		return status, fs, auths
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ra, ok := h.wrapped[fs]; ok {
+		return status, ra, auths
+	}
+	files, err := lru.New[string, *readAhead](readAheadFiles)
+	if err != nil {
+		return nfs.MountStatusErrServerFault, nil, nil
+	}
+	ra := &readAheadFS{Filesystem: fs, window: h.window, files: files}
+	h.wrapped[fs] = ra
+	return status, ra, auths
+}
+
+// unwrap is the filesystem a read ahead filesystem was mounted for.
+func unwrap(fs billy.Filesystem) billy.Filesystem {
+	if ra, ok := fs.(*readAheadFS); ok {
+		return ra.Filesystem
+	}
+	return fs
+}
+
+// Change provides an interface for updating file attributes of the wrapped filesystem.
+func (h *ReadAheadHandler) Change(fs billy.Filesystem) billy.Change {
+	return h.Handler.Change(unwrap(fs))
+}
+
+// FSStat provides information about the wrapped filesystem.
+func (h *ReadAheadHandler) FSStat(ctx context.Context, fs billy.Filesystem, stat *nfs.FSStat) error {
+	return h.Handler.FSStat(ctx, unwrap(fs), stat)
+}
+
+// VerifierFor uses the directory listing cache of the wrapped handler, if it has one.
+func (h *ReadAheadHandler) VerifierFor(path string, contents []fs.FileInfo) uint64 {
+	if vh, ok := h.Handler.(nfs.CachingHandler); ok {
+		return vh.VerifierFor(path, contents)
+	}
+	return 0
+}
+
+// DataForVerifier uses the directory listing cache of the wrapped handler, if it has one.
+func (h *ReadAheadHandler) DataForVerifier(path string, verifier uint64) []fs.FileInfo {
+	if vh, ok := h.Handler.(nfs.CachingHandler); ok {
+		return vh.DataForVerifier(path, verifier)
+	}
+	return nil
+}
+
+// InvalidateVerifier forwards to the wrapped handler.
+func (h *ReadAheadHandler) InvalidateVerifier(path string) {
+	if vi, ok := h.Handler.(nfs.VerifierInvalidator); ok {
+		vi.InvalidateVerifier(path)
+	}
+}
+
+// RenameHandles forwards to the wrapped handler.
+func (h *ReadAheadHandler) RenameHandles(fs billy.Filesystem, from, to []string) {
+	if renamer, ok := h.Handler.(nfs.HandleRenamer); ok {
+		renamer.RenameHandles(fs, from, to)
+	}
+}
+
+// CaseInsensitive forwards to the wrapped handler.
+func (h *ReadAheadHandler) CaseInsensitive() bool {
+	ci, ok := h.Handler.(nfs.CaseInsensitiveHandler)
+	return ok && ci.CaseInsensitive()
+}
+
+// readAheadFS tracks the reads of the files of a filesystem, to read ahead of them.
+type readAheadFS struct {
+	billy.Filesystem
+	window int
+	files  *lru.Cache[string, *readAhead]
+}
+
+// readAhead is the state of reads of a single file.
+type readAhead struct {
+	mu sync.Mutex
+	// next is the offset a sequential read continues from.
+	next int64
+	// buf holds the bytes of the file from offset, to its end when eof is set.
+	offset int64
+	buf    []byte
+	eof    bool
+}
+
+func (r *readAheadFS) Capabilities() billy.Capability {
+	return billy.Capabilities(r.Filesystem)
+}
+
+// invalidate drops what was read ahead of a file, as it is about to change.
+func (r *readAheadFS) invalidate(filename string) {
+	r.files.Remove(r.Join(filename))
+}
+
+func (r *readAheadFS) Open(filename string) (billy.File, error) {
+	return r.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (r *readAheadFS) Create(filename string) (billy.File, error) {
+	return r.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (r *readAheadFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_TRUNC) != 0 {
+		r.invalidate(filename)
+	}
+	f, err := r.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &readAheadFile{File: f, fs: r, name: r.Join(filename)}, nil
+}
+
+func (r *readAheadFS) Remove(filename string) error {
+	r.invalidate(filename)
+	return r.Filesystem.Remove(filename)
+}
+
+func (r *readAheadFS) Rename(oldpath, newpath string) error {
+	// either path may be a directory, whose files are renamed or replaced as well.
+	old, replaced := r.Join(oldpath), r.Join(newpath)
+	for _, name := range r.files.Keys() {
+		if within(name, old) || within(name, replaced) {
+			r.files.Remove(name)
+		}
+	}
+	return r.Filesystem.Rename(oldpath, newpath)
+}
+
+// within reports whether a file is, or is below, a path.
+func within(name, path string) bool {
+	return name == path || strings.HasPrefix(name, strings.TrimSuffix(path, "/")+"/")
+}
+
+// readAt reads a file through what was read ahead of it, reading ahead again when the read
+// continues the last one.
+func (r *readAheadFS) readAt(name string, f io.ReaderAt, p []byte, off int64) (int, error) {
+	ra, ok := r.files.Get(name)
+	if !ok {
+		ra = &readAhead{next: -1}
+		if prev, found, _ := r.files.PeekOrAdd(name, ra); found {
+			ra = prev
+		}
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if n, ok, err := ra.serve(p, off); ok {
+		return n, err
+	}
+	if off != ra.next {
+		// a read elsewhere in the file ends the sequence.
+		ra.buf, ra.eof = nil, false
+		n, err := f.ReadAt(p, off)
+		ra.next = off + int64(n)
+		return n, err
+	}
+
+	buf := make([]byte, len(p)+r.window)
+	n, err := f.ReadAt(buf, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		ra.buf, ra.eof = nil, false
+		return 0, err
+	}
+	ra.offset, ra.buf, ra.eof = off, buf[:n], err != nil
+	n, _, err = ra.serve(p, off)
+	return n, err
+}
+
+// serve answers a read from what was read ahead, if it holds the bytes read.
+func (ra *readAhead) serve(p []byte, off int64) (int, bool, error) {
+	if ra.buf == nil || off < ra.offset || off > ra.offset+int64(len(ra.buf)) {
+		return 0, false, nil
+	}
+	n := copy(p, ra.buf[off-ra.offset:])
+	if n < len(p) && !ra.eof {
+		return 0, false, nil
+	}
+	ra.next = off + int64(n)
+	if n < len(p) {
+		return n, true, io.EOF
+	}
+	return n, true, nil
+}
+
+// readAheadFile is a file of a readAheadFS. Reads at an offset go through the read ahead
+// of the file, and writes drop it.
+type readAheadFile struct {
+	billy.File
+	fs   *readAheadFS
+	name string
+}
+
+func (f *readAheadFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.fs.readAt(f.name, f.File, p, off)
+}
+
+func (f *readAheadFile) Write(p []byte) (int, error) {
+	defer f.fs.files.Remove(f.name)
+	return f.File.Write(p)
+}
+
+func (f *readAheadFile) Truncate(size int64) error {
+	defer f.fs.files.Remove(f.name)
+	return f.File.Truncate(size)
+}
@@ -0,0 +1,185 @@
+package helpers_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// slowFS counts the reads of its files, each of which takes delay.
+type slowFS struct {
+	billy.Filesystem
+	delay time.Duration
+	reads int64
+}
+
+func (s *slowFS) Open(filename string) (billy.File, error) {
+	return s.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (s *slowFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := s.Filesystem.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &slowFile{f, s}, nil
+}
+
+type slowFile struct {
+	billy.File
+	fs *slowFS
+}
+
+func (f *slowFile) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt64(&f.fs.reads, 1)
+	time.Sleep(f.fs.delay)
+	return f.File.ReadAt(p, off)
+}
+
+func readAheadFixture(t testing.TB, window int) (*slowFS, billy.Filesystem, []byte) {
+	contents := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(contents)
+	backend := &slowFS{Filesystem: memfs.New()}
+	if err := util.WriteFile(backend, "/file", contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := helpers.NewReadAheadHandler(helpers.NewCachingHandler(helpers.NewNullAuthHandler(backend), 1024), window)
+	status, fs, _ := handler.Mount(context.Background(), nil, nfs.MountRequest{})
+	if status != nfs.MountStatusOk {
+		t.Fatalf("mount failed: %v", status)
+	}
+	return backend, fs, contents
+}
+
+// readChunk reads as a READ of the server does, opening the file for each.
+func readChunk(t testing.TB, fs billy.Filesystem, off int64, n int) []byte {
+	f, err := fs.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, n)
+	cnt, err := f.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return buf[:cnt]
+}
+
+func TestReadAheadHandler(t *testing.T) {
+	backend, fs, contents := readAheadFixture(t, 64<<10)
+
+	const chunk = 4096
+	for off := 0; off < len(contents); off += chunk {
+		if got := readChunk(t, fs, int64(off), chunk); !bytes.Equal(got, contents[off:off+chunk]) {
+			t.Fatalf("read at %d did not match the file", off)
+		}
+	}
+	if reads := atomic.LoadInt64(&backend.reads); reads > 20 {
+		t.Fatalf("%d sequential reads of the file took %d reads of the backend", len(contents)/chunk, reads)
+	}
+	if got := readChunk(t, fs, int64(len(contents)-10), chunk); !bytes.Equal(got, contents[len(contents)-10:]) {
+		t.Fatal("read at the end of the file did not match it")
+	}
+
+	// a read elsewhere in the file goes to the backend, and drops what was read ahead.
+	readChunk(t, fs, 0, chunk)
+	readChunk(t, fs, chunk, chunk)
+	before := atomic.LoadInt64(&backend.reads)
+	if got := readChunk(t, fs, 512<<10, chunk); !bytes.Equal(got, contents[512<<10:512<<10+chunk]) {
+		t.Fatal("read after seeking did not match the file")
+	}
+	if got := readChunk(t, fs, 2*chunk, chunk); !bytes.Equal(got, contents[2*chunk:3*chunk]) {
+		t.Fatal("read after seeking back did not match the file")
+	}
+	if reads := atomic.LoadInt64(&backend.reads) - before; reads != 2 {
+		t.Fatalf("expected reads away from the sequence to reach the backend, got %d reads", reads)
+	}
+
+	// writes to the file are seen by later reads.
+	readChunk(t, fs, 3*chunk, chunk)
+	f, err := fs.OpenFile("/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(5*chunk, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if got := readChunk(t, fs, 5*chunk, 7); string(got) != "changed" {
+		t.Fatalf("read %q after writing the file", got)
+	}
+}
+
+// BenchmarkReadAhead reads a file from a slow backend in small sequential READs, with and
+// without reading ahead, reporting how many reads of the backend each pass takes.
+func BenchmarkReadAhead(b *testing.B) {
+	for _, bm := range []struct {
+		name   string
+		window int
+	}{{"direct", 0}, {"readahead", 256 << 10}} {
+		b.Run(bm.name, func(b *testing.B) {
+			contents := make([]byte, 1<<20)
+			backend := &slowFS{Filesystem: memfs.New(), delay: 200 * time.Microsecond}
+			if err := util.WriteFile(backend, "/file", contents, 0644); err != nil {
+				b.Fatal(err)
+			}
+			handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(backend), 1024)
+			if bm.window > 0 {
+				handler = helpers.NewReadAheadHandler(handler, bm.window)
+			}
+			listener, err := net.Listen("tcp", "localhost:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			go func() {
+				_ = nfs.Serve(listener, handler)
+			}()
+			defer listener.Close()
+
+			c, err := rpc.DialTCP("tcp", nil, listener.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			mounter := nfsc.Mount{Client: c}
+			target, err := mounter.Mount("/", rpc.AuthNull)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			buf := make([]byte, 8192)
+			b.SetBytes(int64(len(contents)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f, err := target.Open("/file")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.CopyBuffer(io.Discard, struct{ io.Reader }{f}, buf); err != nil {
+					b.Fatal(err)
+				}
+				_ = f.Close()
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&backend.reads))/float64(b.N), "backend-reads/op")
+		})
+	}
+}
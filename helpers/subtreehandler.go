@@ -0,0 +1,166 @@
+package helpers
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs"
+)
+
+// NewSubtreeHandler exports the directory at `root` of the filesystems mounted through `h`,
+// rather than their whole tree. Clients see the subtree as the root of the export, and its
+// files are given the handles `h` mints for them at their full paths, so that only handles
+// below `root` are honored. The subtree is presented through billy's Chroot, and symbolic
+// links within it are followed by the filesystem as they would be without the subtree.
+func NewSubtreeHandler(h nfs.Handler, root []string) *SubtreeHandler {
+	return &SubtreeHandler{
+		Handler: h,
+		root:    append([]string{}, root...),
+		subs:    make(map[billy.Filesystem]billy.Filesystem),
+		bases:   make(map[billy.Filesystem]billy.Filesystem),
+	}
+}
+
+// SubtreeHandler is a Handler limiting the exports of another to a subtree of their filesystems.
+type SubtreeHandler struct {
+	nfs.Handler
+	root []string
+
+	// mu guards the subtrees presented for each filesystem, and the reverse mapping.
+	mu    sync.Mutex
+	subs  map[billy.Filesystem]billy.Filesystem
+	bases map[billy.Filesystem]billy.Filesystem
+}
+
+// Mount backs Mount RPC Requests, answering with the subtree of the mounted filesystem.
+func (s *SubtreeHandler) Mount(ctx context.Context, conn net.Conn, req nfs.MountRequest) (nfs.MountStatus, billy.Filesystem, []nfs.AuthFlavor) {
+	status, base, auths := s.Handler.Mount(ctx, conn, req)
+	if status != nfs.MountStatusOk {
+		return status, base, auths
+	}
+	if info, err := base.Stat(base.Join(s.root...)); err != nil || !info.IsDir() {
+		return nfs.MountStatusErrNoEnt, nil, nil
+	}
+	sub, err := s.subtreeOf(base)
+	if err != nil {
+		return nfs.MountStatusErrServerFault, nil, nil
+	}
+	return status, sub, auths
+}
+
+// subtreeOf presents the subtree of a filesystem, as the same billy.Filesystem each time.
+func (s *SubtreeHandler) subtreeOf(base billy.Filesystem) (billy.Filesystem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sub, ok := s.subs[base]; ok {
+		return sub, nil
+	}
+	sub, err := base.Chroot(base.Join(s.root...))
+	if err != nil {
+		return nil, err
+	}
+	s.subs[base] = sub
+	s.bases[sub] = base
+	return sub, nil
+}
+
+// baseOf is the filesystem a subtree was presented for.
+func (s *SubtreeHandler) baseOf(sub billy.Filesystem) (billy.Filesystem, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	base, ok := s.bases[sub]
+	return base, ok
+}
+
+// fullPath is the path in the whole filesystem of a path within the subtree.
+func (s *SubtreeHandler) fullPath(path []string) []string {
+	full := make([]string, 0, len(s.root)+len(path))
+	full = append(full, s.root...)
+	return append(full, path...)
+}
+
+// Change provides an interface for updating file attributes, addressing files within the subtree.
+func (s *SubtreeHandler) Change(fs billy.Filesystem) billy.Change {
+	base, ok := s.baseOf(fs)
+	if !ok {
+		return s.Handler.Change(fs)
+	}
+	c := s.Handler.Change(base)
+	if c == nil {
+		return nil
+	}
+	return &subtreeChange{c, base, base.Join(s.root...)}
+}
+
+// FSStat provides information about the filesystem the subtree is part of.
+func (s *SubtreeHandler) FSStat(ctx context.Context, fs billy.Filesystem, stat *nfs.FSStat) error {
+	if base, ok := s.baseOf(fs); ok {
+		fs = base
+	}
+	return s.Handler.FSStat(ctx, fs, stat)
+}
+
+// ToHandle mints the handle of a file within the subtree as that of its full path.
+func (s *SubtreeHandler) ToHandle(fs billy.Filesystem, path []string) []byte {
+	base, ok := s.baseOf(fs)
+	if !ok {
+		return s.Handler.ToHandle(fs, path)
+	}
+	return s.Handler.ToHandle(base, s.fullPath(path))
+}
+
+// FromHandle resolves a handle to a file within the subtree. Handles to files outside of
+// it, such as those minted for another export of the same filesystem, are reported as stale.
+func (s *SubtreeHandler) FromHandle(fh []byte) (billy.Filesystem, []string, error) {
+	base, path, err := s.Handler.FromHandle(fh)
+	if err != nil {
+		return nil, []string{}, err
+	}
+	s.mu.Lock()
+	sub, ok := s.subs[base]
+	s.mu.Unlock()
+	if !ok || !hasPrefix(path, s.root) {
+		return nil, []string{}, nfs.Errorf(nfs.NFSStatusStale, "handle is outside of the exported subtree")
+	}
+	return sub, append([]string{}, path[len(s.root):]...), nil
+}
+
+// RenameHandles lets the wrapped handler follow files renamed within the subtree.
+func (s *SubtreeHandler) RenameHandles(fs billy.Filesystem, from, to []string) {
+	renamer, ok := s.Handler.(nfs.HandleRenamer)
+	if !ok {
+		return
+	}
+	if base, ok := s.baseOf(fs); ok {
+		renamer.RenameHandles(base, s.fullPath(from), s.fullPath(to))
+		return
+	}
+	renamer.RenameHandles(fs, from, to)
+}
+
+// subtreeChange updates the attributes of files named by their path within a subtree.
+type subtreeChange struct {
+	billy.Change
+	base billy.Filesystem
+	root string
+}
+
+func (c *subtreeChange) Chmod(name string, mode os.FileMode) error {
+	return c.Change.Chmod(c.base.Join(c.root, name), mode)
+}
+
+func (c *subtreeChange) Lchown(name string, uid, gid int) error {
+	return c.Change.Lchown(c.base.Join(c.root, name), uid, gid)
+}
+
+func (c *subtreeChange) Chown(name string, uid, gid int) error {
+	return c.Change.Chown(c.base.Join(c.root, name), uid, gid)
+}
+
+func (c *subtreeChange) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return c.Change.Chtimes(c.base.Join(c.root, name), atime, mtime)
+}
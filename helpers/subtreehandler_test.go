@@ -0,0 +1,125 @@
+package helpers_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestSubtreeHandler(t *testing.T) {
+	mem := memfs.New()
+	for p, contents := range map[string]string{"/secret": "secret", "/export/pub/file": "public"} {
+		if err := util.WriteFile(mem, p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inner := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)
+	handler := helpers.NewSubtreeHandler(inner, []string{"export"})
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = nfs.Serve(listener, handler)
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+
+	c, err := rpc.DialTCP("tcp", nil, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	mounter := nfsc.Mount{Client: c}
+	target, err := mounter.Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := target.Open("/pub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "public" {
+		t.Fatalf("read %q from the subtree", contents)
+	}
+
+	lookup := func(dir []byte, name string) (nfs.NFSStatus, []byte) {
+		t.Helper()
+		type lookupArgs struct {
+			rpc.Header
+			Dir  []byte
+			Name string
+		}
+		res, err := target.Call(&lookupArgs{
+			Header: rpc.Header{
+				Rpcvers: 2,
+				Prog:    nfsc.Nfs3Prog,
+				Vers:    nfsc.Nfs3Vers,
+				Proc:    uint32(nfs.NFSProcedureLookup),
+				Cred:    rpc.AuthNull,
+				Verf:    rpc.AuthNull,
+			},
+			Dir:  dir,
+			Name: name,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := xdr.ReadUint32(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != uint32(nfs.NFSStatusOk) {
+			return nfs.NFSStatus(status), nil
+		}
+		fh, err := xdr.ReadOpaque(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nfs.NFSStatusOk, fh
+	}
+
+	// climbing out of the subtree stops at its root.
+	_, pub, err := target.Lookup("/pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, root := lookup(pub, "..")
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("looking up the parent of /pub failed: %v", status)
+	}
+	// the parent of the subtree root is the root itself.
+	status, above := lookup(root, "..")
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("looking up the parent of the subtree root failed: %v", status)
+	}
+	if status, _ := lookup(above, "secret"); status != nfs.NFSStatusNoEnt {
+		t.Fatalf("the parent of the subtree root left the subtree: %v", status)
+	}
+	if status, _ := lookup(root, "../secret"); status == nfs.NFSStatusOk {
+		t.Fatal("looked up a file above the subtree")
+	}
+	if status, _ := lookup(root, "secret"); status != nfs.NFSStatusNoEnt {
+		t.Fatalf("expected NOENT looking up a file above the subtree by name, got %v", status)
+	}
+
+	// handles minted for files outside the subtree are not honored through it.
+	outside := inner.ToHandle(mem, []string{"secret"})
+	if _, _, err := handler.FromHandle(outside); err == nil {
+		t.Fatal("resolved a handle outside of the subtree")
+	}
+}
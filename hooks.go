@@ -0,0 +1,96 @@
+package nfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// MetricsHook observes the procedures dispatched by the server, such as to export metrics.
+type MetricsHook interface {
+	// ObserveProcedure is called as each request is answered, with the procedure it called,
+	// such as "nfs.GetAttr", the NFS status of the reply and the time taken to handle it.
+	ObserveProcedure(procedure string, status NFSStatus, elapsed time.Duration)
+}
+
+// SpanHook traces the procedures dispatched by the server, such as with the OpenTelemetry
+// adapter of the tracing package.
+type SpanHook interface {
+	// StartSpan is called as each request is dispatched, with the procedure it calls, its
+	// xid and the size of its arguments. The request is handled with the returned context,
+	// and the returned func is called once it is done.
+	StartSpan(ctx context.Context, procedure string, xid uint32, requestBytes int64) (context.Context, EndSpan)
+}
+
+// EndSpan ends the span of a request. If the request was answered, `replied` is set,
+// with the NFS status and size of the reply; requests that are dropped, such as
+// retransmissions of those still being handled, end without a reply.
+type EndSpan func(replied bool, status NFSStatus, responseBytes int)
+
+// procedureName names the procedure called by a request, qualified by its program.
+func (r *request) procedureName() string {
+	switch r.Header.Prog {
+	case nfsServiceID:
+		return "nfs." + NFSProcedure(r.Header.Proc).String()
+	case mountServiceID:
+		return "mount." + MountProcedure(r.Header.Proc).String()
+	}
+	return fmt.Sprintf("%d.%d", r.Header.Prog, r.Header.Proc)
+}
+
+// replyStatus is the NFS status a request was answered with. Replies that carry no NFS
+// status are reported as NFSStatusOk if they were successful, and NFSStatusServerFault
+// otherwise, unless the request failed with an NFSStatusError.
+func (w *response) replyStatus() NFSStatus {
+	// an accepted reply has its results after the xid, message type, reply status,
+	// verifier and accept status.
+	reply := w.writer.Bytes()
+	results := w.resultsAt
+	if results == 0 {
+		// replies replayed from the reply cache carry a null verifier.
+		results = 24
+	}
+	accepted := len(reply) >= results &&
+		binary.BigEndian.Uint32(reply[8:]) == rpc.MsgAccepted &&
+		binary.BigEndian.Uint32(reply[results-4:]) == uint32(ResponseCodeSuccess)
+	if w.sealed {
+		// sealed results follow their length and sequence number.
+		results += 8
+	}
+	if accepted && w.req.Header.Prog == nfsServiceID && w.req.Header.Proc != uint32(NFSProcedureNull) && len(reply) >= results+4 {
+		return NFSStatus(binary.BigEndian.Uint32(reply[results:]))
+	}
+	var statusErr *NFSStatusError
+	if errors.As(w.err, &statusErr) {
+		return statusErr.NFSStatus
+	}
+	if accepted {
+		return NFSStatusOk
+	}
+	return NFSStatusServerFault
+}
+
+// startSpan starts the span of a request when the server has a Tracer. The span is ended,
+// with the outcome of the request, by the returned func.
+func (c *conn) startSpan(ctx context.Context, w *response) (context.Context, func()) {
+	if c.Server.Tracer == nil {
+		return ctx, func() {}
+	}
+	var argBytes int64
+	if body, ok := w.req.Body.(*io.LimitedReader); ok {
+		argBytes = body.N
+	}
+	ctx, end := c.Server.Tracer.StartSpan(ctx, w.req.procedureName(), w.req.xid, argBytes)
+	return ctx, func() {
+		if w.responded && !w.discard {
+			end(true, w.replyStatus(), w.writer.Len()+w.data.size())
+			return
+		}
+		end(false, NFSStatusOk, 0)
+	}
+}
@@ -0,0 +1,84 @@
+package nfs_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// recordingSpanHook records the spans it is asked to start, as they end.
+type recordingSpanHook struct {
+	mu    sync.Mutex
+	ended map[string]nfs.NFSStatus
+}
+
+func (r *recordingSpanHook) StartSpan(ctx context.Context, procedure string, xid uint32, requestBytes int64) (context.Context, nfs.EndSpan) {
+	return ctx, func(replied bool, status nfs.NFSStatus, responseBytes int) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if replied && responseBytes > 0 {
+			r.ended[procedure] = status
+		}
+	}
+}
+
+func TestTracerEndsSpans(t *testing.T) {
+	_, handler := newMemHandler(t)
+	hook := &recordingSpanHook{ended: make(map[string]nfs.NFSStatus)}
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler, Tracer: hook})), rpc.AuthNull)
+	if _, _, err := target.Lookup("/missing"); err == nil {
+		t.Fatal("lookup of a missing file succeeded")
+	}
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if status, ok := hook.ended["nfs.Lookup"]; !ok || status != nfs.NFSStatusNoEnt {
+		t.Fatalf("lookup span ended with %v, recorded: %v", status, ok)
+	}
+}
+
+func TestOnRequestObservesLookup(t *testing.T) {
+	_, handler := newMemHandler(t)
+	var mu sync.Mutex
+	var lookups []nfs.RequestInfo
+	srv := &nfs.Server{Handler: handler, OnRequest: func(info nfs.RequestInfo) {
+		if info.Procedure == "nfs.Lookup" {
+			mu.Lock()
+			defer mu.Unlock()
+			lookups = append(lookups, info)
+		}
+	}}
+	target := mountServer(t, dialServer(t, startServer(t, srv)), rpc.AuthNull)
+	if _, _, err := target.Lookup("/test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := target.Lookup("/missing"); err == nil {
+		t.Fatal("lookup of a missing file succeeded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lookups) != 2 {
+		t.Fatalf("observed %d lookups, expected 2", len(lookups))
+	}
+	for i, expected := range []struct {
+		name   string
+		status nfs.NFSStatus
+	}{{"test", nfs.NFSStatusOk}, {"missing", nfs.NFSStatusNoEnt}} {
+		info := lookups[i]
+		if info.Status != expected.status {
+			t.Fatalf("lookup of %s was observed with status %v", expected.name, info.Status)
+		}
+		if !strings.Contains(info.Args, `name="`+expected.name+`"`) {
+			t.Fatalf("lookup of %s was observed with arguments %s", expected.name, info.Args)
+		}
+		if info.ClientAddr == nil {
+			t.Fatalf("lookup of %s was observed without a client address", expected.name)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Package metrics exports the procedures handled by an nfs.Server as prometheus metrics.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/willscott/go-nfs"
+)
+
+// Collector counts and times the procedures handled by a server. It is set as the
+// Metrics of an nfs.Server, and registered with a prometheus.Registerer.
+type Collector struct {
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+// NewCollector creates a Collector with metrics named under `namespace`, such as "nfs".
+func NewCollector(namespace string) *Collector {
+	return &Collector{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Requests handled, by procedure.",
+		}, []string{"procedure"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_total",
+			Help:      "Requests answered with an error, by procedure and NFS status.",
+		}, []string{"procedure", "status"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to handle requests, by procedure.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"procedure"}),
+	}
+}
+
+// ObserveProcedure records a handled request.
+func (c *Collector) ObserveProcedure(procedure string, status nfs.NFSStatus, elapsed time.Duration) {
+	c.requests.WithLabelValues(procedure).Inc()
+	if status != nfs.NFSStatusOk {
+		c.errors.WithLabelValues(procedure, statusLabel(status)).Inc()
+	}
+	c.latency.WithLabelValues(procedure).Observe(elapsed.Seconds())
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.requests.Describe(ch)
+	c.errors.Describe(ch)
+	c.latency.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.requests.Collect(ch)
+	c.errors.Collect(ch)
+	c.latency.Collect(ch)
+}
+
+var statusLabels = map[nfs.NFSStatus]string{
+	nfs.NFSStatusOk:          "Ok",
+	nfs.NFSStatusPerm:        "Perm",
+	nfs.NFSStatusNoEnt:       "NoEnt",
+	nfs.NFSStatusIO:          "IO",
+	nfs.NFSStatusNXIO:        "NXIO",
+	nfs.NFSStatusAccess:      "Access",
+	nfs.NFSStatusExist:       "Exist",
+	nfs.NFSStatusXDev:        "XDev",
+	nfs.NFSStatusNoDev:       "NoDev",
+	nfs.NFSStatusNotDir:      "NotDir",
+	nfs.NFSStatusIsDir:       "IsDir",
+	nfs.NFSStatusInval:       "Inval",
+	nfs.NFSStatusFBig:        "FBig",
+	nfs.NFSStatusNoSPC:       "NoSPC",
+	nfs.NFSStatusROFS:        "ROFS",
+	nfs.NFSStatusMlink:       "Mlink",
+	nfs.NFSStatusNameTooLong: "NameTooLong",
+	nfs.NFSStatusNotEmpty:    "NotEmpty",
+	nfs.NFSStatusDQuot:       "DQuot",
+	nfs.NFSStatusStale:       "Stale",
+	nfs.NFSStatusRemote:      "Remote",
+	nfs.NFSStatusBadHandle:   "BadHandle",
+	nfs.NFSStatusNotSync:     "NotSync",
+	nfs.NFSStatusBadCookie:   "BadCookie",
+	nfs.NFSStatusNotSupp:     "NotSupp",
+	nfs.NFSStatusTooSmall:    "TooSmall",
+	nfs.NFSStatusServerFault: "ServerFault",
+	nfs.NFSStatusBadType:     "BadType",
+	nfs.NFSStatusJukebox:     "Jukebox",
+}
+
+// statusLabel names a status as its NFSStatus constant is named.
+func statusLabel(status nfs.NFSStatus) string {
+	if label, ok := statusLabels[status]; ok {
+		return label
+	}
+	return strconv.FormatUint(uint64(status), 10)
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestCollectorCountsGetAttr(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/test")
+	collector := NewCollector("nfs")
+	if err := prometheus.NewRegistry().Register(collector); err != nil {
+		t.Fatal(err)
+	}
+	srv := &nfs.Server{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		Metrics: collector,
+	}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	c, err := rpc.DialTCP("tcp", nil, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	mounter := nfsc.Mount{Client: c}
+	target, err := mounter.Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getattrs := collector.requests.WithLabelValues("nfs.GetAttr")
+	before := testutil.ToFloat64(getattrs)
+	if _, err := target.Getattr("/test"); err != nil {
+		t.Fatal(err)
+	}
+	if after := testutil.ToFloat64(getattrs); after != before+1 {
+		t.Fatalf("GetAttr count went from %v to %v", before, after)
+	}
+	if n := testutil.CollectAndCount(collector, "nfs_request_duration_seconds"); n == 0 {
+		t.Fatal("no latencies were recorded")
+	}
+}
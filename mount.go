@@ -14,7 +14,10 @@ const (
 func init() {
 	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcNull), onMountNull)
 	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcMount), onMount)
+	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcDump), onDump)
 	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcUmnt), onUMount)
+	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcUmntAll), onUMountAll)
+	_ = RegisterMessageHandler(mountServiceID, uint32(MountProcExport), onExport)
 }
 
 func onMountNull(ctx context.Context, w *response, userHandle Handler) error {
@@ -23,12 +26,23 @@ func onMountNull(ctx context.Context, w *response, userHandle Handler) error {
 
 func onMount(ctx context.Context, w *response, userHandle Handler) error {
 	// TODO: auth check.
-	dirpath, err := xdr.ReadOpaque(w.req.Body)
+	dirpath, err := readOpaque(w.req.Body)
 	if err != nil {
-		return err
+		return errGarbageArgs(err)
 	}
 	mountReq := MountRequest{Header: w.req.Header, Dirpath: dirpath}
 	status, handle, flavors := userHandle.Mount(ctx, w.conn, mountReq)
+	if required := w.Server.Export.RequiredAuthFlavors; len(required) > 0 {
+		flavors = required
+	}
+
+	var rootHndl []byte
+	if status == MountStatusOk {
+		// a handler with no room for the handle of the root cannot serve the mount.
+		if rootHndl = userHandle.ToHandle(handle, []string{}); len(rootHndl) == 0 {
+			status = MountStatusErrServerFault
+		}
+	}
 
 	if err := w.writeHeader(ResponseCodeSuccess); err != nil {
 		return err
@@ -39,20 +53,98 @@ func onMount(ctx context.Context, w *response, userHandle Handler) error {
 		return err
 	}
 
-	rootHndl := userHandle.ToHandle(handle, []string{})
-
 	if status == MountStatusOk {
 		_ = xdr.Write(writer, rootHndl)
 		_ = xdr.Write(writer, flavors)
+		if export, ok := exportOf(w.Server, string(dirpath)); ok {
+			w.Server.mounts.add(MountEntry{clientHost(w.conn.RemoteAddr()), export})
+		}
+	}
+	return w.Write(writer.Bytes())
+}
+
+func onDump(ctx context.Context, w *response, userHandle Handler) error {
+	writer := bytes.NewBuffer([]byte{})
+	// the mount list is an xdr linked list, terminated by an absent entry.
+	for _, m := range w.Server.ActiveMounts() {
+		if err := xdr.Write(writer, uint32(1)); err != nil {
+			return err
+		}
+		if err := xdr.Write(writer, m.Hostname); err != nil {
+			return err
+		}
+		if err := xdr.Write(writer, m.Directory); err != nil {
+			return err
+		}
+	}
+	if err := xdr.Write(writer, uint32(0)); err != nil {
+		return err
 	}
 	return w.Write(writer.Bytes())
 }
 
 func onUMount(ctx context.Context, w *response, userHandle Handler) error {
-	_, err := xdr.ReadOpaque(w.req.Body)
+	dirpath, err := readOpaque(w.req.Body)
 	if err != nil {
-		return err
+		return errGarbageArgs(err)
+	}
+	if export, ok := exportOf(w.Server, string(dirpath)); ok {
+		w.Server.mounts.remove(MountEntry{clientHost(w.conn.RemoteAddr()), export})
 	}
 
 	return w.writeHeader(ResponseCodeSuccess)
 }
+
+func onUMountAll(ctx context.Context, w *response, userHandle Handler) error {
+	w.Server.mounts.removeHost(clientHost(w.conn.RemoteAddr()))
+	return w.writeHeader(ResponseCodeSuccess)
+}
+
+// exportsOf lists the exports of a server. Handlers that are not ExportListers
+// serve a single export at the root. Exports without their own groups are
+// restricted to the server's allowed networks.
+func exportsOf(s *Server) []ExportEntry {
+	exports := []ExportEntry{{Dir: "/"}}
+	if lister, ok := s.Handler.(ExportLister); ok {
+		exports = append([]ExportEntry(nil), lister.Exports()...)
+	}
+	var networks []string
+	for _, n := range s.Export.AllowedCIDRs {
+		networks = append(networks, n.String())
+	}
+	for i := range exports {
+		if len(exports[i].Groups) == 0 {
+			exports[i].Groups = networks
+		}
+	}
+	return exports
+}
+
+func onExport(ctx context.Context, w *response, userHandle Handler) error {
+	writer := bytes.NewBuffer([]byte{})
+	// exports and groups are both xdr linked lists: each entry is preceded by
+	// a 'present' flag, and the list is terminated by an absent one.
+	for _, e := range exportsOf(w.Server) {
+		if err := xdr.Write(writer, uint32(1)); err != nil {
+			return err
+		}
+		if err := xdr.Write(writer, e.Dir); err != nil {
+			return err
+		}
+		for _, g := range e.Groups {
+			if err := xdr.Write(writer, uint32(1)); err != nil {
+				return err
+			}
+			if err := xdr.Write(writer, g); err != nil {
+				return err
+			}
+		}
+		if err := xdr.Write(writer, uint32(0)); err != nil {
+			return err
+		}
+	}
+	if err := xdr.Write(writer, uint32(0)); err != nil {
+		return err
+	}
+	return w.Write(writer.Bytes())
+}
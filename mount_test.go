@@ -0,0 +1,242 @@
+package nfs_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+const (
+	mountProg = 100005
+	mountVers = 3
+)
+
+// callMount issues a MOUNT protocol procedure that takes no arguments.
+func callMount(t *testing.T, c *rpc.Client, proc nfs.MountProcedure) io.ReadSeeker {
+	t.Helper()
+	res, err := c.Call(&rpc.Header{
+		Rpcvers: 2,
+		Prog:    mountProg,
+		Vers:    mountVers,
+		Proc:    uint32(proc),
+		Cred:    rpc.AuthNull,
+		Verf:    rpc.AuthNull,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// readString decodes an xdr string, including its padding, which xdr.ReadOpaque does not consume.
+func readString(t *testing.T, r io.Reader) string {
+	t.Helper()
+	var s string
+	if err := xdr.Read(r, &s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// readStringList decodes an xdr linked list of strings.
+func readStringList(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	var list []string
+	for {
+		more, err := xdr.ReadUint32(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if more == 0 {
+			return list
+		}
+		list = append(list, readString(t, r))
+	}
+}
+
+func readExports(t *testing.T, c *rpc.Client) []nfs.ExportEntry {
+	t.Helper()
+	res := callMount(t, c, nfs.MountProcExport)
+	var exports []nfs.ExportEntry
+	for {
+		more, err := xdr.ReadUint32(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if more == 0 {
+			return exports
+		}
+		dir := readString(t, res)
+		exports = append(exports, nfs.ExportEntry{Dir: dir, Groups: readStringList(t, res)})
+	}
+}
+
+func TestExportListsRootExport(t *testing.T) {
+	_, handler := newMemHandler(t)
+	_, network, _ := net.ParseCIDR("127.0.0.0/8")
+	srv := &nfs.Server{Handler: handler, Export: nfs.ExportOptions{AllowedCIDRs: []net.IPNet{*network}}}
+	c := dialServer(t, startServerOn(t, srv, "127.0.0.1:0"))
+
+	expected := []nfs.ExportEntry{{Dir: "/", Groups: []string{"127.0.0.0/8"}}}
+	if exports := readExports(t, c); !reflect.DeepEqual(exports, expected) {
+		t.Fatalf("unexpected exports %+v", exports)
+	}
+}
+
+// listingHandler serves several exports.
+type listingHandler struct {
+	nfs.Handler
+	exports []nfs.ExportEntry
+}
+
+func (h *listingHandler) Exports() []nfs.ExportEntry {
+	return h.exports
+}
+
+func TestExportListsHandlerExports(t *testing.T) {
+	_, handler := newMemHandler(t)
+	exports := []nfs.ExportEntry{
+		{Dir: "/srv/public"},
+		{Dir: "/srv/private", Groups: []string{"trusted.example", "10.0.0.0/8"}},
+	}
+	c := dialServer(t, startServer(t, &nfs.Server{Handler: &listingHandler{handler, exports}}))
+
+	if listed := readExports(t, c); !reflect.DeepEqual(listed, exports) {
+		t.Fatalf("unexpected exports %+v", listed)
+	}
+}
+
+func readMountList(t *testing.T, c *rpc.Client) []nfs.MountEntry {
+	t.Helper()
+	res := callMount(t, c, nfs.MountProcDump)
+	var mounts []nfs.MountEntry
+	for {
+		more, err := xdr.ReadUint32(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if more == 0 {
+			return mounts
+		}
+		host := readString(t, res)
+		mounts = append(mounts, nfs.MountEntry{Hostname: host, Directory: readString(t, res)})
+	}
+}
+
+func TestDumpReportsActiveMounts(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{Handler: handler}
+	c := dialServer(t, startServerOn(t, srv, "127.0.0.1:0"))
+
+	mounter := nfsc.Mount{Client: c}
+	if _, err := mounter.Mount("/", rpc.AuthNull); err != nil {
+		t.Fatal(err)
+	}
+	expected := []nfs.MountEntry{{Hostname: "127.0.0.1", Directory: "/"}}
+	if mounts := readMountList(t, c); !reflect.DeepEqual(mounts, expected) {
+		t.Fatalf("unexpected mounts %+v", mounts)
+	}
+	if mounts := srv.ActiveMounts(); !reflect.DeepEqual(mounts, expected) {
+		t.Fatalf("unexpected active mounts %+v", mounts)
+	}
+
+	if err := mounter.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	if mounts := readMountList(t, c); len(mounts) != 0 {
+		t.Fatalf("mount still listed after unmount: %+v", mounts)
+	}
+	if mounts := srv.ActiveMounts(); len(mounts) != 0 {
+		t.Fatalf("mount still active after unmount: %+v", mounts)
+	}
+}
+
+func TestUmntRemovesOneMount(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{Handler: &listingHandler{handler, []nfs.ExportEntry{{Dir: "/a"}, {Dir: "/b"}}}}
+	c := dialServer(t, startServerOn(t, srv, "127.0.0.1:0"))
+
+	mounter := nfsc.Mount{Client: c}
+	for _, dir := range []string{"/a", "/b"} {
+		if _, err := mounter.Mount(dir, rpc.AuthNull); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Unmount releases the most recent mount, "/b".
+	if err := mounter.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []nfs.MountEntry{{Hostname: "127.0.0.1", Directory: "/a"}}
+	if mounts := readMountList(t, c); !reflect.DeepEqual(mounts, expected) {
+		t.Fatalf("unexpected mounts %+v", mounts)
+	}
+}
+
+func TestUmntAllRemovesClientMounts(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{Handler: &listingHandler{handler, []nfs.ExportEntry{{Dir: "/a"}, {Dir: "/b"}}}}
+	c := dialServer(t, startServerOn(t, srv, "127.0.0.1:0"))
+
+	mounter := nfsc.Mount{Client: c}
+	for _, dir := range []string{"/a", "/b"} {
+		if _, err := mounter.Mount(dir, rpc.AuthNull); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mounts := srv.ActiveMounts(); len(mounts) != 2 {
+		t.Fatalf("expected 2 mounts, have %+v", mounts)
+	}
+	callMount(t, c, nfs.MountProcUmntAll)
+	if mounts := readMountList(t, c); len(mounts) != 0 {
+		t.Fatalf("mounts remain after UMNTALL: %+v", mounts)
+	}
+}
+
+func TestMountsAreRecordedByExport(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{Handler: &listingHandler{handler, []nfs.ExportEntry{{Dir: "/a"}, {Dir: "/a/b"}}}}
+	c := dialServer(t, startServerOn(t, srv, "127.0.0.1:0"))
+
+	mounter := nfsc.Mount{Client: c}
+	// the handler serves every path, but only those within an export are recorded.
+	for _, dir := range []string{"/a/x", "/a/b/../y", "/a/b/c", "/c", "/ab"} {
+		if _, err := mounter.Mount(dir, rpc.AuthNull); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []nfs.MountEntry{
+		{Hostname: "127.0.0.1", Directory: "/a"},
+		{Hostname: "127.0.0.1", Directory: "/a/b"},
+	}
+	if mounts := srv.ActiveMounts(); !reflect.DeepEqual(mounts, expected) {
+		t.Fatalf("unexpected active mounts %+v", mounts)
+	}
+}
+
+func TestMountRegistryIsBounded(t *testing.T) {
+	_, handler := newMemHandler(t)
+	exports := make([]nfs.ExportEntry, nfs.MaxMountEntries+1)
+	for i := range exports {
+		exports[i].Dir = fmt.Sprintf("/%d", i)
+	}
+	srv := &nfs.Server{Handler: &listingHandler{handler, exports}}
+	c := dialServer(t, startServerOn(t, srv, "127.0.0.1:0"))
+
+	mounter := nfsc.Mount{Client: c}
+	for _, e := range exports {
+		if _, err := mounter.Mount(e.Dir, rpc.AuthNull); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(srv.ActiveMounts()); n != nfs.MaxMountEntries {
+		t.Fatalf("%d mounts are recorded, expected the limit of %d", n, nfs.MaxMountEntries)
+	}
+}
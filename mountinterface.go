@@ -74,6 +74,8 @@ const (
 	AuthFlavorUnix  AuthFlavor = 1
 	AuthFlavorShort AuthFlavor = 2
 	AuthFlavorDES   AuthFlavor = 3
+	// AuthFlavorRPCSECGSS is RPCSEC_GSS, per rfc2203, as answered when Server.GSS is set.
+	AuthFlavorRPCSECGSS AuthFlavor = 6
 )
 
 // MountRequest contains the format of a client request to open a mount.
@@ -82,6 +84,14 @@ type MountRequest struct {
 	Dirpath []byte
 }
 
+// ExportEntry describes a directory offered to clients, as listed by the MOUNT EXPORT procedure.
+type ExportEntry struct {
+	// Dir is the path clients mount.
+	Dir string
+	// Groups names the clients allowed to mount Dir. An empty list means any client.
+	Groups []string
+}
+
 // MountResponse is the server's response with status `MountStatusOk`
 type MountResponse struct {
 	rpc.Header
@@ -0,0 +1,101 @@
+package nfs
+
+import (
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxMountEntries bounds the mounts tracked for the MOUNT DUMP procedure. Mounts beyond it
+// are served but not listed.
+const maxMountEntries = 1024
+
+// MountEntry is a directory mounted by a client, as reported by the MOUNT DUMP procedure.
+type MountEntry struct {
+	// Hostname is the address of the client.
+	Hostname string
+	// Directory is the export the client mounted.
+	Directory string
+}
+
+// mountRegistry tracks the exports clients currently hold mounted.
+type mountRegistry struct {
+	mu     sync.Mutex
+	mounts map[MountEntry]struct{}
+}
+
+func (r *mountRegistry) add(e MountEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mounts == nil {
+		r.mounts = make(map[MountEntry]struct{})
+	}
+	if _, ok := r.mounts[e]; !ok && len(r.mounts) >= maxMountEntries {
+		return
+	}
+	r.mounts[e] = struct{}{}
+}
+
+func (r *mountRegistry) remove(e MountEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.mounts, e)
+}
+
+// removeHost removes every mount held by `host`.
+func (r *mountRegistry) removeHost(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for e := range r.mounts {
+		if e.Hostname == host {
+			delete(r.mounts, e)
+		}
+	}
+}
+
+// list returns the registered mounts, ordered by host and then directory.
+func (r *mountRegistry) list() []MountEntry {
+	r.mu.Lock()
+	entries := make([]MountEntry, 0, len(r.mounts))
+	for e := range r.mounts {
+		entries = append(entries, e)
+	}
+	r.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Hostname != entries[j].Hostname {
+			return entries[i].Hostname < entries[j].Hostname
+		}
+		return entries[i].Directory < entries[j].Directory
+	})
+	return entries
+}
+
+// clientHost identifies the client at `addr` for the mount registry and reply cache. Clients
+// may reconnect from a different port, so only the host is used.
+func clientHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// exportOf resolves the directory a client mounts to the export serving it: the export
+// whose path is the longest prefix of `dir`. The mount registry is keyed by export, so that
+// clients cannot grow it with paths of their choosing.
+func exportOf(s *Server, dir string) (string, bool) {
+	dir = path.Clean("/" + dir)
+	best, found := "", false
+	for _, e := range exportsOf(s) {
+		root := path.Clean("/" + e.Dir)
+		if dir != root && root != "/" && !strings.HasPrefix(dir, root+"/") {
+			continue
+		}
+		if !found || len(root) > len(best) {
+			best, found = root, true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,44 @@
+package nfs
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// checkName validates the name of an entry a client creates, removes or renames. Names
+// longer than the filesystem allows are refused with NFSStatusNameTooLong, and those that
+// are not a single path component, or that name the directory itself or its parent, with
+// NFSStatusInval.
+func checkName(fs billy.Filesystem, name []byte) error {
+	if err := checkNameLength(fs, name); err != nil {
+		return err
+	}
+	if string(name) == "." || string(name) == ".." {
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+	return checkComponent(name)
+}
+
+// checkNameLength refuses a name longer than the filesystem allows with NFSStatusNameTooLong,
+// before the name reaches the filesystem.
+func checkNameLength(fs billy.Filesystem, name []byte) error {
+	nameMax := pathConf(fs).NameMax
+	if nameMax == 0 {
+		nameMax = PathNameMax
+	}
+	if len(name) > int(nameMax) {
+		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
+	}
+	return nil
+}
+
+// checkComponent refuses a name that is empty, or that would be joined into a path as more
+// than one component, with NFSStatusInval.
+func checkComponent(name []byte) error {
+	if len(name) == 0 || bytes.IndexByte(name, '/') >= 0 || bytes.IndexByte(name, 0) >= 0 {
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+	return nil
+}
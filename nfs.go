@@ -31,6 +31,42 @@ func init() {
 	_ = RegisterMessageHandler(nfsServiceID, uint32(NFSProcedureFSInfo), onFSInfo)           // 19
 	_ = RegisterMessageHandler(nfsServiceID, uint32(NFSProcedurePathConf), onPathConf)       // 20
 	_ = RegisterMessageHandler(nfsServiceID, uint32(NFSProcedureCommit), onCommit)           // 21
+	_ = RegisterMessageHandler(nfsServiceID, uint32(NFSProcedureGetXattr), onGetXattr)       // 22
+	_ = RegisterMessageHandler(nfsServiceID, uint32(NFSProcedureSetXattr), onSetXattr)       // 23
+	_ = RegisterMessageHandler(nfsServiceID, uint32(NFSProcedureListXattrs), onListXattrs)   // 24
+	_ = RegisterMessageHandler(nfsServiceID, uint32(NFSProcedureRemoveXattr), onRemoveXattr) // 25
+}
+
+// nfsErrorFormatter returns the error formatter matching the failure body of an nfs procedure,
+// for errors raised before the procedure's own handler runs.
+func nfsErrorFormatter(proc NFSProcedure) func(err error) RPCError {
+	switch proc {
+	case NFSProcedureLookup, NFSProcedureAccess, NFSProcedureReadlink, NFSProcedureRead,
+		NFSProcedureReadDir, NFSProcedureReadDirPlus, NFSProcedureFSStat, NFSProcedureFSInfo,
+		NFSProcedurePathConf, NFSProcedureGetXattr, NFSProcedureListXattrs:
+		return opAttrErrorFormatter
+	case NFSProcedureSetAttr, NFSProcedureWrite, NFSProcedureCreate, NFSProcedureMkDir,
+		NFSProcedureSymlink, NFSProcedureMkNod, NFSProcedureRemove, NFSProcedureRmDir,
+		NFSProcedureCommit, NFSProcedureSetXattr, NFSProcedureRemoveXattr:
+		return wccDataErrorFormatter
+	case NFSProcedureRename:
+		return errFormatterWithBody(doubleWccErrorBody[:])
+	case NFSProcedureLink:
+		return errFormatterWithBody(linkErrorBody[:])
+	}
+	return basicErrorFormatter
+}
+
+// mutates reports whether the procedure can modify the exported filesystem.
+func (n NFSProcedure) mutates() bool {
+	switch n {
+	case NFSProcedureSetAttr, NFSProcedureWrite, NFSProcedureCreate, NFSProcedureMkDir,
+		NFSProcedureSymlink, NFSProcedureMkNod, NFSProcedureRemove, NFSProcedureRmDir,
+		NFSProcedureRename, NFSProcedureLink, NFSProcedureCommit, NFSProcedureSetXattr,
+		NFSProcedureRemoveXattr:
+		return true
+	}
+	return false
 }
 
 func onNull(ctx context.Context, w *response, userHandle Handler) error {
@@ -3,35 +3,58 @@ package nfs
 import (
 	"bytes"
 	"context"
+	"os"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
+	"github.com/willscott/go-nfs/file"
+)
+
+// Access bits of the ACCESS procedure, per rfc1813 section 3.3.4.
+const (
+	accessRead    = 0x0001
+	accessLookup  = 0x0002
+	accessModify  = 0x0004
+	accessExtend  = 0x0008
+	accessDelete  = 0x0010
+	accessExecute = 0x0020
 )
 
 func onAccess(ctx context.Context, w *response, userHandle Handler) error {
-	roothandle, err := xdr.ReadOpaque(w.req.Body)
+	w.errorFmt = opAttrErrorFormatter
+	roothandle, err := readOpaque(w.req.Body)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
-	fs, path, err := userHandle.FromHandle(roothandle)
+	fs, path, err := fromHandle(ctx, userHandle, roothandle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(path...)); err != nil {
+		return err
 	}
 	mask, err := xdr.ReadUint32(w.req.Body)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	var attrs *FileAttribute
+	if info, err := fs.Stat(fs.Join(path...)); err != nil {
+		Log.Errorf("err loading attrs for %s: %v", fs.Join(path...), err)
+	} else {
+		attrs = w.attributesOf(fs, path, info)
+		mask &= permittedAccess(CredFromContext(ctx), info)
+	}
+	if err := WritePostOpAttrs(writer, attrs); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
-		mask = mask & (1 | 2 | 0x20)
+		mask = mask & (accessRead | accessLookup | accessExecute)
 	}
 
 	if err := xdr.Write(writer, mask); err != nil {
@@ -42,3 +65,70 @@ func onAccess(ctx context.Context, w *response, userHandle Handler) error {
 	}
 	return nil
 }
+
+// permittedAccess evaluates the mode bits of a file against an AUTH_SYS credential.
+// When the request carries no AUTH_SYS identity, or the filesystem does not report
+// the owner of the file, no restriction is applied.
+func permittedAccess(cred UnixCredential, info os.FileInfo) uint32 {
+	all := uint32(accessRead | accessLookup | accessModify | accessExtend | accessDelete | accessExecute)
+	owner := file.GetInfo(info)
+	if (cred.Flavor != AuthFlavorUnix && cred.Flavor != AuthFlavorRPCSECGSS) || owner == nil {
+		return all
+	}
+
+	perm := uint32(info.Mode().Perm())
+	var bits uint32
+	switch {
+	case cred.UID == 0:
+		// root may read and write anything, but only execute what someone can.
+		bits = 06
+		if perm&0111 != 0 {
+			bits |= 01
+		}
+	case cred.UID == owner.UID:
+		bits = perm >> 6
+	case inGroup(cred, owner.GID):
+		bits = perm >> 3
+	default:
+		bits = perm
+	}
+	r, wr, x := bits&04 != 0, bits&02 != 0, bits&01 != 0
+
+	var granted uint32
+	if info.IsDir() {
+		if r {
+			granted |= accessRead
+		}
+		if x {
+			granted |= accessLookup
+		}
+		// changing the entries of a directory requires searching it too.
+		if wr && x {
+			granted |= accessModify | accessExtend | accessDelete
+		}
+		return granted
+	}
+	if r {
+		granted |= accessRead
+	}
+	if wr {
+		granted |= accessModify | accessExtend
+	}
+	if x {
+		granted |= accessExecute
+	}
+	return granted
+}
+
+// inGroup reports whether a credential's primary or supplementary groups include `gid`.
+func inGroup(cred UnixCredential, gid uint32) bool {
+	if cred.GID == gid {
+		return true
+	}
+	for _, g := range cred.GIDs {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
@@ -9,37 +9,70 @@ import (
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-// onCommit - note this is a no-op, as we always push writes to the backing store.
+// onCommit flushes unstable writes on backends whose files can sync, after writing those
+// held back by Server.WriteBackSize. Other backends already hold the data as durably as
+// they can once a WRITE completes.
 func onCommit(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
-	handle, err := xdr.ReadOpaque(w.req.Body)
+	handle, err := readOpaque(w.req.Body)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
 	// The conn will drain the unread offset and count arguments.
 
-	fs, path, err := userHandle.FromHandle(handle)
+	fs, path, err := fromHandle(ctx, userHandle, handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(path...)); err != nil {
+		return err
 	}
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
 		return &NFSStatusError{NFSStatusServerFault, os.ErrPermission}
 	}
+	info, err := fs.Stat(fs.Join(path...))
+	if err != nil {
+		return &NFSStatusError{StatusFromError(err), err}
+	}
+	if !info.Mode().IsRegular() {
+		// only regular files are written to, and so have writes to commit.
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+
+	pre := w.fileAttribute(info).AsCache()
+	if w.Server.WriteBackSize > 0 {
+		key := writeBackKey{fs, fs.Join(path...)}
+		// the client has seen the file grown by the writes it is committing.
+		pre.Filesize = uint64(w.Server.writeBacks.sizeOf(key, info.Size()))
+		if err := w.Server.writeBacks.commit(key); err != nil {
+			return &NFSStatusError{NFSStatusIO, err}
+		}
+	}
+
+	file, err := fs.Open(fs.Join(path...))
+	if err != nil {
+		return &NFSStatusError{StatusFromError(err), err}
+	}
+	if s, ok := file.(syncer); ok {
+		if err := s.Sync(); err != nil {
+			_ = file.Close()
+			return &NFSStatusError{NFSStatusIO, err}
+		}
+	}
+	if err := file.Close(); err != nil {
+		return &NFSStatusError{NFSStatusIO, err}
+	}
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return err
 	}
 
-	// no pre-op cache data.
-	if err := xdr.Write(writer, uint32(0)); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
-	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, pre, w.tryStat(fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 	// write the 8 bytes of write verification.
-	if err := xdr.Write(writer, w.Server.ID); err != nil {
+	if err := xdr.Write(writer, w.Server.bootVerifier); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
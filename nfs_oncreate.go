@@ -3,10 +3,15 @@ package nfs
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"io"
 	"os"
+	"time"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
+	"github.com/willscott/go-nfs/file"
 )
 
 const (
@@ -15,58 +20,119 @@ const (
 	createModeExclusive = 2
 )
 
-func onCreate(ctx context.Context, w *response, userHandle Handler) error {
-	w.errorFmt = wccDataErrorFormatter
-	obj := DirOpArg{}
-	err := xdr.Read(w.req.Body, &obj)
-	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+// verifierTimes are the access and modification times an EXCLUSIVE create stores its
+// verifier as, until the client sets the attributes of the file. As Linux does, each half of
+// the verifier is kept as whole seconds, which any backend that keeps times holds exactly.
+func verifierTimes(verf [8]byte) (atime, mtime time.Time) {
+	return time.Unix(int64(binary.BigEndian.Uint32(verf[:4])), 0),
+		time.Unix(int64(binary.BigEndian.Uint32(verf[4:])), 0)
+}
+
+// hasVerifier tells if the file described by `s` carries the verifier of an EXCLUSIVE
+// create. The access time is only compared where the backend reports one.
+func hasVerifier(s os.FileInfo, verf [8]byte) bool {
+	atime, mtime := verifierTimes(verf)
+	if !s.Mode().IsRegular() || s.ModTime().Unix() != mtime.Unix() {
+		return false
 	}
-	how, err := xdr.ReadUint32(w.req.Body)
+	if info := file.GetInfo(s); info != nil && !info.Atime.IsZero() {
+		return info.Atime.Unix() == atime.Unix()
+	}
+	return true
+}
+
+// createArgs are the arguments of a CREATE.
+type createArgs struct {
+	DirOpArg
+	How   uint32
+	Attrs *SetFileAttributes
+	// Verf is the verifier of an EXCLUSIVE create.
+	Verf [8]byte
+}
+
+// readCreateArgs decodes the arguments of a CREATE, with times set to the server's time set
+// to `now`.
+func readCreateArgs(body io.Reader, now time.Time) (createArgs, error) {
+	args := createArgs{Attrs: &SetFileAttributes{}}
+	if err := readArgs(body, &args.DirOpArg); err != nil {
+		return args, errGarbageArgs(err)
+	}
+	how, err := xdr.ReadUint32(body)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return args, errGarbageArgs(err)
 	}
-	var attrs *SetFileAttributes
-	if how == createModeUnchecked || how == createModeGuarded {
-		sattr, err := ReadSetFileAttributes(w.req.Body)
-		if err != nil {
-			return &NFSStatusError{NFSStatusInval, err}
+	args.How = how
+	switch how {
+	case createModeUnchecked, createModeGuarded:
+		if args.Attrs, err = readSetFileAttributesAt(body, now); err != nil {
+			return args, errGarbageArgs(err)
 		}
-		attrs = sattr
-	} else if how == createModeExclusive {
+	case createModeExclusive:
 		// read createverf3
-		var verf [8]byte
-		if err := xdr.Read(w.req.Body, &verf); err != nil {
-			return &NFSStatusError{NFSStatusInval, err}
+		if err := readArgs(body, &args.Verf); err != nil {
+			return args, errGarbageArgs(err)
 		}
-		Log.Errorf("failing create to indicate lack of support for 'exclusive' mode.")
-		// TODO: support 'exclusive' mode.
-		return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
-	} else {
+	default:
 		// invalid
-		return &NFSStatusError{NFSStatusNotSupp, os.ErrInvalid}
+		return args, &NFSStatusError{NFSStatusNotSupp, os.ErrInvalid}
 	}
+	return args, nil
+}
 
-	fs, path, err := userHandle.FromHandle(obj.Handle)
+func onCreate(ctx context.Context, w *response, userHandle Handler) error {
+	w.errorFmt = wccDataErrorFormatter
+	args, err := readCreateArgs(w.req.Body, w.Server.now())
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return err
+	}
+	obj, how, attrs, verf := args.DirOpArg, args.How, args.Attrs, args.Verf
+	obj.Filename = w.Server.Export.normalizeName(obj.Filename)
+	w.mapSetFileAttributes(attrs)
+
+	fs, path, err := fromHandle(ctx, userHandle, obj.Handle)
+	if err != nil {
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(path...)); err != nil {
+		return err
 	}
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 
-	if len(string(obj.Filename)) > PathNameMax {
-		return &NFSStatusError{NFSStatusNameTooLong, nil}
+	if err := checkName(fs, obj.Filename); err != nil {
+		return err
 	}
+	obj.Filename = []byte(w.storedName(userHandle, fs, path, string(obj.Filename)))
 
-	newFilePath := fs.Join(append(path, string(obj.Filename))...)
+	changer := userHandle.Change(fs)
+	if how == createModeExclusive && changer == nil {
+		// the verifier is kept in the times of the file, which the backend cannot set.
+		return &NFSStatusError{NFSStatusNotSupp, billy.ErrNotSupported}
+	}
+
+	newFilePath := fs.Join(joinPath(path, string(obj.Filename))...)
+	if err := w.checkLinks(fs, newFilePath); err != nil {
+		return err
+	}
+	var existingSize int64
+	retransmit, existed := false, false
 	if s, err := fs.Stat(newFilePath); err == nil {
+		existed = true
 		if s.IsDir() {
 			return &NFSStatusError{NFSStatusExist, nil}
 		}
-		if how == createModeGuarded {
-			return &NFSStatusError{NFSStatusExist, os.ErrPermission}
+		switch how {
+		case createModeGuarded:
+			return &NFSStatusError{NFSStatusExist, os.ErrExist}
+		case createModeExclusive:
+			// a retransmitted create finds the file it created, with its verifier.
+			if !hasVerifier(s, verf) {
+				return &NFSStatusError{NFSStatusExist, os.ErrExist}
+			}
+			retransmit = true
 		}
+		existingSize = s.Size()
 	} else {
 		if s, err := fs.Stat(fs.Join(path...)); err != nil {
 			return &NFSStatusError{NFSStatusAccess, err}
@@ -75,44 +141,71 @@ func onCreate(ctx context.Context, w *response, userHandle Handler) error {
 		}
 	}
 
-	file, err := fs.Create(newFilePath)
+	var growth int64
+	if attrs.SetSize != nil && int64(*attrs.SetSize) > existingSize {
+		growth = int64(*attrs.SetSize) - existingSize
+	}
+	release, err := w.reserveGrowth(ctx, fs, growth)
 	if err != nil {
-		Log.Errorf("Error Creating: %v", err)
-		return &NFSStatusError{NFSStatusAccess, err}
+		return err
 	}
-	if err := file.Close(); err != nil {
-		Log.Errorf("Error Creating: %v", err)
-		return &NFSStatusError{NFSStatusAccess, err}
+	var grown int64
+	defer func() { release(grown) }()
+
+	pre := w.preOpAttrs(fs, path)
+	if !retransmit {
+		// an unchecked create of an existing file leaves its contents, unless asked to truncate.
+		flag := os.O_RDWR | os.O_CREATE
+		if how != createModeUnchecked {
+			flag |= os.O_EXCL
+		}
+		file, err := fs.OpenFile(newFilePath, flag, 0666)
+		if err != nil {
+			Log.Errorf("Error Creating: %v", err)
+			if errors.Is(err, os.ErrExist) {
+				return &NFSStatusError{NFSStatusExist, err}
+			}
+			return &NFSStatusError{NFSStatusAccess, err}
+		}
+		if err := file.Close(); err != nil {
+			Log.Errorf("Error Creating: %v", err)
+			return &NFSStatusError{NFSStatusAccess, err}
+		}
+		w.invalidateVerifier(userHandle, fs, path)
+		if how == createModeExclusive {
+			atime, mtime := verifierTimes(verf)
+			if err := changer.Chtimes(newFilePath, atime, mtime); err != nil {
+				Log.Errorf("Error storing create verifier: %v", err)
+				_ = fs.Remove(newFilePath)
+				return &NFSStatusError{NFSStatusIO, err}
+			}
+		}
 	}
 
-	fp := userHandle.ToHandle(fs, append(path, file.Name()))
-	changer := userHandle.Change(fs)
+	newPath := joinPath(path, string(obj.Filename))
+	fp := userHandle.ToHandle(fs, newPath)
+	if !existed && how != createModeExclusive {
+		w.stampTimes(attrs, changer)
+	}
 	if err := attrs.Apply(changer, fs, newFilePath); err != nil {
 		Log.Errorf("Error applying attributes: %v\n", err)
 		return &NFSStatusError{NFSStatusIO, err}
 	}
+	grown = growth
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	// "handle follows"
-	if err := xdr.Write(writer, uint32(1)); err != nil {
+	if err := writePostOpFH(writer, fp); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := xdr.Write(writer, fp); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
-	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, append(path, file.Name()))); err != nil {
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, newPath)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	// dir_wcc (we don't include pre_op_attr)
-	if err := xdr.Write(writer, uint32(0)); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
-	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, pre, w.tryStat(fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -20,20 +20,20 @@ const (
 )
 
 func onFSInfo(ctx context.Context, w *response, userHandle Handler) error {
-	roothandle, err := xdr.ReadOpaque(w.req.Body)
+	roothandle, err := readOpaque(w.req.Body)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
-	fs, path, err := userHandle.FromHandle(roothandle)
+	fs, path, err := fromHandle(ctx, userHandle, roothandle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
 	}
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -50,12 +50,13 @@ func onFSInfo(ctx context.Context, w *response, userHandle Handler) error {
 		Properties  uint32
 	}
 
+	limits := w.transferLimits()
 	res := fsinfores{
-		Rtmax:       1 << 30,
-		Rtpref:      1 << 30,
+		Rtmax:       limits.MaxRead,
+		Rtpref:      limits.PreferredRead,
 		Rtmult:      4096,
-		Wtmax:       1 << 30,
-		Wtpref:      1 << 30,
+		Wtmax:       limits.MaxWrite,
+		Wtpref:      limits.PreferredWrite,
 		Wtmult:      4096,
 		Dtpref:      8192,
 		Maxfilesize: 1 << 62, // wild guess. this seems big.
@@ -63,6 +64,10 @@ func onFSInfo(ctx context.Context, w *response, userHandle Handler) error {
 		Properties:  0,
 	}
 
+	if w.Server.MaxFileSize > 0 {
+		res.Maxfilesize = uint64(w.Server.MaxFileSize)
+	}
+
 	// TODO: these aren't great indications of support, really.
 	if _, ok := fs.(billy.Symlink); ok {
 		res.Properties |= FSInfoPropertyLink
@@ -85,3 +90,65 @@ func onFSInfo(ctx context.Context, w *response, userHandle Handler) error {
 	}
 	return nil
 }
+
+// defaultTransferSize is the largest READ and WRITE advertised when the server does not
+// set MaxReadSize or MaxWriteSize.
+const defaultTransferSize = 1 << 30
+
+// TransferLimits are the READ and WRITE sizes FSINFO advertises to a client. NFSv3 clients
+// pick their transfer sizes within these limits without telling the server, so they are
+// the largest READs and WRITEs a handler is asked to serve over the connection.
+type TransferLimits struct {
+	MaxRead        uint32
+	PreferredRead  uint32
+	MaxWrite       uint32
+	PreferredWrite uint32
+}
+
+type limitsContextKey struct{}
+
+// LimitsFromContext returns the transfer sizes advertised to the client of the request
+// being handled. The zero value is returned outside of a request.
+func LimitsFromContext(ctx context.Context) TransferLimits {
+	if limits, ok := ctx.Value(limitsContextKey{}).(TransferLimits); ok {
+		return limits
+	}
+	return TransferLimits{}
+}
+
+func withLimits(ctx context.Context, limits TransferLimits) context.Context {
+	return context.WithValue(ctx, limitsContextKey{}, limits)
+}
+
+// transferLimits are the transfer sizes advertised to the client of a request.
+func (w *response) transferLimits() TransferLimits {
+	var l TransferLimits
+	l.MaxRead, l.PreferredRead = transferSizes(defaultTransferSize, w.Server.MaxReadSize, w.Server.PreferredReadSize)
+	l.MaxWrite, l.PreferredWrite = transferSizes(defaultTransferSize, w.Server.MaxWriteSize, w.Server.PreferredWriteSize)
+	if w.datagram {
+		// replies over udp must fit in a single datagram.
+		l.MaxRead, l.PreferredRead = transferSizes(MaxUDPTransfer, min32(l.MaxRead, MaxUDPTransfer), l.PreferredRead)
+		l.MaxWrite, l.PreferredWrite = transferSizes(MaxUDPTransfer, min32(l.MaxWrite, MaxUDPTransfer), l.PreferredWrite)
+	}
+	return l
+}
+
+// transferSizes applies configured maximum and preferred transfer sizes over a default,
+// keeping the preferred size within the maximum.
+
+func transferSizes(def, max, pref uint32) (uint32, uint32) {
+	if max == 0 {
+		max = def
+	}
+	if pref == 0 || pref > max {
+		pref = max
+	}
+	return max, pref
+}
+
+func min32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
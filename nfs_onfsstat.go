@@ -3,19 +3,20 @@ package nfs
 import (
 	"bytes"
 	"context"
+	"time"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 func onFSStat(ctx context.Context, w *response, userHandle Handler) error {
-	roothandle, err := xdr.ReadOpaque(w.req.Body)
+	roothandle, err := readOpaque(w.req.Body)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
-	fs, path, err := userHandle.FromHandle(roothandle)
+	fs, path, err := fromHandle(ctx, userHandle, roothandle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
 	}
 
 	defaults := FSStat{
@@ -27,6 +28,11 @@ func onFSStat(ctx context.Context, w *response, userHandle Handler) error {
 		AvailableFiles: 1 << 62,
 		CacheHint:      0,
 	}
+	if sfs, ok := fs.(StatFS); ok {
+		if defaults, err = sfs.StatFS(); err != nil {
+			return &NFSStatusError{NFSStatusIO, err}
+		}
+	}
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
 		defaults.AvailableFiles = 0
 		defaults.AvailableSize = 0
@@ -44,11 +50,18 @@ func onFSStat(ctx context.Context, w *response, userHandle Handler) error {
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	if err := xdr.Write(writer, defaults); err != nil {
+	for _, v := range []uint64{defaults.TotalSize, defaults.FreeSize, defaults.AvailableSize,
+		defaults.TotalFiles, defaults.FreeFiles, defaults.AvailableFiles} {
+		if err := xdr.Write(writer, v); err != nil {
+			return &NFSStatusError{NFSStatusServerFault, err}
+		}
+	}
+	// invarsec is a count of seconds.
+	if err := xdr.Write(writer, uint32(defaults.CacheHint/time.Second)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 	if err := w.Write(writer.Bytes()); err != nil {
@@ -3,30 +3,29 @@ package nfs
 import (
 	"bytes"
 	"context"
-	"os"
 
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 func onGetAttr(ctx context.Context, w *response, userHandle Handler) error {
-	handle, err := xdr.ReadOpaque(w.req.Body)
+	handle, err := readOpaque(w.req.Body)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
 
-	fs, path, err := userHandle.FromHandle(handle)
+	fs, path, err := fromHandle(ctx, userHandle, handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
 	}
 
-	info, err := fs.Stat(fs.Join(path...))
+	if err := w.flushWrites(fs, fs.Join(path...)); err != nil {
+		return err
+	}
+	info, err := fs.Lstat(fs.Join(path...))
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
-		}
-		return &NFSStatusError{NFSStatusIO, err}
+		return &NFSStatusError{StatusFromError(err), err}
 	}
-	attr := ToFileAttribute(info)
+	attr := w.attributesOf(fs, path, info)
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
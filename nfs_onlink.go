@@ -1,14 +1,100 @@
 package nfs
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"os"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 var linkErrorBody = [12]byte{}
 
-// Backing billy.FS doesn't support hard links
+// Creates hard links when the backing billy.FS implements LinkFS.
 func onLink(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = errFormatterWithBody(linkErrorBody[:])
-	return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
+	handle, err := readOpaque(w.req.Body)
+	if err != nil {
+		return errGarbageArgs(err)
+	}
+	link := DirOpArg{}
+	if err := readArgs(w.req.Body, &link); err != nil {
+		return errGarbageArgs(err)
+	}
+	link.Filename = w.Server.Export.normalizeName(link.Filename)
+
+	fs, path, err := fromHandle(ctx, userHandle, handle)
+	if err != nil {
+		return handleError(err)
+	}
+	fs2, dirPath, err := fromHandle(ctx, userHandle, link.Handle)
+	if err != nil {
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs2, fs2.Join(dirPath...)); err != nil {
+		return err
+	}
+	if fs != fs2 {
+		return &NFSStatusError{NFSStatusXDev, os.ErrInvalid}
+	}
+	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+	}
+	linker, ok := fs.(LinkFS)
+	if !ok {
+		return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
+	}
+
+	if err := checkName(fs, link.Filename); err != nil {
+		return err
+	}
+
+	info, err := fs.Lstat(fs.Join(path...))
+	if err != nil {
+		return &NFSStatusError{StatusFromError(err), err}
+	}
+	if info.IsDir() {
+		return &NFSStatusError{NFSStatusIsDir, nil}
+	}
+	dirInfo, err := fs.Stat(fs.Join(dirPath...))
+	if err != nil {
+		return &NFSStatusError{StatusFromError(err), err}
+	}
+	if !dirInfo.IsDir() {
+		return &NFSStatusError{NFSStatusNotDir, nil}
+	}
+	preCacheData := w.fileAttribute(dirInfo).AsCache()
+
+	newPath := joinPath(dirPath, string(link.Filename))
+	if _, err := fs.Lstat(fs.Join(newPath...)); err == nil {
+		return &NFSStatusError{NFSStatusExist, os.ErrExist}
+	}
+	if err := linker.Link(fs.Join(path...), fs.Join(newPath...)); err != nil {
+		if errors.Is(err, billy.ErrNotSupported) {
+			return &NFSStatusError{NFSStatusNotSupp, err}
+		}
+		if os.IsExist(err) {
+			return &NFSStatusError{NFSStatusExist, err}
+		}
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	w.invalidateVerifier(userHandle, fs, dirPath)
+
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, path)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := WriteWcc(writer, preCacheData, w.tryStat(fs, dirPath)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+
+	if err := w.Write(writer.Bytes()); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
 }
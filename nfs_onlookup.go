@@ -3,13 +3,16 @@ package nfs
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io/fs"
 	"os"
+	"strings"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-func lookupSuccessResponse(handle []byte, entPath, dirPath []string, fs billy.Filesystem) ([]byte, error) {
+func (w *response) lookupSuccessResponse(handle []byte, entPath, dirPath []string, fs billy.Filesystem) ([]byte, error) {
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return nil, err
@@ -17,10 +20,10 @@ func lookupSuccessResponse(handle []byte, entPath, dirPath []string, fs billy.Fi
 	if err := xdr.Write(writer, handle); err != nil {
 		return nil, err
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, entPath)); err != nil {
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, entPath)); err != nil {
 		return nil, err
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, dirPath)); err != nil {
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, dirPath)); err != nil {
 		return nil, err
 	}
 	return writer.Bytes(), nil
@@ -29,14 +32,18 @@ func lookupSuccessResponse(handle []byte, entPath, dirPath []string, fs billy.Fi
 func onLookup(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
 	obj := DirOpArg{}
-	err := xdr.Read(w.req.Body, &obj)
+	err := readArgs(w.req.Body, &obj)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
+	obj.Filename = w.Server.Export.normalizeName(obj.Filename)
 
-	fs, p, err := userHandle.FromHandle(obj.Handle)
+	fs, p, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(p...)); err != nil {
+		return err
 	}
 	contents, err := fs.ReadDir(fs.Join(p...))
 	if err != nil {
@@ -45,7 +52,7 @@ func onLookup(ctx context.Context, w *response, userHandle Handler) error {
 
 	// Special cases for "." and ".."
 	if bytes.Equal(obj.Filename, []byte(".")) {
-		resp, err := lookupSuccessResponse(obj.Handle, p, p, fs)
+		resp, err := w.lookupSuccessResponse(obj.Handle, p, p, fs)
 		if err != nil {
 			return &NFSStatusError{NFSStatusServerFault, err}
 		}
@@ -55,12 +62,16 @@ func onLookup(ctx context.Context, w *response, userHandle Handler) error {
 		return nil
 	}
 	if bytes.Equal(obj.Filename, []byte("..")) {
-		if len(p) == 0 {
-			return &NFSStatusError{NFSStatusAccess, os.ErrPermission}
+		// the parent of the export root is the root itself.
+		pPath, pHandle := p, obj.Handle
+		if len(p) > 0 {
+			pPath = p[0 : len(p)-1]
+			pHandle = userHandle.ToHandle(fs, pPath)
+		}
+		if len(pHandle) == 0 {
+			return errNoHandle()
 		}
-		pPath := p[0 : len(p)-1]
-		pHandle := userHandle.ToHandle(fs, pPath)
-		resp, err := lookupSuccessResponse(pHandle, pPath, p, fs)
+		resp, err := w.lookupSuccessResponse(pHandle, pPath, p, fs)
 		if err != nil {
 			return &NFSStatusError{NFSStatusServerFault, err}
 		}
@@ -70,22 +81,80 @@ func onLookup(ctx context.Context, w *response, userHandle Handler) error {
 		return nil
 	}
 
+	if err := checkNameLength(fs, obj.Filename); err != nil {
+		return err
+	}
+	if err := checkComponent(obj.Filename); err != nil {
+		return err
+	}
+
 	// TODO: use sorting rather than linear
-	for _, f := range contents {
-		if bytes.Equal([]byte(f.Name()), obj.Filename) {
-			newPath := append(p, f.Name())
-			newHandle := userHandle.ToHandle(fs, newPath)
-			resp, err := lookupSuccessResponse(newHandle, newPath, p, fs)
-			if err != nil {
-				return &NFSStatusError{NFSStatusServerFault, err}
-			}
-			if err := w.Write(resp); err != nil {
-				return &NFSStatusError{NFSStatusServerFault, err}
-			}
-			return nil
+	if name, ok := w.matchName(userHandle, contents, string(obj.Filename)); ok {
+		newPath := joinPath(p, name)
+		newHandle := userHandle.ToHandle(fs, newPath)
+		if len(newHandle) == 0 {
+			return errNoHandle()
+		}
+		resp, err := w.lookupSuccessResponse(newHandle, newPath, p, fs)
+		if err != nil {
+			return &NFSStatusError{NFSStatusServerFault, err}
+		}
+		if err := w.Write(resp); err != nil {
+			return &NFSStatusError{NFSStatusServerFault, err}
 		}
+		return nil
 	}
 
 	Log.Errorf("No file for lookup of %v\n", string(obj.Filename))
 	return &NFSStatusError{NFSStatusNoEnt, os.ErrNotExist}
 }
+
+// matchName finds the entry of a directory listing that `name` refers to, returning the name
+// the entry is stored under. Names match in any Unicode normalization when the export
+// normalizes names, and in any case when the handler is case insensitive, though an entry
+// named exactly as asked is preferred.
+func (w *response) matchName(userHandle Handler, contents []fs.FileInfo, name string) (string, bool) {
+	for _, f := range contents {
+		if f.Name() == name {
+			return name, true
+		}
+	}
+	fold := caseInsensitive(userHandle)
+	if !fold && w.Server.Export.Normalization == NoNormalization {
+		return "", false
+	}
+	want := w.Server.Export.normalizedName(name)
+	for _, f := range contents {
+		if got := w.Server.Export.normalizedName(f.Name()); got == want || fold && strings.EqualFold(got, want) {
+			return f.Name(), true
+		}
+	}
+	return "", false
+}
+
+// storedName is the name an entry of the directory at `dir` is stored under, when `name`
+// matches it in another case or normalization. Otherwise it is `name` itself.
+func (w *response) storedName(userHandle Handler, fs billy.Filesystem, dir []string, name string) string {
+	if !caseInsensitive(userHandle) && w.Server.Export.Normalization == NoNormalization {
+		return name
+	}
+	contents, err := fs.ReadDir(fs.Join(dir...))
+	if err != nil {
+		return name
+	}
+	if stored, ok := w.matchName(userHandle, contents, name); ok {
+		return stored
+	}
+	return name
+}
+
+func caseInsensitive(userHandle Handler) bool {
+	ci, ok := userHandle.(CaseInsensitiveHandler)
+	return ok && ci.CaseInsensitive()
+}
+
+// errNoHandle answers for a file the handler has no room to mint a handle for, asking the
+// client to retry once handles have been released.
+func errNoHandle() error {
+	return &NFSStatusError{NFSStatusJukebox, errors.New("handler refused to mint a handle")}
+}
@@ -16,33 +16,40 @@ const (
 func onMkdir(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
-	err := xdr.Read(w.req.Body, &obj)
+	err := readArgs(w.req.Body, &obj)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
+	obj.Filename = w.Server.Export.normalizeName(obj.Filename)
 
-	attrs, err := ReadSetFileAttributes(w.req.Body)
+	attrs, err := w.readSetFileAttributes()
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
 
-	fs, path, err := userHandle.FromHandle(obj.Handle)
+	fs, path, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(path...)); err != nil {
+		return err
 	}
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 
-	if len(string(obj.Filename)) > PathNameMax {
-		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
-	}
 	if string(obj.Filename) == "." || string(obj.Filename) == ".." {
 		return &NFSStatusError{NFSStatusExist, os.ErrExist}
 	}
+	if err := checkName(fs, obj.Filename); err != nil {
+		return err
+	}
 
-	newFolder := append(path, string(obj.Filename))
+	newFolder := joinPath(path, string(obj.Filename))
 	newFolderPath := fs.Join(newFolder...)
+	if err := w.checkLinks(fs, newFolderPath); err != nil {
+		return err
+	}
 	if s, err := fs.Stat(newFolderPath); err == nil {
 		if s.IsDir() {
 			return &NFSStatusError{NFSStatusExist, nil}
@@ -55,12 +62,15 @@ func onMkdir(ctx context.Context, w *response, userHandle Handler) error {
 		}
 	}
 
+	pre := w.preOpAttrs(fs, path)
 	if err := fs.MkdirAll(newFolderPath, attrs.Mode(mkdirDefaultMode)); err != nil {
 		return &NFSStatusError{NFSStatusAccess, err}
 	}
+	w.invalidateVerifier(userHandle, fs, path)
 
 	fp := userHandle.ToHandle(fs, newFolder)
 	changer := userHandle.Change(fs)
+	w.stampTimes(attrs, changer)
 	if changer != nil {
 		if err := attrs.Apply(changer, fs, newFolderPath); err != nil {
 			return &NFSStatusError{NFSStatusIO, err}
@@ -72,18 +82,14 @@ func onMkdir(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	// "handle follows"
-	if err := xdr.Write(writer, uint32(1)); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
-	}
-	if err := xdr.Write(writer, fp); err != nil {
+	if err := writePostOpFH(writer, fp); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, newFolder)); err != nil {
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, newFolder)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	if err := WriteWcc(writer, nil, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, pre, w.tryStat(fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
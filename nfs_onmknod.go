@@ -1,13 +1,130 @@
 package nfs
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"os"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-// Backing billy.FS doesn't support creation of
-// char, block, socket, or fifo pipe nodes
+// Creates char, block, socket, or fifo pipe nodes when the
+// backing billy.FS implements MknodFS.
 func onMknod(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
-	return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
+	obj := DirOpArg{}
+	err := readArgs(w.req.Body, &obj)
+	if err != nil {
+		return errGarbageArgs(err)
+	}
+	obj.Filename = w.Server.Export.normalizeName(obj.Filename)
+	ftype, err := xdr.ReadUint32(w.req.Body)
+	if err != nil {
+		return errGarbageArgs(err)
+	}
+
+	var mode os.FileMode
+	switch FileType(ftype) {
+	case FileTypeCharacter:
+		mode = os.ModeDevice | os.ModeCharDevice
+	case FileTypeBlock:
+		mode = os.ModeDevice
+	case FileTypeSocket:
+		mode = os.ModeSocket
+	case FileTypeFIFO:
+		mode = os.ModeNamedPipe
+	default:
+		// regular files, directories and symlinks have their own procedures.
+		return &NFSStatusError{NFSStatusBadType, os.ErrInvalid}
+	}
+	attrs, err := w.readSetFileAttributes()
+	if err != nil {
+		return errGarbageArgs(err)
+	}
+	var spec struct {
+		Major uint32
+		Minor uint32
+	}
+	if mode&os.ModeDevice != 0 {
+		if err := readArgs(w.req.Body, &spec); err != nil {
+			return errGarbageArgs(err)
+		}
+	}
+
+	fs, path, err := fromHandle(ctx, userHandle, obj.Handle)
+	if err != nil {
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(path...)); err != nil {
+		return err
+	}
+	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+	}
+	mknod, ok := fs.(MknodFS)
+	if !ok {
+		return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
+	}
+
+	if err := checkName(fs, obj.Filename); err != nil {
+		return err
+	}
+
+	newFilePath := fs.Join(joinPath(path, string(obj.Filename))...)
+	if _, err := fs.Lstat(newFilePath); err == nil {
+		return &NFSStatusError{NFSStatusExist, os.ErrExist}
+	}
+	if s, err := fs.Stat(fs.Join(path...)); err != nil {
+		return &NFSStatusError{NFSStatusAccess, err}
+	} else if !s.IsDir() {
+		return &NFSStatusError{NFSStatusNotDir, nil}
+	}
+
+	perm := os.FileMode(0644)
+	if attrs.SetMode != nil {
+		perm = os.FileMode(*attrs.SetMode) & os.ModePerm
+	}
+	pre := w.preOpAttrs(fs, path)
+	if err := mknod.Mknod(newFilePath, mode|perm, spec.Major, spec.Minor); err != nil {
+		if errors.Is(err, billy.ErrNotSupported) {
+			return &NFSStatusError{NFSStatusNotSupp, err}
+		}
+		if os.IsExist(err) {
+			return &NFSStatusError{NFSStatusExist, err}
+		}
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	w.invalidateVerifier(userHandle, fs, path)
+
+	fp := userHandle.ToHandle(fs, joinPath(path, string(obj.Filename)))
+	changer := userHandle.Change(fs)
+	w.stampTimes(attrs, changer)
+	if changer != nil {
+		if err := attrs.Apply(changer, fs, newFilePath); err != nil {
+			return &NFSStatusError{NFSStatusIO, err}
+		}
+	}
+
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+
+	if err := writePostOpFH(writer, fp); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, joinPath(path, string(obj.Filename)))); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+
+	if err := WriteWcc(writer, pre, w.tryStat(fs, path)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+
+	if err := w.Write(writer.Bytes()); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
 }
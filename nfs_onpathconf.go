@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 
+	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
@@ -11,41 +12,25 @@ import (
 const PathNameMax = 255
 
 func onPathConf(ctx context.Context, w *response, userHandle Handler) error {
-	roothandle, err := xdr.ReadOpaque(w.req.Body)
+	roothandle, err := readOpaque(w.req.Body)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
-	fs, path, err := userHandle.FromHandle(roothandle)
+	fs, path, err := fromHandle(ctx, userHandle, roothandle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
 	}
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	type PathConf struct {
-		LinkMax         uint32
-		NameMax         uint32
-		NoTrunc         uint32
-		ChownRestricted uint32
-		CaseInsensitive uint32
-		CasePreserving  uint32
-	}
-
-	defaults := PathConf{
-		LinkMax:         1,
-		NameMax:         PathNameMax,
-		NoTrunc:         1,
-		ChownRestricted: 0,
-		CaseInsensitive: 0,
-		CasePreserving:  1,
-	}
-	if err := xdr.Write(writer, defaults); err != nil {
+	conf := pathConf(fs)
+	if err := xdr.Write(writer, conf); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 	if err := w.Write(writer.Bytes()); err != nil {
@@ -53,3 +38,19 @@ func onPathConf(ctx context.Context, w *response, userHandle Handler) error {
 	}
 	return nil
 }
+
+// pathConf describes the path limits of a filesystem, which are those of a typical posix
+// file system unless the filesystem implements PathConfFS.
+func pathConf(fs billy.Filesystem) PathConf {
+	if pfs, ok := fs.(PathConfFS); ok {
+		return pfs.PathConf()
+	}
+	return PathConf{
+		LinkMax:         1,
+		NameMax:         PathNameMax,
+		NoTrunc:         true,
+		ChownRestricted: false,
+		CaseInsensitive: false,
+		CasePreserving:  true,
+	}
+}
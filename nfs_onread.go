@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 
+	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
@@ -28,20 +29,52 @@ const MaxRead = 1 << 24
 // CheckRead is a size where - if a request to read is larger than this,
 // the server will stat the file to learn it's actual size before allocating
 // a buffer to read into.
+//
+// Deprecated: every READ is now bounded by the actual size of the file.
 const CheckRead = 1 << 15
 
+// transferChunkSize bounds each read or write against the underlying file, so
+// that cancellation of a large READ or WRITE is noticed between chunks.
+const transferChunkSize = 1 << 16
+
+// readReadArgs decodes the arguments of a READ.
+func readReadArgs(body io.Reader) (nfsReadArgs, error) {
+	var args nfsReadArgs
+	if err := readArgs(body, &args); err != nil {
+		return args, errGarbageArgs(err)
+	}
+	return args, nil
+}
+
 func onRead(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
-	var obj nfsReadArgs
-	err := xdr.Read(w.req.Body, &obj)
+	obj, err := readReadArgs(w.req.Body)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return err
 	}
-	fs, path, err := userHandle.FromHandle(obj.Handle)
+	fs, path, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(path...)); err != nil {
+		return err
+	}
+	if err := w.flushWrites(fs, fs.Join(path...)); err != nil {
+		return err
 	}
 
+	info, err := fs.Stat(fs.Join(path...))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &NFSStatusError{NFSStatusNoEnt, err}
+		}
+		return &NFSStatusError{NFSStatusAccess, err}
+	}
+	if info.IsDir() {
+		return &NFSStatusError{NFSStatusIsDir, os.ErrInvalid}
+	}
+	size := info.Size()
+
 	fh, err := fs.Open(fs.Join(path...))
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -50,23 +83,70 @@ func onRead(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusAccess, err}
 	}
 
+	streamed := false
+	defer func() {
+		if !streamed {
+			_ = fh.Close()
+		}
+	}()
+
 	resp := nfsReadResponse{}
 
-	if obj.Count > CheckRead {
-		info, err := fs.Stat(fs.Join(path...))
-		if err != nil {
-			return &NFSStatusError{NFSStatusAccess, err}
-		}
-		if info.Size()-int64(obj.Offset) < int64(obj.Count) {
-			obj.Count = uint32(uint64(info.Size()) - obj.Offset)
+	if obj.Offset >= uint64(size) {
+		obj.Count = 0
+	} else if uint64(size)-obj.Offset < uint64(obj.Count) {
+		obj.Count = uint32(uint64(size) - obj.Offset)
+	}
+	limit := uint32(MaxRead)
+	if w.Server.MaxReadSize != 0 {
+		limit = w.Server.MaxReadSize
+	}
+	if w.datagram && limit > MaxUDPTransfer {
+		limit = MaxUDPTransfer
+	}
+	if obj.Count > limit {
+		obj.Count = limit
+	}
+	if obj.Offset < uint64(size) && w.canStream(fh) {
+		if err := streamRead(w, fh, fs, path, obj, size); err != nil {
+			return err
 		}
+		streamed = true
+		return nil
 	}
-	if obj.Count > MaxRead {
-		obj.Count = MaxRead
+
+	buf := w.Server.buffers.get(int(obj.Count))
+	defer w.Server.buffers.put(buf, w.Server.pooledBufferSize())
+	resp.Data = *buf
+	cnt := 0
+	// a leading hole reads as zeros, so it need not be read.
+	dataStart, sparse := nextData(fh, int64(obj.Offset))
+	for cnt < len(resp.Data) {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		end := cnt + transferChunkSize
+		if end > len(resp.Data) {
+			end = len(resp.Data)
+		}
+		if err = w.readLimiter.wait(ctx, end-cnt); err != nil {
+			return err
+		}
+		if sparse && int64(obj.Offset)+int64(end) <= dataStart {
+			// the buffer may hold the data of an earlier request.
+			for i := cnt; i < end; i++ {
+				resp.Data[i] = 0
+			}
+			cnt = end
+			continue
+		}
+		var n int
+		n, err = fh.ReadAt(resp.Data[cnt:end], int64(obj.Offset)+int64(cnt))
+		cnt += n
+		if err != nil {
+			break
+		}
 	}
-	resp.Data = make([]byte, obj.Count)
-	// todo: multiple reads if size isn't full
-	cnt, err := fh.ReadAt(resp.Data, int64(obj.Offset))
 	if err != nil && !errors.Is(err, io.EOF) {
 		return &NFSStatusError{NFSStatusIO, err}
 	}
@@ -74,13 +154,16 @@ func onRead(ctx context.Context, w *response, userHandle Handler) error {
 	resp.Data = resp.Data[:resp.Count]
 	if errors.Is(err, io.EOF) {
 		resp.EOF = 1
+	} else if obj.Offset+uint64(cnt) >= uint64(size) {
+		// a read ending at the end of the file, or asking for nothing there, need not see io.EOF.
+		resp.EOF = 1
 	}
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -92,3 +175,33 @@ func onRead(ctx context.Context, w *response, userHandle Handler) error {
 	}
 	return nil
 }
+
+// streamRead answers a READ of a file of `size` bytes, within which the read falls, by
+// streaming its data from the file to the connection.
+func streamRead(w *response, fh billy.File, fs billy.Filesystem, path []string, obj nfsReadArgs, size int64) error {
+	if _, err := fh.Seek(int64(obj.Offset), io.SeekStart); err != nil {
+		return &NFSStatusError{NFSStatusIO, err}
+	}
+	resp := nfsReadResponse{Count: obj.Count}
+	if int64(obj.Offset)+int64(obj.Count) >= size {
+		resp.EOF = 1
+	}
+
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, path)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	// the data follows its length, as it would in an encoded nfsReadResponse.
+	header := struct{ Count, EOF, Length uint32 }{resp.Count, resp.EOF, resp.Count}
+	if err := xdr.Write(writer, header); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := w.Write(writer.Bytes()); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	w.stream(fh, int64(resp.Count))
+	return nil
+}
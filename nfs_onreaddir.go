@@ -5,11 +5,13 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"hash/fnv"
 	"io"
 	"io/fs"
 	"os"
 	"sort"
 
+	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
@@ -27,76 +29,90 @@ type readDirEntity struct {
 	Next   bool
 }
 
+// readReadDirArgs decodes the arguments of a READDIR.
+func readReadDirArgs(body io.Reader) (readDirArgs, error) {
+	var args readDirArgs
+	if err := readArgs(body, &args); err != nil {
+		return args, errGarbageArgs(err)
+	}
+	return args, nil
+}
+
 func onReadDir(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
-	obj := readDirArgs{}
-	err := xdr.Read(w.req.Body, &obj)
+	obj, err := readReadDirArgs(w.req.Body)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return err
 	}
 
 	if obj.Count < 1024 {
 		return &NFSStatusError{NFSStatusTooSmall, io.ErrShortBuffer}
 	}
+	if w.datagram && obj.Count > MaxUDPTransfer {
+		// a listing larger than a datagram would be lost rather than truncated.
+		obj.Count = MaxUDPTransfer
+	}
 
-	fs, p, err := userHandle.FromHandle(obj.Handle)
+	fs, p, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(p...)); err != nil {
+		return err
 	}
 
-	contents, verifier, err := getDirListingWithVerifier(userHandle, obj.Handle, obj.CookieVerif)
+	contents, verifier, err := getDirListingWithVerifier(ctx, userHandle, obj.Handle, obj.CookieVerif)
 	if err != nil {
 		return err
 	}
-	if obj.Cookie > 0 && obj.CookieVerif > 0 && verifier != obj.CookieVerif {
+	if !w.Server.StableCookies && obj.Cookie > 0 && obj.CookieVerif > 0 && verifier != obj.CookieVerif {
 		return &NFSStatusError{NFSStatusBadCookie, nil}
 	}
+	contents, cookies := w.Server.dirCookies(contents)
+	next, err := w.Server.resumeAt(cookies, obj.Cookie)
+	if err != nil {
+		return err
+	}
 
 	entities := make([]readDirEntity, 0)
 	maxBytes := uint32(100) // conservative overhead measure
 
-	started := obj.Cookie == 0
-	if started {
+	if obj.Cookie == 0 {
 		// add '.' and '..' to entities
-		dotdotFileID := uint64(0)
+		// the parent of the root is the root itself.
+		parent := p
 		if len(p) > 0 {
-			ph := userHandle.ToHandle(fs, p[0:len(p)-1])
-			dotdotFileID = binary.BigEndian.Uint64(ph[0:8])
+			parent = p[0 : len(p)-1]
 		}
+		dotdotFileID := w.fileID(fs, parent, nil)
 		entities = append(entities,
-			readDirEntity{Name: []byte("."), Cookie: 0, Next: true, FileID: binary.BigEndian.Uint64(obj.Handle[0:8])},
+			readDirEntity{Name: []byte("."), Cookie: 0, Next: true, FileID: w.fileID(fs, p, nil)},
 			readDirEntity{Name: []byte(".."), Cookie: 1, Next: true, FileID: dotdotFileID},
 		)
 	}
 
 	eof := true
 	maxEntities := userHandle.HandleLimit() / 2
-	for i, c := range contents {
-		// cookie equates to index within contents + 2 (for '.' and '..')
-		cookie := uint64(i + 2)
-		if started {
-			maxBytes += 512 // TODO: better estimation.
-			if maxBytes > obj.Count || len(entities) > maxEntities {
-				eof = false
-				break
-			}
-
-			entities = append(entities, readDirEntity{
-				FileID: 1337, // todo: does this matter?
-				Name:   []byte(c.Name()),
-				Cookie: cookie,
-				Next:   true,
-			})
-		} else if cookie == obj.Cookie {
-			started = true
+	for i := next; i < len(contents); i++ {
+		maxBytes += 512 // TODO: better estimation.
+		if maxBytes > obj.Count || len(entities) > maxEntities {
+			eof = false
+			break
 		}
+
+		entities = append(entities, readDirEntity{
+			FileID: w.fileID(fs, joinPath(p, contents[i].Name()), contents[i]),
+			Name:   []byte(w.Server.Export.normalizedName(contents[i].Name())),
+			Cookie: cookies[i],
+			Next:   true,
+		})
 	}
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, p)); err != nil {
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, p)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -128,11 +144,11 @@ func onReadDir(ctx context.Context, w *response, userHandle Handler) error {
 	return nil
 }
 
-func getDirListingWithVerifier(userHandle Handler, fsHandle []byte, verifier uint64) ([]fs.FileInfo, uint64, error) {
+func getDirListingWithVerifier(ctx context.Context, userHandle Handler, fsHandle []byte, verifier uint64) ([]fs.FileInfo, uint64, error) {
 	// figure out what directory it is.
-	fs, p, err := userHandle.FromHandle(fsHandle)
+	fs, p, err := fromHandle(ctx, userHandle, fsHandle)
 	if err != nil {
-		return nil, 0, &NFSStatusError{NFSStatusStale, err}
+		return nil, 0, handleError(err)
 	}
 
 	path := fs.Join(p...)
@@ -162,19 +178,113 @@ func getDirListingWithVerifier(userHandle Handler, fsHandle []byte, verifier uin
 		return contents, v, nil
 	}
 
-	id := hashPathAndContents(path, contents)
+	id := HashPathAndContents(path, contents)
 	return contents, id, nil
 }
 
-func hashPathAndContents(path string, contents []fs.FileInfo) uint64 {
+// dirCookies orders a sorted listing as it is paged through, and assigns the cookie each
+// entry is resumed after. Cookies 0 and 1 belong to '.' and '..', and the entries are
+// otherwise numbered by their index in the listing, so that resuming a listing that has
+// since changed is refused with NFSStatusBadCookie. With StableCookies, each cookie is
+// instead derived from the name of its entry, and the listing is ordered by cookie.
+func (s *Server) dirCookies(contents []fs.FileInfo) ([]fs.FileInfo, []uint64) {
+	cookies := make([]uint64, len(contents))
+	if !s.StableCookies {
+		for i := range contents {
+			cookies[i] = uint64(i + 2)
+		}
+		return contents, cookies
+	}
+	// the listing may be shared with the verifier cache, so it is ordered in a copy.
+	ordered := make([]fs.FileInfo, len(contents))
+	copy(ordered, contents)
+	for i, c := range ordered {
+		cookies[i] = nameCookie(c.Name())
+	}
+	sort.Sort(byCookie{ordered, cookies})
+	return ordered, cookies
+}
+
+// resumeAt finds the index of the entry a listing resumes with after `cookie`.
+func (s *Server) resumeAt(cookies []uint64, cookie uint64) (int, error) {
+	if cookie < 2 {
+		return 0, nil
+	}
+	if s.StableCookies {
+		// entries removed since the cookie was handed out are simply skipped over.
+		return sort.Search(len(cookies), func(i int) bool { return cookies[i] > cookie }), nil
+	}
+	if next := cookie - 1; next <= uint64(len(cookies)) {
+		return int(next), nil
+	}
+	return 0, &NFSStatusError{NFSStatusBadCookie, nil}
+}
+
+// nameCookie derives the stable cookie of a directory entry from its name. Cookies are
+// kept within 63 bits, as clients may expose them as signed directory offsets, and above
+// the cookies of '.' and '..'.
+func nameCookie(name string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	cookie := h.Sum64() >> 1
+	if cookie < 2 {
+		cookie += 2
+	}
+	return cookie
+}
+
+// byCookie orders a listing by the cookies of its entries, and by name among entries
+// whose cookies collide.
+type byCookie struct {
+	contents []fs.FileInfo
+	cookies  []uint64
+}
+
+func (b byCookie) Len() int { return len(b.contents) }
+
+func (b byCookie) Less(i, j int) bool {
+	if b.cookies[i] != b.cookies[j] {
+		return b.cookies[i] < b.cookies[j]
+	}
+	return b.contents[i].Name() < b.contents[j].Name()
+}
+
+func (b byCookie) Swap(i, j int) {
+	b.contents[i], b.contents[j] = b.contents[j], b.contents[i]
+	b.cookies[i], b.cookies[j] = b.cookies[j], b.cookies[i]
+}
+
+// invalidateVerifier drops the cached listing and link count of a directory whose entries
+// were changed.
+func (w *response) invalidateVerifier(userHandle Handler, fs billy.Filesystem, dir []string) {
+	w.Server.dirLinks.forget(fs, fs.Join(dir...))
+	if vi, ok := userHandle.(VerifierInvalidator); ok {
+		vi.InvalidateVerifier(fs.Join(dir...))
+	}
+}
+
+// HashPathAndContents is a cookie verifier for the listing `contents` of the directory at
+// `path`, which changes when an entry is added, removed or modified. It is the verifier of
+// listings that are not cached, and of CachingHandler's cached listings.
+func HashPathAndContents(path string, contents []fs.FileInfo) uint64 {
 	//calculate a cookie-verifier.
 	vHash := sha256.New()
 
 	// Add the path to avoid collisions of directories with the same content
+	vHash.Write(binary.BigEndian.AppendUint64([]byte{}, uint64(len(path))))
 	vHash.Write([]byte(path))
 
+	// Include the metadata of each entry, so that a listing is invalidated
+	// when a file changes, not only when it is added or removed.
+	var meta [20]byte
 	for _, c := range contents {
-		vHash.Write([]byte(c.Name())) // Never fails according to the docs
+		name := c.Name()
+		vHash.Write(binary.BigEndian.AppendUint64([]byte{}, uint64(len(name))))
+		vHash.Write([]byte(name)) // Never fails according to the docs
+		binary.BigEndian.PutUint64(meta[0:8], uint64(c.Size()))
+		binary.BigEndian.PutUint64(meta[8:16], uint64(c.ModTime().UnixNano()))
+		binary.BigEndian.PutUint32(meta[16:20], uint32(c.Mode()))
+		vHash.Write(meta[:])
 	}
 
 	verify := vHash.Sum(nil)[0:8]
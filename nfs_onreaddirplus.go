@@ -3,8 +3,8 @@ package nfs
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
 
+	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
@@ -25,6 +25,32 @@ type readDirPlusEntity struct {
 	Next       bool
 }
 
+// fileAttributeSize is the xdr encoded size of a fattr3.
+const fileAttributeSize = 84
+
+// xdrOpaqueSize is the encoded size of variable length opaque data or a string of `n` bytes.
+func xdrOpaqueSize(n int) uint32 {
+	return 4 + uint32((n+3)&^3)
+}
+
+// sizes reports the encoded size of the entry, both in total and counting only the
+// fileid, name and cookie that the client's dircount limits.
+func (e *readDirPlusEntity) sizes() (dir uint32, total uint32) {
+	dir = 8 + xdrOpaqueSize(len(e.Name)) + 8
+	// the optional attributes and handle each carry a presence flag, and
+	// each entry is followed by a flag for the next one.
+	total = dir + 4 + 4 + 4
+	if e.Attributes != nil {
+		total += fileAttributeSize
+	}
+	if e.Handle != nil {
+		total += xdrOpaqueSize(len(*e.Handle))
+	}
+	return dir, total
+}
+
+// joinPath extends the path of a directory into a new slice. The path of a handle may be
+// the one its handler holds, which requests handled at once would race appending to.
 func joinPath(parent []string, elements ...string) []string {
 	joinedPath := make([]string, 0, len(parent)+len(elements))
 	joinedPath = append(joinedPath, parent...)
@@ -32,11 +58,23 @@ func joinPath(parent []string, elements ...string) []string {
 	return joinedPath
 }
 
+// toHandles mints the handles of the entries of a directory, all at once if the handler can.
+func toHandles(userHandle Handler, fs billy.Filesystem, paths [][]string) [][]byte {
+	if batcher, ok := userHandle.(HandleBatcher); ok {
+		return batcher.ToHandles(fs, paths)
+	}
+	handles := make([][]byte, len(paths))
+	for i, path := range paths {
+		handles[i] = userHandle.ToHandle(fs, path)
+	}
+	return handles
+}
+
 func onReadDirPlus(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
 	obj := readDirPlusArgs{}
-	if err := xdr.Read(w.req.Body, &obj); err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+	if err := readArgs(w.req.Body, &obj); err != nil {
+		return errGarbageArgs(err)
 	}
 
 	// in case of test, nfs-client send:
@@ -45,72 +83,117 @@ func onReadDirPlus(ctx context.Context, w *response, userHandle Handler) error {
 	if obj.DirCount < 512 || obj.MaxCount < 4096 {
 		return &NFSStatusError{NFSStatusTooSmall, nil}
 	}
+	if w.datagram {
+		// a listing larger than a datagram would be lost rather than truncated.
+		obj.DirCount = min32(obj.DirCount, MaxUDPTransfer)
+		obj.MaxCount = min32(obj.MaxCount, MaxUDPTransfer)
+	}
 
-	fs, p, err := userHandle.FromHandle(obj.Handle)
+	fs, p, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(p...)); err != nil {
+		return err
 	}
 
-	contents, verifier, err := getDirListingWithVerifier(userHandle, obj.Handle, obj.CookieVerif)
+	contents, verifier, err := getDirListingWithVerifier(ctx, userHandle, obj.Handle, obj.CookieVerif)
 	if err != nil {
 		return err
 	}
-	if obj.Cookie > 0 && obj.CookieVerif > 0 && verifier != obj.CookieVerif {
+	if !w.Server.StableCookies && obj.Cookie > 0 && obj.CookieVerif > 0 && verifier != obj.CookieVerif {
 		return &NFSStatusError{NFSStatusBadCookie, nil}
 	}
+	contents, cookies := w.Server.dirCookies(contents)
+	next, err := w.Server.resumeAt(cookies, obj.Cookie)
+	if err != nil {
+		return err
+	}
 
 	entities := make([]readDirPlusEntity, 0)
 	dirBytes := uint32(0)
-	maxBytes := uint32(100) // conservative overhead measure
+	// the fixed part of the reply: status, directory attributes, verifier,
+	// the flag preceding the first entry and eof.
+	maxBytes := uint32(4 + 4 + fileAttributeSize + 8 + 4 + 4)
+	add := func(e readDirPlusEntity) {
+		d, t := e.sizes()
+		dirBytes += d
+		maxBytes += t
+		entities = append(entities, e)
+	}
 
-	started := obj.Cookie == 0
-	if started {
+	if obj.Cookie == 0 {
 		// add '.' and '..' to entities
-		dotdotFileID := uint64(0)
+		// the parent of the root is the root itself.
+		parent := p
 		if len(p) > 0 {
-			ph := userHandle.ToHandle(fs, p[0:len(p)-1])
-			dotdotFileID = binary.BigEndian.Uint64(ph[0:8])
+			parent = p[0 : len(p)-1]
 		}
-		entities = append(entities,
-			readDirPlusEntity{Name: []byte("."), Cookie: 0, Next: true, FileID: binary.BigEndian.Uint64(obj.Handle[0:8])},
-			readDirPlusEntity{Name: []byte(".."), Cookie: 1, Next: true, FileID: dotdotFileID},
-		)
+		dotdotFileID := w.fileID(fs, parent, nil)
+		add(readDirPlusEntity{Name: []byte("."), Cookie: 0, Next: true, FileID: w.fileID(fs, p, nil)})
+		add(readDirPlusEntity{Name: []byte(".."), Cookie: 1, Next: true, FileID: dotdotFileID})
 	}
 
-	eof := true
 	maxEntities := userHandle.HandleLimit() / 2
-	for i, c := range contents {
-		// cookie equates to index within contents + 2 (for '.' and '..')
-		cookie := uint64(i + 2)
-		if started {
-			dirBytes += uint32(len(c.Name()) + 20)
-			maxBytes += 512 // TODO: better estimation.
-			if dirBytes > obj.DirCount || maxBytes > obj.MaxCount || len(entities) > maxEntities {
-				eof = false
+	// entries are picked as though their handles were as long as a handle may be, so that
+	// the handles of those picked are minted together and still fit. Shorter handles leave
+	// room for another round of entries.
+	longest := make([]byte, FHSize)
+	i := next
+	for i < len(contents) {
+		var picked []readDirPlusEntity
+		var paths [][]string
+		dirFree, maxFree := dirBytes, maxBytes
+		capped := false
+		for ; i < len(contents); i++ {
+			if len(entities)+len(picked) >= maxEntities {
+				capped = true
 				break
 			}
-
-			handle := userHandle.ToHandle(fs, joinPath(p, c.Name()))
-			attrs := ToFileAttribute(c)
-			attrs.Fileid = binary.BigEndian.Uint64(handle[0:8])
-			entities = append(entities, readDirPlusEntity{
+			c := contents[i]
+			path := joinPath(p, c.Name())
+			attrs := w.attributesOf(fs, path, c)
+			e := readDirPlusEntity{
 				FileID:     attrs.Fileid,
-				Name:       []byte(c.Name()),
-				Cookie:     cookie,
+				Name:       []byte(w.Server.Export.normalizedName(c.Name())),
+				Cookie:     cookies[i],
 				Attributes: attrs,
-				Handle:     &handle,
+				Handle:     &longest,
 				Next:       true,
-			})
-		} else if cookie == obj.Cookie {
-			started = true
+			}
+			d, t := e.sizes()
+			if dirFree+d > obj.DirCount || maxFree+t > obj.MaxCount {
+				break
+			}
+			dirFree += d
+			maxFree += t
+			picked = append(picked, e)
+			paths = append(paths, path)
+		}
+		for j, handle := range toHandles(userHandle, fs, paths) {
+			e := picked[j]
+			e.Handle = nil
+			if len(handle) > 0 {
+				handle := handle
+				e.Handle = &handle
+			}
+			add(e)
 		}
+		if len(picked) == 0 || capped {
+			break
+		}
+	}
+	eof := i == len(contents)
+	if !eof && len(entities) == 0 {
+		// not even one entry fits in the reply the client allows.
+		return &NFSStatusError{NFSStatusTooSmall, nil}
 	}
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, p)); err != nil {
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, p)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 	if err := xdr.Write(writer, verifier); err != nil {
@@ -133,7 +216,6 @@ func onReadDirPlus(ctx context.Context, w *response, userHandle Handler) error {
 	if err := xdr.Write(writer, eof); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	// TODO: track writer size at this point to validate maxcount estimation and stop early if needed.
 
 	if err := w.Write(writer.Bytes()); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
@@ -3,25 +3,30 @@ package nfs
 import (
 	"bytes"
 	"context"
+	"errors"
 	"os"
 
+	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
 func onReadLink(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = opAttrErrorFormatter
-	handle, err := xdr.ReadOpaque(w.req.Body)
+	handle, err := readOpaque(w.req.Body)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
-	fs, path, err := userHandle.FromHandle(handle)
+	fs, path, err := fromHandle(ctx, userHandle, handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
 	}
 
 	out, err := fs.Readlink(fs.Join(path...))
 	if err != nil {
-		if info, err := fs.Stat(fs.Join(path...)); err == nil {
+		if errors.Is(err, billy.ErrNotSupported) {
+			return &NFSStatusError{NFSStatusNotSupp, err}
+		}
+		if info, statErr := fs.Lstat(fs.Join(path...)); statErr == nil {
 			if info.Mode()&os.ModeSymlink == 0 {
 				return &NFSStatusError{NFSStatusInval, err}
 			}
@@ -37,7 +42,7 @@ func onReadLink(ctx context.Context, w *response, userHandle Handler) error {
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, path)); err != nil {
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
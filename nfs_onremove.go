@@ -12,56 +12,53 @@ import (
 func onRemove(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	obj := DirOpArg{}
-	if err := xdr.Read(w.req.Body, &obj); err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+	if err := readArgs(w.req.Body, &obj); err != nil {
+		return errGarbageArgs(err)
 	}
-	fs, path, err := userHandle.FromHandle(obj.Handle)
+	obj.Filename = w.Server.Export.normalizeName(obj.Filename)
+	fs, path, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(path...)); err != nil {
+		return err
 	}
 
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 
-	if len(string(obj.Filename)) > PathNameMax {
-		return &NFSStatusError{NFSStatusNameTooLong, nil}
+	if err := checkName(fs, obj.Filename); err != nil {
+		return err
 	}
 
 	dirInfo, err := fs.Stat(fs.Join(path...))
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
-		}
-		if os.IsPermission(err) {
-			return &NFSStatusError{NFSStatusAccess, err}
-		}
-		return &NFSStatusError{NFSStatusIO, err}
+		return &NFSStatusError{StatusFromError(err), err}
 	}
 	if !dirInfo.IsDir() {
 		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
-	preCacheData := ToFileAttribute(dirInfo).AsCache()
+	preCacheData := w.fileAttribute(dirInfo).AsCache()
 
-	toDelete := fs.Join(append(path, string(obj.Filename))...)
+	toDelete := fs.Join(joinPath(path, string(obj.Filename))...)
+	if err := w.flushWrites(fs, toDelete); err != nil {
+		return err
+	}
 
 	err = fs.Remove(toDelete)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
-		}
-		if os.IsPermission(err) {
-			return &NFSStatusError{NFSStatusAccess, err}
-		}
-		return &NFSStatusError{NFSStatusIO, err}
+		return &NFSStatusError{StatusFromError(err), err}
 	}
+	w.invalidateVerifier(userHandle, fs, path)
+	w.Server.dirLinks.forgetTree(fs, toDelete)
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	if err := WriteWcc(writer, preCacheData, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, preCacheData, w.tryStat(fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
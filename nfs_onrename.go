@@ -14,22 +14,30 @@ var doubleWccErrorBody = [16]byte{}
 func onRename(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = errFormatterWithBody(doubleWccErrorBody[:])
 	from := DirOpArg{}
-	err := xdr.Read(w.req.Body, &from)
+	err := readArgs(w.req.Body, &from)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
-	fs, fromPath, err := userHandle.FromHandle(from.Handle)
+	from.Filename = w.Server.Export.normalizeName(from.Filename)
+	fs, fromPath, err := fromHandle(ctx, userHandle, from.Handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(fromPath...)); err != nil {
+		return err
 	}
 
 	to := DirOpArg{}
-	if err = xdr.Read(w.req.Body, &to); err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+	if err = readArgs(w.req.Body, &to); err != nil {
+		return errGarbageArgs(err)
 	}
-	fs2, toPath, err := userHandle.FromHandle(to.Handle)
+	to.Filename = w.Server.Export.normalizeName(to.Filename)
+	fs2, toPath, err := fromHandle(ctx, userHandle, to.Handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs2, fs2.Join(toPath...)); err != nil {
+		return err
 	}
 	if fs != fs2 {
 		return &NFSStatusError{NFSStatusNotSupp, os.ErrPermission}
@@ -39,46 +47,77 @@ func onRename(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 
-	if len(string(from.Filename)) > PathNameMax || len(string(to.Filename)) > PathNameMax {
-		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
+	if err := checkName(fs, from.Filename); err != nil {
+		return err
+	}
+	if err := checkName(fs, to.Filename); err != nil {
+		return err
 	}
 
 	fromDirInfo, err := fs.Stat(fs.Join(fromPath...))
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
-		}
-		return &NFSStatusError{NFSStatusIO, err}
+		return &NFSStatusError{StatusFromError(err), err}
 	}
 	if !fromDirInfo.IsDir() {
 		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
-	preCacheData := ToFileAttribute(fromDirInfo).AsCache()
+	preCacheData := w.fileAttribute(fromDirInfo).AsCache()
 
 	toDirInfo, err := fs.Stat(fs.Join(toPath...))
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
-		}
-		return &NFSStatusError{NFSStatusIO, err}
+		return &NFSStatusError{StatusFromError(err), err}
 	}
 	if !toDirInfo.IsDir() {
 		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
-	preDestData := ToFileAttribute(toDirInfo).AsCache()
+	preDestData := w.fileAttribute(toDirInfo).AsCache()
 
-	fromLoc := fs.Join(append(fromPath, string(from.Filename))...)
-	toLoc := fs.Join(append(toPath, string(to.Filename))...)
+	fromLoc := fs.Join(joinPath(fromPath, string(from.Filename))...)
+	toLoc := fs.Join(joinPath(toPath, string(to.Filename))...)
+	if err := w.flushWrites(fs, fromLoc); err != nil {
+		return err
+	}
+	if err := w.flushWrites(fs, toLoc); err != nil {
+		return err
+	}
 
-	err = fs.Rename(fromLoc, toLoc)
+	fromInfo, err := fs.Lstat(fromLoc)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return &NFSStatusError{NFSStatusNoEnt, err}
+		return &NFSStatusError{StatusFromError(err), err}
+	}
+	if toInfo, err := fs.Lstat(toLoc); err == nil {
+		// an existing target is replaced, provided it is compatible with the source.
+		if fromInfo.IsDir() != toInfo.IsDir() {
+			return &NFSStatusError{NFSStatusExist, os.ErrExist}
 		}
-		if os.IsPermission(err) {
-			return &NFSStatusError{NFSStatusAccess, err}
+		if toInfo.IsDir() && fromLoc != toLoc {
+			contents, err := fs.ReadDir(toLoc)
+			if err != nil {
+				return &NFSStatusError{NFSStatusIO, err}
+			}
+			if len(contents) > 0 {
+				return &NFSStatusError{NFSStatusNotEmpty, os.ErrExist}
+			}
+			if err := fs.Remove(toLoc); err != nil {
+				return &NFSStatusError{NFSStatusIO, err}
+			}
 		}
-		return &NFSStatusError{NFSStatusIO, err}
+	}
+
+	if fromLoc != toLoc {
+		err = fs.Rename(fromLoc, toLoc)
+	}
+	if err != nil {
+		return &NFSStatusError{StatusFromError(err), err}
+	}
+	w.invalidateVerifier(userHandle, fs, fromPath)
+	w.invalidateVerifier(userHandle, fs, toPath)
+	if fromLoc != toLoc {
+		w.Server.dirLinks.forgetTree(fs, fromLoc)
+		w.Server.dirLinks.forgetTree(fs, toLoc)
+	}
+	if renamer, ok := userHandle.(HandleRenamer); ok && fromLoc != toLoc {
+		renamer.RenameHandles(fs, joinPath(fromPath, string(from.Filename)), joinPath(toPath, string(to.Filename)))
 	}
 
 	writer := bytes.NewBuffer([]byte{})
@@ -86,10 +125,10 @@ func onRename(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	if err := WriteWcc(writer, preCacheData, tryStat(fs, fromPath)); err != nil {
+	if err := WriteWcc(writer, preCacheData, w.tryStat(fs, fromPath)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WriteWcc(writer, preDestData, tryStat(fs, toPath)); err != nil {
+	if err := WriteWcc(writer, preDestData, w.tryStat(fs, toPath)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -11,20 +11,26 @@ import (
 
 func onSetAttr(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
-	handle, err := xdr.ReadOpaque(w.req.Body)
+	handle, err := readOpaque(w.req.Body)
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
 
-	fs, path, err := userHandle.FromHandle(handle)
+	fs, path, err := fromHandle(ctx, userHandle, handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
 	}
-	attrs, err := ReadSetFileAttributes(w.req.Body)
+	if err := w.checkLinks(fs, fs.Join(path...)); err != nil {
+		return err
+	}
+	attrs, err := w.readSetFileAttributes()
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	}
 
+	if err := w.flushWrites(fs, fs.Join(path...)); err != nil {
+		return err
+	}
 	info, err := fs.Lstat(fs.Join(path...))
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -35,14 +41,14 @@ func onSetAttr(ctx context.Context, w *response, userHandle Handler) error {
 
 	// see if there's a "guard"
 	if guard, err := xdr.ReadUint32(w.req.Body); err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return errGarbageArgs(err)
 	} else if guard != 0 {
 		// read the ctime.
 		t := FileTime{}
-		if err := xdr.Read(w.req.Body, &t); err != nil {
-			return &NFSStatusError{NFSStatusInval, err}
+		if err := readArgs(w.req.Body, &t); err != nil {
+			return errGarbageArgs(err)
 		}
-		attr := ToFileAttribute(info)
+		attr := w.fileAttribute(info)
 		if t != attr.Ctime {
 			return &NFSStatusError{NFSStatusNotSync, nil}
 		}
@@ -58,13 +64,13 @@ func onSetAttr(ctx context.Context, w *response, userHandle Handler) error {
 		return err
 	}
 
-	preAttr := ToFileAttribute(info).AsCache()
+	preAttr := w.fileAttribute(info).AsCache()
 
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WriteWcc(writer, preAttr, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, preAttr, w.tryStat(fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
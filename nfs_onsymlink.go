@@ -3,43 +3,66 @@ package nfs
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io"
 	"os"
+	"time"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
 )
 
-func onSymlink(ctx context.Context, w *response, userHandle Handler) error {
-	w.errorFmt = wccDataErrorFormatter
-	obj := DirOpArg{}
-	err := xdr.Read(w.req.Body, &obj)
-	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+// symlinkArgs are the arguments of a SYMLINK.
+type symlinkArgs struct {
+	DirOpArg
+	Attrs  *SetFileAttributes
+	Target []byte
+}
+
+// readSymlinkArgs decodes the arguments of a SYMLINK, with times set to the server's time
+// set to `now`.
+func readSymlinkArgs(body io.Reader, now time.Time) (symlinkArgs, error) {
+	var args symlinkArgs
+	var err error
+	if err = readArgs(body, &args.DirOpArg); err != nil {
+		return args, errGarbageArgs(err)
 	}
-	attrs, err := ReadSetFileAttributes(w.req.Body)
-	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+	if args.Attrs, err = readSetFileAttributesAt(body, now); err != nil {
+		return args, errGarbageArgs(err)
 	}
+	if args.Target, err = readOpaque(body); err != nil {
+		return args, errGarbageArgs(err)
+	}
+	return args, nil
+}
 
-	target, err := xdr.ReadOpaque(w.req.Body)
+func onSymlink(ctx context.Context, w *response, userHandle Handler) error {
+	w.errorFmt = wccDataErrorFormatter
+	args, err := readSymlinkArgs(w.req.Body, w.Server.now())
 	if err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+		return err
 	}
+	obj, attrs, target := args.DirOpArg, args.Attrs, args.Target
+	obj.Filename = w.Server.Export.normalizeName(obj.Filename)
+	w.mapSetFileAttributes(attrs)
 
-	fs, path, err := userHandle.FromHandle(obj.Handle)
+	fs, path, err := fromHandle(ctx, userHandle, obj.Handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(path...)); err != nil {
+		return err
 	}
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
 	}
 
-	if len(string(obj.Filename)) > PathNameMax {
-		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
+	if err := checkName(fs, obj.Filename); err != nil {
+		return err
 	}
 
-	newFilePath := fs.Join(append(path, string(obj.Filename))...)
-	if _, err := fs.Stat(newFilePath); err == nil {
+	newFilePath := fs.Join(joinPath(path, string(obj.Filename))...)
+	if _, err := fs.Lstat(newFilePath); err == nil {
 		return &NFSStatusError{NFSStatusExist, os.ErrExist}
 	}
 	if s, err := fs.Stat(fs.Join(path...)); err != nil {
@@ -48,12 +71,22 @@ func onSymlink(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusNotDir, nil}
 	}
 
+	pre := w.preOpAttrs(fs, path)
 	err = fs.Symlink(string(target), newFilePath)
 	if err != nil {
+		if errors.Is(err, billy.ErrNotSupported) {
+			return &NFSStatusError{NFSStatusNotSupp, err}
+		}
+		if os.IsExist(err) {
+			return &NFSStatusError{NFSStatusExist, err}
+		}
 		return &NFSStatusError{NFSStatusAccess, err}
 	}
+	w.invalidateVerifier(userHandle, fs, path)
 
-	fp := userHandle.ToHandle(fs, append(path, string(obj.Filename)))
+	fp := userHandle.ToHandle(fs, joinPath(path, string(obj.Filename)))
+	// the mode of a symlink is not meaningful, and chmod would follow it to its target.
+	attrs.SetMode = nil
 	changer := userHandle.Change(fs)
 	if changer != nil {
 		if err := attrs.Apply(changer, fs, newFilePath); err != nil {
@@ -66,18 +99,14 @@ func onSymlink(ctx context.Context, w *response, userHandle Handler) error {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	// "handle follows"
-	if err := xdr.Write(writer, uint32(1)); err != nil {
-		return &NFSStatusError{NFSStatusServerFault, err}
-	}
-	if err := xdr.Write(writer, fp); err != nil {
+	if err := writePostOpFH(writer, fp); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := WritePostOpAttrs(writer, tryStat(fs, append(path, string(obj.Filename)))); err != nil {
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, joinPath(path, string(obj.Filename)))); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	if err := WriteWcc(writer, nil, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, pre, w.tryStat(fs, path)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
@@ -20,6 +20,11 @@ const (
 	fileSync writeStability = 2
 )
 
+// syncer is implemented by billy files that can flush their data to stable storage, such as those of osfs.
+type syncer interface {
+	Sync() error
+}
+
 type writeArgs struct {
 	Handle []byte
 	Offset uint64
@@ -28,16 +33,52 @@ type writeArgs struct {
 	Data   []byte
 }
 
+// readWriteArgs decodes the arguments of a WRITE, reading its data into a buffer from
+// `pool` that must be returned once the data is written.
+func readWriteArgs(body io.Reader, req *writeArgs, pool *bufferPool) (*[]byte, error) {
+	var header struct {
+		Handle []byte
+		Offset uint64
+		Count  uint32
+		How    uint32
+	}
+	if err := readArgs(body, &header); err != nil {
+		return nil, errGarbageArgs(err)
+	}
+	n, err := xdr.ReadUint32(body)
+	if err != nil {
+		return nil, errGarbageArgs(err)
+	}
+	if n > math.MaxInt32 {
+		return nil, &NFSStatusError{NFSStatusFBig, os.ErrInvalid}
+	}
+	// do not allocate more than the request could be carrying.
+	if limited, ok := body.(*io.LimitedReader); ok && int64(n) > limited.N {
+		return nil, errGarbageArgs(io.ErrUnexpectedEOF)
+	}
+	buf := pool.get(int(n))
+	if _, err := io.ReadFull(body, *buf); err != nil {
+		return nil, errGarbageArgs(err)
+	}
+	*req = writeArgs{header.Handle, header.Offset, header.Count, header.How, *buf}
+	return buf, nil
+}
+
 func onWrite(ctx context.Context, w *response, userHandle Handler) error {
 	w.errorFmt = wccDataErrorFormatter
 	var req writeArgs
-	if err := xdr.Read(w.req.Body, &req); err != nil {
-		return &NFSStatusError{NFSStatusInval, err}
+	buf, err := readWriteArgs(w.req.Body, &req, &w.Server.buffers)
+	if err != nil {
+		return err
 	}
+	defer w.Server.buffers.put(buf, w.Server.pooledBufferSize())
 
-	fs, path, err := userHandle.FromHandle(req.Handle)
+	fs, path, err := fromHandle(ctx, userHandle, req.Handle)
 	if err != nil {
-		return &NFSStatusError{NFSStatusStale, err}
+		return handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(path...)); err != nil {
+		return err
 	}
 	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
 		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
@@ -57,10 +98,55 @@ func onWrite(ctx context.Context, w *response, userHandle Handler) error {
 		}
 		return &NFSStatusError{NFSStatusAccess, err}
 	}
+	if info.IsDir() {
+		return &NFSStatusError{NFSStatusIsDir, os.ErrInvalid}
+	}
 	if !info.Mode().IsRegular() {
 		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
 	}
-	preOpCache := ToFileAttribute(info).AsCache()
+	key := writeBackKey{fs, fs.Join(path...)}
+	size := info.Size()
+	if w.Server.WriteBackSize > 0 {
+		size = w.Server.writeBacks.sizeOf(key, size)
+	}
+	preOpCache := w.fileAttribute(info).AsCache()
+	preOpCache.Filesize = uint64(size)
+	end := req.Count
+	if len(req.Data) < int(end) {
+		end = uint32(len(req.Data))
+	}
+	data := req.Data[:end]
+	if limit := w.Server.MaxFileSize; limit > 0 && (req.Offset > uint64(limit) || req.Offset+uint64(len(data)) > uint64(limit)) {
+		return &NFSStatusError{NFSStatusFBig, os.ErrInvalid}
+	}
+	release, err := w.reserveGrowth(ctx, fs, growth(size, req.Offset, len(data)))
+	if err != nil {
+		return err
+	}
+	var grown int64
+	defer func() { release(grown) }()
+
+	if w.Server.WriteBackSize > 0 {
+		held := false
+		if req.How == uint32(unstable) {
+			held, err = w.Server.writeBacks.hold(key, int64(req.Offset), data, info.Mode().Perm(), w.Server.WriteBackSize, w.Server.writeBackDelay())
+			if err != nil {
+				return &NFSStatusError{NFSStatusIO, err}
+			}
+		}
+		if held {
+			grown = growth(size, req.Offset, len(data))
+			post := w.tryStat(fs, path)
+			if post != nil {
+				post.Filesize = uint64(w.Server.writeBacks.sizeOf(key, int64(post.Filesize)))
+			}
+			return w.writeWriteResult(preOpCache, post, len(data), unstable)
+		}
+		// writes held for the file go first.
+		if err := w.flushWrites(fs, key.path); err != nil {
+			return err
+		}
+	}
 
 	// now the actual op.
 	file, err := fs.OpenFile(fs.Join(path...), os.O_RDWR, info.Mode().Perm())
@@ -72,35 +158,64 @@ func onWrite(ctx context.Context, w *response, userHandle Handler) error {
 			return &NFSStatusError{NFSStatusIO, err}
 		}
 	}
-	end := req.Count
-	if len(req.Data) < int(end) {
-		end = uint32(len(req.Data))
+	writtenCount := 0
+	for writtenCount < len(data) {
+		if err := ctx.Err(); err != nil {
+			_ = file.Close()
+			return err
+		}
+		chunk := data[writtenCount:]
+		if len(chunk) > transferChunkSize {
+			chunk = chunk[:transferChunkSize]
+		}
+		if err := w.writeLimiter.wait(ctx, len(chunk)); err != nil {
+			_ = file.Close()
+			return err
+		}
+		n, err := file.Write(chunk)
+		writtenCount += n
+		grown = growth(size, req.Offset, writtenCount)
+		if err != nil {
+			Log.Errorf("Error writing: %v", err)
+			return &NFSStatusError{NFSStatusIO, err}
+		}
 	}
-	writtenCount, err := file.Write(req.Data[:end])
-	if err != nil {
-		Log.Errorf("Error writing: %v", err)
-		return &NFSStatusError{NFSStatusIO, err}
+	// backends that cannot sync have no firmer guarantee to offer than the write itself.
+	committed := fileSync
+	if s, ok := file.(syncer); ok {
+		if req.How == uint32(unstable) {
+			// left for COMMIT to flush.
+			committed = unstable
+		} else if err := s.Sync(); err != nil {
+			Log.Errorf("error syncing: %v", err)
+			_ = file.Close()
+			return &NFSStatusError{NFSStatusIO, err}
+		}
 	}
 	if err := file.Close(); err != nil {
 		Log.Errorf("error closing: %v", err)
 		return &NFSStatusError{NFSStatusIO, err}
 	}
+	return w.writeWriteResult(preOpCache, w.tryStat(fs, path), writtenCount, committed)
+}
 
+// writeWriteResult answers a WRITE of `count` bytes, committed as `committed`.
+func (w *response) writeWriteResult(pre *FileCacheAttribute, post *FileAttribute, count int, committed writeStability) error {
 	writer := bytes.NewBuffer([]byte{})
 	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
-	if err := WriteWcc(writer, preOpCache, tryStat(fs, path)); err != nil {
+	if err := WriteWcc(writer, pre, post); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := xdr.Write(writer, uint32(writtenCount)); err != nil {
+	if err := xdr.Write(writer, uint32(count)); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := xdr.Write(writer, fileSync); err != nil {
+	if err := xdr.Write(writer, committed); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
-	if err := xdr.Write(writer, w.Server.ID); err != nil {
+	if err := xdr.Write(writer, w.Server.bootVerifier); err != nil {
 		return &NFSStatusError{NFSStatusServerFault, err}
 	}
 
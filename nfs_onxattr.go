@@ -0,0 +1,213 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sort"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// XattrNameMax is the maximum length of the name of an extended attribute.
+const XattrNameMax = 255
+
+// How SETXATTR treats an attribute that is already set, as the setxattr_option4 of RFC 8276.
+const (
+	setXattrEither uint32 = iota
+	setXattrCreate
+	setXattrReplace
+)
+
+// xattrTarget resolves the file of an xattr procedure, and the XattrFS it is stored in.
+func (w *response) xattrTarget(ctx context.Context, userHandle Handler, fh []byte) (XattrFS, billy.Filesystem, []string, error) {
+	fs, path, err := fromHandle(ctx, userHandle, fh)
+	if err != nil {
+		return nil, nil, nil, handleError(err)
+	}
+	if err := w.checkLinks(fs, fs.Join(path...)); err != nil {
+		return nil, nil, nil, err
+	}
+	xfs, ok := fs.(XattrFS)
+	if !ok {
+		return nil, nil, nil, &NFSStatusError{NFSStatusNotSupp, billy.ErrNotSupported}
+	}
+	return xfs, fs, path, nil
+}
+
+// checkXattrName validates the name of an extended attribute.
+func checkXattrName(name string) error {
+	if name == "" {
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+	if len(name) > XattrNameMax {
+		return &NFSStatusError{NFSStatusNameTooLong, os.ErrInvalid}
+	}
+	return nil
+}
+
+func onGetXattr(ctx context.Context, w *response, userHandle Handler) error {
+	w.errorFmt = opAttrErrorFormatter
+	var obj struct {
+		Handle []byte
+		Name   string
+	}
+	if err := readArgs(w.req.Body, &obj); err != nil {
+		return errGarbageArgs(err)
+	}
+	xfs, fs, path, err := w.xattrTarget(ctx, userHandle, obj.Handle)
+	if err != nil {
+		return err
+	}
+	if err := checkXattrName(obj.Name); err != nil {
+		return err
+	}
+
+	value, err := xfs.Getxattr(fs.Join(path...), obj.Name)
+	if err != nil {
+		return &NFSStatusError{StatusFromError(err), err}
+	}
+
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, path)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := xdr.Write(writer, value); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := w.Write(writer.Bytes()); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
+}
+
+func onSetXattr(ctx context.Context, w *response, userHandle Handler) error {
+	w.errorFmt = wccDataErrorFormatter
+	var obj struct {
+		Handle []byte
+		Option uint32
+		Name   string
+		Value  []byte
+	}
+	if err := readArgs(w.req.Body, &obj); err != nil {
+		return errGarbageArgs(err)
+	}
+	xfs, fs, path, err := w.xattrTarget(ctx, userHandle, obj.Handle)
+	if err != nil {
+		return err
+	}
+	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+	}
+	if err := checkXattrName(obj.Name); err != nil {
+		return err
+	}
+	if obj.Option > setXattrReplace {
+		return &NFSStatusError{NFSStatusInval, os.ErrInvalid}
+	}
+
+	file := fs.Join(path...)
+	info, err := fs.Lstat(file)
+	if err != nil {
+		return &NFSStatusError{StatusFromError(err), err}
+	}
+	if obj.Option != setXattrEither {
+		_, err := xfs.Getxattr(file, obj.Name)
+		switch {
+		case err == nil && obj.Option == setXattrCreate:
+			return &NFSStatusError{NFSStatusExist, os.ErrExist}
+		case errors.Is(err, os.ErrNotExist) && obj.Option == setXattrReplace:
+			return &NFSStatusError{NFSStatusNoEnt, err}
+		case err != nil && !errors.Is(err, os.ErrNotExist):
+			return &NFSStatusError{StatusFromError(err), err}
+		}
+	}
+	if err := xfs.Setxattr(file, obj.Name, obj.Value); err != nil {
+		return &NFSStatusError{StatusFromError(err), err}
+	}
+	return w.writeXattrWcc(w.fileAttribute(info).AsCache(), fs, path)
+}
+
+func onListXattrs(ctx context.Context, w *response, userHandle Handler) error {
+	w.errorFmt = opAttrErrorFormatter
+	handle, err := readOpaque(w.req.Body)
+	if err != nil {
+		return errGarbageArgs(err)
+	}
+	xfs, fs, path, err := w.xattrTarget(ctx, userHandle, handle)
+	if err != nil {
+		return err
+	}
+
+	names, err := xfs.Listxattr(fs.Join(path...))
+	if err != nil {
+		return &NFSStatusError{StatusFromError(err), err}
+	}
+	sort.Strings(names)
+
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := WritePostOpAttrs(writer, w.tryStat(fs, path)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := xdr.Write(writer, names); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := w.Write(writer.Bytes()); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
+}
+
+func onRemoveXattr(ctx context.Context, w *response, userHandle Handler) error {
+	w.errorFmt = wccDataErrorFormatter
+	var obj struct {
+		Handle []byte
+		Name   string
+	}
+	if err := readArgs(w.req.Body, &obj); err != nil {
+		return errGarbageArgs(err)
+	}
+	xfs, fs, path, err := w.xattrTarget(ctx, userHandle, obj.Handle)
+	if err != nil {
+		return err
+	}
+	if !billy.CapabilityCheck(fs, billy.WriteCapability) {
+		return &NFSStatusError{NFSStatusROFS, os.ErrPermission}
+	}
+	if err := checkXattrName(obj.Name); err != nil {
+		return err
+	}
+
+	file := fs.Join(path...)
+	info, err := fs.Lstat(file)
+	if err != nil {
+		return &NFSStatusError{StatusFromError(err), err}
+	}
+	if err := xfs.Removexattr(file, obj.Name); err != nil {
+		return &NFSStatusError{StatusFromError(err), err}
+	}
+	return w.writeXattrWcc(w.fileAttribute(info).AsCache(), fs, path)
+}
+
+// writeXattrWcc answers a procedure that changed the extended attributes of a file.
+func (w *response) writeXattrWcc(pre *FileCacheAttribute, fs billy.Filesystem, path []string) error {
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, uint32(NFSStatusOk)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := WriteWcc(writer, pre, w.tryStat(fs, path)); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	if err := w.Write(writer.Bytes()); err != nil {
+		return &NFSStatusError{NFSStatusServerFault, err}
+	}
+	return nil
+}
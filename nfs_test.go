@@ -2,16 +2,29 @@ package nfs_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	nfs "github.com/willscott/go-nfs"
 	"github.com/willscott/go-nfs/helpers"
 
+	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
 	nfsc "github.com/willscott/go-nfs-client/nfs"
 	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
 	"github.com/willscott/go-nfs-client/nfs/xdr"
@@ -257,3 +270,2962 @@ func readDir(target *nfsc.Target, dir string) ([]*readDirEntry, error) {
 
 	return entries, nil
 }
+
+// startServer serves srv on a local listener for the duration of the test,
+// returning the address it is listening on.
+func startServer(t testing.TB, srv *nfs.Server) string {
+	t.Helper()
+	return startServerOn(t, srv, "localhost:0")
+}
+
+// startServerOn is startServer with an explicit listen address.
+func startServerOn(t testing.TB, srv *nfs.Server, addr string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", addr, err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	return listener.Addr().String()
+}
+
+// dialServer connects an RPC client to a server started with startServer.
+func dialServer(t testing.TB, addr string) *rpc.Client {
+	t.Helper()
+	c, err := rpc.DialTCP("tcp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// mountServer mounts the root export over an RPC client.
+func mountServer(t testing.TB, c *rpc.Client, auth rpc.Auth) *nfsc.Target {
+	t.Helper()
+	mounter := nfsc.Mount{Client: c}
+	target, err := mounter.Mount("/", auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+// newMemHandler returns a caching handler over an in-memory filesystem.
+func newMemHandler(t *testing.T) (billy.Filesystem, nfs.Handler) {
+	t.Helper()
+	mem := memfs.New()
+	// File needs to exist in the root for memfs to acknowledge the root exists.
+	_, _ = mem.Create("/test")
+	return mem, helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)
+}
+
+func TestAccessHonorsModeBits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file ownership is not reported on windows")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "owned.txt"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bfs := osfs.New(dir)
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(bfs), 1024)
+	addr := startServer(t, &nfs.Server{Handler: handler})
+
+	const modify, read = 0x4, 0x1
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	for _, tc := range []struct {
+		name     string
+		uid, gid uint32
+		expected uint32
+	}{
+		{"owner", uid, gid, read | modify},
+		{"other", uid + 1, gid + 1, read},
+	} {
+		if tc.name == "other" && uid == 0 {
+			// root already owns the file; uid 1 is an ordinary user.
+			tc.uid, tc.gid = 1, 1
+		}
+		target := mountServer(t, dialServer(t, addr), rpc.NewAuthUnix("client.example", tc.uid, tc.gid).Auth())
+		granted, err := target.Access("/owned.txt", read|modify)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if granted != tc.expected {
+			t.Errorf("%s was granted access %#x, expected %#x", tc.name, granted, tc.expected)
+		}
+	}
+}
+
+// setAttr issues a SETATTR call without a guard and returns the status and wcc data of the reply.
+func TestIDMapper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file ownership is not reported on windows")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "owned.txt"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(osfs.New(dir)), 1024)
+	recorder := &credRecordingHandler{handler, make(chan nfs.UnixCredential, 1)}
+
+	// the client knows the owner of the files as uid 1000, whatever uid the server runs as.
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	clientUID, clientGID := uint32(1000), uint32(1000)
+	if uid == clientUID {
+		clientUID = 5000
+	}
+	if gid == clientGID {
+		clientGID = 5000
+	}
+	mapper := helpers.NewStaticIDMapper(map[uint32]uint32{clientUID: uid}, map[uint32]uint32{clientGID: gid})
+	srv := &nfs.Server{Handler: recorder, Export: nfs.ExportOptions{IDMapper: mapper}}
+	target := mountServer(t, dialServer(t, startServer(t, srv)), rpc.NewAuthUnix("client.example", clientUID, clientGID).Auth())
+
+	if cred := <-recorder.mounted; cred.UID != uid || cred.GID != gid {
+		t.Fatalf("client identity was not mapped in: %+v", cred)
+	}
+	attr, err := target.Getattr("/owned.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr.UID != clientUID || attr.GID != clientGID {
+		t.Fatalf("expected the owner to be mapped to %d:%d, got %d:%d", clientUID, clientGID, attr.UID, attr.GID)
+	}
+	const modify, read = 0x4, 0x1
+	if granted, err := target.Access("/owned.txt", read|modify); err != nil || granted != read|modify {
+		t.Fatalf("mapped owner was granted access %#x: %v", granted, err)
+	}
+}
+
+func setAttr(t *testing.T, target *nfsc.Target, fh []byte, sattr nfsc.Sattr3) (nfs.NFSStatus, nfsc.WccData) {
+	t.Helper()
+	return setAttrGuarded(t, target, fh, sattr, nfsc.Sattrguard3{})
+}
+
+// setAttrGuarded issues a SETATTR call and returns the status and wcc data of the reply.
+func setAttrGuarded(t *testing.T, target *nfsc.Target, fh []byte, sattr nfsc.Sattr3, guard nfsc.Sattrguard3) (nfs.NFSStatus, nfsc.WccData) {
+	t.Helper()
+	type setAttrArgs struct {
+		rpc.Header
+		Handle []byte
+		Sattr  nfsc.Sattr3
+		Guard  nfsc.Sattrguard3
+	}
+	res, err := target.Call(&setAttrArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureSetAttr),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle: fh,
+		Sattr:  sattr,
+		Guard:  guard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wcc nfsc.WccData
+	if err := xdr.Read(res, &wcc); err != nil {
+		t.Fatal(err)
+	}
+	return nfs.NFSStatus(status), wcc
+}
+
+func TestSetAttrSize(t *testing.T) {
+	mem, handler := newMemHandler(t)
+	f, err := mem.Create("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte("0123456789"))
+	_ = f.Close()
+
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		size     uint64
+		contents string
+	}{
+		{4, "0123"},
+		{4, "0123"},
+		{6, "0123\x00\x00"},
+	} {
+		before, err := mem.Stat("/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, wcc := setAttr(t, target, fh, nfsc.Sattr3{Size: nfsc.SetSize{SetIt: true, Size: tc.size}})
+		if status != nfs.NFSStatusOk {
+			t.Fatalf("setattr to size %d failed: %v", tc.size, status)
+		}
+		if wcc.Before.Size != uint64(before.Size()) || wcc.After.Attr.Filesize != tc.size {
+			t.Fatalf("wcc reported size %d -> %d, expected %d -> %d", wcc.Before.Size, wcc.After.Attr.Filesize, before.Size(), tc.size)
+		}
+		contents, err := util.ReadFile(mem, "/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != tc.contents {
+			t.Fatalf("file contains %q after truncating to %d, expected %q", contents, tc.size, tc.contents)
+		}
+	}
+}
+
+func TestSetAttrGuard(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "data")
+	if err := os.WriteFile(name, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctime := time.Unix(1600000000, 500)
+	if err := os.Chtimes(name, ctime, ctime); err != nil {
+		t.Fatal(err)
+	}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(osfs.New(dir)), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncate := nfsc.Sattr3{Size: nfsc.SetSize{SetIt: true, Size: 4}}
+
+	stale := nfsc.Sattrguard3{Check: 1, Time: nfsc.NFS3Time{Seconds: uint32(ctime.Unix()) - 1}}
+	if status, _ := setAttrGuarded(t, target, fh, truncate, stale); status != nfs.NFSStatusNotSync {
+		t.Fatalf("expected NOT_SYNC for a stale guard, got %v", status)
+	}
+	if info, err := os.Stat(name); err != nil || info.Size() != 10 {
+		t.Fatalf("file was changed despite a failed guard: %v, %v", info, err)
+	}
+
+	current := nfsc.Sattrguard3{Check: 1, Time: nfsc.NFS3Time{Seconds: uint32(ctime.Unix()), Nseconds: 500}}
+	if status, _ := setAttrGuarded(t, target, fh, truncate, current); status != nfs.NFSStatusOk {
+		t.Fatalf("expected a current guard to pass, got %v", status)
+	}
+	if info, err := os.Stat(name); err != nil || info.Size() != 4 {
+		t.Fatalf("file was not truncated: %v, %v", info, err)
+	}
+}
+
+// chtimesFS is an in-memory filesystem supporting billy.Change, which records the times it is asked to set.
+type chtimesFS struct {
+	billy.Filesystem
+	atime, mtime time.Time
+}
+
+func (c *chtimesFS) Chmod(name string, mode os.FileMode) error { return nil }
+func (c *chtimesFS) Lchown(name string, uid, gid int) error    { return nil }
+func (c *chtimesFS) Chown(name string, uid, gid int) error     { return nil }
+func (c *chtimesFS) Chtimes(name string, atime, mtime time.Time) error {
+	c.atime, c.mtime = atime, mtime
+	return nil
+}
+
+func TestSetAttrTimes(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/data")
+	fs := &chtimesFS{Filesystem: mem}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientTime := nfsc.NFS3Time{Seconds: 1600000000, Nseconds: 42}
+	status, _ := setAttr(t, target, fh, nfsc.Sattr3{
+		Atime: nfsc.SetTime{SetIt: nfsc.SetToClientTime, Time: clientTime},
+		Mtime: nfsc.SetTime{SetIt: nfsc.SetToClientTime, Time: clientTime},
+	})
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("setting client time failed: %v", status)
+	}
+	if expected := time.Unix(1600000000, 42); !fs.atime.Equal(expected) || !fs.mtime.Equal(expected) {
+		t.Fatalf("times set to %v / %v, expected %v", fs.atime, fs.mtime, expected)
+	}
+
+	before := time.Now()
+	status, _ = setAttr(t, target, fh, nfsc.Sattr3{Mtime: nfsc.SetTime{SetIt: nfsc.SetToServerTime}})
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("setting server time failed: %v", status)
+	}
+	if fs.mtime.Before(before) || fs.mtime.After(time.Now()) {
+		t.Fatalf("mtime set to %v, expected the server's current time", fs.mtime)
+	}
+}
+
+// fakeClock is a Clock stopped at a fixed time.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c fakeClock) Now() time.Time { return c.now }
+
+func TestServerClock(t *testing.T) {
+	clock := fakeClock{time.Unix(1500000000, 7000)}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(changeFS{newOSFileFS(t.TempDir())}), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler, Clock: clock})), rpc.AuthNull)
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := nfsc.NFS3Time{Seconds: 1500000000, Nseconds: 7000}
+
+	const unchecked = 0
+	if status := createFile(t, target, root, "file", unchecked, nfsc.Sattr3{}); status != nfs.NFSStatusOk {
+		t.Fatalf("create failed: %v", status)
+	}
+	if _, err := target.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/file", "/dir"} {
+		attr, err := target.Getattr(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attr.Mtime != want || attr.Atime != want {
+			t.Fatalf("%s was made with times %v / %v, expected the clock's %v", name, attr.Atime, attr.Mtime, want)
+		}
+	}
+
+	_, fh, err := target.Lookup("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTime := nfsc.NFS3Time{Seconds: 1600000000}
+	if status, _ := setAttr(t, target, fh, nfsc.Sattr3{Mtime: nfsc.SetTime{SetIt: nfsc.SetToClientTime, Time: clientTime}}); status != nfs.NFSStatusOk {
+		t.Fatalf("setting client time failed: %v", status)
+	}
+	if status, _ := setAttr(t, target, fh, nfsc.Sattr3{Mtime: nfsc.SetTime{SetIt: nfsc.SetToServerTime}}); status != nfs.NFSStatusOk {
+		t.Fatalf("setting server time failed: %v", status)
+	}
+	if attr, err := target.Getattr("/file"); err != nil || attr.Mtime != want {
+		t.Fatalf("mtime set to the server time is %v, expected the clock's %v: %v", attr.Mtime, want, err)
+	}
+}
+
+func TestSetAttrTimesUnsupported(t *testing.T) {
+	_, handler := newMemHandler(t)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ := setAttr(t, target, fh, nfsc.Sattr3{Mtime: nfsc.SetTime{SetIt: nfsc.SetToServerTime}})
+	if status != nfs.NFSStatusNotSupp {
+		t.Fatalf("expected NOTSUPP from a backend without Chtimes, got %v", status)
+	}
+}
+
+// syncingFS is an in-memory filesystem whose files count calls to Sync.
+type syncingFS struct {
+	billy.Filesystem
+	syncs atomic.Int32
+}
+
+func (s *syncingFS) Open(name string) (billy.File, error) {
+	return s.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (s *syncingFS) OpenFile(name string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := s.Filesystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &syncingFile{f, s}, nil
+}
+
+type syncingFile struct {
+	billy.File
+	fs *syncingFS
+}
+
+func (f *syncingFile) Sync() error {
+	f.fs.syncs.Add(1)
+	return nil
+}
+
+// writeFile issues a WRITE at offset 0 and returns how the write was committed, and the write verifier.
+func writeFile(t *testing.T, target *nfsc.Target, fh []byte, how uint32, data []byte) (uint32, [8]byte) {
+	t.Helper()
+	status, committed, verf := writeAt(t, target, fh, 0, how, data)
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("write failed: %v", status)
+	}
+	return committed, verf
+}
+
+// writeAt writes `data` at `offset`, returning the status of the reply.
+func writeAt(t testing.TB, target *nfsc.Target, fh []byte, offset uint64, how uint32, data []byte) (nfs.NFSStatus, uint32, [8]byte) {
+	t.Helper()
+	status, reply := writeReplyAt(t, target, fh, offset, how, data)
+	return status, reply.Committed, reply.Verf
+}
+
+// writeReply is the body of a successful WRITE reply.
+type writeReply struct {
+	Wcc       nfsc.WccData
+	Count     uint32
+	Committed uint32
+	Verf      [8]byte
+}
+
+// writeReplyAt writes `data` at `offset`, returning the status and body of the reply.
+func writeReplyAt(t testing.TB, target *nfsc.Target, fh []byte, offset uint64, how uint32, data []byte) (nfs.NFSStatus, writeReply) {
+	t.Helper()
+	type writeArgs struct {
+		rpc.Header
+		Handle []byte
+		Offset uint64
+		Count  uint32
+		How    uint32
+		Data   []byte
+	}
+	res, err := target.Call(&writeArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureWrite),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle: fh,
+		Offset: offset,
+		Count:  uint32(len(data)),
+		How:    how,
+		Data:   data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply writeReply
+	if status != uint32(nfs.NFSStatusOk) {
+		return nfs.NFSStatus(status), reply
+	}
+	if err := xdr.Read(res, &reply); err != nil {
+		t.Fatal(err)
+	}
+	return nfs.NFSStatusOk, reply
+}
+
+func TestWritePreOpAttrs(t *testing.T) {
+	// memfs reports the time of each stat as the mtime of its files.
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(osfs.New(dir)), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		offset uint64
+		data   string
+		pre    uint64
+		post   uint64
+	}{
+		{5, " world", 5, 11},
+		{0, "HELLO", 11, 11},
+		{20, "!", 11, 21},
+	} {
+		before, err := target.Getattr("/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, reply := writeReplyAt(t, target, fh, c.offset, 2, []byte(c.data))
+		if status != nfs.NFSStatusOk {
+			t.Fatalf("write at %d failed: %v", c.offset, status)
+		}
+		wcc := reply.Wcc
+		if !wcc.Before.IsSet || wcc.Before.Size != c.pre {
+			t.Fatalf("write at %d reported a pre-op size of %d, expected %d", c.offset, wcc.Before.Size, c.pre)
+		}
+		if wcc.Before.MTime != before.Mtime || wcc.Before.CTime != before.Ctime {
+			t.Fatalf("write at %d reported pre-op times %v, %v rather than %v, %v", c.offset, wcc.Before.MTime, wcc.Before.CTime, before.Mtime, before.Ctime)
+		}
+		if !wcc.After.IsSet || wcc.After.Attr.Filesize != c.post {
+			t.Fatalf("write at %d reported a post-op size of %d, expected %d", c.offset, wcc.After.Attr.Filesize, c.post)
+		}
+	}
+}
+
+// commitFile issues a COMMIT for the whole file and returns the write verifier.
+func commitFile(t *testing.T, target *nfsc.Target, fh []byte) [8]byte {
+	t.Helper()
+	status, verf := commitStatus(t, target, fh)
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("commit failed: %v", status)
+	}
+	return verf
+}
+
+// commitStatus issues a COMMIT for the whole file and returns its status and write verifier.
+func commitStatus(t *testing.T, target *nfsc.Target, fh []byte) (nfs.NFSStatus, [8]byte) {
+	t.Helper()
+	type commitArgs struct {
+		rpc.Header
+		Handle []byte
+		Offset uint64
+		Count  uint32
+	}
+	res, err := target.Call(&commitArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureCommit),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle: fh,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != uint32(nfs.NFSStatusOk) {
+		return nfs.NFSStatus(status), [8]byte{}
+	}
+	var reply struct {
+		Wcc  nfsc.WccData
+		Verf [8]byte
+	}
+	if err := xdr.Read(res, &reply); err != nil {
+		t.Fatal(err)
+	}
+	return nfs.NFSStatusOk, reply.Verf
+}
+
+func TestCommitNonRegularFile(t *testing.T) {
+	mem, handler := newMemHandler(t)
+	if err := mem.MkdirAll("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Symlink("dir", "/link"); err != nil {
+		t.Fatal(err)
+	}
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+
+	for _, name := range []string{"/dir", "/link"} {
+		_, fh, err := target.Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status, _ := commitStatus(t, target, fh); status != nfs.NFSStatusInval {
+			t.Fatalf("expected COMMIT of %s to fail with INVAL, got %v", name, status)
+		}
+	}
+	_, fh, err := target.Lookup("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, target, fh)
+}
+
+func TestWriteStability(t *testing.T) {
+	const unstable, fileSync = 0, 2
+	mem := memfs.New()
+	_, _ = mem.Create("/data")
+	fs := &syncingFS{Filesystem: mem}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	committed, verf := writeFile(t, target, fh, unstable, []byte("unstable"))
+	if committed != unstable || fs.syncs.Load() != 0 {
+		t.Fatalf("unstable write was committed as %d with %d syncs", committed, fs.syncs.Load())
+	}
+	if commitFile(t, target, fh) != verf {
+		t.Fatal("commit returned a different verifier than write")
+	}
+	if fs.syncs.Load() != 1 {
+		t.Fatalf("commit made %d syncs, expected 1", fs.syncs.Load())
+	}
+
+	committed, syncVerf := writeFile(t, target, fh, fileSync, []byte("stable"))
+	if committed != fileSync || fs.syncs.Load() != 2 {
+		t.Fatalf("FILE_SYNC write was committed as %d with %d syncs", committed, fs.syncs.Load())
+	}
+	if syncVerf != verf {
+		t.Fatal("write verifier changed during the life of the server")
+	}
+}
+
+func TestWriteVerifierChangesOnRestart(t *testing.T) {
+	const unstable = 0
+	mem := memfs.New()
+	_, _ = mem.Create("/data")
+	fs := &syncingFS{Filesystem: mem}
+	id := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// a server configured with a fixed ID still tells its restarts apart.
+	var verfs [][8]byte
+	for i := 0; i < 2; i++ {
+		handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+		target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler, ID: id})), rpc.AuthNull)
+		_, fh, err := target.Lookup("/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, verf := writeFile(t, target, fh, unstable, []byte("unstable"))
+		if verf == id {
+			t.Fatal("write verifier is the server ID")
+		}
+		verfs = append(verfs, verf)
+	}
+	if verfs[0] == verfs[1] {
+		t.Fatal("write verifier did not change when the server restarted")
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	const unstable = 0
+	mem := memfs.New()
+	_, _ = mem.Create("/data")
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)
+	target := mountServer(b, dialServer(b, startServer(b, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/data")
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := make([]byte, 64<<10)
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if status, _, _ := writeAt(b, target, fh, 0, unstable, data); status != nfs.NFSStatusOk {
+			b.Fatalf("write failed: %v", status)
+		}
+	}
+}
+
+func TestWriteQuota(t *testing.T) {
+	const unstable = 0
+	for _, tc := range []struct {
+		name           string
+		total, perUser int64
+		want           nfs.NFSStatus
+	}{
+		{"per user", 0, 10, nfs.NFSStatusDQuot},
+		{"export total", 10, 0, nfs.NFSStatusNoSPC},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := memfs.New()
+			_, _ = mem.Create("/data")
+			quota := helpers.NewByteQuota(tc.total, tc.perUser)
+			handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)
+			target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler, Quota: quota})), rpc.AuthNull)
+			_, fh, err := target.Lookup("/data")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if status, _, _ := writeAt(t, target, fh, 0, unstable, []byte("12345678")); status != nfs.NFSStatusOk {
+				t.Fatalf("write within quota failed: %v", status)
+			}
+			// overwriting written bytes does not grow the file.
+			if status, _, _ := writeAt(t, target, fh, 0, unstable, []byte("abcd")); status != nfs.NFSStatusOk {
+				t.Fatalf("overwrite within quota failed: %v", status)
+			}
+			if total, _ := quota.Usage(mem, 0); total != 8 {
+				t.Fatalf("quota charged %d bytes, expected 8", total)
+			}
+			if status, _, _ := writeAt(t, target, fh, 8, unstable, []byte("9abc")); status != tc.want {
+				t.Fatalf("write past quota returned %v, expected %v", status, tc.want)
+			}
+			if info, _ := mem.Stat("/data"); info.Size() != 8 {
+				t.Fatalf("refused write grew the file to %d bytes", info.Size())
+			}
+		})
+	}
+}
+
+func TestWriteMaxFileSize(t *testing.T) {
+	const unstable = 0
+	mem := memfs.New()
+	_, _ = mem.Create("/data")
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler, MaxFileSize: 16})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _, _ := writeAt(t, target, fh, 8, unstable, []byte("123456789")); status != nfs.NFSStatusFBig {
+		t.Fatalf("write past the maximum file size returned %v", status)
+	}
+	if status, _, _ := writeAt(t, target, fh, 1<<63, unstable, []byte("1")); status != nfs.NFSStatusFBig {
+		t.Fatalf("write at a huge offset returned %v", status)
+	}
+	if status, _, _ := writeAt(t, target, fh, 8, unstable, []byte("12345678")); status != nfs.NFSStatusOk {
+		t.Fatalf("write up to the maximum file size returned %v", status)
+	}
+	if info, _ := mem.Stat("/data"); info.Size() != 16 {
+		t.Fatalf("file is %d bytes, expected 16", info.Size())
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	const unstable, fileSync = 0, 2
+	mem := memfs.New()
+	_, _ = mem.Create("/data")
+	fs := &countingFS{Filesystem: mem}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	srv := &nfs.Server{Handler: handler, WriteBackSize: 1 << 20, WriteBackDelay: time.Hour}
+	target := mountServer(t, dialServer(t, startServer(t, srv)), rpc.AuthNull)
+	_, fh, err := target.Lookup("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []byte
+	var first [8]byte
+	for i := 0; i < 100; i++ {
+		chunk := bytes.Repeat([]byte{byte(i)}, 512)
+		status, committed, verf := writeAt(t, target, fh, uint64(len(want)), unstable, chunk)
+		if status != nfs.NFSStatusOk || committed != unstable {
+			t.Fatalf("write %d failed with %v, committed as %d", i, status, committed)
+		}
+		if i == 0 {
+			first = verf
+		} else if verf != first {
+			t.Fatal("write verifier changed during the life of the server")
+		}
+		want = append(want, chunk...)
+	}
+	if n := fs.writes.Load(); n != 0 {
+		t.Fatalf("%d backend writes were made before COMMIT", n)
+	}
+	if commitFile(t, target, fh) != first {
+		t.Fatal("commit returned a different verifier than write")
+	}
+	if n := fs.writes.Load(); n != 1 {
+		t.Fatalf("expected the writes to reach the backend as one write, got %d", n)
+	}
+	if got, err := util.ReadFile(mem, "/data"); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("file does not hold the written data: %v", err)
+	}
+
+	// a write that does not continue those held flushes them.
+	writeAt(t, target, fh, 0, unstable, []byte("first"))
+	writeAt(t, target, fh, 1024, unstable, []byte("second"))
+	if n := fs.writes.Load(); n != 2 {
+		t.Fatalf("expected a gap to flush the held write, got %d backend writes", n)
+	}
+	// as does a stable write, which is made after them.
+	writeAt(t, target, fh, 1024, fileSync, []byte("SECOND"))
+	if n := fs.writes.Load(); n != 4 {
+		t.Fatalf("expected a stable write to flush the held write, got %d backend writes", n)
+	}
+	got, err := util.ReadFile(mem, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got[:5]) != "first" || string(got[1024:1030]) != "SECOND" {
+		t.Fatal("writes reached the file out of order")
+	}
+
+	// reads see held writes.
+	writeAt(t, target, fh, 0, unstable, []byte("third"))
+	f, err := target.Open("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "third" {
+		t.Fatalf("read %q after a held write: %v", buf, err)
+	}
+}
+
+func TestWriteBackDelay(t *testing.T) {
+	const unstable = 0
+	mem := memfs.New()
+	_, _ = mem.Create("/data")
+	fs := &countingFS{Filesystem: mem}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	srv := &nfs.Server{Handler: handler, WriteBackSize: 1 << 20, WriteBackDelay: 10 * time.Millisecond}
+	target := mountServer(t, dialServer(t, startServer(t, srv)), rpc.AuthNull)
+	_, fh, err := target.Lookup("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAt(t, target, fh, 0, unstable, []byte("held"))
+	deadline := time.Now().Add(5 * time.Second)
+	for fs.writes.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("held write was not flushed after the delay")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	f, err := target.Open("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(f); err != nil || string(got) != "held" {
+		t.Fatalf("read %q after the held write was flushed: %v", got, err)
+	}
+	if n := fs.writes.Load(); n != 1 {
+		t.Fatalf("expected the held write to be flushed once, got %d backend writes", n)
+	}
+}
+
+func TestFileIDStable(t *testing.T) {
+	mem, handler := newMemHandler(t)
+	for _, name := range []string{"a", "b", "dir/c"} {
+		if err := util.WriteFile(mem, name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+
+	fileIDs := make(map[string]uint64)
+	for _, name := range []string{"a", "b", "dir", "dir/c"} {
+		info, _, err := target.Lookup("/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := info.(*nfsc.Fattr).Fileid
+		again, _, err := target.Lookup("/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.(*nfsc.Fattr).Fileid != id {
+			t.Fatalf("lookups of %s returned different fileids", name)
+		}
+		attr, err := target.Getattr("/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attr.Fileid != id {
+			t.Fatalf("GETATTR of %s returned fileid %d, LOOKUP %d", name, attr.Fileid, id)
+		}
+		for other, otherID := range fileIDs {
+			if otherID == id {
+				t.Fatalf("%s and %s share fileid %d", name, other, id)
+			}
+		}
+		fileIDs[name] = id
+	}
+
+	entries, err := target.ReadDirPlus("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		id, ok := fileIDs[e.FileName]
+		if !ok {
+			continue
+		}
+		if e.FileId != id || e.Attr.Attr.Fileid != id {
+			t.Fatalf("READDIRPLUS listed %s with fileid %d and attributes %d, LOOKUP %d", e.FileName, e.FileId, e.Attr.Attr.Fileid, id)
+		}
+	}
+
+	// the fileid follows a file across a rename.
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := rename(t, target, root, "a", root, "renamed"); status != nfs.NFSStatusOk {
+		t.Fatalf("rename failed: %v", status)
+	}
+	attr, err := target.Getattr("/renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr.Fileid != fileIDs["a"] {
+		t.Fatalf("renamed file has fileid %d, had %d", attr.Fileid, fileIDs["a"])
+	}
+}
+
+// readDirCountingFS counts the directories listed on it.
+type readDirCountingFS struct {
+	billy.Filesystem
+	listings atomic.Int32
+}
+
+func (r *readDirCountingFS) ReadDir(path string) ([]os.FileInfo, error) {
+	r.listings.Add(1)
+	return r.Filesystem.ReadDir(path)
+}
+
+func TestDirectoryNlink(t *testing.T) {
+	mem := memfs.New()
+	for _, dir := range []string{"dir/one", "dir/two/nested"} {
+		if err := mem.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := util.WriteFile(mem, "dir/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := &readDirCountingFS{Filesystem: mem}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+
+	// without link counts from the filesystem, directories are linked from their parent, "."
+	// and the ".." of each subdirectory.
+	nlinks := map[string]uint32{"/dir": 4, "/dir/one": 2, "/dir/two": 3, "/dir/file": 1}
+	for name, want := range nlinks {
+		attr, err := target.Getattr(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attr.Nlink != want {
+			t.Errorf("%s has nlink %d, expected %d", name, attr.Nlink, want)
+		}
+	}
+	// the counts are kept, rather than listing the directories on every fetch.
+	type getattrArgs struct {
+		rpc.Header
+		Handle []byte
+	}
+	listed := fs.listings.Load()
+	for name := range nlinks {
+		res, err := target.Call(&getattrArgs{
+			Header: rpc.Header{
+				Rpcvers: 2,
+				Prog:    nfsc.Nfs3Prog,
+				Vers:    nfsc.Nfs3Vers,
+				Proc:    uint32(nfs.NFSProcedureGetAttr),
+				Cred:    rpc.AuthNull,
+				Verf:    rpc.AuthNull,
+			},
+			Handle: handler.ToHandle(fs, strings.Split(strings.TrimPrefix(name, "/"), "/")),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply struct {
+			Status uint32
+			Attr   nfsc.Fattr
+		}
+		if err := xdr.Read(res, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Attr.Nlink != nlinks[name] {
+			t.Errorf("%s has nlink %d, expected %d", name, reply.Attr.Nlink, nlinks[name])
+		}
+	}
+	if n := fs.listings.Load() - listed; n != 0 {
+		t.Fatalf("fetching attributes again listed %d directories", n)
+	}
+	entries, err := target.ReadDirPlus("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.FileName == "dir" && e.Attr.Attr.Nlink != 4 {
+			t.Errorf("READDIRPLUS listed dir with nlink %d, expected 4", e.Attr.Attr.Nlink)
+		}
+	}
+
+	// a new subdirectory drops the kept count.
+	if _, err := target.Mkdir("/dir/three", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if attr, err := target.Getattr("/dir"); err != nil || attr.Nlink != 5 {
+		t.Fatalf("after mkdir dir has nlink %v, expected 5: %v", attr, err)
+	}
+	// as does removing one, including the count of the directory removed.
+	if err := target.RmDir("/dir/one"); err != nil {
+		t.Fatal(err)
+	}
+	if attr, err := target.Getattr("/dir"); err != nil || attr.Nlink != 4 {
+		t.Fatalf("after rmdir dir has nlink %v, expected 4: %v", attr, err)
+	}
+}
+
+func TestUsedSpace(t *testing.T) {
+	mem, handler := newMemHandler(t)
+	contents := bytes.Repeat([]byte("x"), 10000)
+	if err := util.WriteFile(mem, "file", contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	attr, err := target.Getattr("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr.Filesize != uint64(len(contents)) || attr.Used != attr.Filesize {
+		t.Fatalf("expected a file of %d bytes to use as much, got size %d and used %d", len(contents), attr.Filesize, attr.Used)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	// files of filesystems reporting their allocation use the blocks allocated to them.
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler = helpers.NewCachingHandler(helpers.NewNullAuthHandler(osfs.New(dir)), 1024)
+	target = mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	if attr, err = target.Getattr("/file"); err != nil {
+		t.Fatal(err)
+	}
+	if attr.Used == 0 || attr.Used%512 != 0 {
+		t.Fatalf("expected the blocks allocated to the file, got used %d", attr.Used)
+	}
+}
+
+func TestReadDirPlusPaging(t *testing.T) {
+	mem := memfs.New()
+	for i := 0; i < 1000; i++ {
+		if _, err := mem.Create(fmt.Sprintf("/dir/file-%04d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 4096)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type readDirPlusArgs struct {
+		rpc.Header
+		Handle     []byte
+		Cookie     uint64
+		CookieVerf uint64
+		DirCount   uint32
+		MaxCount   uint32
+	}
+	type entryList struct {
+		IsSet bool           `xdr:"union"`
+		Entry nfsc.EntryPlus `xdr:"unioncase=1"`
+	}
+	const maxCount = 4096
+
+	seen := map[string]bool{}
+	cookie, verf := uint64(0), uint64(0)
+	calls := 0
+	for eof := false; !eof; calls++ {
+		res, err := target.Call(&readDirPlusArgs{
+			Header: rpc.Header{
+				Rpcvers: 2,
+				Prog:    nfsc.Nfs3Prog,
+				Vers:    nfsc.Nfs3Vers,
+				Proc:    uint32(nfs.NFSProcedureReadDirPlus),
+				Cred:    rpc.AuthNull,
+				Verf:    rpc.AuthNull,
+			},
+			Handle:     fh,
+			Cookie:     cookie,
+			CookieVerf: verf,
+			DirCount:   512,
+			MaxCount:   maxCount,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, _ := res.Seek(0, io.SeekCurrent)
+		end, _ := res.Seek(0, io.SeekEnd)
+		if end-start > maxCount {
+			t.Fatalf("reply of %d bytes exceeds maxcount %d", end-start, maxCount)
+		}
+		_, _ = res.Seek(start, io.SeekStart)
+
+		var head struct {
+			Status   uint32
+			DirAttrs nfsc.PostOpAttr
+			Verf     uint64
+		}
+		if err := xdr.Read(res, &head); err != nil {
+			t.Fatal(err)
+		}
+		if head.Status != uint32(nfs.NFSStatusOk) {
+			t.Fatalf("readdirplus failed: %v", nfs.NFSStatus(head.Status))
+		}
+		verf = head.Verf
+		for {
+			var item entryList
+			if err := xdr.Read(res, &item); err != nil {
+				t.Fatal(err)
+			}
+			if !item.IsSet {
+				break
+			}
+			if seen[item.Entry.FileName] {
+				t.Fatalf("%s listed twice", item.Entry.FileName)
+			}
+			seen[item.Entry.FileName] = true
+			cookie = item.Entry.Cookie
+		}
+		if err := xdr.Read(res, &eof); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 1000 files, plus "." and "..".
+	if len(seen) != 1002 {
+		t.Fatalf("listed %d entries, expected 1002", len(seen))
+	}
+	if calls < 2 {
+		t.Fatalf("expected the listing to span several calls, took %d", calls)
+	}
+}
+
+// readDirPage issues a single READDIR call and returns its status, verifier and the cookie of its last entry.
+func readDirPage(t *testing.T, target *nfsc.Target, fh []byte, cookie, verf uint64) (nfs.NFSStatus, uint64, uint64) {
+	t.Helper()
+	status, verf, names, last, _ := readDirNames(t, target, fh, cookie, verf)
+	if len(names) == 0 {
+		last = cookie
+	}
+	return status, verf, last
+}
+
+// readDirNames issues a single READDIR call and returns its status, verifier, the names
+// listed, the cookie of the last of them and whether the listing is complete.
+func readDirNames(t *testing.T, target *nfsc.Target, fh []byte, cookie, verf uint64) (nfs.NFSStatus, uint64, []string, uint64, bool) {
+	t.Helper()
+	type readDirArgs struct {
+		rpc.Header
+		Handle     []byte
+		Cookie     uint64
+		CookieVerf uint64
+		Count      uint32
+	}
+	res, err := target.Call(&readDirArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureReadDir),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle:     fh,
+		Cookie:     cookie,
+		CookieVerf: verf,
+		Count:      1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != uint32(nfs.NFSStatusOk) {
+		return nfs.NFSStatus(status), 0, nil, 0, false
+	}
+	var head struct {
+		DirAttrs nfsc.PostOpAttr
+		Verf     uint64
+	}
+	if err := xdr.Read(res, &head); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var last uint64
+	for {
+		var item struct {
+			IsSet bool `xdr:"union"`
+			Entry struct {
+				FileID uint64
+				Name   string
+				Cookie uint64
+			} `xdr:"unioncase=1"`
+		}
+		if err := xdr.Read(res, &item); err != nil {
+			t.Fatal(err)
+		}
+		if !item.IsSet {
+			break
+		}
+		names = append(names, item.Entry.Name)
+		last = item.Entry.Cookie
+	}
+	var eof bool
+	if err := xdr.Read(res, &eof); err != nil {
+		t.Fatal(err)
+	}
+	return nfs.NFSStatusOk, head.Verf, names, last, eof
+}
+
+func TestReadDirStaleCookie(t *testing.T) {
+	mem, handler := newMemHandler(t)
+	for i := 0; i < 20; i++ {
+		_, _ = mem.Create(fmt.Sprintf("/dir/file-%02d", i))
+	}
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, verf, cookie := readDirPage(t, target, fh, 0, 0)
+	if status != nfs.NFSStatusOk {
+		t.Fatal(status)
+	}
+	if status, _, _ := readDirPage(t, target, fh, cookie, verf); status != nfs.NFSStatusOk {
+		t.Fatalf("resuming an unchanged listing failed: %v", status)
+	}
+
+	if _, err := target.Create("/dir/new", 0666); err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := readDirPage(t, target, fh, cookie, verf); status != nfs.NFSStatusBadCookie {
+		t.Fatalf("expected BAD_COOKIE resuming a changed listing, got %v", status)
+	}
+}
+
+func TestReadDirBadCookie(t *testing.T) {
+	mem, handler := newMemHandler(t)
+	for i := 0; i < 3; i++ {
+		_, _ = mem.Create(fmt.Sprintf("/dir/file-%02d", i))
+	}
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := readDirPage(t, target, fh, 1000, 0); status != nfs.NFSStatusBadCookie {
+		t.Fatalf("expected BAD_COOKIE resuming past the end of a listing, got %v", status)
+	}
+}
+
+func TestReadDirStableCookiesAcrossRestart(t *testing.T) {
+	mem := memfs.New()
+	var want []string
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("file-%02d", i)
+		_, _ = mem.Create("/dir/" + name)
+		want = append(want, name)
+	}
+	serve := func() *nfsc.Target {
+		// a new handler starts with an empty cache of listings, as after a restart.
+		handler := helpers.NewDeterministicCachingHandler(helpers.NewNullAuthHandler(mem), 1024).(*helpers.CachingHandler)
+		handler.Preload(mem, [][]string{{"dir"}})
+		return mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler, StableCookies: true})), rpc.AuthNull)
+	}
+
+	target := serve()
+	_, fh, err := target.Lookup("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	var cookie, verf uint64
+	for len(listed) < 6 {
+		status, v, names, last, eof := readDirNames(t, target, fh, cookie, verf)
+		if status != nfs.NFSStatusOk {
+			t.Fatal(status)
+		}
+		if eof {
+			t.Fatal("expected the listing to span several calls")
+		}
+		listed, cookie, verf = append(listed, names...), last, v
+	}
+
+	// an entry listed before the restart is removed, which would shift later entries
+	// were cookies positions in the listing.
+	if err := mem.Remove("/dir/" + listed[len(listed)-1]); err != nil {
+		t.Fatal(err)
+	}
+	target = serve()
+	for eof := false; !eof; {
+		var status nfs.NFSStatus
+		var names []string
+		status, verf, names, cookie, eof = readDirNames(t, target, fh, cookie, verf)
+		if status != nfs.NFSStatusOk {
+			t.Fatalf("resuming the listing after a restart failed: %v", status)
+		}
+		listed = append(listed, names...)
+	}
+
+	got := make([]string, 0, len(listed))
+	for _, name := range listed {
+		if name != "." && name != ".." {
+			got = append(got, name)
+		}
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected each entry to be listed once, got %v", got)
+	}
+}
+
+func TestReadDirNoVerifierCache(t *testing.T) {
+	// the listings are hashed, and memfs reports every file as modified just now.
+	bfs := osfs.New(t.TempDir())
+	var want []string
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("file-%02d", i)
+		f, err := bfs.Create("/dir/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = f.Close()
+		want = append(want, name)
+	}
+	h, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(bfs), helpers.CachingHandlerOptions{Limit: 1024, NoVerifierCache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := h.(*helpers.CachingHandler)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	var cookie, verf uint64
+	calls := 0
+	for eof := false; !eof; calls++ {
+		var status nfs.NFSStatus
+		var names []string
+		status, verf, names, cookie, eof = readDirNames(t, target, fh, cookie, verf)
+		if status != nfs.NFSStatusOk {
+			t.Fatalf("listing failed after %d calls: %v", calls, status)
+		}
+		for _, name := range names {
+			if name != "." && name != ".." {
+				got = append(got, name)
+			}
+		}
+	}
+	if calls < 2 {
+		t.Fatalf("expected the listing to span several calls, took %d", calls)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected each entry to be listed once, got %v", got)
+	}
+	if stats := handler.Stats(); stats.Verifiers != 0 || len(handler.DumpVerifiers()) != 0 {
+		t.Fatalf("expected no listings to be cached, got %+v", stats)
+	}
+
+	// a listing resumed after the directory changed is refused, as it cannot be served
+	// from a cached copy.
+	_, verf, _, cookie, _ = readDirNames(t, target, fh, 0, 0)
+	f, err := bfs.Create("/dir/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if status, _, _, _, _ := readDirNames(t, target, fh, cookie, verf); status != nfs.NFSStatusBadCookie {
+		t.Fatalf("expected resuming a changed listing to be refused, got %v", status)
+	}
+}
+
+// countingFS counts the ReadAt and Write calls made against its files.
+type countingFS struct {
+	billy.Filesystem
+	reads  atomic.Int32
+	writes atomic.Int32
+}
+
+func (c *countingFS) Open(name string) (billy.File, error) {
+	return c.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (c *countingFS) OpenFile(name string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := c.Filesystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &countingFile{f, c}, nil
+}
+
+type countingFile struct {
+	billy.File
+	fs *countingFS
+}
+
+func (f *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.reads.Add(1)
+	return f.File.ReadAt(p, off)
+}
+
+func (f *countingFile) Write(p []byte) (int, error) {
+	defer f.fs.writes.Add(1)
+	return f.File.Write(p)
+}
+
+// readAt issues a READ, returning its status, the data read and the eof flag.
+func readAt(t *testing.T, target *nfsc.Target, fh []byte, offset uint64, count uint32) (nfs.NFSStatus, []byte, bool) {
+	t.Helper()
+	type readArgs struct {
+		rpc.Header
+		Handle []byte
+		Offset uint64
+		Count  uint32
+	}
+	res, err := target.Call(&readArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureRead),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle: fh,
+		Offset: offset,
+		Count:  count,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != uint32(nfs.NFSStatusOk) {
+		return nfs.NFSStatus(status), nil, false
+	}
+	var reply struct {
+		Attr  nfsc.PostOpAttr
+		Count uint32
+		EOF   uint32
+		Data  []byte
+	}
+	if err := xdr.Read(res, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if int(reply.Count) != len(reply.Data) {
+		t.Fatalf("READ counted %d bytes, but returned %d", reply.Count, len(reply.Data))
+	}
+	return nfs.NFSStatusOk, reply.Data, reply.EOF != 0
+}
+
+func TestReadEOF(t *testing.T) {
+	mem, handler := newMemHandler(t)
+	contents := bytes.Repeat([]byte("0123456789"), 10)
+	if err := util.WriteFile(mem, "file", contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		offset uint64
+		count  uint32
+		want   []byte
+		eof    bool
+	}{
+		{"within the file", 0, 50, contents[:50], false},
+		{"to the end of the file", 50, 50, contents[50:], true},
+		{"spanning the end of the file", 90, 20, contents[90:], true},
+		{"at the end of the file", 100, 10, nil, true},
+		{"nothing at the end of the file", 100, 0, nil, true},
+		{"past the end of the file", 200, 10, nil, true},
+		{"a large read past the end of the file", 200, 1 << 16, nil, true},
+	} {
+		status, data, eof := readAt(t, target, fh, tc.offset, tc.count)
+		if status != nfs.NFSStatusOk {
+			t.Fatalf("read %s failed: %v", tc.name, status)
+		}
+		if !bytes.Equal(data, tc.want) || eof != tc.eof {
+			t.Errorf("read %s returned %d bytes with eof %v, expected %d bytes with eof %v", tc.name, len(data), eof, len(tc.want), tc.eof)
+		}
+	}
+}
+
+func TestReadWriteDirectory(t *testing.T) {
+	mem, handler := newMemHandler(t)
+	if err := mem.MkdirAll("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := readAt(t, target, fh, 0, 100); status != nfs.NFSStatusIsDir {
+		t.Fatalf("expected READ of a directory to fail with ISDIR, got %v", status)
+	}
+	if status, _, _ := writeAt(t, target, fh, 0, 2, []byte("data")); status != nfs.NFSStatusIsDir {
+		t.Fatalf("expected WRITE of a directory to fail with ISDIR, got %v", status)
+	}
+}
+
+func TestSparseRead(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("hole detection is only implemented on linux")
+	}
+	const size = 4 << 20
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("head"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("tail"), size-4); err != nil {
+		t.Fatal(err)
+	}
+	// SEEK_DATA from within the hole should land on the final block.
+	if off, err := f.Seek(1<<20, 3); err != nil || off < 2<<20 {
+		t.Skip("filesystem does not report holes")
+	}
+
+	bfs := &countingFS{Filesystem: osfs.New(dir)}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(bfs), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+
+	rf, err := target.Open("/sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rf.Seek(1<<20, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	hole := make([]byte, 1<<20)
+	if _, err := io.ReadFull(rf, hole); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hole, make([]byte, len(hole))) {
+		t.Fatal("hole did not read as zeros")
+	}
+	if n := bfs.reads.Load(); n != 0 {
+		t.Fatalf("hole was read from the file %d times", n)
+	}
+
+	if _, err := rf.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := io.ReadAll(rf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents) != size || !bytes.Equal(contents[:4], []byte("head")) || !bytes.Equal(contents[size-4:], []byte("tail")) {
+		t.Fatalf("unexpected contents of %d bytes", len(contents))
+	}
+	if !bytes.Equal(contents[4:size-4], make([]byte, size-8)) {
+		t.Fatal("unexpected data within the hole")
+	}
+}
+
+// osFileFS opens the files of a directory as *os.File, exposing their descriptors.
+type osFileFS struct {
+	billy.Filesystem
+	dir string
+}
+
+func newOSFileFS(dir string) *osFileFS {
+	return &osFileFS{osfs.New(dir), dir}
+}
+
+func (o *osFileFS) Open(name string) (billy.File, error) {
+	return o.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (o *osFileFS) OpenFile(name string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := os.OpenFile(filepath.Join(o.dir, name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+type osFile struct {
+	*os.File
+}
+
+func (osFile) Lock() error   { return nil }
+func (osFile) Unlock() error { return nil }
+
+// changeFS is an osFileFS that can change the attributes of its files.
+type changeFS struct {
+	*osFileFS
+}
+
+func (c changeFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(filepath.Join(c.dir, name), mode)
+}
+
+func (c changeFS) Lchown(name string, uid, gid int) error {
+	return os.Lchown(filepath.Join(c.dir, name), uid, gid)
+}
+
+func (c changeFS) Chown(name string, uid, gid int) error {
+	return os.Chown(filepath.Join(c.dir, name), uid, gid)
+}
+
+func (c changeFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(filepath.Join(c.dir, name), atime, mtime)
+}
+
+// createFile issues a CREATE call in `how` mode, with the attributes of UNCHECKED and
+// GUARDED creates or the verifier of EXCLUSIVE ones, and returns the status of the reply.
+func createFile(t *testing.T, target *nfsc.Target, dir []byte, name string, how uint32, how3 interface{}) nfs.NFSStatus {
+	t.Helper()
+	type createArgs struct {
+		rpc.Header
+		Dir  []byte
+		Name string
+		How  uint32
+		How3 interface{}
+	}
+	res, err := target.Call(&createArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureCreate),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Dir:  dir,
+		Name: name,
+		How:  how,
+		How3: how3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nfs.NFSStatus(status)
+}
+
+func TestCreateModes(t *testing.T) {
+	const unchecked, guarded, exclusive = 0, 1, 2
+	dir := t.TempDir()
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(changeFS{newOSFileFS(dir)}), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noAttrs := nfsc.Sattr3{}
+
+	// UNCHECKED creates a file, or leaves an existing one as it is.
+	if status := createFile(t, target, root, "unchecked", unchecked, noAttrs); status != nfs.NFSStatusOk {
+		t.Fatalf("unchecked create failed: %v", status)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "unchecked"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if status := createFile(t, target, root, "unchecked", unchecked, noAttrs); status != nfs.NFSStatusOk {
+		t.Fatalf("unchecked create of an existing file failed: %v", status)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "unchecked")); err != nil || info.Size() != 4 {
+		t.Fatalf("unchecked create truncated the existing file: %v", err)
+	}
+
+	// GUARDED fails if the file exists.
+	if status := createFile(t, target, root, "guarded", guarded, noAttrs); status != nfs.NFSStatusOk {
+		t.Fatalf("guarded create failed: %v", status)
+	}
+	if status := createFile(t, target, root, "guarded", guarded, noAttrs); status != nfs.NFSStatusExist {
+		t.Fatalf("guarded create of an existing file returned %v", status)
+	}
+
+	// EXCLUSIVE succeeds again only for a retransmission carrying the same verifier.
+	verf := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if status := createFile(t, target, root, "exclusive", exclusive, verf); status != nfs.NFSStatusOk {
+		t.Fatalf("exclusive create failed: %v", status)
+	}
+	if status := createFile(t, target, root, "exclusive", exclusive, verf); status != nfs.NFSStatusOk {
+		t.Fatalf("retransmitted exclusive create returned %v", status)
+	}
+	other := [8]byte{8, 7, 6, 5, 4, 3, 2, 1}
+	if status := createFile(t, target, root, "exclusive", exclusive, other); status != nfs.NFSStatusExist {
+		t.Fatalf("exclusive create with another verifier returned %v", status)
+	}
+	if status := createFile(t, target, root, "unchecked", exclusive, verf); status != nfs.NFSStatusExist {
+		t.Fatalf("exclusive create of a file created otherwise returned %v", status)
+	}
+
+	// every bit of the verifier tells creates apart, in either half of it.
+	for _, other := range [][8]byte{
+		{0x81, 2, 3, 4, 5, 6, 7, 8},
+		{9, 2, 3, 4, 5, 6, 7, 8},
+		{1, 2, 3, 4, 5, 6, 7, 9},
+	} {
+		if status := createFile(t, target, root, "exclusive", exclusive, other); status != nfs.NFSStatusExist {
+			t.Fatalf("exclusive create with verifier %v returned %v", other, status)
+		}
+	}
+	top := [8]byte{0x80, 0, 0, 0, 0x80, 0, 0, 1}
+	if status := createFile(t, target, root, "top", exclusive, top); status != nfs.NFSStatusOk {
+		t.Fatalf("exclusive create failed: %v", status)
+	}
+	if status := createFile(t, target, root, "top", exclusive, top); status != nfs.NFSStatusOk {
+		t.Fatalf("retransmitted exclusive create with the top bits set returned %v", status)
+	}
+	if status := createFile(t, target, root, "top", exclusive, [8]byte{0, 0, 0, 0, 0, 0, 0, 1}); status != nfs.NFSStatusExist {
+		t.Fatalf("exclusive create differing in the top bits returned %v", status)
+	}
+}
+
+func TestCreateExclusiveUnsupported(t *testing.T) {
+	_, handler := newMemHandler(t)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// memfs cannot set file times, so it has nowhere to keep the verifier.
+	if status := createFile(t, target, root, "exclusive", 2, [8]byte{1}); status != nfs.NFSStatusNotSupp {
+		t.Fatalf("exclusive create without Chtimes returned %v", status)
+	}
+}
+
+func TestCaseInsensitiveLookup(t *testing.T) {
+	const unchecked, guarded = 0, 1
+	mem := memfs.New()
+	if err := util.WriteFile(mem, "/file.txt", []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), helpers.CachingHandlerOptions{
+		Limit:           1024,
+		Deterministic:   true,
+		CaseInsensitive: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+
+	info, fh, err := target.Lookup("/File.TXT")
+	if err != nil {
+		t.Fatalf("case insensitive lookup failed: %v", err)
+	}
+	if info.Size() != 5 {
+		t.Fatalf("expected the attributes of file.txt, got a size of %d", info.Size())
+	}
+	_, stored, err := target.Lookup("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fh, stored) {
+		t.Fatal("expected names differing in case to share a handle")
+	}
+
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := createFile(t, target, root, "FILE.txt", guarded, nfsc.Sattr3{}); status != nfs.NFSStatusExist {
+		t.Fatalf("expected a guarded create colliding in case to fail with EXIST, got %v", status)
+	}
+	if status := createFile(t, target, root, "FILE.txt", unchecked, nfsc.Sattr3{}); status != nfs.NFSStatusOk {
+		t.Fatalf("unchecked create colliding in case failed: %v", status)
+	}
+	entries, err := mem.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "file.txt" || entries[0].Size() != 5 {
+		t.Fatalf("expected only the stored file.txt to remain, got %v", entries)
+	}
+}
+
+func TestCaseSensitiveLookup(t *testing.T) {
+	mem, handler := newMemHandler(t)
+	_, _ = mem.Create("/file.txt")
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	if _, _, err := target.Lookup("/File.TXT"); err == nil {
+		t.Fatal("expected names differing in case not to match by default")
+	}
+}
+
+func TestNormalizedNames(t *testing.T) {
+	const unchecked = 0
+	const nfc, nfd = "caf\u00e9", "cafe\u0301"
+	mem, handler := newMemHandler(t)
+	srv := &nfs.Server{Handler: handler, Export: nfs.ExportOptions{Normalization: nfs.NormalizeNFC}}
+	target := mountServer(t, dialServer(t, startServer(t, srv)), rpc.AuthNull)
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := createFile(t, target, root, nfc, unchecked, nfsc.Sattr3{}); status != nfs.NFSStatusOk {
+		t.Fatalf("create failed: %v", status)
+	}
+	if _, _, err := target.Lookup("/" + nfd); err != nil {
+		t.Fatalf("lookup of a name created in NFC failed in NFD: %v", err)
+	}
+	if status := createFile(t, target, root, nfd, unchecked, nfsc.Sattr3{}); status != nfs.NFSStatusOk {
+		t.Fatalf("create in NFD failed: %v", status)
+	}
+	if _, err := mem.Stat("/" + nfd); err == nil {
+		t.Fatal("expected the name created in NFD to be stored in NFC")
+	}
+
+	// names stored in another form are found, and listed in the form of the export.
+	_, _ = mem.Create("/nai\u0308ve")
+	if _, _, err := target.Lookup("/na\u00efve"); err != nil {
+		t.Fatalf("lookup of a name stored in NFD failed: %v", err)
+	}
+	entries, err := target.ReadDirPlus("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	if expected := []string{".", "..", nfc, "na\u00efve", "test"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("listed %q, expected %q", names, expected)
+	}
+}
+
+func TestStreamedRead(t *testing.T) {
+	dir := t.TempDir()
+	// an odd length, so that the final read needs padding.
+	contents := make([]byte, 200003)
+	for i := range contents {
+		contents[i] = byte(i * 7)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data"), contents, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(newOSFileFS(dir)), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	rf, err := target.Open("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rf.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][]byte{contents[1:100001], contents[100001:]} {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(rf, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatal("streamed read returned unexpected data")
+		}
+	}
+	if n, err := rf.Read(make([]byte, nfs.CheckRead+1)); n != 0 || err != io.EOF {
+		t.Fatalf("read past the end returned %d bytes and %v", n, err)
+	}
+}
+
+// BenchmarkRead compares reads streamed from an os file to the connection with reads
+// copied through a buffer, which the countingFS wrapper forces by hiding the descriptor.
+func BenchmarkRead(b *testing.B) {
+	const size, chunk = 16 << 20, 1 << 20
+	dir := b.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "data"), make([]byte, size), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	for _, bc := range []struct {
+		name string
+		fs   billy.Filesystem
+	}{
+		{"streamed", newOSFileFS(dir)},
+		{"buffered", &countingFS{Filesystem: newOSFileFS(dir)}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(bc.fs), 1024)
+			target := mountServer(b, dialServer(b, startServer(b, &nfs.Server{Handler: handler})), rpc.AuthNull)
+			rf, err := target.Open("/data")
+			if err != nil {
+				b.Fatal(err)
+			}
+			buf := make([]byte, chunk)
+
+			b.SetBytes(chunk)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := rf.Seek(int64(i%(size/chunk))*chunk, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(rf, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// statFS reports a fixed capacity for the filesystem it wraps.
+type statFS struct {
+	billy.Filesystem
+	stat nfs.FSStat
+}
+
+func (s *statFS) StatFS() (nfs.FSStat, error) { return s.stat, nil }
+
+func TestFSStatFromBackend(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/test")
+	bfs := &statFS{mem, nfs.FSStat{
+		TotalSize:      1 << 40,
+		FreeSize:       1 << 30,
+		AvailableSize:  1 << 29,
+		TotalFiles:     1000,
+		FreeFiles:      600,
+		AvailableFiles: 500,
+		CacheHint:      30 * time.Second,
+	}}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(bfs), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type fsStatArgs struct {
+		rpc.Header
+		Handle []byte
+	}
+	res, err := target.Call(&fsStatArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureFSStat),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle: fh,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply struct {
+		Status                 uint32
+		Attr                   nfsc.PostOpAttr
+		TBytes, FBytes, ABytes uint64
+		TFiles, FFiles, AFiles uint64
+		InvarSec               uint32
+	}
+	if err := xdr.Read(res, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Status != uint32(nfs.NFSStatusOk) {
+		t.Fatalf("fsstat failed: %v", nfs.NFSStatus(reply.Status))
+	}
+	got := nfs.FSStat{
+		TotalSize:      reply.TBytes,
+		FreeSize:       reply.FBytes,
+		AvailableSize:  reply.ABytes,
+		TotalFiles:     reply.TFiles,
+		FreeFiles:      reply.FFiles,
+		AvailableFiles: reply.AFiles,
+		CacheHint:      time.Duration(reply.InvarSec) * time.Second,
+	}
+	if got != bfs.stat {
+		t.Fatalf("unexpected fsstat %+v, expected %+v", got, bfs.stat)
+	}
+}
+
+// caseInsensitiveFS advertises case-insensitive names for the filesystem it wraps.
+type caseInsensitiveFS struct {
+	billy.Filesystem
+}
+
+func (caseInsensitiveFS) PathConf() nfs.PathConf {
+	return nfs.PathConf{LinkMax: 1, NameMax: 128, NoTrunc: true, CaseInsensitive: true, CasePreserving: true}
+}
+
+func TestPathConfFromBackend(t *testing.T) {
+	type pathConfReply struct {
+		Status          uint32
+		Attr            nfsc.PostOpAttr
+		LinkMax         uint32
+		NameMax         uint32
+		NoTrunc         bool
+		ChownRestricted bool
+		CaseInsensitive bool
+		CasePreserving  bool
+	}
+	pathConf := func(bfs billy.Filesystem) pathConfReply {
+		t.Helper()
+		_, _ = bfs.Create("/test")
+		handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(bfs), 1024)
+		target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+		_, fh, err := target.Lookup("/test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		type pathConfArgs struct {
+			rpc.Header
+			Handle []byte
+		}
+		res, err := target.Call(&pathConfArgs{
+			Header: rpc.Header{
+				Rpcvers: 2,
+				Prog:    nfsc.Nfs3Prog,
+				Vers:    nfsc.Nfs3Vers,
+				Proc:    uint32(nfs.NFSProcedurePathConf),
+				Cred:    rpc.AuthNull,
+				Verf:    rpc.AuthNull,
+			},
+			Handle: fh,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply pathConfReply
+		if err := xdr.Read(res, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Status != uint32(nfs.NFSStatusOk) {
+			t.Fatalf("pathconf failed: %v", nfs.NFSStatus(reply.Status))
+		}
+		return reply
+	}
+
+	plain := pathConf(memfs.New())
+	if plain.CaseInsensitive || !plain.CasePreserving || plain.NameMax != nfs.PathNameMax {
+		t.Fatalf("unexpected default pathconf %+v", plain)
+	}
+	folded := pathConf(caseInsensitiveFS{memfs.New()})
+	if !folded.CaseInsensitive || !folded.CasePreserving || folded.NameMax != 128 {
+		t.Fatalf("backend pathconf was not reported: %+v", folded)
+	}
+}
+
+func TestNameTooLong(t *testing.T) {
+	const unchecked = 0
+	isNameTooLong := func(err error) bool {
+		var nfsErr *nfsc.Error
+		return errors.As(err, &nfsErr) && nfsErr.ErrorNum == nfsc.NFS3ErrNameTooLong
+	}
+	long := strings.Repeat("a", 512)
+
+	_, handler := newMemHandler(t)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := createFile(t, target, root, long, unchecked, nfsc.Sattr3{}); status != nfs.NFSStatusNameTooLong {
+		t.Fatalf("expected NAMETOOLONG creating a 512 character name, got %v", status)
+	}
+	if _, err := target.Mkdir("/"+long, 0o755); !isNameTooLong(err) {
+		t.Fatalf("expected NAMETOOLONG making a 512 character directory, got %v", err)
+	}
+
+	// the limit is the name_max the backend advertises.
+	mem := memfs.New()
+	_, _ = mem.Create("/test")
+	handler = helpers.NewCachingHandler(helpers.NewNullAuthHandler(caseInsensitiveFS{mem}), 1024)
+	target = mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	if _, err := target.Mkdir("/"+strings.Repeat("a", 129), 0o755); !isNameTooLong(err) {
+		t.Fatalf("expected NAMETOOLONG beyond the name_max of the backend, got %v", err)
+	}
+	if _, err := target.Mkdir("/"+strings.Repeat("a", 128), 0o755); err != nil {
+		t.Fatalf("making a directory named within name_max failed: %v", err)
+	}
+}
+
+// lookupName issues a LOOKUP call and returns its status.
+func lookupName(t *testing.T, target *nfsc.Target, dir []byte, name string) nfs.NFSStatus {
+	t.Helper()
+	status, _, _ := lookupEntry(t, target, dir, name)
+	return status
+}
+
+// lookupEntry issues a LOOKUP call, returning the handle and attributes of the entry found.
+func lookupEntry(t *testing.T, target *nfsc.Target, dir []byte, name string) (nfs.NFSStatus, []byte, nfsc.PostOpAttr) {
+	t.Helper()
+	type lookupArgs struct {
+		rpc.Header
+		Dir  []byte
+		Name string
+	}
+	type lookupOk struct {
+		Handle []byte
+		Attr   nfsc.PostOpAttr
+	}
+	res, err := target.Call(&lookupArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureLookup),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Dir:  dir,
+		Name: name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nfs.NFSStatus(status) != nfs.NFSStatusOk {
+		return nfs.NFSStatus(status), nil, nfsc.PostOpAttr{}
+	}
+	var ok lookupOk
+	if err := xdr.Read(res, &ok); err != nil {
+		t.Fatal(err)
+	}
+	return nfs.NFSStatusOk, ok.Handle, ok.Attr
+}
+
+func TestLookupDotEntries(t *testing.T) {
+	mem, handler := newMemHandler(t)
+	if err := mem.MkdirAll("/dir/sub", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	fileIDOf := func(p string) uint64 {
+		t.Helper()
+		attr, err := target.Getattr(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return attr.Fileid
+	}
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sub, err := target.Lookup("/dir/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		dir  []byte
+		name string
+		want string
+	}{
+		{sub, ".", "/dir/sub"},
+		{sub, "..", "/dir"},
+		{root, ".", "/"},
+		{root, "..", "/"},
+	} {
+		status, fh, attr := lookupEntry(t, target, c.dir, c.name)
+		if status != nfs.NFSStatusOk {
+			t.Fatalf("LOOKUP of %q for %s failed with %v", c.name, c.want, status)
+		}
+		if !attr.IsSet || attr.Attr.Fileid != fileIDOf(c.want) {
+			t.Fatalf("LOOKUP of %q for %s returned the attributes of another file", c.name, c.want)
+		}
+		// the handle returned must itself be usable.
+		if status, _, again := lookupEntry(t, target, fh, "."); status != nfs.NFSStatusOk || again.Attr.Fileid != attr.Attr.Fileid {
+			t.Fatalf("the handle LOOKUP of %q returned for %s does not resolve to it: %v", c.name, c.want, status)
+		}
+	}
+}
+
+func TestLookupRefusedHandle(t *testing.T) {
+	mem := memfs.New()
+	if err := util.WriteFile(mem, "/a", []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := helpers.NewCachingHandlerWithOptions(helpers.NewNullAuthHandler(mem), helpers.CachingHandlerOptions{Limit: 1, RefuseWhenFull: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the root fills the cache, so there is no room for the handle of /a.
+	if status := lookupName(t, target, root, "a"); status != nfs.NFSStatusJukebox {
+		t.Fatalf("expected JUKEBOX looking up a file the handler has no room for, got %v", status)
+	}
+	if status, _, _ := lookupEntry(t, target, root, "."); status != nfs.NFSStatusOk {
+		t.Fatalf("expected the cached root to be looked up, got %v", status)
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	const unchecked = 0
+	mem, handler := newMemHandler(t)
+	_, _ = mem.Create("/private/secret")
+	_, _ = mem.Create("/public/file")
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, public, err := target.Lookup("/public")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"../escape", "..", ".", "a\x00b", ""} {
+		if status := createFile(t, target, public, name, unchecked, nfsc.Sattr3{}); status != nfs.NFSStatusInval {
+			t.Errorf("expected INVAL creating %q, got %v", name, status)
+		}
+		if status, _, _ := rename(t, target, public, "file", public, name); status != nfs.NFSStatusInval {
+			t.Errorf("expected INVAL renaming onto %q, got %v", name, status)
+		}
+	}
+	if status, _, _ := rename(t, target, public, "../private/secret", public, "stolen"); status != nfs.NFSStatusInval {
+		t.Errorf("expected INVAL renaming from a name with a slash, got %v", status)
+	}
+	if status := lookupName(t, target, public, "../private"); status != nfs.NFSStatusInval {
+		t.Errorf("expected INVAL looking up a name with a slash, got %v", status)
+	}
+	if status := lookupName(t, target, public, ".."); status != nfs.NFSStatusOk {
+		t.Errorf("looking up '..' failed: %v", status)
+	}
+
+	if _, err := mem.Stat("/escape"); err == nil {
+		t.Error("a create escaped its directory")
+	}
+	if _, err := mem.Stat("/private/secret"); err != nil {
+		t.Errorf("a rename escaped its directory: %v", err)
+	}
+}
+
+func TestFSInfoTransferSizes(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{
+		Handler:           handler,
+		MaxReadSize:       1 << 20,
+		MaxWriteSize:      1 << 20,
+		PreferredReadSize: 1 << 19,
+	}
+	target := mountServer(t, dialServer(t, startServer(t, srv)), rpc.AuthNull)
+	info, err := target.FSInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.RTMax != 1<<20 || info.RTPref != 1<<19 {
+		t.Errorf("unexpected read sizes %d/%d", info.RTMax, info.RTPref)
+	}
+	// an unset preferred size follows the maximum.
+	if info.WTMax != 1<<20 || info.WTPref != 1<<20 {
+		t.Errorf("unexpected write sizes %d/%d", info.WTMax, info.WTPref)
+	}
+}
+
+// limitsHandler records the transfer limits of the requests it resolves handles for.
+type limitsHandler struct {
+	nfs.Handler
+	mu     sync.Mutex
+	limits []nfs.TransferLimits
+}
+
+func (l *limitsHandler) FromHandleContext(ctx context.Context, fh []byte) (billy.Filesystem, []string, error) {
+	l.mu.Lock()
+	l.limits = append(l.limits, nfs.LimitsFromContext(ctx))
+	l.mu.Unlock()
+	return l.Handler.FromHandle(fh)
+}
+
+func TestLimitsFromContext(t *testing.T) {
+	mem, inner := newMemHandler(t)
+	if err := util.WriteFile(mem, "/data", []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler := &limitsHandler{Handler: inner}
+	srv := &nfs.Server{
+		Handler:           handler,
+		MaxReadSize:       1 << 20,
+		PreferredReadSize: 1 << 16,
+		MaxWriteSize:      1 << 18,
+	}
+	target := mountServer(t, dialServer(t, startServer(t, srv)), rpc.AuthNull)
+	f, err := target.Open("/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.mu.Lock()
+	handler.limits = nil
+	handler.mu.Unlock()
+	if _, err := io.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+
+	want := nfs.TransferLimits{MaxRead: 1 << 20, PreferredRead: 1 << 16, MaxWrite: 1 << 18, PreferredWrite: 1 << 18}
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if len(handler.limits) == 0 {
+		t.Fatal("READ did not resolve its handle through the handler")
+	}
+	for _, got := range handler.limits {
+		if got != want {
+			t.Fatalf("handler saw limits %+v during READ, expected %+v", got, want)
+		}
+	}
+	if got := nfs.LimitsFromContext(context.Background()); got != (nfs.TransferLimits{}) {
+		t.Fatalf("limits %+v outside of a request", got)
+	}
+}
+
+// symlink issues a SYMLINK call creating `name` in the directory `dir` and returns its status.
+func symlink(t *testing.T, target *nfsc.Target, dir []byte, name, to string) nfs.NFSStatus {
+	t.Helper()
+	type symlinkArgs struct {
+		rpc.Header
+		Handle []byte
+		Name   string
+		Sattr  nfsc.Sattr3
+		To     string
+	}
+	res, err := target.Call(&symlinkArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureSymlink),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle: dir,
+		Name:   name,
+		To:     to,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nfs.NFSStatus(status)
+}
+
+// readlink issues a READLINK call and returns its status and the target of the link.
+func readlink(t *testing.T, target *nfsc.Target, fh []byte) (nfs.NFSStatus, string) {
+	t.Helper()
+	type readlinkArgs struct {
+		rpc.Header
+		Handle []byte
+	}
+	res, err := target.Call(&readlinkArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureReadlink),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle: fh,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply struct {
+		Status uint32
+		Attr   nfsc.PostOpAttr
+	}
+	if err := xdr.Read(res, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Status != uint32(nfs.NFSStatusOk) {
+		return nfs.NFSStatus(reply.Status), ""
+	}
+	var to string
+	if err := xdr.Read(res, &to); err != nil {
+		t.Fatal(err)
+	}
+	return nfs.NFSStatusOk, to
+}
+
+func TestSymlinkRoundTrip(t *testing.T) {
+	_, handler := newMemHandler(t)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, to := range map[string]string{
+		"relative": "test",
+		"absolute": "/etc/hosts",
+		"spaced":   "../some dir/with spaces",
+	} {
+		if status := symlink(t, target, root, name, to); status != nfs.NFSStatusOk {
+			t.Fatalf("symlink %s failed: %v", name, status)
+		}
+		info, fh, err := target.Lookup("/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const nf3lnk = 5
+		if typ := info.(*nfsc.Fattr).Type; typ != nf3lnk {
+			t.Errorf("%s has type %d, expected a symlink", name, typ)
+		}
+		status, got := readlink(t, target, fh)
+		if status != nfs.NFSStatusOk {
+			t.Fatalf("readlink %s failed: %v", name, status)
+		}
+		if got != to {
+			t.Errorf("%s links to %q, expected %q", name, got, to)
+		}
+	}
+	if status := symlink(t, target, root, "relative", "elsewhere"); status != nfs.NFSStatusExist {
+		t.Fatalf("expected EXIST replacing a symlink, got %v", status)
+	}
+}
+
+// noSymlinkFS is a filesystem that cannot create or read symlinks.
+type noSymlinkFS struct {
+	billy.Filesystem
+}
+
+func (noSymlinkFS) Symlink(target, link string) error    { return billy.ErrNotSupported }
+func (noSymlinkFS) Readlink(link string) (string, error) { return "", billy.ErrNotSupported }
+
+func TestSymlinkUnsupported(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/test")
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(noSymlinkFS{mem}), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := symlink(t, target, root, "link", "test"); status != nfs.NFSStatusNotSupp {
+		t.Fatalf("expected NOTSUPP creating a symlink, got %v", status)
+	}
+	_, fh, err := target.Lookup("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := readlink(t, target, fh); status != nfs.NFSStatusNotSupp {
+		t.Fatalf("expected NOTSUPP reading a link, got %v", status)
+	}
+}
+
+func TestSymlinkLoop(t *testing.T) {
+	const unchecked, filesync = 0, 2
+	mem, handler := newMemHandler(t)
+	_ = mem.Symlink("b", "/a")
+	_ = mem.Symlink("a", "/b")
+	_ = util.WriteFile(mem, "/file", []byte("data"), 0o644)
+	_ = mem.Symlink("file", "/chain3")
+	_ = mem.Symlink("chain3", "/chain2")
+	_ = mem.Symlink("chain2", "/chain1")
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler, MaxSymlinkHops: 2})), rpc.AuthNull)
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loop, err := target.Lookup("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// memfs follows links without bound, so these would not return were the server to
+	// leave the cycle for it to follow.
+	if status, _, _ := writeAt(t, target, loop, 0, filesync, []byte("x")); status != nfs.NFSStatusMlink {
+		t.Fatalf("expected MLINK writing through a cycle of links, got %v", status)
+	}
+	if status := createFile(t, target, root, "b", unchecked, nfsc.Sattr3{}); status != nfs.NFSStatusMlink {
+		t.Fatalf("expected MLINK creating at a cycle of links, got %v", status)
+	}
+
+	_, chain, err := target.Lookup("/chain1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := writeAt(t, target, chain, 0, filesync, []byte("x")); status != nfs.NFSStatusMlink {
+		t.Fatalf("expected MLINK following more links than allowed, got %v", status)
+	}
+	_, chain, err = target.Lookup("/chain2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := writeAt(t, target, chain, 0, filesync, []byte("x")); status != nfs.NFSStatusOk {
+		t.Fatalf("writing through links within the limit failed: %v", status)
+	}
+}
+
+// xattrFS keeps extended attributes in memory for the files of the filesystem it wraps.
+type xattrFS struct {
+	billy.Filesystem
+	mu    sync.Mutex
+	attrs map[string]map[string][]byte
+}
+
+func (x *xattrFS) Getxattr(name, attr string) ([]byte, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	value, ok := x.attrs[name][attr]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return value, nil
+}
+
+func (x *xattrFS) Setxattr(name, attr string, value []byte) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.attrs[name] == nil {
+		x.attrs[name] = make(map[string][]byte)
+	}
+	x.attrs[name][attr] = value
+	return nil
+}
+
+func (x *xattrFS) Listxattr(name string) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	names := []string{}
+	for attr := range x.attrs[name] {
+		names = append(names, attr)
+	}
+	return names, nil
+}
+
+func (x *xattrFS) Removexattr(name, attr string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.attrs[name][attr]; !ok {
+		return os.ErrNotExist
+	}
+	delete(x.attrs[name], attr)
+	return nil
+}
+
+// callXattr issues an xattr procedure and returns its status and the rest of its reply.
+func callXattr(t *testing.T, target *nfsc.Target, proc nfs.NFSProcedure, args interface{}) (nfs.NFSStatus, io.Reader) {
+	t.Helper()
+	res, err := target.Call(&struct {
+		rpc.Header
+		Args interface{}
+	}{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(proc),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Args: args,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nfs.NFSStatus(status), res
+}
+
+func TestXattrs(t *testing.T) {
+	const either, create, replace = 0, 1, 2
+	type nameArgs struct {
+		Handle []byte
+		Name   string
+	}
+	type setArgs struct {
+		Handle []byte
+		Option uint32
+		Name   string
+		Value  []byte
+	}
+	mem, _ := newMemHandler(t)
+	_, _ = mem.Create("/file")
+	xfs := &xattrFS{Filesystem: mem, attrs: make(map[string]map[string][]byte)}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(xfs), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(name string) (nfs.NFSStatus, []byte) {
+		t.Helper()
+		status, res := callXattr(t, target, nfs.NFSProcedureGetXattr, nameArgs{fh, name})
+		if status != nfs.NFSStatusOk {
+			return status, nil
+		}
+		var reply struct {
+			Attrs nfsc.PostOpAttr
+			Value []byte
+		}
+		if err := xdr.Read(res, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return status, reply.Value
+	}
+
+	if status, _ := callXattr(t, target, nfs.NFSProcedureSetXattr, setArgs{fh, create, "user.color", []byte("blue")}); status != nfs.NFSStatusOk {
+		t.Fatalf("setting an xattr failed: %v", status)
+	}
+	if status, value := get("user.color"); status != nfs.NFSStatusOk || string(value) != "blue" {
+		t.Fatalf("read back %q with %v, expected \"blue\"", value, status)
+	}
+	if status, _ := callXattr(t, target, nfs.NFSProcedureSetXattr, setArgs{fh, create, "user.color", []byte("red")}); status != nfs.NFSStatusExist {
+		t.Fatalf("expected EXIST creating an xattr that is set, got %v", status)
+	}
+	if status, _ := callXattr(t, target, nfs.NFSProcedureSetXattr, setArgs{fh, replace, "user.size", []byte("xl")}); status != nfs.NFSStatusNoEnt {
+		t.Fatalf("expected NOENT replacing an xattr that is not set, got %v", status)
+	}
+	if status, _ := callXattr(t, target, nfs.NFSProcedureSetXattr, setArgs{fh, either, "user.size", []byte("xl")}); status != nfs.NFSStatusOk {
+		t.Fatalf("setting a second xattr failed: %v", status)
+	}
+
+	status, res := callXattr(t, target, nfs.NFSProcedureListXattrs, fh)
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("listing xattrs failed: %v", status)
+	}
+	var list struct {
+		Attrs nfsc.PostOpAttr
+		Names []string
+	}
+	if err := xdr.Read(res, &list); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"user.color", "user.size"}; !reflect.DeepEqual(list.Names, expected) {
+		t.Fatalf("listed %q, expected %q", list.Names, expected)
+	}
+
+	if status, _ := callXattr(t, target, nfs.NFSProcedureRemoveXattr, nameArgs{fh, "user.color"}); status != nfs.NFSStatusOk {
+		t.Fatalf("removing an xattr failed: %v", status)
+	}
+	if status, _ := get("user.color"); status != nfs.NFSStatusNoEnt {
+		t.Fatalf("expected NOENT reading a removed xattr, got %v", status)
+	}
+
+	// filesystems without xattrs answer that they are not supported.
+	_, plain := newMemHandler(t)
+	target = mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: plain})), rpc.AuthNull)
+	_, fh, err = target.Lookup("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := get("user.color"); status != nfs.NFSStatusNotSupp {
+		t.Fatalf("expected NOTSUPP from a filesystem without xattrs, got %v", status)
+	}
+}
+
+// mknodFS creates fifos and sockets as empty entries of the filesystem it wraps.
+type mknodFS struct {
+	billy.Filesystem
+}
+
+func (m mknodFS) Mknod(name string, mode os.FileMode, major, minor uint32) error {
+	if mode&os.ModeDevice != 0 {
+		return billy.ErrNotSupported
+	}
+	f, err := m.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// mknod issues a MKNOD call for a fifo or socket and returns its status.
+func mknod(t *testing.T, target *nfsc.Target, dir []byte, name string, ftype uint32) nfs.NFSStatus {
+	t.Helper()
+	type mknodArgs struct {
+		rpc.Header
+		Handle []byte
+		Name   string
+		Type   uint32
+		Sattr  nfsc.Sattr3
+		Spec   [2]uint32
+	}
+	res, err := target.Call(&mknodArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureMkNod),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle: dir,
+		Name:   name,
+		Type:   ftype,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := xdr.ReadUint32(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nfs.NFSStatus(status)
+}
+
+func TestMknodFIFO(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/test")
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mknodFS{mem}), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, root, err := target.Lookup("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := mknod(t, target, root, "pipe", uint32(nfs.FileTypeFIFO)); status != nfs.NFSStatusOk {
+		t.Fatalf("mknod failed: %v", status)
+	}
+	attr, err := target.Getattr("/pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nfs.FileType(attr.Type) != nfs.FileTypeFIFO {
+		t.Fatalf("created node has type %v, expected a fifo", nfs.FileType(attr.Type))
+	}
+
+	if status := mknod(t, target, root, "pipe", uint32(nfs.FileTypeFIFO)); status != nfs.NFSStatusExist {
+		t.Fatalf("expected EXIST recreating a node, got %v", status)
+	}
+	if status := mknod(t, target, root, "tty", uint32(nfs.FileTypeCharacter)); status != nfs.NFSStatusNotSupp {
+		t.Fatalf("expected NOTSUPP for an unsupported device, got %v", status)
+	}
+	if status := mknod(t, target, root, "file", uint32(nfs.FileTypeRegular)); status != nfs.NFSStatusBadType {
+		t.Fatalf("expected BADTYPE for a regular file, got %v", status)
+	}
+}
+
+// linkFS emulates hard links over the filesystem it wraps by copying the linked file.
+type linkFS struct {
+	billy.Filesystem
+}
+
+func (l linkFS) Link(oldname, newname string) error {
+	data, err := util.ReadFile(l, oldname)
+	if err != nil {
+		return err
+	}
+	return util.WriteFile(l, newname, data, 0666)
+}
+
+// link issues a LINK call and returns its status and the wcc data of the directory.
+func link(t *testing.T, target *nfsc.Target, fh, dir []byte, name string) (nfs.NFSStatus, nfsc.WccData) {
+	t.Helper()
+	type linkArgs struct {
+		rpc.Header
+		Handle []byte
+		Dir    []byte
+		Name   string
+	}
+	res, err := target.Call(&linkArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureLink),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		Handle: fh,
+		Dir:    dir,
+		Name:   name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply struct {
+		Status uint32
+		Attr   nfsc.PostOpAttr
+		Wcc    nfsc.WccData
+	}
+	if err := xdr.Read(res, &reply); err != nil {
+		t.Fatal(err)
+	}
+	return nfs.NFSStatus(reply.Status), reply.Wcc
+}
+
+func TestLink(t *testing.T) {
+	mem := memfs.New()
+	if err := util.WriteFile(mem, "/dir/source", []byte("linked"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(linkFS{mem}), 1024)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	_, fh, err := target.Lookup("/dir/source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dir, err := target.Lookup("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, wcc := link(t, target, fh, dir, "alias")
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("link failed: %v", status)
+	}
+	if !wcc.Before.IsSet || !wcc.After.IsSet {
+		t.Error("expected wcc data for the directory")
+	}
+	data, err := util.ReadFile(mem, "/dir/alias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "linked" {
+		t.Fatalf("unexpected contents %q through the link", data)
+	}
+
+	if status, _ := link(t, target, fh, dir, "alias"); status != nfs.NFSStatusExist {
+		t.Fatalf("expected EXIST linking onto an existing name, got %v", status)
+	}
+}
+
+// rename issues a RENAME call and returns its status and the wcc data of both directories.
+func rename(t *testing.T, target *nfsc.Target, fromDir []byte, fromName string, toDir []byte, toName string) (nfs.NFSStatus, nfsc.WccData, nfsc.WccData) {
+	t.Helper()
+	type renameArgs struct {
+		rpc.Header
+		From     []byte
+		FromName string
+		To       []byte
+		ToName   string
+	}
+	res, err := target.Call(&renameArgs{
+		Header: rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureRename),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		},
+		From:     fromDir,
+		FromName: fromName,
+		To:       toDir,
+		ToName:   toName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply struct {
+		Status uint32
+		From   nfsc.WccData
+		To     nfsc.WccData
+	}
+	if err := xdr.Read(res, &reply); err != nil {
+		t.Fatal(err)
+	}
+	return nfs.NFSStatus(reply.Status), reply.From, reply.To
+}
+
+func TestRenameDirectory(t *testing.T) {
+	mem, handler := newMemHandler(t)
+	for _, f := range []string{"/src/dir/a", "/src/dir/b", "/dst/file", "/dst/full/x"} {
+		if err := util.WriteFile(mem, f, []byte(f), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+	lookup := func(p string) []byte {
+		t.Helper()
+		_, fh, err := target.Lookup(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fh
+	}
+	src, dst := lookup("/src"), lookup("/dst")
+	dir, child := lookup("/src/dir"), lookup("/src/dir/a")
+
+	status, fromWcc, toWcc := rename(t, target, src, "dir", dst, "moved")
+	if status != nfs.NFSStatusOk {
+		t.Fatalf("rename failed: %v", status)
+	}
+	if !fromWcc.Before.IsSet || !fromWcc.After.IsSet || !toWcc.Before.IsSet || !toWcc.After.IsSet {
+		t.Error("expected wcc data for both directories")
+	}
+	for _, tc := range []struct {
+		fh       []byte
+		expected []string
+	}{
+		{dir, []string{"dst", "moved"}},
+		{child, []string{"dst", "moved", "a"}},
+	} {
+		_, p, err := handler.FromHandle(tc.fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(p, tc.expected) {
+			t.Errorf("handle resolved to %v after rename, expected %v", p, tc.expected)
+		}
+	}
+
+	if status, _, _ := rename(t, target, dst, "moved", dst, "full"); status != nfs.NFSStatusNotEmpty {
+		t.Fatalf("expected NOTEMPTY renaming onto a populated directory, got %v", status)
+	}
+	if status, _, _ := rename(t, target, dst, "moved", dst, "file"); status != nfs.NFSStatusExist {
+		t.Fatalf("expected EXIST renaming a directory onto a file, got %v", status)
+	}
+	if status, _, _ := rename(t, target, dir, "b", dst, "file"); status != nfs.NFSStatusOk {
+		t.Fatalf("replacing a file failed: %v", status)
+	}
+	data, err := util.ReadFile(mem, "/dst/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "/src/dir/b" {
+		t.Fatalf("rename did not replace the target, it holds %q", data)
+	}
+}
+
+func TestMalformedAndUnknownHandles(t *testing.T) {
+	_, handler := newMemHandler(t)
+	target := mountServer(t, dialServer(t, startServer(t, &nfs.Server{Handler: handler})), rpc.AuthNull)
+
+	type getattrArgs struct {
+		rpc.Header
+		Handle []byte
+	}
+	for _, tc := range []struct {
+		name   string
+		handle []byte
+		status nfs.NFSStatus
+	}{
+		{"malformed", []byte{1, 2, 3}, nfs.NFSStatusBadHandle},
+		{"unknown", []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, nfs.NFSStatusStale},
+	} {
+		res, err := target.Call(&getattrArgs{
+			Header: rpc.Header{
+				Rpcvers: 2,
+				Prog:    nfsc.Nfs3Prog,
+				Vers:    nfsc.Nfs3Vers,
+				Proc:    uint32(nfs.NFSProcedureGetAttr),
+				Cred:    rpc.AuthNull,
+				Verf:    rpc.AuthNull,
+			},
+			Handle: tc.handle,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := xdr.ReadUint32(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nfs.NFSStatus(status) != tc.status {
+			t.Fatalf("getattr of a %s handle failed with %v, expected %v", tc.name, nfs.NFSStatus(status), tc.status)
+		}
+	}
+}
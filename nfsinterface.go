@@ -29,6 +29,16 @@ const (
 	NFSProcedureCommit
 )
 
+// Extended attribute procedures are an extension of NFSv3 modelled on the xattr operations of
+// NFSv4.2 (RFC 8276), numbered after the procedures of the protocol. They are answered for
+// filesystems implementing XattrFS, and with NFSStatusNotSupp otherwise.
+const (
+	NFSProcedureGetXattr NFSProcedure = iota + NFSProcedureCommit + 1
+	NFSProcedureSetXattr
+	NFSProcedureListXattrs
+	NFSProcedureRemoveXattr
+)
+
 func (n NFSProcedure) String() string {
 	switch n {
 	case NFSProcedureNull:
@@ -75,6 +85,14 @@ func (n NFSProcedure) String() string {
 		return "PathConf"
 	case NFSProcedureCommit:
 		return "Commit"
+	case NFSProcedureGetXattr:
+		return "GetXattr"
+	case NFSProcedureSetXattr:
+		return "SetXattr"
+	case NFSProcedureListXattrs:
+		return "ListXattrs"
+	case NFSProcedureRemoveXattr:
+		return "RemoveXattr"
 	default:
 		return "Unknown"
 	}
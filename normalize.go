@@ -0,0 +1,43 @@
+package nfs
+
+import "golang.org/x/text/unicode/norm"
+
+// Normalization selects the Unicode normalization form file names are converted to.
+type Normalization int
+
+// Normalization values
+const (
+	// NoNormalization passes file names through as clients send them.
+	NoNormalization Normalization = iota
+	// NormalizeNFC composes file names, as most Linux and Windows clients send them.
+	NormalizeNFC
+	// NormalizeNFD decomposes file names, as macOS clients send them.
+	NormalizeNFD
+)
+
+// form is the normalization form of a mode, if it normalizes names.
+func (n Normalization) form() (norm.Form, bool) {
+	switch n {
+	case NormalizeNFC:
+		return norm.NFC, true
+	case NormalizeNFD:
+		return norm.NFD, true
+	}
+	return 0, false
+}
+
+// normalizeName converts a file name sent by a client to the normalization of the export.
+func (o *ExportOptions) normalizeName(name []byte) []byte {
+	if f, ok := o.Normalization.form(); ok {
+		return f.Bytes(name)
+	}
+	return name
+}
+
+// normalizedName is the name of a directory entry as listed to clients.
+func (o *ExportOptions) normalizedName(name string) string {
+	if f, ok := o.Normalization.form(); ok {
+		return f.String(name)
+	}
+	return name
+}
@@ -0,0 +1,248 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// The portmapper protocol (version 2), per rfc1833 section 3.
+const (
+	portmapServiceID = 100000
+	portmapVersion   = 2
+	portmapPort      = 111
+
+	portmapProcNull    = 0
+	portmapProcSet     = 1
+	portmapProcUnset   = 2
+	portmapProcGetPort = 3
+	portmapProcDump    = 4
+
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+)
+
+func init() {
+	_ = RegisterMessageHandler(portmapServiceID, portmapProcNull, onPortmapNull)
+	_ = RegisterMessageHandler(portmapServiceID, portmapProcSet, onPortmapSet)
+	_ = RegisterMessageHandler(portmapServiceID, portmapProcUnset, onPortmapUnset)
+	_ = RegisterMessageHandler(portmapServiceID, portmapProcGetPort, onPortmapGetPort)
+	_ = RegisterMessageHandler(portmapServiceID, portmapProcDump, onPortmapDump)
+}
+
+// portMapping is the `mapping` of a program and version to the port it is served on.
+type portMapping struct {
+	Prog uint32
+	Vers uint32
+	Prot uint32
+	Port uint32
+}
+
+// ServePortmap answers portmapper queries on `l` for the programs the server is serving,
+// as set up for port 111 by EmbeddedPortmap. Only the portmapper is answered on `l`, and
+// it is answered only there.
+func (s *Server) ServePortmap(l net.Listener) error {
+	return s.serve(l, rolePortmap)
+}
+
+// startPortmap serves the embedded portmapper on its well-known port, once per server.
+func (s *Server) startPortmap() {
+	s.portmapOnce.Do(func() {
+		addr := fmt.Sprintf(":%d", portmapPort)
+		if l, err := net.Listen("tcp", addr); err != nil {
+			Log.Errorf("embedded portmap unavailable over tcp: %v", err)
+		} else {
+			go func() { _ = s.serve(l, rolePortmap) }()
+		}
+		if pc, err := net.ListenPacket("udp", addr); err != nil {
+			Log.Errorf("embedded portmap unavailable over udp: %v", err)
+		} else {
+			go func() { _ = s.serveUDP(pc, rolePortmap) }()
+		}
+	})
+}
+
+// portMappings lists the programs exposed on each of the sockets the server is serving, and
+// those registered with the embedded portmapper.
+func (s *Server) portMappings() []portMapping {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.portMappingsLocked()
+}
+
+func (s *Server) portMappingsLocked() []portMapping {
+	var mappings []portMapping
+	// MOUNT is only advertised on the NFS sockets when it has none of its own.
+	mountSeparate := false
+	for _, role := range s.listeners {
+		mountSeparate = mountSeparate || role == roleMount
+	}
+	add := func(addr net.Addr, prot uint32, role socketRole) {
+		var port int
+		switch a := addr.(type) {
+		case *net.TCPAddr:
+			port = a.Port
+		case *net.UDPAddr:
+			port = a.Port
+		default:
+			return
+		}
+		switch role {
+		case rolePortmap:
+			mappings = append(mappings, portMapping{portmapServiceID, portmapVersion, prot, uint32(port)})
+		case roleMount:
+			mappings = append(mappings, portMapping{mountServiceID, 3, prot, uint32(port)})
+		default:
+			mappings = append(mappings, portMapping{nfsServiceID, 3, prot, uint32(port)})
+			if !mountSeparate {
+				mappings = append(mappings, portMapping{mountServiceID, 3, prot, uint32(port)})
+			}
+		}
+	}
+	for l, role := range s.listeners {
+		add(l.Addr(), ipProtoTCP, role)
+	}
+	for pc, role := range s.packetConns {
+		add(pc.LocalAddr(), ipProtoUDP, role)
+	}
+	for m := range s.portmapRegistrations {
+		mappings = append(mappings, m)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		a, b := mappings[i], mappings[j]
+		if a.Prog != b.Prog {
+			return a.Prog < b.Prog
+		}
+		if a.Prot != b.Prot {
+			return a.Prot < b.Prot
+		}
+		return a.Port < b.Port
+	})
+	return mappings
+}
+
+func onPortmapNull(ctx context.Context, w *response, userHandle Handler) error {
+	return w.writeHeader(ResponseCodeSuccess)
+}
+
+// onPortmapSet registers the port of a program of another local service. It is refused when
+// the program, version and protocol are already mapped, or when the caller is not local.
+func onPortmapSet(ctx context.Context, w *response, userHandle Handler) error {
+	var mapping portMapping
+	if err := readArgs(w.req.Body, &mapping); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	ok := false
+	if isLocal(w.conn.RemoteAddr()) {
+		ok = w.Server.setPortMapping(mapping)
+	}
+	return writeBool(w, ok)
+}
+
+// onPortmapUnset removes the registrations of a program version over every protocol. The
+// mappings of the server's own sockets are not removed.
+func onPortmapUnset(ctx context.Context, w *response, userHandle Handler) error {
+	var mapping portMapping
+	if err := readArgs(w.req.Body, &mapping); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	ok := false
+	if isLocal(w.conn.RemoteAddr()) {
+		ok = w.Server.unsetPortMapping(mapping.Prog, mapping.Vers)
+	}
+	return writeBool(w, ok)
+}
+
+// setPortMapping registers `m`, reporting false if its program, version and protocol are
+// already mapped.
+func (s *Server) setPortMapping(m portMapping) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.portMappingsLocked() {
+		if existing.Prog == m.Prog && existing.Vers == m.Vers && existing.Prot == m.Prot {
+			return false
+		}
+	}
+	if s.portmapRegistrations == nil {
+		s.portmapRegistrations = make(map[portMapping]struct{})
+	}
+	s.portmapRegistrations[m] = struct{}{}
+	return true
+}
+
+// unsetPortMapping removes the registrations of a program version, reporting whether there were any.
+func (s *Server) unsetPortMapping(prog, vers uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := false
+	for m := range s.portmapRegistrations {
+		if m.Prog == prog && m.Vers == vers {
+			delete(s.portmapRegistrations, m)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// isLocal reports whether `addr` is a loopback address, from which services on the same
+// host register with the portmapper.
+func isLocal(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func writeBool(w *response, b bool) error {
+	v := uint32(0)
+	if b {
+		v = 1
+	}
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, v); err != nil {
+		return err
+	}
+	return w.Write(writer.Bytes())
+}
+
+func onPortmapGetPort(ctx context.Context, w *response, userHandle Handler) error {
+	var query portMapping
+	if err := readArgs(w.req.Body, &query); err != nil {
+		return &ResponseCodeGarbageArgsError{}
+	}
+	// a port of zero means the program is not registered.
+	port := uint32(0)
+	for _, m := range w.Server.portMappings() {
+		if m.Prog == query.Prog && m.Vers == query.Vers && m.Prot == query.Prot {
+			port = m.Port
+			break
+		}
+	}
+	writer := bytes.NewBuffer([]byte{})
+	if err := xdr.Write(writer, port); err != nil {
+		return err
+	}
+	return w.Write(writer.Bytes())
+}
+
+func onPortmapDump(ctx context.Context, w *response, userHandle Handler) error {
+	writer := bytes.NewBuffer([]byte{})
+	for _, m := range w.Server.portMappings() {
+		if err := xdr.Write(writer, uint32(1)); err != nil {
+			return err
+		}
+		if err := xdr.Write(writer, m); err != nil {
+			return err
+		}
+	}
+	if err := xdr.Write(writer, uint32(0)); err != nil {
+		return err
+	}
+	return w.Write(writer.Bytes())
+}
@@ -0,0 +1,158 @@
+package nfs_test
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	nfs "github.com/willscott/go-nfs"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+func TestEmbeddedPortmap(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{Handler: handler}
+	addr := startServer(t, srv)
+	// once mounted, the server is known to be serving its listener.
+	mountServer(t, dialServer(t, addr), rpc.AuthNull)
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		_ = srv.ServePortmap(listener)
+	}()
+	pm := &rpc.Portmapper{Client: dialServer(t, listener.Addr().String())}
+
+	_, portStr, _ := net.SplitHostPort(addr)
+	nfsPort, _ := strconv.Atoi(portStr)
+	for _, prog := range []uint32{nfsc.Nfs3Prog, nfsc.MountProg} {
+		port, err := pm.Getport(rpc.Mapping{Prog: prog, Vers: 3, Prot: rpc.IPProtoTCP})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port != nfsPort {
+			t.Errorf("program %d was mapped to port %d, expected %d", prog, port, nfsPort)
+		}
+	}
+	if port, err := pm.Getport(rpc.Mapping{Prog: nfsc.Nfs3Prog, Vers: 3, Prot: rpc.IPProtoUDP}); err != nil || port != 0 {
+		t.Errorf("expected no mapping over udp, got port %d: %v", port, err)
+	}
+
+	res, err := pm.Call(&rpc.Header{
+		Rpcvers: 2,
+		Prog:    rpc.PmapProg,
+		Vers:    rpc.PmapVers,
+		Proc:    4,
+		Cred:    rpc.AuthNull,
+		Verf:    rpc.AuthNull,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var progs []uint32
+	for {
+		more, err := xdr.ReadUint32(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if more == 0 {
+			break
+		}
+		var m rpc.Mapping
+		if err := xdr.Read(res, &m); err != nil {
+			t.Fatal(err)
+		}
+		progs = append(progs, m.Prog)
+	}
+	expected := []uint32{rpc.PmapProg, nfsc.Nfs3Prog, nfsc.MountProg}
+	if len(progs) != len(expected) {
+		t.Fatalf("unexpected mappings for programs %v", progs)
+	}
+	for i := range expected {
+		if progs[i] != expected[i] {
+			t.Fatalf("unexpected mappings for programs %v, expected %v", progs, expected)
+		}
+	}
+}
+
+// startPortmap serves the portmapper of srv on a local listener for the duration of the test.
+func startPortmap(t *testing.T, srv *nfs.Server) *rpc.Portmapper {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		_ = srv.ServePortmap(listener)
+	}()
+	return &rpc.Portmapper{Client: dialServer(t, listener.Addr().String())}
+}
+
+func TestPortmapIsServedOnlyOnItsSocket(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{Handler: handler}
+	nfsClient := dialServer(t, startServer(t, srv))
+	pm := startPortmap(t, srv)
+
+	_, err := nfsClient.Call(&rpc.Header{Rpcvers: 2, Prog: rpc.PmapProg, Vers: rpc.PmapVers, Cred: rpc.AuthNull, Verf: rpc.AuthNull})
+	if err == nil || !strings.Contains(err.Error(), "PROG_UNAVAIL") {
+		t.Fatalf("expected the portmapper to be unavailable on the NFS socket, got %v", err)
+	}
+	_, err = pm.Call(&rpc.Header{Rpcvers: 2, Prog: nfsc.Nfs3Prog, Vers: nfsc.Nfs3Vers, Cred: rpc.AuthNull, Verf: rpc.AuthNull})
+	if err == nil || !strings.Contains(err.Error(), "PROG_UNAVAIL") {
+		t.Fatalf("expected NFS to be unavailable on the portmapper socket, got %v", err)
+	}
+	if _, err := pm.Call(&rpc.Header{Rpcvers: 2, Prog: rpc.PmapProg, Vers: rpc.PmapVers, Cred: rpc.AuthNull, Verf: rpc.AuthNull}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPortmapSetAndUnset(t *testing.T) {
+	_, handler := newMemHandler(t)
+	pm := startPortmap(t, &nfs.Server{Handler: handler})
+
+	call := func(proc uint32, m rpc.Mapping) uint32 {
+		t.Helper()
+		res, err := pm.Call(&struct {
+			rpc.Header
+			rpc.Mapping
+		}{rpc.Header{Rpcvers: 2, Prog: rpc.PmapProg, Vers: rpc.PmapVers, Proc: proc, Cred: rpc.AuthNull, Verf: rpc.AuthNull}, m})
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := xdr.ReadUint32(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	const set, unset = 1, 2
+	mapping := rpc.Mapping{Prog: 100099, Vers: 1, Prot: rpc.IPProtoTCP, Port: 4242}
+
+	if ok := call(set, mapping); ok != 1 {
+		t.Fatal("registration was refused")
+	}
+	if port, err := pm.Getport(mapping); err != nil || port != 4242 {
+		t.Fatalf("registered program is mapped to port %d: %v", port, err)
+	}
+	if ok := call(set, rpc.Mapping{Prog: 100099, Vers: 1, Prot: rpc.IPProtoTCP, Port: 4343}); ok != 0 {
+		t.Fatal("a mapped program was registered again")
+	}
+	if ok := call(unset, mapping); ok != 1 {
+		t.Fatal("unregistration was refused")
+	}
+	if port, err := pm.Getport(mapping); err != nil || port != 0 {
+		t.Fatalf("unregistered program is mapped to port %d: %v", port, err)
+	}
+	if ok := call(unset, mapping); ok != 0 {
+		t.Fatal("a program without mappings was unregistered")
+	}
+}
@@ -0,0 +1,42 @@
+package nfs
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// Quota accounts for the bytes written to each filesystem, and refuses requests that would
+// exceed its limits. It is consulted before a WRITE or CREATE grows a file.
+type Quota interface {
+	// Reserve is called before a request grows `fs` by up to `n` bytes on behalf of the user
+	// `uid`, and holds them for the request so that concurrent requests cannot also be
+	// allowed them. Returning an error refuses the request: ErrDQuot when the user is over
+	// their quota, or ErrNoSpc when the filesystem is full. Otherwise `release` is called
+	// once, with the bytes the request grew `fs` by, and the rest of the reservation is
+	// returned to the quota.
+	Reserve(fs billy.Filesystem, uid uint32, n int64) (release func(used int64), err error)
+}
+
+// reserveGrowth reserves the quota of the server for `fs` to grow by up to `n` bytes. The
+// returned func records how much it grew by, once it has.
+func (w *response) reserveGrowth(ctx context.Context, fs billy.Filesystem, n int64) (func(used int64), error) {
+	if w.Server.Quota == nil || n <= 0 {
+		return func(int64) {}, nil
+	}
+	release, err := w.Server.Quota.Reserve(fs, CredFromContext(ctx).UID, n)
+	var statusErr *NFSStatusError
+	if err == nil || errors.As(err, &statusErr) {
+		return release, err
+	}
+	return nil, &NFSStatusError{StatusFromError(err), err}
+}
+
+// growth is how much writing `n` bytes at `offset` extends a file of `size` bytes.
+func growth(size int64, offset uint64, n int) int64 {
+	if end := int64(offset) + int64(n); end > size {
+		return end - size
+	}
+	return 0
+}
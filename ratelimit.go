@@ -0,0 +1,67 @@
+package nfs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimit caps the bandwidth available to each client connection.
+type RateLimit struct {
+	// ReadBytesPerSecond limits the file data returned by READ. Zero means no limit.
+	ReadBytesPerSecond int
+	// WriteBytesPerSecond limits the file data accepted by WRITE. Zero means no limit.
+	WriteBytesPerSecond int
+}
+
+// tokenBucket paces a byte stream to a fixed rate.
+// A nil bucket imposes no limit.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int) *tokenBucket {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(bytesPerSecond),
+		burst:  transferChunkSize,
+		tokens: transferChunkSize,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until `n` bytes may be transferred, or `ctx` is done.
+// Requests larger than the burst size are allowed to borrow from future refills.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	t := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
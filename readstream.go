@@ -0,0 +1,86 @@
+package nfs
+
+import (
+	"io"
+	"syscall"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// reply is a serialized response, waiting to be written to the connection.
+type reply struct {
+	msg  []byte
+	data *streamedData
+}
+
+// streamedData is file data appended to a reply as the reply is written to the connection,
+// rather than copied into the reply beforehand.
+type streamedData struct {
+	file billy.File
+	n    int64
+}
+
+// size is the number of bytes the data adds to a reply, including its XDR padding.
+func (s *streamedData) size() int {
+	if s == nil {
+		return 0
+	}
+	return int(s.n + (4-s.n%4)%4)
+}
+
+// writeTo copies the data from the current offset of its file to `dst`, and closes the
+// file. Copying from a file backed by a file descriptor to a TCP connection lets the net
+// package send it with sendfile. A file that shrank since its size was checked is padded
+// with zeros, so that the reply still has the length announced in its record header.
+func (s *streamedData) writeTo(dst io.Writer) error {
+	defer s.file.Close()
+	n, err := io.CopyN(dst, s.file, s.n)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var zeros [4096]byte
+	for remaining := int64(s.size()) - n; remaining > 0; {
+		chunk := zeros[:]
+		if remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		written, err := dst.Write(chunk)
+		if err != nil {
+			return err
+		}
+		remaining -= int64(written)
+	}
+	return nil
+}
+
+// close releases the file of data that will not be written.
+func (s *streamedData) close() {
+	if s != nil {
+		_ = s.file.Close()
+	}
+}
+
+// canStream reports whether file data can be sent to the client straight from `file`,
+// which is the case for unthrottled replies over TCP from files with a file descriptor,
+// other than to requests whose results are wrapped for RPCSEC_GSS integrity.
+// Backends opt in by returning files implementing syscall.Conn, such as by embedding an
+// *os.File; the files of billy's osfs.New hide theirs behind its chroot.
+func (w *response) canStream(file billy.File) bool {
+	if w.datagram || w.readLimiter != nil {
+		return false
+	}
+	if w.gss != nil && w.gss.cred.Service != GSSServiceNone {
+		return false
+	}
+	if _, ok := w.Conn.(io.ReaderFrom); !ok {
+		return false
+	}
+	_, ok := file.(syscall.Conn)
+	return ok
+}
+
+// stream appends `n` bytes read from the current offset of `file` to the reply. The
+// response takes ownership of the file, which is closed once the reply is written.
+func (w *response) stream(file billy.File, n int64) {
+	w.data = &streamedData{file: file, n: n}
+}
@@ -0,0 +1,118 @@
+package nfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// lastFragment marks the final fragment of a record.
+const lastFragment = 1 << 31
+
+// maxFragment is the largest fragment length a record marking header can carry.
+const maxFragment = lastFragment - 1
+
+// recordWriter frames replies as records of fragments, per rfc5531 section 11. Fragment
+// headers and replies are buffered, while streamed data is copied straight to the connection.
+type recordWriter struct {
+	w    *bufio.Writer
+	conn io.Writer
+	// max is the largest fragment to send.
+	max int
+	// remaining is how much of the record is still to be written, and left how much
+	// of it belongs to the current fragment.
+	remaining int
+	left      int
+}
+
+// start begins a record of `size` bytes.
+func (r *recordWriter) start(size, maxFragmentSize int) {
+	r.max = maxFragmentSize
+	if r.max <= 0 || r.max > maxFragment {
+		r.max = maxFragment
+	}
+	r.remaining = size
+	r.left = 0
+}
+
+// fragment writes the header of the next fragment of the record.
+func (r *recordWriter) fragment() error {
+	r.left = r.remaining
+	header := uint32(r.left) | lastFragment
+	if r.left > r.max {
+		r.left = r.max
+		header = uint32(r.left)
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], header)
+	_, err := r.w.Write(b[:])
+	return err
+}
+
+func (r *recordWriter) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		if r.left == 0 {
+			if r.remaining == 0 {
+				return written, io.ErrShortWrite
+			}
+			if err := r.fragment(); err != nil {
+				return written, err
+			}
+		}
+		chunk := b[written:]
+		if len(chunk) > r.left {
+			chunk = chunk[:r.left]
+		}
+		n, err := r.w.Write(chunk)
+		written += n
+		r.left -= n
+		r.remaining -= n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ReadFrom copies `src` into the record straight to the connection, fragment by fragment,
+// keeping the source unwrapped so that the connection can send it with sendfile.
+func (r *recordWriter) ReadFrom(src io.Reader) (int64, error) {
+	limit := int64(-1)
+	if lr, ok := src.(*io.LimitedReader); ok {
+		src, limit = lr.R, lr.N
+		defer func() { lr.N = limit }()
+	}
+	var total int64
+	for limit != 0 {
+		if r.left == 0 {
+			if r.remaining == 0 {
+				return total, io.ErrShortWrite
+			}
+			if err := r.fragment(); err != nil {
+				return total, err
+			}
+		}
+		if err := r.w.Flush(); err != nil {
+			return total, err
+		}
+		n := int64(r.left)
+		if limit >= 0 && limit < n {
+			n = limit
+		}
+		copied, err := io.CopyN(r.conn, src, n)
+		total += copied
+		r.left -= int(copied)
+		r.remaining -= int(copied)
+		if limit >= 0 {
+			limit -= copied
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
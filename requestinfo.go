@@ -0,0 +1,168 @@
+package nfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// RequestInfo describes a request the server has answered, as reported to Server.OnRequest.
+type RequestInfo struct {
+	// Procedure is the procedure called, qualified by its program, such as "nfs.Lookup".
+	Procedure string
+	// ClientAddr is the address the request was received from.
+	ClientAddr net.Addr
+	// Args summarizes the arguments of the request, such as `dir=<handle> name="a.txt"`.
+	// File data is summarized by its length.
+	Args string
+	// Status is the NFS status the request was answered with.
+	Status NFSStatus
+	// Duration is the time taken to handle the request.
+	Duration time.Duration
+}
+
+// maxSummarizedArgs bounds how much of a request is kept to summarize its arguments,
+// which is enough for the handles and names preceding any data.
+const maxSummarizedArgs = 1024
+
+// prefixWriter keeps the first `max` bytes written to it.
+type prefixWriter struct {
+	buf []byte
+	max int
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	if room := p.max - len(p.buf); room > 0 {
+		if len(b) > room {
+			p.buf = append(p.buf, b[:room]...)
+		} else {
+			p.buf = append(p.buf, b...)
+		}
+	}
+	return len(b), nil
+}
+
+// captureArgs keeps the start of the arguments of a request in `args` as the handler reads
+// them. It is called once the arguments are unwrapped from any RPCSEC_GSS integrity checksum.
+func (w *response) captureArgs(args *prefixWriter) {
+	if body, ok := w.req.Body.(*io.LimitedReader); ok {
+		w.req.Body = &io.LimitedReader{R: io.TeeReader(body.R, args), N: body.N}
+	}
+}
+
+// reportRequest passes the outcome of a request to the OnRequest hook of the server.
+func (c *conn) reportRequest(w *response, start time.Time, args *prefixWriter) {
+	if !w.responded || w.discard {
+		return
+	}
+	c.Server.OnRequest(RequestInfo{
+		Procedure:  w.req.procedureName(),
+		ClientAddr: c.Conn.RemoteAddr(),
+		Args:       summarizeArgs(w.req.Header.Prog, w.req.Header.Proc, args.buf),
+		Status:     w.replyStatus(),
+		Duration:   time.Since(start),
+	})
+}
+
+// summarizeArgs describes the arguments of a procedure, from as much of them as was read.
+func summarizeArgs(prog, proc uint32, args []byte) string {
+	s := &argSummary{r: bytes.NewReader(args)}
+	switch prog {
+	case mountServiceID:
+		switch MountProcedure(proc) {
+		case MountProcMount, MountProcUmnt:
+			s.name("path")
+		}
+	case nfsServiceID:
+		switch NFSProcedure(proc) {
+		case NFSProcedureGetAttr, NFSProcedureSetAttr, NFSProcedureAccess, NFSProcedureReadlink,
+			NFSProcedureFSStat, NFSProcedureFSInfo, NFSProcedurePathConf:
+			s.handle("fh")
+		case NFSProcedureLookup, NFSProcedureCreate, NFSProcedureMkDir, NFSProcedureSymlink,
+			NFSProcedureMkNod, NFSProcedureRemove, NFSProcedureRmDir:
+			s.handle("dir")
+			s.name("name")
+		case NFSProcedureRead, NFSProcedureCommit:
+			s.handle("fh")
+			s.uint64("offset")
+			s.uint32("count")
+		case NFSProcedureWrite:
+			s.handle("fh")
+			s.uint64("offset")
+			s.uint32("count")
+			s.uint32("stable")
+			// the data itself is not kept, only its length.
+			s.uint32("datalen")
+		case NFSProcedureRename:
+			s.handle("from")
+			s.name("fromname")
+			s.handle("to")
+			s.name("toname")
+		case NFSProcedureLink:
+			s.handle("fh")
+			s.handle("dir")
+			s.name("name")
+		case NFSProcedureReadDir, NFSProcedureReadDirPlus:
+			s.handle("fh")
+			s.uint64("cookie")
+		case NFSProcedureGetXattr, NFSProcedureRemoveXattr:
+			s.handle("fh")
+			s.name("xattr")
+		case NFSProcedureSetXattr:
+			s.handle("fh")
+			s.uint32("option")
+			s.name("xattr")
+		case NFSProcedureListXattrs:
+			s.handle("fh")
+		}
+	}
+	return strings.Join(s.fields, " ")
+}
+
+// argSummary decodes arguments into fields, until it runs out of them.
+type argSummary struct {
+	r      io.Reader
+	fields []string
+	failed bool
+}
+
+// read decodes the next argument into `v`, unless an earlier one could not be decoded.
+func (s *argSummary) read(v interface{}) bool {
+	if !s.failed && xdr.Read(s.r, v) != nil {
+		s.failed = true
+	}
+	return !s.failed
+}
+
+func (s *argSummary) handle(field string) {
+	var h []byte
+	if s.read(&h) {
+		s.fields = append(s.fields, fmt.Sprintf("%s=%x", field, h))
+	}
+}
+
+func (s *argSummary) name(field string) {
+	var n string
+	if s.read(&n) {
+		s.fields = append(s.fields, fmt.Sprintf("%s=%q", field, n))
+	}
+}
+
+func (s *argSummary) uint32(field string) {
+	var v uint32
+	if s.read(&v) {
+		s.fields = append(s.fields, fmt.Sprintf("%s=%d", field, v))
+	}
+}
+
+func (s *argSummary) uint64(field string) {
+	var v uint64
+	if s.read(&v) {
+		s.fields = append(s.fields, fmt.Sprintf("%s=%d", field, v))
+	}
+}
@@ -5,15 +5,318 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrServerClosed is returned by Serve after a call to Shutdown.
+var ErrServerClosed = errors.New("nfs: server closed")
+
+// shutdownPollInterval is how often Shutdown checks for connections that have become idle.
+const shutdownPollInterval = 10 * time.Millisecond
+
 // Server is a handle to the listening NFS server.
 type Server struct {
 	Handler
+	// ID identifies the server, and is picked at random if not configured.
 	ID [8]byte
 	context.Context
+	// Export controls how requests are admitted and presented to the Handler.
+	Export ExportOptions
+	// MaxConnections bounds the number of connections served at once. Zero means no limit.
+	MaxConnections int
+	// RejectOnFull closes connections accepted while MaxConnections are already
+	// being served, rather than waiting for one of them to finish.
+	RejectOnFull bool
+	// MaxRequestsPerConnection bounds how many requests of each TCP connection are handled
+	// at once, so that a client pipelining requests cannot starve those of other connections.
+	// Requests beyond it are left unread until one being handled is answered, and replies
+	// are sent as they are ready rather than in the order of their requests. Zero or one
+	// handles the requests of a connection one at a time.
+	MaxRequestsPerConnection int
+	// MaxDatagrams bounds how many requests arriving over UDP are handled at once across
+	// each listener. Datagrams arriving beyond it are dropped, to be retransmitted by their
+	// clients. Zero allows DefaultMaxDatagrams.
+	MaxDatagrams int
+	// RateLimit caps the READ and WRITE bandwidth of each connection.
+	RateLimit RateLimit
+	// Port is the TCP port ListenAndServe binds for NFS. Zero picks an ephemeral port.
+	Port int
+	// MountPort, if set, is a separate TCP port ListenAndServe binds for the MOUNT service.
+	// Otherwise MOUNT is answered on Port alongside NFS.
+	MountPort int
+	// EmbeddedPortmap answers portmapper queries on port 111 over TCP and UDP, so that
+	// clients can locate the NFS and MOUNT services without a system rpcbind.
+	EmbeddedPortmap bool
+	// MaxReadSize and MaxWriteSize are the largest READ and WRITE transfers advertised
+	// by FSINFO, and PreferredReadSize and PreferredWriteSize the sizes clients should
+	// favor. Zero leaves the server default. Reads are capped at MaxReadSize when it is set.
+	MaxReadSize        uint32
+	MaxWriteSize       uint32
+	PreferredReadSize  uint32
+	PreferredWriteSize uint32
+	// ProcedureTimeout bounds how long each procedure is handled for. The context of the
+	// handler is cancelled at the deadline, and the request is answered with
+	// NFSStatusJukebox, so that the client retries later, even when the handler is blocked
+	// in a filesystem call that takes no context. What such a handler answers once it
+	// returns is discarded. Requests are read into memory before being handled when it is
+	// set. Zero does not bound procedures.
+	ProcedureTimeout time.Duration
+	// IdleTimeout closes TCP connections on which no request arrives for this long.
+	// Zero keeps idle connections open.
+	IdleTimeout time.Duration
+	// MaxRequestSize bounds the size of the requests accepted over TCP. A connection
+	// announcing a larger request is closed before the request is read. Zero allows
+	// requests up to 1MiB larger than the largest WRITE advertised by FSINFO.
+	MaxRequestSize int
+	// MaxFragmentSize bounds the record fragments each reply over TCP is sent in. Zero
+	// sends each reply as a single fragment.
+	MaxFragmentSize int
+	// MaxFileSize is the largest size WRITE may grow a file to, and the maximum file size
+	// advertised by FSINFO. Zero does not limit file sizes.
+	MaxFileSize int64
+	// WriteBackSize, if set, holds back contiguous UNSTABLE writes to a file until up to this
+	// many bytes of them can be written to the filesystem at once. Held writes are written on
+	// COMMIT, when a write to the file does not continue them, after WriteBackDelay, and
+	// before other procedures read or change the file. COMMIT returns the write verifier only
+	// once they are written, and fails with NFSStatusIO if writing them after the delay failed.
+	WriteBackSize int
+	// WriteBackDelay is how long writes are held back for. Zero uses DefaultWriteBackDelay.
+	WriteBackDelay time.Duration
+	// StableCookies derives the READDIR and READDIRPLUS cookie of each directory entry from
+	// its name, rather than from its position in a listing remembered by the handler. A
+	// client may then resume a listing after the server restarts, or after the directory
+	// changes, skipping any entries removed since. It suits handlers whose file handles
+	// also survive restarts, such as those of NewDeterministicCachingHandler.
+	StableCookies bool
+	// MaxSymlinkHops bounds how many symbolic links are followed in a row to reach the file
+	// a procedure acts on, such as reading through a link. Longer chains, and cycles of links,
+	// are refused with NFSStatusMlink rather than left for the filesystem to follow. Zero
+	// allows DefaultMaxSymlinkHops.
+	MaxSymlinkHops int
+	// ReplyCacheTTL is how long the replies to requests that modify the filesystem are kept,
+	// so that a retransmitted request is answered without being executed twice. Zero uses
+	// DefaultReplyCacheTTL, and a negative ttl disables the cache.
+	ReplyCacheTTL time.Duration
+	// Quota, if set, limits how much WRITE and CREATE may grow each filesystem.
+	Quota Quota
+	// Metrics, if set, observes each procedure dispatched by the server.
+	Metrics MetricsHook
+	// Tracer, if set, starts a span for each procedure dispatched by the server. The context
+	// a request is handled with carries its span.
+	Tracer SpanHook
+	// OnRequest, if set, is called as each request is answered, such as to keep an audit log.
+	OnRequest func(RequestInfo)
+	// Clock, if set, is the time the server stamps files with in place of time.Now: the
+	// times SETATTR sets to the server's time, and those of the files CREATE, MKDIR and
+	// MKNOD make.
+	Clock Clock
+	// GSS, if set, accepts requests authenticated with RPCSEC_GSS, such as by Kerberos V5.
+	GSS *GSSAuth
+
+	connections atomic.Int64
+	mounts      mountRegistry
+	replies     replyCache
+	buffers     bufferPool
+	writeBacks  writeBack
+	dirLinks    dirLinks
+	gssContexts gssContexts
+
+	idOnce sync.Once
+	idErr  error
+	// bootVerifier is the write verifier of WRITE and COMMIT. Unlike ID it is drawn anew
+	// each time the server starts, so that clients resend the unstable writes a restart lost.
+	bootVerifier [8]byte
+	portmapOnce  sync.Once
+
+	inShutdown atomic.Bool
+	// mu guards the listeners and connections tracked for Shutdown.
+	mu sync.Mutex
+	// the listeners and packet conns are mapped to the programs they are advertised for.
+	listeners   map[net.Listener]socketRole
+	packetConns map[net.PacketConn]socketRole
+	activeConns map[*conn]struct{}
+	// portmapRegistrations are the mappings set through the embedded portmapper.
+	portmapRegistrations map[portMapping]struct{}
+	// datagrams counts the UDP requests being handled.
+	datagrams atomic.Int64
+	done      chan struct{}
+}
+
+// ActiveMounts lists the exports clients have mounted and not yet unmounted.
+func (s *Server) ActiveMounts() []MountEntry {
+	return s.mounts.list()
+}
+
+// CurrentConnections is the number of client connections currently being served.
+func (s *Server) CurrentConnections() int {
+	return int(s.connections.Load())
+}
+
+// socketRole is the set of programs a socket is advertised for by the embedded portmapper.
+// Portmapper sockets answer only the portmapper, and other sockets every other program.
+type socketRole uint8
+
+const (
+	roleNFS socketRole = iota
+	roleMount
+	rolePortmap
+)
+
+// serves reports whether sockets of the role answer requests for program `prog`.
+func (r socketRole) serves(prog uint32) bool {
+	return (r == rolePortmap) == (prog == portmapServiceID)
+}
+
+// ListenAndServe listens on Port, and on MountPort if it is set, and serves requests
+// on them until the server is shut down.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
+	if err != nil {
+		return err
+	}
+	if s.MountPort != 0 && s.MountPort != s.Port {
+		ml, err := net.Listen("tcp", fmt.Sprintf(":%d", s.MountPort))
+		if err != nil {
+			l.Close()
+			return err
+		}
+		defer ml.Close()
+		go func() {
+			if err := s.serve(ml, roleMount); err != nil && err != ErrServerClosed {
+				Log.Errorf("mount listener failed: %v", err)
+			}
+		}()
+	}
+	return s.Serve(l)
+}
+
+// Addr is the address the server is serving NFS on over TCP, or nil if it is not yet serving.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addr net.Addr
+	for l, role := range s.listeners {
+		if role != roleNFS {
+			continue
+		}
+		// with several listeners, pick by address so that the answer is stable.
+		if addr == nil || l.Addr().String() < addr.String() {
+			addr = l.Addr()
+		}
+	}
+	return addr
+}
+
+// Shutdown stops the server from accepting connections, then waits for the requests being
+// handled to complete and closes every connection as it becomes idle. If `ctx` ends first,
+// the remaining connections are closed and its error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+	defer s.writeBacks.flushAll()
+
+	s.mu.Lock()
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.listeners, l)
+	}
+	for pc := range s.packetConns {
+		if cerr := pc.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(s.packetConns, pc)
+	}
+	s.closeDoneLocked()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			for c := range s.activeConns {
+				c.Close()
+			}
+			s.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdleConns closes the connections that are not handling a request, and reports
+// whether every connection has finished.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.activeConns {
+		if c.pending.Load() == 0 {
+			c.Close()
+		}
+	}
+	return len(s.activeConns) == 0 && s.datagrams.Load() == 0
+}
+
+func (s *Server) doneChan() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+func (s *Server) closeDoneLocked() {
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+func (s *Server) trackListener(l net.Listener, role socketRole) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown.Load() {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]socketRole)
+	}
+	s.listeners[l] = role
+	return true
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *Server) trackConn(c *conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.activeConns == nil {
+			s.activeConns = make(map[*conn]struct{})
+		}
+		s.activeConns[c] = struct{}{}
+	} else {
+		delete(s.activeConns, c)
+	}
 }
 
 // RegisterMessageHandler registers a handler for a specific
@@ -44,16 +347,29 @@ type registeredHandlerID struct {
 var registeredHandlers map[registeredHandlerID]HandleFunc
 
 // Serve listens on the provided listener port for incoming client requests.
+// After Shutdown, Serve returns ErrServerClosed.
 func (s *Server) Serve(l net.Listener) error {
+	if s.EmbeddedPortmap {
+		s.startPortmap()
+	}
+	return s.serve(l, roleNFS)
+}
+
+func (s *Server) serve(l net.Listener, role socketRole) error {
 	defer l.Close()
-	baseCtx := context.Background()
-	if s.Context != nil {
-		baseCtx = s.Context
+	if !s.trackListener(l, role) {
+		return ErrServerClosed
 	}
-	if bytes.Equal(s.ID[:], []byte{0, 0, 0, 0, 0, 0, 0, 0}) {
-		if _, err := rand.Reader.Read(s.ID[:]); err != nil {
-			return err
-		}
+	defer s.untrackListener(l)
+	done := s.doneChan()
+	baseCtx := s.baseContext()
+	if err := s.ensureID(); err != nil {
+		return err
+	}
+
+	var slots chan struct{}
+	if s.MaxConnections > 0 {
+		slots = make(chan struct{}, s.MaxConnections)
 	}
 
 	var tempDelay time.Duration
@@ -73,18 +389,77 @@ func (s *Server) Serve(l net.Listener) error {
 				time.Sleep(tempDelay)
 				continue
 			}
+			if s.inShutdown.Load() {
+				return ErrServerClosed
+			}
 			return err
 		}
 		tempDelay = 0
-		c := s.newConn(conn)
-		go c.serve(baseCtx)
+		if slots != nil {
+			if s.RejectOnFull {
+				select {
+				case slots <- struct{}{}:
+				default:
+					Log.Warnf("rejecting connection from %v: %d connections already open", conn.RemoteAddr(), s.MaxConnections)
+					conn.Close()
+					continue
+				}
+			} else {
+				select {
+				case slots <- struct{}{}:
+				case <-baseCtx.Done():
+					conn.Close()
+					return baseCtx.Err()
+				case <-done:
+					conn.Close()
+					return ErrServerClosed
+				}
+			}
+		}
+		c := s.newConn(conn, role)
+		s.connections.Add(1)
+		s.trackConn(c, true)
+		go func() {
+			defer func() {
+				s.trackConn(c, false)
+				s.connections.Add(-1)
+				if slots != nil {
+					<-slots
+				}
+			}()
+			c.serve(baseCtx)
+		}()
+	}
+}
+
+func (s *Server) baseContext() context.Context {
+	if s.Context != nil {
+		return s.Context
 	}
+	return context.Background()
+}
+
+// ensureID picks a random server ID if none was configured, and the boot verifier of the
+// server. It is safe to call from each of the listeners a server is serving.
+func (s *Server) ensureID() error {
+	s.idOnce.Do(func() {
+		if bytes.Equal(s.ID[:], []byte{0, 0, 0, 0, 0, 0, 0, 0}) {
+			if _, s.idErr = rand.Reader.Read(s.ID[:]); s.idErr != nil {
+				return
+			}
+		}
+		_, s.idErr = rand.Reader.Read(s.bootVerifier[:])
+	})
+	return s.idErr
 }
 
-func (s *Server) newConn(nc net.Conn) *conn {
+func (s *Server) newConn(nc net.Conn, role socketRole) *conn {
 	c := &conn{
-		Server: s,
-		Conn:   nc,
+		Server:       s,
+		Conn:         nc,
+		role:         role,
+		readLimiter:  newTokenBucket(s.RateLimit.ReadBytesPerSecond),
+		writeLimiter: newTokenBucket(s.RateLimit.WriteBytesPerSecond),
 	}
 	return c
 }
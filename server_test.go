@@ -0,0 +1,269 @@
+package nfs_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// waitForConnections polls until the server reports `n` open connections.
+func waitForConnections(t *testing.T, srv *nfs.Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.CurrentConnections() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d connections, have %d", n, srv.CurrentConnections())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMaxConnectionsRejectOnFull(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{Handler: handler, MaxConnections: 2, RejectOnFull: true}
+	addr := startServer(t, srv)
+
+	first := dialServer(t, addr)
+	mountServer(t, first, rpc.AuthNull)
+	mountServer(t, dialServer(t, addr), rpc.AuthNull)
+	waitForConnections(t, srv, 2)
+
+	mounter := nfsc.Mount{Client: dialServer(t, addr)}
+	if _, err := mounter.Mount("/", rpc.AuthNull); err == nil {
+		t.Fatal("expected a connection beyond the limit to be rejected")
+	}
+	if n := srv.CurrentConnections(); n != 2 {
+		t.Fatalf("limit of 2 connections exceeded: %d", n)
+	}
+
+	_ = first.Close()
+	waitForConnections(t, srv, 1)
+	mountServer(t, dialServer(t, addr), rpc.AuthNull)
+}
+
+func TestMaxConnectionsWaits(t *testing.T) {
+	_, handler := newMemHandler(t)
+	srv := &nfs.Server{Handler: handler, MaxConnections: 1}
+	addr := startServer(t, srv)
+
+	first := dialServer(t, addr)
+	mountServer(t, first, rpc.AuthNull)
+	waitForConnections(t, srv, 1)
+
+	mounter := nfsc.Mount{Client: dialServer(t, addr)}
+	mounted := make(chan error, 1)
+	go func() {
+		_, err := mounter.Mount("/", rpc.AuthNull)
+		mounted <- err
+	}()
+	select {
+	case err := <-mounted:
+		t.Fatalf("connection beyond the limit was served early: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := srv.CurrentConnections(); n != 1 {
+		t.Fatalf("limit of 1 connection exceeded: %d", n)
+	}
+
+	_ = first.Close()
+	select {
+	case err := <-mounted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting connection was never served")
+	}
+}
+
+// timedRead measures reading a 512KiB file from a server with the given rate limit.
+func timedRead(t *testing.T, limit nfs.RateLimit) time.Duration {
+	t.Helper()
+	mem, handler := newMemHandler(t)
+	f, err := mem.Create("/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make([]byte, 512*1024)
+	if _, err := f.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	srv := &nfs.Server{Handler: handler, RateLimit: limit}
+	target := mountServer(t, dialServer(t, startServer(t, srv)), rpc.AuthNull)
+	start := time.Now()
+	r, err := target.Open("/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != len(contents) {
+		t.Fatalf("read %d bytes, expected %d", len(data), len(contents))
+	}
+	return time.Since(start)
+}
+
+func TestReadRateLimit(t *testing.T) {
+	unlimited := timedRead(t, nfs.RateLimit{})
+	// 512KiB at 1MiB/s, less the initial burst, takes a little under half a second.
+	limited := timedRead(t, nfs.RateLimit{ReadBytesPerSecond: 1 << 20})
+	if limited < 350*time.Millisecond {
+		t.Fatalf("rate limited read took %v, expected at least 350ms", limited)
+	}
+	if limited < 2*unlimited {
+		t.Fatalf("rate limited read took %v, unlimited took %v", limited, unlimited)
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/test")
+	fs := &stallingFS{
+		Filesystem: mem,
+		started:    make(chan struct{}),
+		release:    make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	srv := &nfs.Server{Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(listener) }()
+
+	c := dialServer(t, listener.Addr().String())
+	target := mountServer(t, c, rpc.AuthNull)
+	_, fh, err := target.Lookup("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type writeArgs struct {
+		rpc.Header
+		Handle []byte
+		Offset uint64
+		Count  uint32
+		How    uint32
+		Data   []byte
+	}
+	data := []byte("drained")
+	written := make(chan error, 1)
+	go func() {
+		res, err := c.Call(&writeArgs{
+			Header: rpc.Header{
+				Rpcvers: 2,
+				Prog:    nfsc.Nfs3Prog,
+				Vers:    nfsc.Nfs3Vers,
+				Proc:    uint32(nfs.NFSProcedureWrite),
+				Cred:    rpc.AuthNull,
+				Verf:    rpc.AuthNull,
+			},
+			Handle: fh,
+			Count:  uint32(len(data)),
+			How:    2,
+			Data:   data,
+		})
+		if err == nil {
+			var status uint32
+			status, err = xdr.ReadUint32(res)
+			if err == nil && status != uint32(nfs.NFSStatusOk) {
+				err = &nfs.NFSStatusError{NFSStatus: nfs.NFSStatus(status)}
+			}
+		}
+		written <- err
+	}()
+	select {
+	case <-fs.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write never reached the filesystem")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(ctx) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := <-served; err != nfs.ErrServerClosed {
+		t.Fatalf("expected Serve to return ErrServerClosed, got %v", err)
+	}
+
+	close(fs.release)
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	// the reply is flushed before the connection is closed, so the client receives it.
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("in-flight write failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight write was never answered")
+	}
+	if contents, err := util.ReadFile(mem, "/test"); err != nil || string(contents) != string(data) {
+		t.Fatalf("write was not completed: %q, %v", contents, err)
+	}
+}
+
+// freePort finds a local tcp port that is not in use.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestListenOnFixedPorts(t *testing.T) {
+	_, handler := newMemHandler(t)
+	port, mountPort := freePort(t), freePort(t)
+	srv := &nfs.Server{Handler: handler, Port: port, MountPort: mountPort}
+	go func() {
+		_ = srv.ListenAndServe()
+	}()
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Addr() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("server never started listening")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if p := srv.Addr().(*net.TCPAddr).Port; p != port {
+		t.Fatalf("server is listening on port %d, expected %d", p, port)
+	}
+
+	target := mountServer(t, dialServer(t, fmt.Sprintf("localhost:%d", mountPort)), rpc.AuthNull)
+	_, fh, err := target.Lookup("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a handle from the mount port is usable on the nfs port.
+	if _, err := nfsc.NewTargetWithClient(dialServer(t, fmt.Sprintf("localhost:%d", port)), rpc.AuthNull, fh, "/"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,30 @@
+package nfs
+
+import (
+	"errors"
+	"io"
+	"syscall"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// whence values for lseek, as defined by linux.
+const (
+	seekData = 3
+)
+
+// nextData returns the offset of the first data at or after `off`, or the end of the file
+// if only a hole follows. It reports false when the file cannot locate holes, such as for
+// backends that are not backed by an os file.
+func nextData(f billy.File, off int64) (int64, bool) {
+	pos, err := f.Seek(off, seekData)
+	if err == nil {
+		// backends that ignore an unknown whence report their current position instead.
+		return pos, pos >= off
+	}
+	if errors.Is(err, syscall.ENXIO) {
+		end, err := f.Seek(0, io.SeekEnd)
+		return end, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package nfs
+
+import (
+	"github.com/go-git/go-billy/v5"
+)
+
+// nextData is only implemented on linux, where lseek supports SEEK_DATA.
+func nextData(f billy.File, off int64) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,68 @@
+package nfs
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// errnoStatuses maps the errors of system calls to the statuses they correspond to.
+var errnoStatuses = map[syscall.Errno]NFSStatus{
+	syscall.EPERM:        NFSStatusPerm,
+	syscall.ENOENT:       NFSStatusNoEnt,
+	syscall.EIO:          NFSStatusIO,
+	syscall.ENXIO:        NFSStatusNXIO,
+	syscall.EACCES:       NFSStatusAccess,
+	syscall.EEXIST:       NFSStatusExist,
+	syscall.EXDEV:        NFSStatusXDev,
+	syscall.ENODEV:       NFSStatusNoDev,
+	syscall.ENOTDIR:      NFSStatusNotDir,
+	syscall.EISDIR:       NFSStatusIsDir,
+	syscall.EINVAL:       NFSStatusInval,
+	syscall.EFBIG:        NFSStatusFBig,
+	syscall.ENOSPC:       NFSStatusNoSPC,
+	syscall.EROFS:        NFSStatusROFS,
+	syscall.EMLINK:       NFSStatusMlink,
+	syscall.ENAMETOOLONG: NFSStatusNameTooLong,
+	syscall.ENOTEMPTY:    NFSStatusNotEmpty,
+	syscall.EDQUOT:       NFSStatusDQuot,
+	syscall.ESTALE:       NFSStatusStale,
+	syscall.ENOTSUP:      NFSStatusNotSupp,
+}
+
+// StatusFromError is the NFS status best describing an error from a filesystem. It looks
+// through wrapping for an NFSStatusError, a syscall.Errno, or one of the standard errors
+// of the os, io/fs and billy packages, and reports anything else as NFSStatusIO.
+func StatusFromError(err error) NFSStatus {
+	if err == nil {
+		return NFSStatusOk
+	}
+	var statusErr *NFSStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.NFSStatus
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if status, ok := errnoStatuses[errno]; ok {
+			return status
+		}
+		return NFSStatusIO
+	}
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return NFSStatusNoEnt
+	case errors.Is(err, fs.ErrPermission):
+		return NFSStatusAccess
+	case errors.Is(err, fs.ErrExist):
+		return NFSStatusExist
+	case errors.Is(err, fs.ErrInvalid):
+		return NFSStatusInval
+	case errors.Is(err, billy.ErrNotSupported):
+		return NFSStatusNotSupp
+	case errors.Is(err, billy.ErrReadOnly):
+		return NFSStatusROFS
+	}
+	return NFSStatusIO
+}
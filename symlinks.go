@@ -0,0 +1,49 @@
+package nfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// DefaultMaxSymlinkHops is the number of symbolic links followed in a row when
+// Server.MaxSymlinkHops is not set, as in the Linux kernel.
+const DefaultMaxSymlinkHops = 40
+
+// errSymlinkLoop is reported for chains of symbolic links longer than the server follows.
+var errSymlinkLoop = errors.New("too many levels of symbolic links")
+
+func (s *Server) maxSymlinkHops() int {
+	if s.MaxSymlinkHops > 0 {
+		return s.MaxSymlinkHops
+	}
+	return DefaultMaxSymlinkHops
+}
+
+// checkLinks follows the chain of symbolic links starting at `p`, before the filesystem is
+// asked to follow it, refusing chains longer than the server allows with NFSStatusMlink.
+// Filesystems such as memfs follow links without bound, so that a cycle of links would
+// otherwise never be resolved. Whatever else stops the chain is left for the procedure to
+// report as it reaches the file.
+func (w *response) checkLinks(fs billy.Filesystem, p string) error {
+	for hops := 0; ; hops++ {
+		info, err := fs.Lstat(p)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		if hops == w.Server.maxSymlinkHops() {
+			return &NFSStatusError{NFSStatusMlink, errSymlinkLoop}
+		}
+		target, err := fs.Readlink(p)
+		if err != nil {
+			return nil
+		}
+		if !filepath.IsAbs(target) && !strings.HasPrefix(target, "/") {
+			target = fs.Join(filepath.Dir(p), target)
+		}
+		p = target
+	}
+}
@@ -0,0 +1,46 @@
+// Package tracing traces the procedures handled by an nfs.Server with OpenTelemetry.
+package tracing
+
+import (
+	"context"
+
+	"github.com/willscott/go-nfs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer starts a span for each procedure handled by a server. It is set as the Tracer
+// of an nfs.Server.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer creates a Tracer starting its spans with `tracer`.
+func NewTracer(tracer trace.Tracer) *Tracer {
+	return &Tracer{tracer: tracer}
+}
+
+// StartSpan starts the span of a request, as a server span named for its procedure.
+func (t *Tracer) StartSpan(ctx context.Context, procedure string, xid uint32, requestBytes int64) (context.Context, nfs.EndSpan) {
+	ctx, span := t.tracer.Start(ctx, procedure,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "onc_rpc"),
+			attribute.String("nfs.procedure", procedure),
+			attribute.Int64("rpc.xid", int64(xid)),
+			attribute.Int64("nfs.request.bytes", requestBytes),
+		))
+	return ctx, func(replied bool, status nfs.NFSStatus, responseBytes int) {
+		if replied {
+			span.SetAttributes(
+				attribute.Int64("nfs.status", int64(status)),
+				attribute.Int("nfs.response.bytes", responseBytes),
+			)
+			if status != nfs.NFSStatusOk {
+				span.SetStatus(codes.Error, status.String())
+			}
+		}
+		span.End()
+	}
+}
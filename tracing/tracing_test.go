@@ -0,0 +1,77 @@
+package tracing
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+func TestTracerSpansRead(t *testing.T) {
+	mem := memfs.New()
+	f, err := mem.Create("/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte("hello world"))
+	_ = f.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	srv := &nfs.Server{
+		Handler: helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024),
+		Tracer:  NewTracer(provider.Tracer("nfs")),
+	}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	c, err := rpc.DialTCP("tcp", nil, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	mounter := nfsc.Mount{Client: c}
+	target, err := mounter.Mount("/", rpc.AuthNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := target.Open("/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	var read sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "nfs.Read" {
+			read = span
+		}
+	}
+	if read == nil {
+		t.Fatal("no span was recorded for the read")
+	}
+	attrs := attribute.NewSet(read.Attributes()...)
+	if status, ok := attrs.Value("nfs.status"); !ok || status.AsInt64() != int64(nfs.NFSStatusOk) {
+		t.Fatalf("read span has status %v", status.Emit())
+	}
+	if size, ok := attrs.Value("nfs.response.bytes"); !ok || size.AsInt64() < int64(len("hello world")) {
+		t.Fatalf("read span has a response of %v bytes", size.Emit())
+	}
+}
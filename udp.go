@@ -0,0 +1,170 @@
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// maxDatagramSize is the largest payload of a UDP datagram over IPv4.
+const maxDatagramSize = 65507
+
+// MaxUDPTransfer bounds READ and WRITE transfers over UDP, so that a reply, with its
+// headers and attributes, fits within a single datagram.
+const MaxUDPTransfer = 1 << 15
+
+// DefaultMaxDatagrams is how many UDP requests are handled at once when
+// Server.MaxDatagrams is not set.
+const DefaultMaxDatagrams = 64
+
+// ServeUDP answers requests arriving as datagrams on `pc`. Each datagram carries a single
+// rpc message without the record marking used over TCP, and is answered with one datagram.
+// Connections served by Serve and ServeUDP may share a Server.
+//
+// UDP clients retransmit requests they believe were lost, so a non-idempotent request,
+// such as a REMOVE, may be received more than once. Those received again within
+// ReplyCacheTTL are answered with the earlier reply rather than executed again.
+func (s *Server) ServeUDP(pc net.PacketConn) error {
+	if s.EmbeddedPortmap {
+		s.startPortmap()
+	}
+	return s.serveUDP(pc, roleNFS)
+}
+
+func (s *Server) serveUDP(pc net.PacketConn, role socketRole) error {
+	defer pc.Close()
+	if !s.trackPacketConn(pc, role) {
+		return ErrServerClosed
+	}
+	defer s.untrackPacketConn(pc)
+	baseCtx := s.baseContext()
+	if err := s.ensureID(); err != nil {
+		return err
+	}
+
+	// rate limits apply to the listener as a whole, as datagrams have no connection.
+	readLimiter := newTokenBucket(s.RateLimit.ReadBytesPerSecond)
+	writeLimiter := newTokenBucket(s.RateLimit.WriteBytesPerSecond)
+
+	limit := s.MaxDatagrams
+	if limit <= 0 {
+		limit = DefaultMaxDatagrams
+	}
+	slots := make(chan struct{}, limit)
+
+	buf := make([]byte, maxDatagramSize)
+	var tempDelay time.Duration
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
+			}
+			if s.inShutdown.Load() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		tempDelay = 0
+		if s.inShutdown.Load() {
+			continue
+		}
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			// the client retransmits a request that goes unanswered.
+			Log.Debugf("dropping datagram from %v: %d requests already being handled", addr, limit)
+			continue
+		}
+		c := &conn{
+			Server:       s,
+			Conn:         &datagramConn{pc, addr},
+			role:         role,
+			readLimiter:  readLimiter,
+			writeLimiter: writeLimiter,
+			datagram:     true,
+		}
+		msg := append([]byte(nil), buf[:n]...)
+		s.datagrams.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				s.datagrams.Add(-1)
+			}()
+			c.serveDatagram(baseCtx, msg)
+		}()
+	}
+}
+
+// serveDatagram handles the rpc message of a single datagram and sends its reply.
+func (c *conn) serveDatagram(ctx context.Context, msg []byte) {
+	w, err := c.readRequest(&io.LimitedReader{R: bytes.NewReader(msg), N: int64(len(msg))})
+	if err != nil {
+		Log.Debugf("discarding malformed datagram from %v: %v", c.RemoteAddr(), err)
+		return
+	}
+	Log.Tracef("request: %v", w.req)
+	if err := c.handle(ctx, w); err != nil {
+		Log.Errorf("error handling req: %v", err)
+		return
+	}
+	if w.discard {
+		return
+	}
+	reply := w.writer.Bytes()
+	if len(reply) > maxDatagramSize {
+		Log.Errorf("dropping reply to %v: %d bytes exceeds the datagram limit", w.req, len(reply))
+		return
+	}
+	if _, err := c.Conn.Write(reply); err != nil {
+		Log.Errorf("error sending response: %v", err)
+	}
+}
+
+func (s *Server) trackPacketConn(pc net.PacketConn, role socketRole) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown.Load() {
+		return false
+	}
+	if s.packetConns == nil {
+		s.packetConns = make(map[net.PacketConn]socketRole)
+	}
+	s.packetConns[pc] = role
+	return true
+}
+
+func (s *Server) untrackPacketConn(pc net.PacketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.packetConns, pc)
+}
+
+// datagramConn presents the sender of a datagram as a net.Conn, so that requests from
+// UDP clients are handled as those of TCP clients are. Writes are sent back to the
+// sender as a single datagram; there is nothing further to read.
+type datagramConn struct {
+	pc   net.PacketConn
+	addr net.Addr
+}
+
+func (d *datagramConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (d *datagramConn) Write(b []byte) (int, error)        { return d.pc.WriteTo(b, d.addr) }
+func (d *datagramConn) Close() error                       { return nil }
+func (d *datagramConn) LocalAddr() net.Addr                { return d.pc.LocalAddr() }
+func (d *datagramConn) RemoteAddr() net.Addr               { return d.addr }
+func (d *datagramConn) SetDeadline(t time.Time) error      { return nil }
+func (d *datagramConn) SetReadDeadline(t time.Time) error  { return nil }
+func (d *datagramConn) SetWriteDeadline(t time.Time) error { return nil }
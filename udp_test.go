@@ -0,0 +1,284 @@
+package nfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/helpers"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+
+	nfsc "github.com/willscott/go-nfs-client/nfs"
+	rpc "github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/willscott/go-nfs-client/nfs/xdr"
+)
+
+// startUDPServer serves srv on a local udp socket for the duration of the test,
+// returning a socket connected to it.
+func startUDPServer(t *testing.T, srv *nfs.Server) net.Conn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Skipf("cannot listen on udp: %v", err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		_ = srv.ServeUDP(pc)
+	}()
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// callUDP sends a single rpc call as a datagram and returns the results of its accepted reply.
+func callUDP(t *testing.T, c net.Conn, xid, prog, vers, proc uint32, args ...interface{}) *bytes.Reader {
+	t.Helper()
+	msg := bytes.NewBuffer(nil)
+	call := []interface{}{xid, uint32(0), rpc.Header{
+		Rpcvers: 2,
+		Prog:    prog,
+		Vers:    vers,
+		Proc:    proc,
+		Cred:    rpc.AuthNull,
+		Verf:    rpc.AuthNull,
+	}}
+	for _, v := range append(call, args...) {
+		if err := xdr.Write(msg, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Write(msg.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 65536)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := bytes.NewReader(buf[:n])
+	var header struct {
+		Xid        uint32
+		MsgType    uint32
+		ReplyStat  uint32
+		Verf       rpc.Auth
+		AcceptStat uint32
+	}
+	if err := xdr.Read(reply, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Xid != xid || header.MsgType != 1 || header.ReplyStat != 0 || header.AcceptStat != 0 {
+		t.Fatalf("unexpected reply header %+v", header)
+	}
+	return reply
+}
+
+func TestUDPRequests(t *testing.T) {
+	_, handler := newMemHandler(t)
+	c := startUDPServer(t, &nfs.Server{Handler: handler})
+
+	if reply := callUDP(t, c, 1, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureNull)); reply.Len() != 0 {
+		t.Fatalf("unexpected %d bytes in a NULL reply", reply.Len())
+	}
+
+	reply := callUDP(t, c, 2, mountProg, mountVers, uint32(nfs.MountProcMount), "/")
+	var mount struct {
+		Status uint32
+		Handle []byte
+	}
+	if err := xdr.Read(reply, &mount); err != nil {
+		t.Fatal(err)
+	}
+	if mount.Status != 0 {
+		t.Fatalf("mount failed with status %d", mount.Status)
+	}
+
+	reply = callUDP(t, c, 3, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureGetAttr), mount.Handle)
+	var getattr struct {
+		Status uint32
+		Attr   nfsc.Fattr
+	}
+	if err := xdr.Read(reply, &getattr); err != nil {
+		t.Fatal(err)
+	}
+	if getattr.Status != uint32(nfs.NFSStatusOk) {
+		t.Fatalf("getattr failed: %v", nfs.NFSStatus(getattr.Status))
+	}
+	if nfs.FileType(getattr.Attr.Type) != nfs.FileTypeDirectory {
+		t.Fatalf("root has type %v", nfs.FileType(getattr.Attr.Type))
+	}
+}
+
+// removeCountingFS counts the files removed from it.
+type removeCountingFS struct {
+	billy.Filesystem
+	removes atomic.Int32
+}
+
+func (r *removeCountingFS) Remove(name string) error {
+	r.removes.Add(1)
+	return r.Filesystem.Remove(name)
+}
+
+func TestUDPRetransmittedRemove(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/test")
+	fs := &removeCountingFS{Filesystem: mem}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	c := startUDPServer(t, &nfs.Server{Handler: handler})
+
+	reply := callUDP(t, c, 1, mountProg, mountVers, uint32(nfs.MountProcMount), "/")
+	var mount struct {
+		Status uint32
+		Handle []byte
+	}
+	if err := xdr.Read(reply, &mount); err != nil {
+		t.Fatal(err)
+	}
+
+	var replies [2][]byte
+	for i := range replies {
+		reply := callUDP(t, c, 2, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureRemove), mount.Handle, "test")
+		body, err := io.ReadAll(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies[i] = body
+	}
+	if status := nfs.NFSStatus(replies[0][3]); status != nfs.NFSStatusOk {
+		t.Fatalf("remove failed: %v", status)
+	}
+	if !bytes.Equal(replies[0], replies[1]) {
+		t.Fatalf("retransmission was answered differently: %x, then %x", replies[0], replies[1])
+	}
+	if n := fs.removes.Load(); n != 1 {
+		t.Fatalf("file was removed %d times", n)
+	}
+}
+
+func TestRetransmissionFromAnotherPort(t *testing.T) {
+	mem := memfs.New()
+	_, _ = mem.Create("/test")
+	_, _ = mem.Create("/other")
+	fs := &removeCountingFS{Filesystem: mem}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	root := handler.ToHandle(fs, []string{})
+	c := startUDPServer(t, &nfs.Server{Handler: handler})
+	other, err := net.Dial("udp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	// a retransmission from another port of the client is answered from the cache.
+	first, _ := io.ReadAll(callUDP(t, c, 1, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureRemove), root, "test"))
+	again, _ := io.ReadAll(callUDP(t, other, 1, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureRemove), root, "test"))
+	if status := nfs.NFSStatus(first[3]); status != nfs.NFSStatusOk {
+		t.Fatalf("remove failed: %v", status)
+	}
+	if !bytes.Equal(first, again) {
+		t.Fatalf("retransmission was answered differently: %x, then %x", first, again)
+	}
+	if n := fs.removes.Load(); n != 1 {
+		t.Fatalf("file was removed %d times", n)
+	}
+
+	// a call reusing the xid with other arguments is not a retransmission.
+	reply, _ := io.ReadAll(callUDP(t, other, 1, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureRemove), root, "other"))
+	if status := nfs.NFSStatus(reply[3]); status != nfs.NFSStatusOk {
+		t.Fatalf("remove of another file with the same xid returned %v", status)
+	}
+	if n := fs.removes.Load(); n != 2 {
+		t.Fatal("remove with a reused xid was answered from the cache")
+	}
+}
+
+func TestUDPReadDirFitsDatagram(t *testing.T) {
+	mem := memfs.New()
+	name := strings.Repeat("n", 200)
+	for i := 0; i < 1000; i++ {
+		_, _ = mem.Create(fmt.Sprintf("/%s%04d", name, i))
+	}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(mem), 1024)
+	root := handler.ToHandle(mem, []string{})
+	c := startUDPServer(t, &nfs.Server{Handler: handler})
+
+	// a listing of the whole directory would not fit in a datagram.
+	reply := callUDP(t, c, 1, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureReadDir), root, uint64(0), uint64(0), uint32(1<<20))
+	var status uint32
+	if err := xdr.Read(reply, &status); err != nil {
+		t.Fatal(err)
+	}
+	if nfs.NFSStatus(status) != nfs.NFSStatusOk {
+		t.Fatalf("readdir failed: %v", nfs.NFSStatus(status))
+	}
+
+	reply = callUDP(t, c, 2, nfsc.Nfs3Prog, nfsc.Nfs3Vers, uint32(nfs.NFSProcedureReadDirPlus), root, uint64(0), uint64(0), uint32(1<<20), uint32(1<<20))
+	if err := xdr.Read(reply, &status); err != nil {
+		t.Fatal(err)
+	}
+	if nfs.NFSStatus(status) != nfs.NFSStatusOk {
+		t.Fatalf("readdirplus failed: %v", nfs.NFSStatus(status))
+	}
+}
+
+func TestMaxDatagrams(t *testing.T) {
+	const limit, requests = 2, 8
+	mem := memfs.New()
+	f, _ := mem.Create("/data")
+	_, _ = f.Write([]byte("data"))
+	_ = f.Close()
+	fs := &concurrencyFS{Filesystem: mem, delay: 50 * time.Millisecond}
+	handler := helpers.NewCachingHandler(helpers.NewNullAuthHandler(fs), 1024)
+	fh := handler.ToHandle(fs, []string{"data"})
+	c := startUDPServer(t, &nfs.Server{Handler: handler, MaxDatagrams: limit})
+
+	for xid := uint32(1); xid <= requests; xid++ {
+		msg := bytes.NewBuffer(nil)
+		for _, v := range []interface{}{xid, uint32(0), rpc.Header{
+			Rpcvers: 2,
+			Prog:    nfsc.Nfs3Prog,
+			Vers:    nfsc.Nfs3Vers,
+			Proc:    uint32(nfs.NFSProcedureRead),
+			Cred:    rpc.AuthNull,
+			Verf:    rpc.AuthNull,
+		}, fh, uint64(0), uint32(4)} {
+			if err := xdr.Write(msg, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := c.Write(msg.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	answered := 0
+	buf := make([]byte, 65536)
+	for {
+		_ = c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, err := c.Read(buf); err != nil {
+			break
+		}
+		answered++
+	}
+	if answered == 0 || answered >= requests {
+		t.Fatalf("%d of %d datagrams were answered", answered, requests)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.max > limit {
+		t.Fatalf("%d datagrams were handled at once, above the limit of %d", fs.max, limit)
+	}
+}
@@ -0,0 +1,176 @@
+package nfs
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// DefaultWriteBackDelay is how long unstable writes are held back for when
+// Server.WriteBackDelay is not set.
+const DefaultWriteBackDelay = time.Second
+
+// writeBackKey identifies a file with writes held back.
+type writeBackKey struct {
+	fs   billy.Filesystem
+	path string
+}
+
+// pendingWrite is a run of contiguous unstable writes that has not reached its file yet.
+type pendingWrite struct {
+	offset int64
+	data   []byte
+	perm   os.FileMode
+	timer  *time.Timer
+}
+
+// writeBack coalesces the contiguous UNSTABLE writes to each file, so that they reach the
+// filesystem as a single write. Writes held for a file are flushed on COMMIT, by a write
+// that does not continue them or would grow them past the buffer, after a delay, and before
+// other procedures read or change the file. Flushes are made under the lock, so that a file
+// sees its writes in the order they were made.
+type writeBack struct {
+	mu      sync.Mutex
+	pending map[writeBackKey]*pendingWrite
+	// failed holds the errors of flushes made after the delay, for the COMMIT of their file.
+	failed map[writeBackKey]error
+}
+
+// hold adds a write to those held back for a file, if it fits within `limit` bytes of them.
+// Writes already held that the write does not continue are flushed first.
+func (b *writeBack) hold(key writeBackKey, offset int64, data []byte, perm os.FileMode, limit int, delay time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.pending[key]
+	if p != nil && (offset != p.offset+int64(len(p.data)) || len(p.data)+len(data) > limit) {
+		if err := b.flushLocked(key, p); err != nil {
+			return false, err
+		}
+		p = nil
+	}
+	if len(data) > limit {
+		return false, nil
+	}
+	if p == nil {
+		if b.pending == nil {
+			b.pending = make(map[writeBackKey]*pendingWrite)
+		}
+		p = &pendingWrite{offset: offset, perm: perm}
+		p.timer = time.AfterFunc(delay, func() { b.expire(key, p) })
+		b.pending[key] = p
+	}
+	p.data = append(p.data, data...)
+	return true, nil
+}
+
+// expire flushes writes held back for the delay, recording a failure for the next COMMIT.
+func (b *writeBack) expire(key writeBackKey, p *pendingWrite) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pending[key] != p {
+		return
+	}
+	if err := b.flushLocked(key, p); err != nil {
+		Log.Errorf("error flushing writes to %s: %v", key.path, err)
+		if b.failed == nil {
+			b.failed = make(map[writeBackKey]error)
+		}
+		b.failed[key] = err
+	}
+}
+
+// flushLocked writes held writes to their file.
+func (b *writeBack) flushLocked(key writeBackKey, p *pendingWrite) error {
+	delete(b.pending, key)
+	p.timer.Stop()
+	file, err := key.fs.OpenFile(key.path, os.O_RDWR, p.perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(p.offset, io.SeekStart); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if _, err := file.Write(p.data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// flush writes the writes held back for a file, and those of files below it when it is a
+// directory, so that they are seen by a procedure about to act on it.
+func (b *writeBack) flush(fs billy.Filesystem, path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	for key, p := range b.pending {
+		if key.fs != fs || (key.path != path && !strings.HasPrefix(key.path, strings.TrimSuffix(path, "/")+"/")) {
+			continue
+		}
+		if ferr := b.flushLocked(key, p); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// commit flushes the writes held back for a file, and reports a failure to flush them since
+// the last COMMIT.
+func (b *writeBack) commit(key writeBackKey) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p, ok := b.pending[key]; ok {
+		if err := b.flushLocked(key, p); err != nil {
+			return err
+		}
+	}
+	if err, ok := b.failed[key]; ok {
+		delete(b.failed, key)
+		return err
+	}
+	return nil
+}
+
+// sizeOf is the size a file will have once the writes held back for it are flushed.
+func (b *writeBack) sizeOf(key writeBackKey, size int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p, ok := b.pending[key]; ok && p.offset+int64(len(p.data)) > size {
+		return p.offset + int64(len(p.data))
+	}
+	return size
+}
+
+// flushAll writes every write held back, as the server shuts down.
+func (b *writeBack) flushAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, p := range b.pending {
+		if err := b.flushLocked(key, p); err != nil {
+			Log.Errorf("error flushing writes to %s: %v", key.path, err)
+		}
+	}
+}
+
+// flushWrites flushes the writes held back for a file before a procedure acts on it.
+func (w *response) flushWrites(fs billy.Filesystem, path string) error {
+	if w.Server.WriteBackSize <= 0 {
+		return nil
+	}
+	if err := w.Server.writeBacks.flush(fs, path); err != nil {
+		return &NFSStatusError{NFSStatusIO, err}
+	}
+	return nil
+}
+
+func (s *Server) writeBackDelay() time.Duration {
+	if s.WriteBackDelay > 0 {
+		return s.WriteBackDelay
+	}
+	return DefaultWriteBackDelay
+}